@@ -1,11 +1,31 @@
 package jogdb
 
 import "github.com/gorilla/mux"
+import "net"
 import "net/http"
-import "io/ioutil"
+import "bytes"
+import "errors"
+import "sync"
 import "path/filepath"
 import "encoding/json"
+import "strings"
+import "net/url"
+import "strconv"
+import "fmt"
+import "mime"
+import "mime/multipart"
+import "net/textproto"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/base64"
+import "time"
+import "log"
+import "unicode/utf8"
+import "regexp"
+import "compress/gzip"
+import "io"
 import "github.com/FMNSSun/rndstring"
+import "github.com/pmezard/go-difflib/difflib"
 
 type ApiState struct {
 	ContentTypes map[string]string
@@ -13,157 +33,2424 @@ type ApiState struct {
 	DataStore DataStore
 	StringGenerator rndstring.StringGenerator
 	Delimiters map[string][]byte
+
+	// Content types by leading bytes of the document. When serving a whole
+	// document the first entry whose prefix matches is used, before
+	// looking at ContentTypes.
+	MagicTypes []MagicType
+
+	// Request bodies are read into pooled buffers. Buffers which grew
+	// beyond this capacity are not returned to the pool. Defaults to
+	// 64KiB if zero.
+	MaxPooledBufferSize int
+
+	// Maximum size of the request body of the streaming append route.
+	// Bigger bodies are rejected with 413 and nothing is appended. The
+	// route is also subject to MaxDocSize. Defaults to 64MiB if zero.
+	MaxStreamAppendSize int64
+
+	// Content validators by file extension. Documents with an extension
+	// that has a validator are only written if the validator accepts the
+	// content. For appends the validator is given the combined value.
+	// Streaming appends are not validated.
+	Validators map[string]func([]byte) error
+
+	// Human readable labels (e.g. "ci-bot") by token. These are used
+	// instead of tokens wherever tokens would end up in logs. Tokens
+	// without a label are masked.
+	TokenLabels map[string]string
+
+	// If true, POST requests may carry an X-HTTP-Method-Override header to
+	// be handled as PUT, DELETE or PATCH requests. Only honored by handlers
+	// created through NewHandler.
+	AllowMethodOverride bool
+
+	// Origins browsers may call the API from (e.g.
+	// "https://app.example.com"). "*" allows any origin. CORS headers are
+	// only sent and preflight requests only answered if this isn't empty.
+	// Only honored by handlers created through NewHandler.
+	AllowedOrigins []string
+
+	// If true, JSON responses and errors of the management routes (/m/...)
+	// are wrapped in an envelope of the form
+	// {"data":...,"error":...,"requestId":"..."}. Documents are never wrapped.
+	EnvelopeResponses bool
+
+	// Maximum size in bytes of a document written through the put and
+	// append routes. Bigger request bodies or appends that would make the
+	// document bigger are rejected with 413. Zero means only
+	// MaxRequestBytes applies.
+	MaxDocSize int64
+
+	// Maximum size in bytes of the request body of the append route,
+	// rejected with 413 if exceeded. Zero means MaxDocSize is used.
+	MaxAppendSize int64
+
+	// Maximum size in bytes of request bodies of the document routes,
+	// rejected with 413 if exceeded. Defaults to 10MiB if zero. It's
+	// raised to MaxDocSize or MaxAppendSize if those are bigger.
+	MaxRequestBytes int64
+
+	// Like MaxRequestBytes but for the management routes (/m/...) apart
+	// from imports and restores. Defaults to 64KiB if zero.
+	MaxManagementRequestBytes int64
+
+	// Put requests with a Content-Length above this many bytes are
+	// streamed to the DataStore (see PutStream) instead of being read
+	// into memory first. Defaults to 1MiB if zero. Puts needing the whole
+	// body up front (validated, conditional, compressed, transcoded or
+	// with a TTL) and puts storing their content type are never streamed.
+	StreamPutsAbove int64
+
+	// Whole documents bigger than this many bytes are sent gzip compressed
+	// to clients accepting it. Zero (the default) disables compression.
+	CompressResponsesAbove int
+
+	// Address (host:port) of a statsd server. If set, request counts and
+	// timings by route are sent there over UDP.
+	StatsdAddr string
+
+	// If true, request counts and latencies by operation as well as the
+	// store stats are exposed for Prometheus at /metrics.
+	EnableMetrics bool
+
+	// If true, request bodies of text types (text/*, JSON and XML) are
+	// converted to UTF-8 according to the charset parameter of their
+	// Content-Type. Only ISO-8859-1 and US-ASCII (besides UTF-8) are
+	// supported, other charsets are rejected with 415.
+	TranscodeToUTF8 bool
+
+	// If true, the Content-Type of a put is stored with the document (see
+	// PutWithMeta) and served instead of the one derived from its name
+	// or value. Off by default as clients like curl send form content
+	// types unless told otherwise. Conditional puts store no content type.
+	StoreContentTypes bool
+
+	// Pattern namespace and document names in URLs and batch writes
+	// must match. Defaults to `DefaultNamePattern` if nil. The names "."
+	// and ".." are never allowed and document names must not start with
+	// '_' or be "export" or "import". Names of prefix grants are checked
+	// without their trailing '*'.
+	NamePattern *regexp.Regexp
+
+	// Limits the request rate per address and token. Requests beyond it
+	// are rejected with 429. Disabled by
+	// default. Only honored by handlers created through NewHandler.
+	RateLimit RateLimit
+
+	// IPs (e.g. "10.0.0.1") and networks (e.g. "10.0.0.0/8") allowed to
+	// use the management routes (/m/...). Requests from other addresses
+	// are rejected with 403. Everybody is allowed if this is empty.
+	AdminIPAllowList []string
+
+	// If true, the client address is taken from the last entry of the
+	// X-Forwarded-For header (as added by the proxy in front of the API)
+	// when checking AdminIPAllowList. Only set this if all requests come
+	// through a trusted proxy, otherwise clients can pick their address.
+	TrustProxy bool
+
+	// If true, requests without a token (see getToken) are rejected with
+	// 401 before their body is read. This applies to all routes except
+	// the index and /metrics. Leave this off to allow anonymous access
+	// to documents that grant it.
+	RequireToken bool
+
+	// If set, all successful writes to documents and counters, changes of
+	// tokens and admins, imports and restores are passed to it, see
+	// AuditLogger.
+	AuditLogger AuditLogger
+
+	// Strictly for test and development environments: Must be set for
+	// DebugDelay to have any effect. Never enable this in production.
+	DebugMode bool
+
+	// Time to sleep before handling requests to the document routes
+	// (/r/...) to test how clients deal with slow responses. Ignored
+	// unless DebugMode is set.
+	DebugDelay time.Duration
+}
+
+// A content type for documents starting with `Prefix`.
+type MagicType struct {
+	Prefix []byte
+	ContentType string
+}
+
+// The default for ApiState.NamePattern.
+var DefaultNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type envelope struct {
+	Data interface{} `json:"data"`
+	Error interface{} `json:"error"`
+	RequestId string `json:"requestId"`
+}
+
+const defaultMaxPooledBufferSize = 64 * 1024
+const defaultMaxStreamAppendSize = 64 * 1024 * 1024
+const defaultMaxRequestBytes = 10 * 1024 * 1024
+const defaultMaxManagementRequestBytes = 64 * 1024
+const defaultStreamPutsAbove = 1024 * 1024
+
+// Maximum size of a gzip compressed request body after decompression if
+// MaxDocSize is zero.
+const defaultMaxDecompressedSize = 64 * 1024 * 1024
+
+// Maximum number of documents that can be fetched with a single batch
+// request.
+const maxBatchDocs = 1000
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
 }
 
 func (e *ApiState) generateToken() string {
 	return e.StringGenerator.Generate()
 }
 
+// Sets the X-Generated-Token header if the token was generated rather than
+// supplied by the client, so it isn't only in the body.
+func setGeneratedToken(w http.ResponseWriter, token string, generated bool) {
+	if generated {
+		w.Header().Set("X-Generated-Token", token)
+	}
+}
+
+// Returns the label for the token or, if it has none, the token with all
+// but the first few characters masked.
+func (e *ApiState) LabelForToken(token string) string {
+	label := e.TokenLabels[token]
+
+	if label != "" {
+		return label
+	}
+
+	if len(token) <= 8 {
+		return "****"
+	}
+
+	return token[:4] + "****"
+}
+
+// Sets the user of the request URL to the label of the request's token.
+// Access loggers reporting the URL user (like the one in gorilla/handlers)
+// thus log who made a request without logging the token. Needs to wrap
+// the access logger.
+func (e *ApiState) LabelTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := getToken(r)
+
+		if token != "" {
+			r.URL.User = url.User(e.LabelForToken(token))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the token from the X-API-TOKEN header or, if that is missing,
+// from an "Authorization: Bearer <token>" header.
 func getToken(r *http.Request) string {
-	return r.Header.Get("X-API-TOKEN")
+	if token := r.Header.Get("X-API-TOKEN"); token != "" {
+		return token
+	}
+
+	auth := r.Header.Get("Authorization")
+
+	if len(auth) <= len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(auth[len("Bearer "):])
+}
+
+func (e *ApiState) envelopes(r *http.Request) bool {
+	return e.EnvelopeResponses && strings.HasPrefix(r.URL.Path, "/m/")
+}
+
+// Returns the request id supplied by the client via X-Request-ID or
+// generates a new one.
+func (e *ApiState) requestId(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+
+	if id == "" {
+		id = e.StringGenerator.Generate()
+	}
+
+	return id
+}
+
+func (e *ApiState) writeEnvelope(env envelope, status int, w http.ResponseWriter) {
+	b, err := json.Marshal(env)
+
+	if err != nil {
+		http.Error(w, "ErrJSON: These was an internal error. Contact administrator or try again.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Request-ID", env.RequestId)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Returns true if the client explicitly accepts JSON responses.
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+		if err == nil && mediaType == "application/json" && params["q"] != "0" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Writes an error response. `msg` has the form "ErrCode: Message.". Clients
+// accepting JSON get {"error":"Code","message":"Message."}, others get `msg`
+// as text. Errors of the management routes are wrapped in an envelope
+// instead if EnvelopeResponses is set.
+func (e *ApiState) writeError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	if e.envelopes(r) {
+		e.writeEnvelope(envelope{ Error: msg, RequestId: e.requestId(r) }, status, w)
+		return
+	}
+
+	if !acceptsJSON(r) {
+		http.Error(w, msg, status)
+		return
+	}
+
+	code, message, _ := strings.Cut(msg, ": ")
+	code = strings.TrimPrefix(code, "Err")
+
+	b, _ := json.Marshal(errorResponse{ Error: code, Message: message })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func (e *ApiState) checkErrJSON(err error, w http.ResponseWriter, r *http.Request) bool {
+	if err != nil {
+		e.writeError(w, r, "ErrJSON: Your request contained invalid JSON.", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (e *ApiState) returnJSON(v interface{}, w http.ResponseWriter, r *http.Request) {
+	if e.envelopes(r) {
+		e.writeEnvelope(envelope{ Data: v, RequestId: e.requestId(r) }, http.StatusOK, w)
+		return
+	}
+
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		e.writeError(w, r, "ErrJSON: These was an internal error. Contact administrator or try again.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (e *ApiState) checkErr(err error, w http.ResponseWriter, r *http.Request) bool {
+	if err == ErrAccessDenied {
+		e.writeError(w, r, "AccessDenied: Either no X-API-TOKEN was supplied or you don't have permissions for this action.", http.StatusForbidden)
+		return false
+	}
+
+	if err == ErrInvalidName {
+		e.writeError(w, r, "ErrInvalidName: The namespace or document name is not supported.", http.StatusBadRequest)
+		return false
+	}
+
+	if err == ErrTooLarge {
+		e.writeTooLarge(w, r)
+		return false
+	}
+
+	if err != nil {
+		e.writeError(w, r, "ErrPut: There was an internal error. Contact administrator or try again.", http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+func (e *ApiState) releaseBuffer(buf *bytes.Buffer) {
+	max := e.MaxPooledBufferSize
+
+	if max == 0 {
+		max = defaultMaxPooledBufferSize
+	}
+
+	if buf.Cap() > max {
+		return
+	}
+
+	bufferPool.Put(buf)
+}
+
+// Returns the maximum size of the request body read by readRequest.
+func (e *ApiState) maxRequestBytes(r *http.Request) int64 {
+	if strings.HasPrefix(r.URL.Path, "/m/") {
+		if e.MaxManagementRequestBytes > 0 {
+			return e.MaxManagementRequestBytes
+		}
+
+		return defaultMaxManagementRequestBytes
+	}
+
+	limit := e.MaxRequestBytes
+
+	if limit <= 0 {
+		limit = defaultMaxRequestBytes
+	}
+
+	if e.MaxDocSize > limit {
+		limit = e.MaxDocSize
+	}
+
+	if e.MaxAppendSize > limit {
+		limit = e.MaxAppendSize
+	}
+
+	return limit
+}
+
+func (e *ApiState) readRequest(w http.ResponseWriter, r *http.Request) []byte {
+	// Routes may have limited the body further already, the smaller
+	// limit applies.
+	r.Body = http.MaxBytesReader(w, r.Body, e.maxRequestBytes(r))
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	_, err := buf.ReadFrom(r.Body)
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		e.releaseBuffer(buf)
+		e.writeTooLarge(w, r)
+		return nil
+	}
+
+	if err != nil {
+		e.releaseBuffer(buf)
+		e.writeError(w, r, "ErrReadingRequest: There was an error reading your request.", http.StatusInternalServerError)
+		return nil
+	}
+
+	// The buffer goes back to the pool and will be reused by other
+	// requests so the caller gets its own copy.
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+
+	e.releaseBuffer(buf)
+
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		b = e.decompressRequest(w, r, b)
+
+		if b == nil {
+			return nil
+		}
+	}
+
+	if e.TranscodeToUTF8 {
+		b, err = toUTF8(r.Header.Get("Content-Type"), b)
+
+		if err != nil {
+			e.writeError(w, r, "ErrUnsupportedCharset: The charset of your request is not supported.", http.StatusUnsupportedMediaType)
+			return nil
+		}
+	}
+
+	return b
+}
+
+// Decompresses a gzip compressed request body. The result may be at most
+// MaxDocSize (or `defaultMaxDecompressedSize`) bytes. Writes an error
+// response and returns nil if that fails.
+func (e *ApiState) decompressRequest(w http.ResponseWriter, r *http.Request, b []byte) []byte {
+	limit := e.MaxDocSize
+
+	if limit <= 0 {
+		limit = defaultMaxDecompressedSize
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+
+	if err != nil {
+		e.writeError(w, r, "ErrBadRequest: The request body is not valid gzip.", http.StatusBadRequest)
+		return nil
+	}
+
+	// One more byte than allowed is read to notice if there is more.
+	v, err := io.ReadAll(io.LimitReader(zr, limit + 1))
+
+	if err != nil {
+		e.writeError(w, r, "ErrBadRequest: The request body is not valid gzip.", http.StatusBadRequest)
+		return nil
+	}
+
+	if int64(len(v)) > limit {
+		e.writeTooLarge(w, r)
+		return nil
+	}
+
+	return v
+}
+
+// Returns true if the client accepts gzip compressed responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.TrimSpace(coding)
+
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		// Only "q=0" refuses the coding.
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+
+			if name == "q" {
+				q, err := strconv.ParseFloat(value, 64)
+				return err == nil && q > 0
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Limits the request body to `limit` bytes unless it is zero. Reading beyond
+// that makes readRequest respond with 413.
+func (e *ApiState) limitBody(w http.ResponseWriter, r *http.Request, limit int64) {
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+}
+
+// Returns the maximum request body size of the append route.
+func (e *ApiState) maxAppendSize() int64 {
+	if e.MaxAppendSize > 0 {
+		return e.MaxAppendSize
+	}
+
+	return e.MaxDocSize
+}
+
+func (e *ApiState) writeTooLarge(w http.ResponseWriter, r *http.Request) {
+	e.writeError(w, r, "ErrTooLarge: The request or the resulting document exceeds the maximum size.", http.StatusRequestEntityTooLarge)
+}
+
+// Validator accepting only valid JSON.
+func ValidateJSON(v []byte) error {
+	if !json.Valid(v) {
+		return errors.New("The document is not valid JSON.")
+	}
+
+	return nil
+}
+
+// Runs the validator for the document's extension (if any) and writes an
+// error response if it rejects the content. Returns false in that case.
+func (e *ApiState) checkValid(doc string, v []byte, w http.ResponseWriter, r *http.Request) bool {
+	validator := e.Validators[filepath.Ext(doc)]
+
+	if validator == nil {
+		return true
+	}
+
+	err := validator(v)
+
+	if err != nil {
+		e.writeError(w, r, "ErrValidation: " + err.Error(), http.StatusUnprocessableEntity)
+		return false
+	}
+
+	return true
+}
+
+type validateResponse struct {
+	Valid bool `json:"valid"`
+	Errors []string `json:"errors"`
+}
+
+// Runs the validator for the document's extension on the body without
+// storing anything. Requires Put permissions.
+func (e *ApiState) validateDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	ok, err := hasPerm(e.DataStore, e.DataStore.CanPut, clientToken, ns, doc)
+
+	if err == nil && !ok {
+		err = ErrAccessDenied
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	resp := validateResponse{ Valid: true, Errors: []string{} }
+
+	if validator := e.Validators[filepath.Ext(doc)]; validator != nil {
+		err = validator(b)
+
+		if err != nil {
+			resp.Valid = false
+			resp.Errors = append(resp.Errors, err.Error())
+		}
+	}
+
+	e.returnJSON(resp, w, r)
+}
+
+func (e *ApiState) index(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("jogdb api"))
 }
 
-func checkErrJSON(err error, w http.ResponseWriter) bool {
-	if err != nil {
-		http.Error(w, "ErrJSON: Your request contained invalid JSON.", http.StatusBadRequest)
-		return false
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+// Liveness check. Doesn't look at the DataStore.
+func (e *ApiState) healthz(w http.ResponseWriter, r *http.Request) {
+	e.returnJSON(healthResponse{ Status: "ok" }, w, r)
+}
+
+// Readiness check. Responds with 503 if the DataStore can't be reached.
+func (e *ApiState) readyz(w http.ResponseWriter, r *http.Request) {
+	err := e.DataStore.Ping()
+
+	if err != nil {
+		log.Printf("Readiness check failed: %v", err.Error())
+
+		b, _ := json.Marshal(healthResponse{ Status: "unavailable" })
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(b)
+		return
+	}
+
+	e.returnJSON(healthResponse{ Status: "ok" }, w, r)
+}
+
+func (e *ApiState) putDoc(w http.ResponseWriter, r *http.Request) {
+	e.limitBody(w, r, e.MaxDocSize)
+
+	if e.streamPut(r) {
+		e.putDocStream(w, r)
+		return
+	}
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	if !e.checkValid(doc, b, w, r) {
+		return
+	}
+
+	var ttl time.Duration
+
+	if v := r.Header.Get("X-TTL-Seconds"); v != "" {
+		secs, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil || secs <= 0 {
+			e.writeError(w, r, "ErrBadRequest: The header 'X-TTL-Seconds' must be a positive integer.", http.StatusBadRequest)
+			return
+		}
+
+		ttl = time.Duration(secs) * time.Second
+	}
+
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+
+	if ifMatch == "" && ifNoneMatch != "*" {
+		var meta DocMeta
+
+		if e.StoreContentTypes {
+			meta.ContentType = e.requestContentType(r)
+		}
+
+		err := CheckedPutWithMeta(e.DataStore, clientToken, ns, doc, b, meta, ttl)
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+	} else {
+		if ttl != 0 || (ifMatch != "" && ifNoneMatch != "") {
+			e.writeError(w, r, "ErrBadRequest: Only one of 'If-Match' and 'If-None-Match: *' may be used and not together with 'X-TTL-Seconds'.", http.StatusBadRequest)
+			return
+		}
+
+		if !e.conditionalPut(w, r, clientToken, ns, doc, ifMatch, b) {
+			return
+		}
+	}
+
+	e.audit(r, ns, doc)
+
+	w.Header().Set("ETag", etag(b))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+// Returns true if the body of the put request is big enough to be streamed
+// and nothing needs to see all of it before it's stored.
+func (e *ApiState) streamPut(r *http.Request) bool {
+	above := e.StreamPutsAbove
+
+	if above <= 0 {
+		above = defaultStreamPutsAbove
+	}
+
+	if r.ContentLength <= above || e.TranscodeToUTF8 || e.StoreContentTypes {
+		return false
+	}
+
+	if e.Validators[filepath.Ext(mux.Vars(r)["doc"])] != nil {
+		return false
+	}
+
+	for _, header := range []string{"If-Match", "If-None-Match", "X-TTL-Seconds"} {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+
+	return r.Header.Get("Content-Encoding") != "gzip"
+}
+
+// Like putDoc but the body is passed on to PutStream as it's read. The
+// ETag is computed along the way.
+func (e *ApiState) putDocStream(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	r.Body = http.MaxBytesReader(w, r.Body, e.maxRequestBytes(r))
+
+	h := sha256.New()
+	err := CheckedPutStream(e.DataStore, clientToken, ns, doc, io.TeeReader(r.Body, h))
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		e.writeTooLarge(w, r)
+		return
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, doc)
+
+	w.Header().Set("ETag", etagForHash(h.Sum(nil)))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+// Returns the ETag of the document's content.
+func etag(v []byte) string {
+	sum := sha256.Sum256(v)
+
+	return etagForHash(sum[:])
+}
+
+// Returns the ETag for a SHA-256 as returned by `Hasher`.
+func etagForHash(sum []byte) string {
+	return "\"" + hex.EncodeToString(sum) + "\""
+}
+
+// Like etagMatches but ignores whether the ETags are weak. This is the
+// comparison needed for If-None-Match.
+func etagMatchesWeak(list, tag string) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+
+		if t == "*" || t == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if `tag` is in the comma separated list of ETags or the list
+// is "*".
+func etagMatches(list, tag string) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Writes the document only if it currently matches `ifMatch` (a list of ETags
+// or "*" for any existing document) or, if `ifMatch` is empty, if it doesn't
+// exist. Comparing ETags requires Get permissions. Writes an error response
+// and returns false if the write didn't happen.
+func (e *ApiState) conditionalPut(w http.ResponseWriter, r *http.Request, clientToken, ns, doc, ifMatch string, v []byte) bool {
+	var expected []byte
+
+	if ifMatch != "" {
+		cur, err := CheckedGet(e.DataStore, clientToken, ns, doc)
+
+		if !e.checkErr(err, w, r) {
+			return false
+		}
+
+		if cur == nil || !etagMatches(ifMatch, etag(cur)) {
+			e.writeError(w, r, "ErrPreconditionFailed: The document does not match the precondition.", http.StatusPreconditionFailed)
+			return false
+		}
+
+		expected = cur
+	}
+
+	swapped, err := CheckedCompareAndPut(e.DataStore, clientToken, ns, doc, expected, v)
+
+	if !e.checkErr(err, w, r) {
+		return false
+	}
+
+	if !swapped {
+		e.writeError(w, r, "ErrPreconditionFailed: The document does not match the precondition.", http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+// Appends to the document or, with ?mode=prepend, inserts at its start.
+func (e *ApiState) appendDoc(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("mode") {
+	case "", "append":
+		e.writeAppend(w, r, false)
+	case "prepend":
+		e.writeAppend(w, r, true)
+	default:
+		e.writeError(w, r, "ErrBadRequest: Unknown mode.", http.StatusBadRequest)
+	}
+}
+
+func (e *ApiState) prependDoc(w http.ResponseWriter, r *http.Request) {
+	e.writeAppend(w, r, true)
+}
+
+// Returns the delimiter to append with. This is the X-Delimiter header if
+// present (base64 encoded with `X-Delimiter-Encoding: base64`) and otherwise
+// the delimiter configured for the extension of the document. Writes an
+// error and returns false if the header can't be decoded.
+func (e *ApiState) appendDelimiter(w http.ResponseWriter, r *http.Request, doc string) ([]byte, bool) {
+	hdr, ok := r.Header["X-Delimiter"]
+
+	if !ok {
+		delim := e.Delimiters[filepath.Ext(doc)]
+
+		if delim == nil {
+			delim = []byte{}
+		}
+
+		return delim, true
+	}
+
+	switch strings.ToLower(r.Header.Get("X-Delimiter-Encoding")) {
+	case "":
+		return []byte(hdr[0]), true
+	case "base64":
+		delim, err := base64.StdEncoding.DecodeString(hdr[0])
+
+		if err != nil {
+			e.writeError(w, r, "ErrBadRequest: Invalid X-Delimiter.", http.StatusBadRequest)
+			return nil, false
+		}
+
+		return delim, true
+	}
+
+	e.writeError(w, r, "ErrBadRequest: Unknown X-Delimiter-Encoding.", http.StatusBadRequest)
+	return nil, false
+}
+
+// Appends or prepends the request body to the document. The delimiter is
+// chosen by `appendDelimiter` in both cases.
+func (e *ApiState) writeAppend(w http.ResponseWriter, r *http.Request, prepend bool) {
+	e.limitBody(w, r, e.maxAppendSize())
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	ext := filepath.Ext(doc)
+
+	delim, ok := e.appendDelimiter(w, r, doc)
+
+	if !ok {
+		return
+	}
+
+	if e.Validators[ext] != nil || e.MaxDocSize > 0 {
+		// The current value or its size is needed to check the combined
+		// value so permissions have to be checked before reading it.
+		can := e.DataStore.CanAppend
+
+		if prepend {
+			can = e.DataStore.CanPrepend
+		}
+
+		ok, err := hasPerm(e.DataStore, can, clientToken, ns, doc)
+
+		if err == nil && !ok {
+			err = ErrAccessDenied
+		}
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+	}
+
+	if e.MaxDocSize > 0 {
+		// Not atomic with the append, concurrent appends may still
+		// overshoot the limit slightly.
+		size, _, err := e.DataStore.Size(ns, doc)
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+
+		if size + int64(len(b) + len(delim)) > e.MaxDocSize {
+			e.writeTooLarge(w, r)
+			return
+		}
+	}
+
+	if e.Validators[ext] != nil {
+		cur, err := e.DataStore.Get(ns, doc)
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+
+		var combined []byte
+
+		if prepend {
+			combined = append(append(append([]byte{}, b...), delim...), cur...)
+		} else {
+			combined = append(append(cur, b...), delim...)
+		}
+
+		if !e.checkValid(doc, combined, w, r) {
+			return
+		}
+	}
+
+	var err error
+
+	if prepend {
+		err = CheckedPrepend(e.DataStore, clientToken, ns, doc, delim, b)
+	} else {
+		err = CheckedAppend(e.DataStore, clientToken, ns, doc, delim, b)
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, doc)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+type replaceRequest struct {
+	Old string
+	New string
+	All bool
+}
+
+type replaceResponse struct {
+	Replaced int
+}
+
+func (e *ApiState) replaceInDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	var rr replaceRequest
+	err := json.Unmarshal(b, &rr)
+
+	if !e.checkErrJSON(err, w, r) {
+		return
+	}
+
+	if rr.Old == "" {
+		e.writeError(w, r, "ErrBadRequest: 'Old' must not be empty.", http.StatusBadRequest)
+		return
+	}
+
+	n, err := CheckedReplaceInDoc(e.DataStore, clientToken, ns, doc, []byte(rr.Old), []byte(rr.New), rr.All)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, doc)
+
+	e.returnJSON(replaceResponse{ Replaced: n }, w, r)
+}
+
+// Adds the integer in the body, or in the X-Incr-By header if the body is
+// empty, to the document and returns the new value. The default is 1.
+func (e *ApiState) incrDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	by := strings.TrimSpace(string(b))
+
+	if by == "" {
+		by = r.Header.Get("X-Incr-By")
+	}
+
+	delta := int64(1)
+
+	if by != "" {
+		var err error
+		delta, err = strconv.ParseInt(by, 10, 64)
+
+		if err != nil {
+			e.writeError(w, r, "ErrBadRequest: The delta must be an integer.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	v, err := CheckedIncrDoc(e.DataStore, clientToken, ns, doc, delta)
+
+	if err == ErrNotInteger {
+		e.writeError(w, r, "ErrNotInteger: The document is not an integer or the result would overflow.", http.StatusConflict)
+		return
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, doc)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strconv.FormatInt(v, 10)))
+}
+
+// Returns true if the content type (which may have parameters) is JSON.
+func isJSONMediaType(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// Applies a JSON Merge Patch (RFC 7386) or a JSON Patch (RFC 6902) to the
+// document depending on the Content-Type. Documents whose extension has a
+// content type other than JSON can't be patched.
+func (e *ApiState) mergeDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType != "application/merge-patch+json" && mediaType != "application/json-patch+json" {
+		e.writeError(w, r, "ErrUnsupportedMediaType: The Content-Type must be application/merge-patch+json or application/json-patch+json.", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if ct := e.ContentTypes[filepath.Ext(doc)]; ct != "" && !isJSONMediaType(ct) {
+		e.writeError(w, r, "ErrUnsupportedMediaType: Only JSON documents can be patched.", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	var v []byte
+	var err error
+
+	if mediaType == "application/json-patch+json" {
+		v, err = CheckedPatchJSON(e.DataStore, clientToken, ns, doc, b)
+	} else {
+		v, err = CheckedMergeJSON(e.DataStore, clientToken, ns, doc, b)
+	}
+
+	if err == ErrInvalidPatch {
+		e.writeError(w, r, "ErrJSON: Your request contained invalid JSON.", http.StatusBadRequest)
+		return
+	}
+
+	if err == ErrNotJSON {
+		e.writeError(w, r, "ErrNotJSON: The document is not valid JSON.", http.StatusConflict)
+		return
+	}
+
+	if err == ErrPatchFailed {
+		e.writeError(w, r, "ErrPatchFailed: The patch can't be applied to the document.", http.StatusConflict)
+		return
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, doc)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(v)
+}
+
+func (e *ApiState) deleteDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	err := CheckedDelete(e.DataStore, clientToken, ns, doc)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, doc)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+func (e *ApiState) appendDocStream(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	// Validators need the whole document.
+	if e.Validators[filepath.Ext(doc)] != nil {
+		e.writeError(w, r, "ErrBadRequest: Documents with a validator can't be appended to by streaming.", http.StatusBadRequest)
+		return
+	}
+
+	delim, ok := e.appendDelimiter(w, r, doc)
+
+	if !ok {
+		return
+	}
+
+	limit := e.MaxStreamAppendSize
+
+	if limit == 0 {
+		limit = defaultMaxStreamAppendSize
+	}
+
+	if e.MaxDocSize > 0 {
+		// The size is only revealed to clients allowed to append. Not
+		// atomic with the append, concurrent appends may still overshoot
+		// the limit slightly.
+		ok, err := hasPerm(e.DataStore, e.DataStore.CanAppend, clientToken, ns, doc)
+
+		if err == nil && !ok {
+			err = ErrAccessDenied
+		}
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+
+		size, _, err := e.DataStore.Size(ns, doc)
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+
+		if left := e.MaxDocSize - size - int64(len(delim)); left < limit {
+			limit = left
+		}
+
+		if limit < 0 {
+			e.writeTooLarge(w, r)
+			return
+		}
+	}
+
+	n, err := CheckedAppendFrom(e.DataStore, clientToken, ns, doc, delim, r.Body, limit)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, doc)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strconv.FormatInt(n, 10)))
+}
+
+func (e *ApiState) getDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	// "1" and "true" collapse duplicate entries, "count" also counts them.
+	uniq := r.URL.Query().Get("uniq")
+
+	switch uniq {
+	case "", "1", "true", "count":
+	default:
+		e.writeError(w, r, "ErrBadRequest: Unsupported value for 'uniq'.", http.StatusBadRequest)
+		return
+	}
+
+	// Transformed documents have no ETag.
+	raw := r.URL.Query().Get("as") == "" && uniq == "" && r.URL.Query().Get("numbered") == ""
+	ifNoneMatch := r.Header.Get("If-None-Match")
+
+	rangeHeader := r.Header.Get("Range")
+	ifRange := r.Header.Get("If-Range")
+	h, hasHasher := e.DataStore.(Hasher)
+	rev := r.URL.Query().Get("rev")
+
+	// A DataStore with cached hashes can answer the conditional request
+	// without reading the document.
+	if hasHasher && raw && rev == "" && ifNoneMatch != "" {
+		sum, err := CheckedHash(e.DataStore, h, clientToken, ns, doc)
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+
+		if sum != nil && etagMatchesWeak(ifNoneMatch, etagForHash(sum)) {
+			w.Header().Set("ETag", etagForHash(sum))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// Unless the whole document is needed for the ETag only the
+	// requested range is read.
+	if raw && rev == "" && rangeHeader != "" && ifRange == "" && (ifNoneMatch == "" || hasHasher) {
+		if e.getRange(w, r, clientToken, ns, doc, rangeHeader) {
+			return
+		}
+	}
+
+	var v []byte
+	var err error
+
+	if rev != "" {
+		vs, ok := e.DataStore.(Versioner)
+
+		if !ok {
+			e.writeError(w, r, "ErrBadRequest: This datastore does not keep versions.", http.StatusBadRequest)
+			return
+		}
+
+		revN, convErr := strconv.Atoi(rev)
+
+		if convErr != nil || revN < 1 {
+			e.writeError(w, r, "ErrBadRequest: Invalid revision.", http.StatusBadRequest)
+			return
+		}
+
+		v, err = CheckedGetVersion(e.DataStore, vs, clientToken, ns, doc, revN)
+	} else {
+		v, err = CheckedGet(e.DataStore, clientToken, ns, doc)
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	if v == nil {
+		e.writeError(w, r, "ErrNotFound: The resource you requested could not be found.", http.StatusNotFound)
+		return
+	}
+
+	// Older versions are served by name as the stored type belongs to
+	// the current one.
+	var ct string
+
+	if rev == "" {
+		ct, err = e.storedContentType(clientToken, ns, doc)
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+	}
+
+	if raw {
+		// Computed from the value sent as the hash may belong to a
+		// newer version.
+		tag := etag(v)
+		w.Header().Set("ETag", tag)
+
+		if ifNoneMatch != "" && etagMatchesWeak(ifNoneMatch, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		// A range is only sent if the document is still the one the
+		// client has the other parts of. There is no Last-Modified so
+		// dates never match.
+		if ifRange != "" && ifRange != tag {
+			rangeHeader = ""
+		}
+
+		rangeCT := ct
+
+		if rangeCT == "" {
+			rangeCT = e.contentType(doc)
+		}
+
+		if rangeHeader != "" && e.writeRange(w, r, rangeCT, rangeHeader, v) {
+			return
+		}
+	}
+
+	switch r.URL.Query().Get("as") {
+	case "":
+	case "json-lines":
+		e.writeJSONLines(w, r, doc, v)
+		return
+	default:
+		e.writeError(w, r, "ErrBadRequest: Unsupported value for 'as'.", http.StatusBadRequest)
+		return
+	}
+
+	if uniq != "" {
+		v = e.collapseDuplicates(doc, v, uniq == "count")
+	}
+
+	if r.URL.Query().Get("numbered") != "" {
+		v = e.numberEntries(doc, v)
+	}
+
+	if ct == "" {
+		ct = e.contentTypeOf(doc, v)
+	}
+
+	w.Header().Set("Content-Type", ct)
+
+	if e.CompressResponsesAbove > 0 && len(v) > e.CompressResponsesAbove {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if acceptsGzip(r) {
+			v = gzipBytes(v)
+			w.Header().Set("Content-Encoding", "gzip")
+
+			// The compressed bytes differ from the document.
+			if tag := w.Header().Get("ETag"); tag != "" {
+				w.Header().Set("ETag", "W/" + tag)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(v)))
+	w.Write(v)
+}
+
+func gzipBytes(v []byte) []byte {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	zw.Write(v)
+	zw.Close() // writes to a bytes.Buffer don't fail
+
+	return buf.Bytes()
+}
+
+// Parses a Range header with a single byte range ("bytes=first-last",
+// "bytes=first-" or "bytes=-suffixLength") for a document of `size` bytes
+// and returns the offset and length of the range. `ok` is false if the
+// header is malformed or asks for multiple ranges, such headers are ignored.
+// `satisfiable` is false if the range lies outside of the document.
+func parseRange(h string, size int64) (off, length int64, ok, satisfiable bool) {
+	if !strings.HasPrefix(h, "bytes=") {
+		return 0, 0, false, false
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(h, "bytes="))
+	dash := strings.Index(spec, "-")
+
+	if dash < 0 || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash + 1:])
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+
+		if n > size {
+			n = size
+		}
+
+		return size - n, n, true, true
+	}
+
+	off, err := strconv.ParseInt(first, 10, 64)
+
+	if err != nil || off < 0 {
+		return 0, 0, false, false
+	}
+
+	end := size - 1
+
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+
+		if err != nil || end < off {
+			return 0, 0, false, false
+		}
+
+		if end > size - 1 {
+			end = size - 1
+		}
+	}
+
+	if off >= size {
+		return 0, 0, true, false
+	}
+
+	return off, end - off + 1, true, true
+}
+
+// Responds with the part of the document `v` requested by the Range header
+// `rh` as content type `ct`. Returns false without writing anything if the
+// header is to be ignored.
+func (e *ApiState) writeRange(w http.ResponseWriter, r *http.Request, ct, rh string, v []byte) bool {
+	size := int64(len(v))
+	off, length, ok, satisfiable := parseRange(rh, size)
+
+	if !ok {
+		return false
+	}
+
+	if !satisfiable {
+		e.writeRangeNotSatisfiable(w, r, size)
+		return true
+	}
+
+	e.writePartial(w, ct, off, size, v[off:off + length])
+	return true
+}
+
+// Like writeRange but only reads the requested range from the DataStore.
+func (e *ApiState) getRange(w http.ResponseWriter, r *http.Request, clientToken, ns, doc, rh string) bool {
+	size, exists, err := CheckedSize(e.DataStore, clientToken, ns, doc)
+
+	if !e.checkErr(err, w, r) {
+		return true
+	}
+
+	if !exists {
+		e.writeError(w, r, "ErrNotFound: The resource you requested could not be found.", http.StatusNotFound)
+		return true
+	}
+
+	off, length, ok, satisfiable := parseRange(rh, size)
+
+	if !ok {
+		return false
+	}
+
+	if !satisfiable {
+		e.writeRangeNotSatisfiable(w, r, size)
+		return true
+	}
+
+	v, err := CheckedGetRange(e.DataStore, clientToken, ns, doc, off, length)
+
+	// The document may have shrunk or vanished since asking for its size.
+	if err == ErrInvalidRange {
+		e.writeRangeNotSatisfiable(w, r, size)
+		return true
+	}
+
+	if !e.checkErr(err, w, r) {
+		return true
+	}
+
+	if v == nil {
+		e.writeError(w, r, "ErrNotFound: The resource you requested could not be found.", http.StatusNotFound)
+		return true
+	}
+
+	if len(v) == 0 {
+		e.writeRangeNotSatisfiable(w, r, size)
+		return true
+	}
+
+	ct, err := e.storedContentType(clientToken, ns, doc)
+
+	if !e.checkErr(err, w, r) {
+		return true
+	}
+
+	if ct == "" {
+		ct = e.contentType(doc)
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	e.writePartial(w, ct, off, size, v)
+	return true
+}
+
+func (e *ApiState) writeRangeNotSatisfiable(w http.ResponseWriter, r *http.Request, size int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	e.writeError(w, r, "ErrRangeNotSatisfiable: The requested range lies outside of the document.", http.StatusRequestedRangeNotSatisfiable)
+}
+
+// Writes a 206 response with the part `v` of the document starting at `off`.
+func (e *ApiState) writePartial(w http.ResponseWriter, ct string, off, size int64, v []byte) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off + int64(len(v)) - 1, size))
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Length", strconv.Itoa(len(v)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(v)
+}
+
+// Reads a JSON array of document names for the batch routes. Writes an error
+// response and returns nil if that fails or there are too many names.
+func (e *ApiState) readDocNames(w http.ResponseWriter, r *http.Request) []string {
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return nil
+	}
+
+	var docs []string
+	err := json.Unmarshal(b, &docs)
+
+	if !e.checkErrJSON(err, w, r) {
+		return nil
+	}
+
+	// `null` unmarshals into a nil slice which would look like an error
+	// was already written.
+	if docs == nil {
+		e.writeError(w, r, "ErrBadRequest: Expected a JSON array of document names.", http.StatusBadRequest)
+		return nil
+	}
+
+	if len(docs) > maxBatchDocs {
+		e.writeError(w, r, fmt.Sprintf("ErrBadRequest: At most %d documents can be requested at once.", maxBatchDocs), http.StatusBadRequest)
+		return nil
+	}
+
+	return docs
+}
+
+// Puts all documents of a JSON object mapping names to base64 encoded values
+// at once. The token needs Put permissions for all of them and all of them
+// have to pass validation, otherwise nothing is written.
+func (e *ApiState) msetDocs(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns := vars["ns"]
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	var docs map[string][]byte
+	err := json.Unmarshal(b, &docs)
+
+	if !e.checkErrJSON(err, w, r) {
+		return
+	}
+
+	if len(docs) > maxBatchDocs {
+		e.writeError(w, r, fmt.Sprintf("ErrBadRequest: At most %d documents can be written at once.", maxBatchDocs), http.StatusBadRequest)
+		return
+	}
+
+	for doc, v := range docs {
+		if !e.validDocName(doc) {
+			e.writeError(w, r, "ErrInvalidName: The document name is not allowed.", http.StatusBadRequest)
+			return
+		}
+
+		if v == nil {
+			v = []byte{}
+			docs[doc] = v
+		}
+
+		if !e.checkValid(doc, v, w, r) {
+			return
+		}
+	}
+
+	err = CheckedPutBatch(e.DataStore, clientToken, ns, docs)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, "")
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+// Returns the requested documents as a JSON object mapping names to base64
+// encoded values. Documents the token can't read or that don't exist are
+// left out.
+func (e *ApiState) mgetDocs(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns := vars["ns"]
+
+	docs := e.readDocNames(w, r)
+
+	if docs == nil {
+		return
+	}
+
+	values := make(map[string][]byte)
+
+	for _, doc := range docs {
+		v, err := CheckedGet(e.DataStore, clientToken, ns, doc)
+
+		if err == ErrAccessDenied {
+			continue
+		}
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+
+		if v == nil {
+			continue
+		}
+
+		values[doc] = v
+	}
+
+	e.returnJSON(values, w, r)
+}
+
+// Returns the requested documents as a multipart/mixed response with one
+// part per document. Documents the token can't read or that don't exist
+// become empty parts with a Status header of 403 or 404.
+func (e *ApiState) multipartDocs(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns := vars["ns"]
+
+	docs := e.readDocNames(w, r)
+
+	if docs == nil {
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary=" + mw.Boundary())
+
+	for _, doc := range docs {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{ "filename": doc }))
+
+		v, err := CheckedGet(e.DataStore, clientToken, ns, doc)
+
+		var ct string
+
+		if err == nil && v != nil {
+			ct, err = e.storedContentType(clientToken, ns, doc)
+
+			if err != nil {
+				v = nil
+			}
+		}
+
+		if ct == "" {
+			ct = e.contentType(doc)
+		}
+
+		switch {
+		case err == ErrAccessDenied:
+			header.Set("Status", "403")
+		case err != nil:
+			header.Set("Status", "500")
+		case v == nil:
+			header.Set("Status", "404")
+		default:
+			header.Set("Status", "200")
+			header.Set("Content-Type", ct)
+		}
+
+		part, err := mw.CreatePart(header)
+
+		if err != nil {
+			return // the client is gone
+		}
+
+		part.Write(v)
+	}
+
+	mw.Close()
+}
+
+// Returns the content type for the document based on its extension.
+// Like contentType but checks MagicTypes against the value first.
+func (e *ApiState) contentTypeOf(doc string, v []byte) string {
+	for _, mt := range e.MagicTypes {
+		if bytes.HasPrefix(v, mt.Prefix) {
+			return mt.ContentType
+		}
+	}
+
+	return e.contentType(doc)
+}
+
+func (e *ApiState) contentType(doc string) string {
+	ct := e.ContentTypes[filepath.Ext(doc)]
+
+	if ct == "" {
+		ct = e.DefaultContentType
+	}
+
+	return ct
+}
+
+// Returns the content type stored with the document if StoreContentTypes
+// is set. Empty if there is none, the caller falls back to contentType or
+// contentTypeOf then.
+func (e *ApiState) storedContentType(clientToken, ns, doc string) (string, error) {
+	if !e.StoreContentTypes {
+		return "", nil
+	}
+
+	meta, err := CheckedGetMeta(e.DataStore, clientToken, ns, doc)
+
+	return meta.ContentType, err
+}
+
+// Returns the content type of the put request to store with the document,
+// empty if it has none or it's invalid. Transcoded bodies are UTF-8.
+func (e *ApiState) requestContentType(r *http.Request) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if err != nil {
+		return ""
+	}
+
+	if e.TranscodeToUTF8 && isTextMediaType(mediaType) && params["charset"] != "" {
+		params["charset"] = "utf-8"
+	}
+
+	return mime.FormatMediaType(mediaType, params)
+}
+
+type sizeResponse struct {
+	Size int64 `json:"size"`
+	Exists bool `json:"exists"`
+}
+
+func (e *ApiState) listVersions(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	vs, ok := e.DataStore.(Versioner)
+
+	if !ok {
+		e.writeError(w, r, "ErrBadRequest: This datastore does not keep versions.", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := CheckedListVersions(e.DataStore, vs, clientToken, ns, doc)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.returnJSON(versions, w, r)
+}
+
+func (e *ApiState) sizeDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	size, exists, err := CheckedSize(e.DataStore, clientToken, ns, doc)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.returnJSON(sizeResponse{ Size: size, Exists: exists }, w, r)
+}
+
+func (e *ApiState) headDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc := vars["ns"], vars["doc"]
+
+	size, exists, err := CheckedSize(e.DataStore, clientToken, ns, doc)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ct, err := e.storedContentType(clientToken, ns, doc)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	if ct == "" {
+		ct = e.contentType(doc)
+	}
+
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Splits a document into its delimiter separated entries. Empty trailing
+// entries are dropped.
+func splitEntries(v, delim []byte) [][]byte {
+	entries := bytes.Split(v, delim)
+
+	for len(entries) > 0 && len(entries[len(entries)-1]) == 0 {
+		entries = entries[:len(entries)-1]
+	}
+
+	return entries
+}
+
+// Collapses consecutive identical entries of a document into one (like uniq).
+// If `count` is true each entry is prefixed with the number of times it occurred.
+// Documents without a configured delimiter are returned unchanged.
+func (e *ApiState) collapseDuplicates(doc string, v []byte, count bool) []byte {
+	delim := e.Delimiters[filepath.Ext(doc)]
+
+	if len(delim) == 0 {
+		return v
+	}
+
+	entries := splitEntries(v, delim)
+
+	var buf bytes.Buffer
+
+	for i := 0; i < len(entries); {
+		n := 1
+
+		for i+n < len(entries) && bytes.Equal(entries[i], entries[i+n]) {
+			n++
+		}
+
+		if count {
+			buf.WriteString(strconv.Itoa(n))
+			buf.WriteByte(' ')
+		}
+
+		buf.Write(entries[i])
+		buf.Write(delim)
+
+		i += n
+	}
+
+	return buf.Bytes()
+}
+
+// Prefixes each entry of a document with its 1-based number and a tab
+// (like cat -n). Documents without a configured delimiter are returned
+// unchanged.
+func (e *ApiState) numberEntries(doc string, v []byte) []byte {
+	delim := e.Delimiters[filepath.Ext(doc)]
+
+	if len(delim) == 0 {
+		return v
+	}
+
+	var buf bytes.Buffer
+
+	for i, entry := range splitEntries(v, delim) {
+		buf.WriteString(strconv.Itoa(i + 1))
+		buf.WriteByte('\t')
+		buf.Write(entry)
+		buf.Write(delim)
+	}
+
+	return buf.Bytes()
+}
+
+// Writes the entries of a document as a JSON array. The entries are
+// strings if the document is valid UTF-8 and base64 otherwise.
+func (e *ApiState) writeJSONLines(w http.ResponseWriter, r *http.Request, doc string, v []byte) {
+	delim := e.Delimiters[filepath.Ext(doc)]
+
+	if len(delim) == 0 {
+		e.writeError(w, r, "ErrBadRequest: There is no delimiter configured for this document.", http.StatusBadRequest)
+		return
+	}
+
+	entries := splitEntries(v, delim)
+
+	if !utf8.Valid(v) {
+		e.returnJSON(entries, w, r)
+		return
+	}
+
+	lines := make([]string, len(entries))
+
+	for i, entry := range entries {
+		lines[i] = string(entry)
+	}
+
+	e.returnJSON(lines, w, r)
+}
+
+func (e *ApiState) diffDocs(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, a, b := vars["ns"], vars["a"], vars["b"]
+
+	va, err := CheckedGet(e.DataStore, clientToken, ns, a)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	vb, err := CheckedGet(e.DataStore, clientToken, ns, b)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	if va == nil || vb == nil {
+		e.writeError(w, r, "ErrNotFound: The resource you requested could not be found.", http.StatusNotFound)
+		return
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A: difflib.SplitLines(string(va)),
+		B: difflib.SplitLines(string(vb)),
+		FromFile: a,
+		ToFile: b,
+		Context: 3,
+	})
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(diff))
+}
+
+type createDocResponse struct {
+	Doc string
+}
+
+func (e *ApiState) createDoc(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns := vars["ns"]
+	prefix := r.URL.Query().Get("prefix")
+
+	if strings.HasPrefix(prefix, "_") {
+		e.writeError(w, r, "ErrInvalidName: The document name is not allowed.", http.StatusBadRequest)
+		return
+	}
+
+	doc, err := CheckedCreateUnique(e.DataStore, clientToken, ns, prefix)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, doc)
+
+	e.returnJSON(createDocResponse{ Doc: doc }, w, r)
+}
+
+func (e *ApiState) exportNamespace(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns := vars["ns"]
+
+	// Buffered so errors can still be reported properly.
+	var buf bytes.Buffer
+
+	err := CheckedExportNamespace(e.DataStore, clientToken, ns, &buf)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	buf.WriteTo(w)
+}
+
+func (e *ApiState) importNamespace(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns := vars["ns"]
+
+	err := CheckedImportNamespace(e.DataStore, clientToken, ns, r.Body)
+
+	if err == ErrInvalidSnapshot {
+		e.writeError(w, r, "ErrInvalidSnapshot: The snapshot is not valid JSON or has an unsupported version.", http.StatusBadRequest)
+		return
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, ns, "")
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+func (e *ApiState) exportPolicy(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+
+	// Buffered so errors can still be reported properly.
+	var buf bytes.Buffer
+
+	err := CheckedExportPolicy(e.DataStore, clientToken, &buf)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	buf.WriteTo(w)
+}
+
+func (e *ApiState) importPolicy(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+
+	err := CheckedImportPolicy(e.DataStore, clientToken, r.Body)
+
+	if err == ErrInvalidPolicy {
+		e.writeError(w, r, "ErrInvalidPolicy: The policy is not valid JSON, has an unsupported version or invalid entries.", http.StatusBadRequest)
+		return
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, "", "")
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+func (e *ApiState) snapshot(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+
+	ss, ok := e.DataStore.(Snapshotter)
+
+	if !ok {
+		e.writeError(w, r, "ErrBadRequest: This datastore does not support snapshots.", http.StatusBadRequest)
+		return
+	}
+
+	// Not buffered as snapshots can be big.
+	w.Header().Set("Content-Type", "application/json")
+
+	err := CheckedSnapshot(e.DataStore, ss, clientToken, w)
+
+	// Other errors come from writing to the client, it's too late to
+	// report them.
+	if err == ErrAccessDenied {
+		e.checkErr(err, w, r)
+	}
+}
+
+func (e *ApiState) restore(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+
+	ss, ok := e.DataStore.(Snapshotter)
+
+	if !ok {
+		e.writeError(w, r, "ErrBadRequest: This datastore does not support snapshots.", http.StatusBadRequest)
+		return
+	}
+
+	err := CheckedRestore(e.DataStore, ss, clientToken, r.Body)
+
+	if err == ErrInvalidSnapshot {
+		e.writeError(w, r, "ErrInvalidSnapshot: The snapshot is not valid JSON or has an unsupported version.", http.StatusBadRequest)
+		return
+	}
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.audit(r, "", "")
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+type namespaceDetail struct {
+	Name string `json:"name"`
+	DocCount int `json:"docCount"`
+	TotalBytes int64 `json:"totalBytes"`
+	AdminCount int `json:"adminCount"`
+}
+
+func (e *ApiState) listNamespaces(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+
+	names, err := CheckedListNamespaces(e.DataStore, clientToken)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	if r.URL.Query().Get("detail") != "1" {
+		e.returnJSON(names, w, r)
+		return
+	}
+
+	details := make([]namespaceDetail, 0, len(names))
+
+	for _, ns := range names {
+		stats, err := CheckedNamespaceStats(e.DataStore, clientToken, ns)
+
+		if !e.checkErr(err, w, r) {
+			return
+		}
+
+		details = append(details, namespaceDetail{
+			Name: ns,
+			DocCount: stats.DocCount,
+			TotalBytes: stats.TotalBytes,
+			AdminCount: stats.AdminCount,
+		})
+	}
+
+	e.returnJSON(details, w, r)
+}
+
+type storeStats struct {
+	Namespaces int `json:"namespaces"`
+	Documents int `json:"documents"`
+	TotalBytes int64 `json:"totalBytes"`
+}
+
+func (e *ApiState) stats(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+
+	stats, err := CheckedStats(e.DataStore, clientToken)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.returnJSON(storeStats{
+		Namespaces: stats.Namespaces,
+		Documents: stats.Documents,
+		TotalBytes: stats.TotalBytes,
+	}, w, r)
+}
+
+type docRef struct {
+	Ns string `json:"ns"`
+	Doc string `json:"doc"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Number of documents returned by the recent route if 'n' is missing.
+const defaultRecentDocs = 10
+
+// Returns the most recently modified documents of all namespaces.
+func (e *ApiState) recentlyModified(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+
+	n := defaultRecentDocs
+
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+
+		if err != nil || n < 0 || n > maxBatchDocs {
+			e.writeError(w, r, fmt.Sprintf("ErrBadRequest: The parameter 'n' must be an integer between 0 and %d.", maxBatchDocs), http.StatusBadRequest)
+			return
+		}
+	}
+
+	refs, err := CheckedRecentlyModified(e.DataStore, clientToken, n)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	resp := make([]docRef, len(refs))
+
+	for i, ref := range refs {
+		resp[i] = docRef{ Ns: ref.Ns, Doc: ref.Doc, ModTime: ref.ModTime }
 	}
 
-	return true
+	e.returnJSON(resp, w, r)
 }
 
-func returnJSON(v interface{}, w http.ResponseWriter) {
-	b, err := json.Marshal(v)
+func (e *ApiState) listDocs(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns := vars["ns"]
 
-	if err != nil {
-		http.Error(w, "ErrJSON: These was an internal error. Contact administrator or try again.", http.StatusInternalServerError)
+	docs, err := CheckedList(e.DataStore, clientToken, ns)
+
+	if !e.checkErr(err, w, r) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
+	e.returnJSON(docs, w, r)
 }
 
-func checkErr(err error, w http.ResponseWriter) bool {
-	if err == ErrAccessDenied {
-		http.Error(w, "AccessDenied: Either no X-API-TOKEN was supplied or you don't have permissions for this action.", http.StatusForbidden)
-		return false
-	}
+func (e *ApiState) listAccessibleDocs(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, token := vars["ns"], vars["token"]
 
-	if err != nil {
-		http.Error(w, "ErrPut: There was an internal error. Contact administrator or try again.", http.StatusInternalServerError)
-		return false
+	docs, err := CheckedListAccessibleDocs(e.DataStore, clientToken, token, ns)
+
+	if !e.checkErr(err, w, r) {
+		return
 	}
 
-	return true
+	e.returnJSON(docs, w, r)
 }
 
-func readRequest(w http.ResponseWriter, r *http.Request) []byte {
-	b, err := ioutil.ReadAll(r.Body)
+func (e *ApiState) incrCounter(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, name := vars["ns"], vars["name"]
 
-	if err != nil {
-		http.Error(w, "ErrReadingRequest: There was an error reading your request.", http.StatusInternalServerError)
-		return nil
-	}
+	delta := int64(1)
 
-	return b
-}
+	if by := r.URL.Query().Get("by"); by != "" {
+		var err error
+		delta, err = strconv.ParseInt(by, 10, 64)
 
-func (e *ApiState) index(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("jogdb api"))
-}
+		if err != nil {
+			e.writeError(w, r, "ErrBadRequest: The parameter 'by' must be an integer.", http.StatusBadRequest)
+			return
+		}
+	}
 
-func (e *ApiState) putDoc(w http.ResponseWriter, r *http.Request) {
-	b := readRequest(w, r)
+	v, err := CheckedIncrCounter(e.DataStore, clientToken, ns, name, delta)
 
-	if b == nil {
+	if !e.checkErr(err, w, r) {
 		return
 	}
 
+	e.audit(r, ns, name)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strconv.FormatInt(v, 10)))
+}
+
+func (e *ApiState) getCounter(w http.ResponseWriter, r *http.Request) {
 	clientToken := getToken(r)
 	vars := mux.Vars(r)
-	ns, doc := vars["ns"], vars["doc"]
+	ns, name := vars["ns"], vars["name"]
 
-	err := CheckedPut(e.DataStore, clientToken, ns, doc, b)
+	v, err := CheckedGetCounter(e.DataStore, clientToken, ns, name)
 
-	if !checkErr(err, w) {
+	if !e.checkErr(err, w, r) {
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("OK"))
+	w.Write([]byte(strconv.FormatInt(v, 10)))
 }
 
-func (e *ApiState) appendDoc(w http.ResponseWriter, r *http.Request) {
-	b := readRequest(w, r)
+type explainResponse struct {
+	Token string
+	Ns string
+	Doc string
+	Explanation
+}
 
-	if b == nil {
+// Returns all grants of the namespace with tokens given as their SHA-256.
+func (e *ApiState) dumpPermissions(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	ns := mux.Vars(r)["ns"]
+
+	dump, err := CheckedDumpPermissions(e.DataStore, clientToken, ns)
+
+	if !e.checkErr(err, w, r) {
 		return
 	}
 
+	e.returnJSON(dump, w, r)
+}
+
+func (e *ApiState) explain(w http.ResponseWriter, r *http.Request) {
 	clientToken := getToken(r)
 	vars := mux.Vars(r)
-	ns, doc := vars["ns"], vars["doc"]
-
-	ext := filepath.Ext(doc)
+	ns, doc, token := vars["ns"], vars["doc"], vars["token"]
 
-	delim := e.Delimiters[ext]
+	ex, err := CheckedExplain(e.DataStore, clientToken, token, ns, doc)
 
-	if delim == nil {
-		delim = []byte{}
+	if !e.checkErr(err, w, r) {
+		return
 	}
 
-	err := CheckedAppend(e.DataStore, clientToken, ns, doc, delim, b)
+	e.returnJSON(explainResponse{ Token: token, Ns: ns, Doc: doc, Explanation: ex }, w, r)
+}
+
+type setTokenRequest struct {
+	Token string
+	Put bool
+	Get bool
+	Append bool
+	Delete bool
+	Prepend bool
+}
+
+func (e *ApiState) getTokenPerms(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, doc, token := vars["ns"], vars["doc"], vars["token"]
+
+	get, put, app, del, pre, err := CheckedGetToken(e.DataStore, clientToken, token, ns, doc)
 
-	if !checkErr(err, w) {
+	if !e.checkErr(err, w, r) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("OK"))
+	e.returnJSON(setTokenRequest{ Token: token, Get: get, Put: put, Append: app, Delete: del, Prepend: pre }, w, r)
 }
 
-func (e *ApiState) getDoc(w http.ResponseWriter, r *http.Request) {
+func (e *ApiState) setToken(w http.ResponseWriter, r *http.Request) {
 	clientToken := getToken(r)
 	vars := mux.Vars(r)
 	ns, doc := vars["ns"], vars["doc"]
 
-	v, err := CheckedGet(e.DataStore, clientToken, ns, doc)
+	b := e.readRequest(w, r)
 
-	if !checkErr(err, w) {
+	if b == nil {
 		return
 	}
 
-	if v == nil {
-		http.Error(w, "ErrNotFound: The resource you requested could not be found.", http.StatusNotFound)
+	var str setTokenRequest
+	err := json.Unmarshal(b, &str)
+
+	if !e.checkErrJSON(err, w, r) {
 		return
 	}
 
-	ct := e.ContentTypes[filepath.Ext(doc)]
+	generated := str.Token == ""
 
-	if ct == "" {
-		ct = e.DefaultContentType
+	if generated {
+		str.Token = e.generateToken()
 	}
 
-	w.Header().Set("Content-Type", ct)
-	w.Write(v)
-}
+	err = CheckedSetToken(e.DataStore, clientToken, str.Token, ns, doc, str.Get, str.Put, str.Append, str.Delete, str.Prepend)
 
-type setTokenRequest struct {
-	Token string
-	Put bool
-	Get bool
-	Append bool
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.auditToken(r, ns, doc, str.Token)
+
+	setGeneratedToken(w, str.Token, generated)
+	e.returnJSON(str, w, r)
 }
 
-func (e *ApiState) setToken(w http.ResponseWriter, r *http.Request) {
+func (e *ApiState) setNamespaceToken(w http.ResponseWriter, r *http.Request) {
 	clientToken := getToken(r)
 	vars := mux.Vars(r)
-	ns, doc := vars["ns"], vars["doc"]
+	ns := vars["ns"]
 
-	b := readRequest(w, r)
+	b := e.readRequest(w, r)
 
 	if b == nil {
 		return
@@ -172,21 +2459,46 @@ func (e *ApiState) setToken(w http.ResponseWriter, r *http.Request) {
 	var str setTokenRequest
 	err := json.Unmarshal(b, &str)
 
-	if !checkErrJSON(err, w) {
+	if !e.checkErrJSON(err, w, r) {
 		return
 	}
 
-	if str.Token == "" {
+	generated := str.Token == ""
+
+	if generated {
 		str.Token = e.generateToken()
 	}
 
-	err = CheckedSetToken(e.DataStore, clientToken, str.Token, ns, doc, str.Put, str.Get, str.Append)
+	// Namespace grants only cover reading and writing.
+	str.Delete, str.Prepend = false, false
+
+	err = CheckedSetNamespaceToken(e.DataStore, clientToken, str.Token, ns, str.Get, str.Put, str.Append)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.auditToken(r, ns, "", str.Token)
+
+	setGeneratedToken(w, str.Token, generated)
+	e.returnJSON(str, w, r)
+}
+
+func (e *ApiState) revokeToken(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns, token := vars["ns"], vars["token"]
+
+	err := CheckedRevokeToken(e.DataStore, clientToken, token, ns)
 
-	if !checkErr(err, w) {
+	if !e.checkErr(err, w, r) {
 		return
 	}
 
-	returnJSON(str, w)
+	e.auditToken(r, ns, "", token)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
 }
 
 type setNamespaceAdminRequest struct {
@@ -199,7 +2511,7 @@ func (e *ApiState) setNamespaceAdmin(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	ns := vars["ns"]
 
-	b := readRequest(w, r)
+	b := e.readRequest(w, r)
 
 	if b == nil {
 		return
@@ -208,21 +2520,97 @@ func (e *ApiState) setNamespaceAdmin(w http.ResponseWriter, r *http.Request) {
 	var snar setNamespaceAdminRequest
 	err := json.Unmarshal(b, &snar)
 
-	if !checkErrJSON(err, w) {
+	if !e.checkErrJSON(err, w, r) {
 		return
 	}
 
-	if snar.Token == "" {
+	generated := snar.Token == ""
+
+	if generated {
 		snar.Token = e.generateToken()
 	}
 
 	err = CheckedSetNamespaceAdmin(e.DataStore, clientToken, snar.Token, ns, snar.Is)
 
-	if !checkErr(err, w) {
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.auditToken(r, ns, "", snar.Token)
+
+	setGeneratedToken(w, snar.Token, generated)
+	e.returnJSON(snar, w, r)
+}
+
+type setNamespaceAdminsRequest struct {
+	Tokens []string
+	Is bool
+}
+
+type setNamespaceAdminsResult struct {
+	Token string
+	OK bool
+	Error string
+}
+
+type setNamespaceAdminsResponse struct {
+	Results []setNamespaceAdminsResult
+}
+
+func (e *ApiState) setNamespaceAdmins(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+	vars := mux.Vars(r)
+	ns := vars["ns"]
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	var snar setNamespaceAdminsRequest
+	err := json.Unmarshal(b, &snar)
+
+	if !e.checkErrJSON(err, w, r) {
+		return
+	}
+
+	// The caller must be an admin. This is checked once for the whole
+	// batch rather than once per token.
+	ok, err := e.DataStore.IsAdmin(clientToken)
+
+	if err == nil && !ok {
+		err = ErrAccessDenied
+	}
+
+	if !e.checkErr(err, w, r) {
 		return
 	}
 
-	returnJSON(snar, w)
+	resp := setNamespaceAdminsResponse{
+		Results: make([]setNamespaceAdminsResult, 0, len(snar.Tokens)),
+	}
+
+	for _, token := range snar.Tokens {
+		if token == "" {
+			token = e.generateToken()
+		}
+
+		res := setNamespaceAdminsResult{ Token: token, OK: true }
+
+		err = e.DataStore.SetNamespaceAdmin(token, ns, snar.Is)
+
+		if err != nil {
+			res.OK = false
+			res.Error = err.Error()
+		} else {
+			e.auditToken(r, ns, "", token)
+		}
+
+		resp.Results = append(resp.Results, res)
+	}
+
+	e.returnJSON(resp, w, r)
 }
 
 type setAdminRequest struct {
@@ -233,7 +2621,7 @@ type setAdminRequest struct {
 func (e *ApiState) setAdmin(w http.ResponseWriter, r *http.Request) {
 	clientToken := getToken(r)
 
-	b := readRequest(w, r)
+	b := e.readRequest(w, r)
 
 	if b == nil {
 		return
@@ -242,34 +2630,434 @@ func (e *ApiState) setAdmin(w http.ResponseWriter, r *http.Request) {
 	var sar setAdminRequest
 	err := json.Unmarshal(b, &sar)
 
-	if !checkErrJSON(err, w) {
+	if !e.checkErrJSON(err, w, r) {
 		return
 	}
 
-	if sar.Token == "" {
+	generated := sar.Token == ""
+
+	if generated {
 		sar.Token = e.generateToken()
 	}
 
 	err = CheckedSetAdmin(e.DataStore, clientToken, sar.Token, sar.Is)
 
-	if !checkErr(err, w) {
+	if !e.checkErr(err, w, r) {
 		return
 	}
 
-	returnJSON(sar, w)
+	e.auditToken(r, "", "", sar.Token)
+
+	setGeneratedToken(w, sar.Token, generated)
+	e.returnJSON(sar, w, r)
+}
+
+type rotateRootRequest struct {
+	Old string
+	New string
+}
+
+type rotateRootResponse struct {
+	Token string
 }
 
+// Replaces the root token. The request has to be made with the root token
+// and name it as `Old` too. A new token is generated if `New` is empty.
+func (e *ApiState) rotateRoot(w http.ResponseWriter, r *http.Request) {
+	clientToken := getToken(r)
+
+	b := e.readRequest(w, r)
+
+	if b == nil {
+		return
+	}
+
+	var rrr rotateRootRequest
+	err := json.Unmarshal(b, &rrr)
+
+	if !e.checkErrJSON(err, w, r) {
+		return
+	}
+
+	generated := rrr.New == ""
+
+	if generated {
+		rrr.New = e.generateToken()
+	}
+
+	err = CheckedRotateRootToken(e.DataStore, clientToken, rrr.Old, rrr.New)
+
+	if !e.checkErr(err, w, r) {
+		return
+	}
+
+	e.auditToken(r, "", "", rrr.New)
+
+	setGeneratedToken(w, rrr.New, generated)
+	e.returnJSON(rotateRootResponse{ Token: rrr.New }, w, r)
+}
 
 func NewAPI(e *ApiState) *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/", e.index).Methods("GET")
-	r.HandleFunc("/r/{ns}/{doc}", e.appendDoc).Methods("PUT")
-	r.HandleFunc("/r/{ns}/{doc}", e.putDoc).Methods("POST")
-	r.HandleFunc("/r/{ns}/{doc}", e.getDoc).Methods("GET")
-	r.HandleFunc("/m/token/{ns}/{doc}", e.setToken).Methods("PUT")
-	r.HandleFunc("/m/admin/{ns}", e.setNamespaceAdmin).Methods("PUT")
-	r.HandleFunc("/m/admin", e.setAdmin).Methods("PUT")
+	r.HandleFunc("/", e.index).Methods("GET").Name("index")
+	r.HandleFunc("/healthz", e.healthz).Methods("GET").Name("healthz")
+	r.HandleFunc("/readyz", e.readyz).Methods("GET").Name("readyz")
+	r.HandleFunc("/r/{ns}/export", e.exportNamespace).Methods("GET").Name("exportNamespace")
+	r.HandleFunc("/r/{ns}/import", e.importNamespace).Methods("PUT").Name("importNamespace")
+	r.HandleFunc("/r/{ns}/{doc}", e.appendDoc).Methods("PUT").Name("appendDoc")
+	r.HandleFunc("/r/{ns}/_mget", e.mgetDocs).Methods("POST").Name("mgetDocs")
+	r.HandleFunc("/r/{ns}/_mset", e.msetDocs).Methods("POST").Name("msetDocs")
+	r.HandleFunc("/r/{ns}/{doc}", e.putDoc).Methods("POST").Name("putDoc")
+	r.HandleFunc("/r/{ns}/{doc}", e.deleteDoc).Methods("DELETE").Name("deleteDoc")
+	r.HandleFunc("/r/{ns}/{doc}", e.mergeDoc).Methods("PATCH").Name("mergeDoc")
+	r.HandleFunc("/r/{ns}/{doc}/replace", e.replaceInDoc).Methods("POST").Name("replaceInDoc")
+	r.HandleFunc("/r/{ns}/{doc}/incr", e.incrDoc).Methods("POST").Name("incrDoc")
+	r.HandleFunc("/r/{ns}/{doc}/validate", e.validateDoc).Methods("POST").Name("validateDoc")
+	r.HandleFunc("/r/{ns}/{doc}/stream", e.appendDocStream).Methods("PUT").Name("appendDocStream")
+	r.HandleFunc("/r/{ns}/{doc}/prepend", e.prependDoc).Methods("PUT").Name("prependDoc")
+	r.HandleFunc("/r/{ns}/diff", e.diffDocs).Methods("GET").Queries("a", "{a}", "b", "{b}").Name("diffDocs")
+	r.HandleFunc("/r/{ns}/{doc}", e.getDoc).Methods("GET").Name("getDoc")
+	r.HandleFunc("/r/{ns}/{doc}", e.headDoc).Methods("HEAD").Name("headDoc")
+	r.HandleFunc("/r/{ns}/{doc}/size", e.sizeDoc).Methods("GET").Name("sizeDoc")
+	r.HandleFunc("/r/{ns}/{doc}/versions", e.listVersions).Methods("GET").Name("listVersions")
+	r.HandleFunc("/r", e.listNamespaces).Methods("GET").Name("listNamespaces")
+	r.HandleFunc("/r/{ns}", e.createDoc).Methods("POST").Name("createDoc")
+	r.HandleFunc("/r/{ns}", e.listAccessibleDocs).Methods("GET").Queries("accessible_for", "{token}").Name("listAccessibleDocs")
+	r.HandleFunc("/r/{ns}", e.listDocs).Methods("GET").Name("listDocs")
+	r.HandleFunc("/batch/{ns}/multipart", e.multipartDocs).Methods("POST").Name("multipartDocs")
+	r.HandleFunc("/c/{ns}/{name}", e.incrCounter).Methods("POST").Name("incrCounter")
+	r.HandleFunc("/c/{ns}/{name}", e.getCounter).Methods("GET").Name("getCounter")
+	r.HandleFunc("/m/token/{ns}/{doc}", e.setToken).Methods("PUT").Name("setToken")
+	r.HandleFunc("/m/token/{ns}/{doc}", e.getTokenPerms).Methods("GET").Queries("token", "{token}").Name("getToken")
+	r.HandleFunc("/m/token/{ns}", e.setNamespaceToken).Methods("PUT").Name("setNamespaceToken")
+	r.HandleFunc("/m/token/{ns}", e.revokeToken).Methods("DELETE").Queries("token", "{token}").Name("revokeToken")
+	r.HandleFunc("/m/perms/{ns}", e.dumpPermissions).Methods("GET").Name("dumpPermissions")
+	r.HandleFunc("/m/explain/{ns}/{doc}", e.explain).Methods("GET").Queries("token", "{token}").Name("explain")
+	r.HandleFunc("/m/admin/{ns}", e.setNamespaceAdmin).Methods("PUT").Name("setNamespaceAdmin")
+	r.HandleFunc("/m/admin/{ns}/batch", e.setNamespaceAdmins).Methods("PUT").Name("setNamespaceAdmins")
+	r.HandleFunc("/m/admin", e.setAdmin).Methods("PUT").Name("setAdmin")
+	r.HandleFunc("/m/root", e.rotateRoot).Methods("PUT").Name("rotateRoot")
+	r.HandleFunc("/m/stats", e.stats).Methods("GET").Name("stats")
+	r.HandleFunc("/m/namespaces", e.listNamespaces).Methods("GET").Name("namespaces")
+	r.HandleFunc("/m/recent", e.recentlyModified).Methods("GET").Name("recentlyModified")
+	r.HandleFunc("/m/policy", e.exportPolicy).Methods("GET").Name("exportPolicy")
+	r.HandleFunc("/m/policy", e.importPolicy).Methods("PUT").Name("importPolicy")
+	r.HandleFunc("/m/snapshot", e.snapshot).Methods("GET").Name("snapshot")
+	r.HandleFunc("/m/restore", e.restore).Methods("PUT").Name("restore")
+
+	e.useMetrics(r)
+	e.useDebugDelay(r)
+	e.useStatsd(r)
+	e.useAdminIPAllowList(r)
+	e.useRequireToken(r)
+	r.Use(e.checkNames)
 
 	return r
 }
+
+// Returns the address of the client (see `e.TrustProxy`) or nil if it
+// can't be determined.
+func (e *ApiState) clientIP(r *http.Request) net.IP {
+	if e.TrustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+
+			return net.ParseIP(strings.TrimSpace(parts[len(parts) - 1]))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// Parses IPs and networks in CIDR notation. Invalid entries are logged
+// and skipped.
+func parseIPNets(list []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(list))
+
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil {
+				bits := 8 * len(ip.To16())
+
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+
+				nets = append(nets, &net.IPNet{ IP: ip, Mask: net.CIDRMask(bits, bits) })
+				continue
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(s)
+
+		if err != nil {
+			log.Printf("AdminIPAllowList: Ignoring invalid entry %q.", s)
+			continue
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets
+}
+
+// Adds a middleware rejecting requests to the management routes from
+// addresses not in `e.AdminIPAllowList` if it isn't empty. This happens
+// before tokens are looked at.
+func (e *ApiState) useAdminIPAllowList(r *mux.Router) {
+	if len(e.AdminIPAllowList) == 0 {
+		return
+	}
+
+	nets := parseIPNets(e.AdminIPAllowList)
+
+	allowed := func(ip net.IP) bool {
+		if ip == nil {
+			return false
+		}
+
+		for _, ipNet := range nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/m/") && !allowed(e.clientIP(r)) {
+				e.writeError(w, r, "ErrForbidden: Management requests are not allowed from your address.", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// Returns true if the name may be used for namespaces and documents.
+func (e *ApiState) validName(name string) bool {
+	pattern := e.NamePattern
+
+	if pattern == nil {
+		pattern = DefaultNamePattern
+	}
+
+	return name != "." && name != ".." && pattern.MatchString(name)
+}
+
+// Document names used by routes like /r/{ns}/export.
+var reservedDocNames = map[string]bool{
+	"export": true,
+	"import": true,
+}
+
+// Returns true if the name may be used for documents. Names starting with
+// '_' are reserved for routes like /r/{ns}/_mget, see also
+// `reservedDocNames`.
+func (e *ApiState) validDocName(name string) bool {
+	return e.validName(name) && !strings.HasPrefix(name, "_") && !reservedDocNames[name]
+}
+
+// A mux middleware rejecting requests whose namespace or document name
+// isn't valid with 400. The management routes may use prefix grants.
+func (e *ApiState) checkNames(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		if ns, ok := vars["ns"]; ok && !e.validName(ns) {
+			e.writeError(w, r, "ErrInvalidName: The namespace name is not allowed.", http.StatusBadRequest)
+			return
+		}
+
+		if doc, ok := vars["doc"]; ok {
+			valid := e.validDocName(doc)
+
+			// A lone '*' grants the whole namespace.
+			if !valid && strings.HasPrefix(r.URL.Path, "/m/") && isPrefixGrant(doc) {
+				prefix := strings.TrimSuffix(doc, "*")
+				// "export*" still matches documents like "exports".
+				valid = prefix == "" || (e.validName(prefix) && !strings.HasPrefix(prefix, "_"))
+			}
+
+			if !valid {
+				e.writeError(w, r, "ErrInvalidName: The document name is not allowed.", http.StatusBadRequest)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns true if requests to the path need a token when
+// `e.RequireToken` is set.
+func needsToken(path string) bool {
+	for _, prefix := range []string{ "/r/", "/m/", "/batch/", "/c/" } {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return path == "/r"
+}
+
+// Adds a middleware rejecting requests without a token if
+// `e.RequireToken` is set.
+func (e *ApiState) useRequireToken(r *mux.Router) {
+	if !e.RequireToken {
+		return
+	}
+
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if getToken(r) == "" && needsToken(r.URL.Path) {
+				e.writeError(w, r, "ErrUnauthorized: No X-API-TOKEN was supplied.", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// Adds a middleware delaying requests to the document routes by
+// `e.DebugDelay` if `e.DebugMode` is set.
+func (e *ApiState) useDebugDelay(r *mux.Router) {
+	if !e.DebugMode || e.DebugDelay <= 0 {
+		return
+	}
+
+	log.Printf("DebugMode: Delaying requests to /r/... by %v. Don't use this in production!", e.DebugDelay)
+
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/r/") {
+				time.Sleep(e.DebugDelay)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// Methods a POST request may be turned into through X-HTTP-Method-Override.
+var overridableMethods = map[string]bool {
+	"PUT": true,
+	"DELETE": true,
+	"PATCH": true,
+}
+
+// Handles POST requests carrying an X-HTTP-Method-Override header as if they
+// were requests of the specified method. The header is ignored on other
+// requests and for methods not in `overridableMethods`. Unlike
+// handlers.HTTPMethodOverrideHandler this never looks at the body as
+// that would consume uploaded documents.
+func MethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			method := strings.ToUpper(r.Header.Get("X-HTTP-Method-Override"))
+
+			if overridableMethods[method] {
+				r.Method = method
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the router created by NewAPI wrapped in the middlewares
+// enabled in `e`.
+func NewHandler(e *ApiState) http.Handler {
+	var h http.Handler = NewAPI(e)
+
+	if e.AllowMethodOverride {
+		h = MethodOverride(h)
+	}
+
+	if e.RateLimit.PerSecond > 0 {
+		h = e.rateLimited(h)
+	}
+
+	if len(e.AllowedOrigins) > 0 {
+		h = e.CORS(h)
+	}
+
+	return h
+}
+
+const corsAllowMethods = "GET, HEAD, POST, PUT, PATCH, DELETE"
+const corsAllowHeaders = "X-API-TOKEN, Authorization, Content-Type, If-Match, If-None-Match, Range, X-TTL-Seconds, X-Request-ID, X-HTTP-Method-Override, X-Delimiter, X-Delimiter-Encoding, X-Incr-By"
+const corsExposeHeaders = "ETag, Content-Range, Accept-Ranges, X-Request-ID, X-Generated-Token"
+
+// Returns the value for Access-Control-Allow-Origin or "" if the origin
+// isn't in `e.AllowedOrigins`.
+func (e *ApiState) allowOrigin(origin string) string {
+	for _, allowed := range e.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+
+		if allowed == origin {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+// Adds CORS headers to responses to requests from origins in
+// `e.AllowedOrigins` and answers their preflight requests. Preflight
+// requests from other origins are rejected with 403, other requests from
+// them are handled without CORS headers (which makes browsers hide the
+// response). Needs to wrap the router as it doesn't route OPTIONS.
+func (e *ApiState) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		allowed := e.allowOrigin(origin)
+
+		if allowed == "" {
+			if preflight {
+				e.writeError(w, r, "ErrOriginNotAllowed: Requests from this origin are not allowed.", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+
+		if allowed != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
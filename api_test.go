@@ -0,0 +1,1474 @@
+package jogdb
+
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "io/ioutil"
+import "bytes"
+import "path/filepath"
+import "strings"
+import "encoding/json"
+import "compress/gzip"
+import "strconv"
+import "sync"
+import "time"
+import "errors"
+import "github.com/FMNSSun/rndstring"
+
+const testRootToken = "root"
+
+// Returns an ApiState serving a new MemDataStore with `testRootToken` as
+// the root token.
+func newTestAPI(t testing.TB) *ApiState {
+	tg, err := rndstring.NewStringGenerator("hex", 14)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &ApiState {
+		ContentTypes: map[string]string{ ".txt": "text/plain" },
+		DefaultContentType: "application/octet-stream",
+		DataStore: NewMemDataStore(testRootToken),
+		StringGenerator: tg,
+		Delimiters: map[string][]byte{},
+	}
+}
+
+// Sends a request with `token` (unless empty) to `h` and returns the
+// response. `headers` are pairs of header names and values.
+func doRequest(h http.Handler, method, url, token, body string, headers ...string) *httptest.ResponseRecorder {
+	return doRequestFrom(h, "192.0.2.1:1234", method, url, token, body, headers...)
+}
+
+// Like doRequest but from the address `remoteAddr`.
+func doRequestFrom(h http.Handler, remoteAddr, method, url, token, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+
+	if token != "" {
+		r.Header.Set("X-API-TOKEN", token)
+	}
+
+	for i := 0; i + 1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i + 1])
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("Expected status %d but got %d: %s", status, w.Code, w.Body.String())
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 32 * 1024)
+
+	for _, bc := range []struct {
+		name string
+		maxPooled int
+	} {
+		{ "pooled", 0 },
+		// Every buffer grows beyond this so none is reused.
+		{ "unpooled", 1 },
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			e := newTestAPI(b)
+			e.MaxPooledBufferSize = bc.maxPooled
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/r/ns/doc", nil)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+				if e.readRequest(w, r) == nil {
+					b.Fatal("Reading the request failed.")
+				}
+			}
+		})
+	}
+}
+
+func TestGetDocUniq(t *testing.T) {
+	e := newTestAPI(t)
+	e.Delimiters[".log"] = []byte("\n")
+	h := NewHandler(e)
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.log", testRootToken, "x\nx\ny\n"), http.StatusOK)
+
+	for _, tc := range []struct {
+		uniq string
+		status int
+		body string
+	} {
+		{ "1", http.StatusOK, "x\ny\n" },
+		{ "true", http.StatusOK, "x\ny\n" },
+		{ "count", http.StatusOK, "2 x\n1 y\n" },
+		{ "0", http.StatusBadRequest, "" },
+		{ "false", http.StatusBadRequest, "" },
+	} {
+		w := doRequest(h, "GET", "/r/ns/a.log?uniq=" + tc.uniq, testRootToken, "")
+		expectStatus(t, w, tc.status)
+
+		if tc.status == http.StatusOK && w.Body.String() != tc.body {
+			t.Fatalf("uniq=%s: Expected %q but got %q.", tc.uniq, tc.body, w.Body.String())
+		}
+	}
+}
+
+func TestAppendDocStreamLimits(t *testing.T) {
+	e := newTestAPI(t)
+	e.MaxStreamAppendSize = 8
+	e.Validators = map[string]func([]byte) error{ ".json": ValidateJSON }
+	h := NewHandler(e)
+
+	w := doRequest(h, "PUT", "/r/ns/a.txt/stream", testRootToken, "12345678")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Body.String() != "8" {
+		t.Fatalf("Expected 8 bytes to be appended but got %s.", w.Body.String())
+	}
+
+	// Too big bodies are rejected as a whole.
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.txt/stream", testRootToken, "123456789"), http.StatusRequestEntityTooLarge)
+	expectDoc(t, e.DataStore, "ns", "a.txt", "12345678")
+
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.json/stream", testRootToken, "{}"), http.StatusBadRequest)
+	expectNoDoc(t, e.DataStore, "ns", "a.json")
+
+	e.MaxDocSize = 10
+
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.txt/stream", testRootToken, "123"), http.StatusRequestEntityTooLarge)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.txt/stream", testRootToken, "12"), http.StatusOK)
+	expectDoc(t, e.DataStore, "ns", "a.txt", "1234567812")
+}
+
+func TestCORS(t *testing.T) {
+	e := newTestAPI(t)
+	e.AllowedOrigins = []string{ "https://app.example.com" }
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+
+	w := doRequest(h, "OPTIONS", "/r/ns/a.txt", "", "",
+		"Origin", "https://app.example.com",
+		"Access-Control-Request-Method", "POST",
+		"Access-Control-Request-Headers", "X-API-TOKEN")
+	expectStatus(t, w, http.StatusNoContent)
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatalf("Unexpected Access-Control-Allow-Origin: %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	if !strings.Contains(w.Header().Get("Access-Control-Allow-Methods"), "POST") || !strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "X-API-TOKEN") {
+		t.Fatalf("Unexpected preflight headers: %v", w.Header())
+	}
+
+	// Preflights from other origins are rejected.
+	w = doRequest(h, "OPTIONS", "/r/ns/a.txt", "", "",
+		"Origin", "https://evil.example.com",
+		"Access-Control-Request-Method", "POST")
+	expectStatus(t, w, http.StatusForbidden)
+
+	// Actual requests get the origin and the exposed headers.
+	w = doRequest(h, "POST", "/r/ns/a.txt", "tok", "hi", "Origin", "https://app.example.com")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || !strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "ETag") {
+		t.Fatalf("Unexpected CORS headers: %v", w.Header())
+	}
+
+	// Other origins get no CORS headers.
+	w = doRequest(h, "POST", "/r/ns/a.txt", "tok", "hi", "Origin", "https://evil.example.com")
+
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected no CORS headers but got %v", w.Header())
+	}
+}
+
+func TestAdminIPAllowList(t *testing.T) {
+	e := newTestAPI(t)
+	e.AdminIPAllowList = []string{ "10.0.0.0/8", "192.168.1.5" }
+	h := NewHandler(e)
+
+	if err := e.DataStore.SetAdmin("admin", true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		addr string
+		status int
+	} {
+		{ "10.1.2.3:5000", http.StatusOK },
+		{ "192.168.1.5:5000", http.StatusOK },
+		{ "192.168.1.6:5000", http.StatusForbidden },
+		{ "[::1]:5000", http.StatusForbidden },
+	} {
+		w := doRequestFrom(h, tc.addr, "GET", "/m/stats", "admin", "")
+
+		if w.Code != tc.status {
+			t.Fatalf("%s: Expected %d but got %d: %s", tc.addr, tc.status, w.Code, w.Body.String())
+		}
+	}
+
+	// Document routes are not restricted.
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+
+	expectStatus(t, doRequestFrom(h, "192.168.1.6:5000", "POST", "/r/ns/a.txt", "tok", "hi"), http.StatusOK)
+
+	// X-Forwarded-For is only used behind a trusted proxy.
+	expectStatus(t, doRequestFrom(h, "192.168.1.6:5000", "GET", "/m/stats", "admin", "", "X-Forwarded-For", "10.0.0.1"), http.StatusForbidden)
+
+	e.TrustProxy = true
+	h = NewHandler(e)
+
+	expectStatus(t, doRequestFrom(h, "192.168.1.6:5000", "GET", "/m/stats", "admin", "", "X-Forwarded-For", "10.0.0.1"), http.StatusOK)
+}
+
+func TestRateLimit(t *testing.T) {
+	e := newTestAPI(t)
+	e.RateLimit = RateLimit{ PerSecond: 0.001, Burst: 2 }
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt", "tok", ""), http.StatusNotFound)
+	}
+
+	w := doRequest(h, "GET", "/r/ns/a.txt", "tok", "")
+	expectStatus(t, w, http.StatusTooManyRequests)
+
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("Expected a Retry-After header.")
+	}
+
+	// Other tokens from the same address and the same token from other
+	// addresses have their own buckets.
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt", "other", ""), http.StatusForbidden)
+	expectStatus(t, doRequestFrom(h, "192.0.2.2:1234", "GET", "/r/ns/a.txt", "tok", ""), http.StatusNotFound)
+
+	// Anonymous requests are limited by address.
+	for i := 0; i < 2; i++ {
+		doRequest(h, "GET", "/r/ns/a.txt", "", "")
+	}
+
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt", "", ""), http.StatusTooManyRequests)
+}
+
+func TestErrorShapes(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+
+	w := doRequest(h, "GET", "/r/ns/a.txt", "nobody", "")
+	expectStatus(t, w, http.StatusForbidden)
+
+	if !strings.HasPrefix(w.Body.String(), "AccessDenied: ") {
+		t.Fatalf("Unexpected text error: %q", w.Body.String())
+	}
+
+	w = doRequest(h, "PUT", "/m/token/ns/a.txt", "nsadmin", "{", "Accept", "application/json")
+	expectStatus(t, w, http.StatusBadRequest)
+
+	var resp errorResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected a JSON error but got %q: %v", w.Body.String(), err)
+	}
+
+	if w.Header().Get("Content-Type") != "application/json" || resp.Error != "JSON" || resp.Message == "" {
+		t.Fatalf("Unexpected JSON error: %q", w.Body.String())
+	}
+
+	w = doRequest(h, "GET", "/r/ns/a.txt", "nobody", "", "Accept", "application/json")
+	expectStatus(t, w, http.StatusForbidden)
+
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error != "AccessDenied" {
+		t.Fatalf("Unexpected JSON error: %q", w.Body.String())
+	}
+}
+
+func TestGetDocVersions(t *testing.T) {
+	e := newTestAPI(t)
+	e.DataStore = NewVersionedMemDataStore(testRootToken, 2)
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+
+	for _, v := range []string{ "one", "two", "three" } {
+		expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "tok", v), http.StatusOK)
+	}
+
+	w := doRequest(h, "GET", "/r/ns/a.txt?rev=2", "tok", "")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Body.String() != "two" {
+		t.Fatalf("Expected revision 2 but got %q.", w.Body.String())
+	}
+
+	// Revision 1 was pruned.
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt?rev=1", "tok", ""), http.StatusNotFound)
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt?rev=x", "tok", ""), http.StatusBadRequest)
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt?rev=2", "nobody", ""), http.StatusForbidden)
+
+	w = doRequest(h, "GET", "/r/ns/a.txt/versions", "tok", "")
+	expectStatus(t, w, http.StatusOK)
+
+	var versions []VersionInfo
+
+	if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil || len(versions) != 2 || versions[0].Rev != 2 {
+		t.Fatalf("Unexpected versions %q: %v", w.Body.String(), err)
+	}
+
+	// Datastores without versions reject revisions.
+	e.DataStore = NewMemDataStore(testRootToken)
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt?rev=1", "tok", ""), http.StatusBadRequest)
+}
+
+func TestRequestSizeLimits(t *testing.T) {
+	e := newTestAPI(t)
+	e.MaxRequestBytes = 100
+	e.MaxManagementRequestBytes = 50
+	h := NewHandler(e)
+
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+	grantAll(t, e.DataStore, "writer", "ns", "a.txt")
+	grantAll(t, e.DataStore, "writer", "ns", "b.txt")
+
+	body := `{"token":"tok","get":true,"padding":"` + strings.Repeat("x", 50) + `"}`
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns/a.txt", "nsadmin", body), http.StatusRequestEntityTooLarge)
+
+	if ok, _ := e.DataStore.CanGet("tok", "ns", "a.txt"); ok {
+		t.Fatal("The permissions of an oversized request were set.")
+	}
+
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns/a.txt", "nsadmin", `{"token":"tok","get":true}`), http.StatusOK)
+
+	// Document routes have their own limit.
+	doc := strings.Repeat("x", 100)
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "writer", doc), http.StatusOK)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "writer", doc + "x"), http.StatusRequestEntityTooLarge)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.txt", "writer", doc + "x"), http.StatusRequestEntityTooLarge)
+	expectDoc(t, e.DataStore, "ns", "a.txt", doc)
+
+	// So do streamed puts.
+	e.StreamPutsAbove = 10
+	expectStatus(t, doRequest(h, "POST", "/r/ns/b.txt", "writer", doc + "x"), http.StatusRequestEntityTooLarge)
+	expectNoDoc(t, e.DataStore, "ns", "b.txt")
+}
+
+func TestIncrDoc(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	for _, doc := range []string{ "n", "empty", "text" } {
+		grantAll(t, e.DataStore, "tok", "ns", doc)
+	}
+
+	for _, tc := range []struct {
+		body string
+		headers []string
+		expected string
+	} {
+		{ "", nil, "1" },
+		{ "5", nil, "6" },
+		{ "", []string{ "X-Incr-By", "-10" }, "-4" },
+	} {
+		w := doRequest(h, "POST", "/r/ns/n/incr", "tok", tc.body, tc.headers...)
+		expectStatus(t, w, http.StatusOK)
+
+		if w.Body.String() != tc.expected {
+			t.Fatalf("Expected %s but got %s.", tc.expected, w.Body.String())
+		}
+	}
+
+	expectDoc(t, e.DataStore, "ns", "n", "-4")
+
+	// Empty documents count as zero.
+	e.DataStore.Put("ns", "empty", []byte{})
+
+	w := doRequest(h, "POST", "/r/ns/empty/incr", "tok", "")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Body.String() != "1" {
+		t.Fatalf("Expected 1 but got %s.", w.Body.String())
+	}
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/n/incr", "tok", "x"), http.StatusBadRequest)
+
+	e.DataStore.Put("ns", "text", []byte("hello"))
+	expectStatus(t, doRequest(h, "POST", "/r/ns/text/incr", "tok", ""), http.StatusConflict)
+	expectDoc(t, e.DataStore, "ns", "text", "hello")
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/n/incr", "nobody", ""), http.StatusForbidden)
+}
+
+func TestIncrDocConcurrent(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "n")
+
+	const workers = 8
+	const increments = 50
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < increments; j++ {
+				if w := doRequest(h, "POST", "/r/ns/n/incr", "tok", ""); w.Code != http.StatusOK {
+					t.Errorf("Expected 200 but got %d.", w.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	expectDoc(t, e.DataStore, "ns", "n", strconv.Itoa(workers * increments))
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	e := newTestAPI(t)
+	e.AuditLogger = NewJSONAuditLogger(&buf)
+	h := NewHandler(e)
+
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+	grantAll(t, e.DataStore, "writer", "ns", "n")
+
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns/a.txt", "nsadmin", `{"token":"tok","get":true}`), http.StatusOK)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/n/incr", "writer", ""), http.StatusOK)
+	expectStatus(t, doRequest(h, "DELETE", "/m/token/ns?token=tok", "nsadmin", ""), http.StatusOK)
+	// Failed operations aren't recorded.
+	expectStatus(t, doRequest(h, "POST", "/r/ns/n/incr", "tok", ""), http.StatusForbidden)
+
+	if strings.Contains(buf.String(), "nsadmin") || strings.Contains(buf.String(), "writer") || strings.Contains(buf.String(), "tok\"") {
+		t.Fatalf("Tokens ended up in the audit log: %s", buf.String())
+	}
+
+	var records []auditRecord
+	dec := json.NewDecoder(&buf)
+
+	for dec.More() {
+		var rec auditRecord
+
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.Time.IsZero() {
+			t.Fatalf("Record without a time: %+v", rec)
+		}
+
+		rec.Time = time.Time{}
+		records = append(records, rec)
+	}
+
+	nsadmin, writer, tok := hashToken("nsadmin"), hashToken("writer"), hashToken("tok")
+
+	expected := []auditRecord {
+		{ Token: nsadmin, Op: "setToken", Ns: "ns", Doc: "a.txt", Subject: tok },
+		{ Token: writer, Op: "incrDoc", Ns: "ns", Doc: "n" },
+		{ Token: nsadmin, Op: "revokeToken", Ns: "ns", Subject: tok },
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records but got %+v.", len(expected), records)
+	}
+
+	for i := range expected {
+		if records[i] != expected[i] {
+			t.Fatalf("Expected %+v but got %+v.", expected[i], records[i])
+		}
+	}
+}
+
+func TestStoredContentTypes(t *testing.T) {
+	e := newTestAPI(t)
+	e.StoreContentTypes = true
+	h := NewHandler(e)
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/image.bin", testRootToken, "\x89PNG", "Content-Type", "image/png"), http.StatusOK)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", testRootToken, "hi"), http.StatusOK)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/b.bin", testRootToken, "hi"), http.StatusOK)
+
+	for doc, expected := range map[string]string {
+		// The stored type wins over the extension.
+		"image.bin": "image/png",
+		// Without one the extension and then the default apply.
+		"a.txt": "text/plain",
+		"b.bin": "application/octet-stream",
+	} {
+		for _, method := range []string{ "GET", "HEAD" } {
+			w := doRequest(h, method, "/r/ns/" + doc, testRootToken, "")
+			expectStatus(t, w, http.StatusOK)
+
+			if ct := w.Header().Get("Content-Type"); ct != expected {
+				t.Fatalf("%s %s: Expected %q but got %q.", method, doc, expected, ct)
+			}
+		}
+	}
+
+	// Overwriting without a type drops the stored one.
+	expectStatus(t, doRequest(h, "POST", "/r/ns/image.bin", testRootToken, "x"), http.StatusOK)
+
+	if ct := doRequest(h, "GET", "/r/ns/image.bin", testRootToken, "").Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Fatalf("Expected the default type but got %q.", ct)
+	}
+
+	// Types are ignored unless StoreContentTypes is set.
+	e.StoreContentTypes = false
+	expectStatus(t, doRequest(h, "POST", "/r/ns/c.bin", testRootToken, "x", "Content-Type", "image/png"), http.StatusOK)
+	e.StoreContentTypes = true
+
+	if ct := doRequest(h, "GET", "/r/ns/c.bin", testRootToken, "").Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Fatalf("Expected the default type but got %q.", ct)
+	}
+}
+
+func TestHeadDoc(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+	grantAll(t, e.DataStore, "tok", "ns", "missing.txt")
+
+	w := doRequest(h, "HEAD", "/r/ns/missing.txt", "tok", "")
+	expectStatus(t, w, http.StatusNotFound)
+
+	e.DataStore.Put("ns", "a.txt", []byte("hello"))
+
+	w = doRequest(h, "HEAD", "/r/ns/a.txt", "tok", "")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Header().Get("Content-Length") != "5" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("Unexpected headers: %v", w.Header())
+	}
+
+	if w.Body.Len() != 0 {
+		t.Fatalf("Expected no body but got %q.", w.Body.String())
+	}
+
+	expectStatus(t, doRequest(h, "HEAD", "/r/ns/a.txt", "nobody", ""), http.StatusForbidden)
+}
+
+func TestGetDocIfNoneMatch(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+	e.DataStore.Put("ns", "a.txt", []byte("hello"))
+
+	w := doRequest(h, "GET", "/r/ns/a.txt", "tok", "")
+	expectStatus(t, w, http.StatusOK)
+
+	tag := w.Header().Get("ETag")
+
+	if tag == "" {
+		t.Fatal("Expected an ETag.")
+	}
+
+	for _, inm := range []string{ tag, `"other", ` + tag, "*" } {
+		w = doRequest(h, "GET", "/r/ns/a.txt", "tok", "", "If-None-Match", inm)
+		expectStatus(t, w, http.StatusNotModified)
+
+		if w.Body.Len() != 0 {
+			t.Fatalf("Expected no body but got %q.", w.Body.String())
+		}
+	}
+
+	// Appending changes the ETag.
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.txt", "tok", " world"), http.StatusOK)
+
+	w = doRequest(h, "GET", "/r/ns/a.txt", "tok", "", "If-None-Match", tag)
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Body.String() != "hello world" {
+		t.Fatalf("Expected %q but got %q.", "hello world", w.Body.String())
+	}
+
+	if w.Header().Get("ETag") == "" || w.Header().Get("ETag") == tag {
+		t.Fatalf("Expected a new ETag but got %q.", w.Header().Get("ETag"))
+	}
+}
+
+func TestGetDocRange(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+	e.DataStore.Put("ns", "a.txt", []byte("0123456789"))
+
+	for _, tc := range []struct {
+		rh string
+		status int
+		body string
+		contentRange string
+	} {
+		{ "bytes=0-3", http.StatusPartialContent, "0123", "bytes 0-3/10" },
+		{ "bytes=-3", http.StatusPartialContent, "789", "bytes 7-9/10" },
+		{ "bytes=-100", http.StatusPartialContent, "0123456789", "bytes 0-9/10" },
+		{ "bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10" },
+		{ "bytes=5-100", http.StatusPartialContent, "56789", "bytes 5-9/10" },
+		// Multiple ranges and other units are ignored.
+		{ "bytes=0-1,4-5", http.StatusOK, "0123456789", "" },
+		{ "items=0-1", http.StatusOK, "0123456789", "" },
+		{ "bytes=10-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10" },
+		{ "bytes=-0", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10" },
+	} {
+		w := doRequest(h, "GET", "/r/ns/a.txt", "tok", "", "Range", tc.rh)
+
+		if w.Code != tc.status {
+			t.Fatalf("%s: Expected status %d but got %d: %s", tc.rh, tc.status, w.Code, w.Body.String())
+		}
+
+		if w.Header().Get("Content-Range") != tc.contentRange {
+			t.Fatalf("%s: Expected Content-Range %q but got %q.", tc.rh, tc.contentRange, w.Header().Get("Content-Range"))
+		}
+
+		if tc.status != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != tc.body {
+			t.Fatalf("%s: Expected %q but got %q.", tc.rh, tc.body, w.Body.String())
+		}
+	}
+}
+
+// A DataStore whose documents shrink to `v` between Size and GetRange.
+type shrinkingDataStore struct {
+	DataStore
+	v []byte
+}
+
+func (ds *shrinkingDataStore) GetRange(ns, doc string, off, length int64) ([]byte, error) {
+	return ds.v, nil
+}
+
+func TestGetDocRangeShrunk(t *testing.T) {
+	e := newTestAPI(t)
+	e.DataStore.Put("ns", "a.txt", []byte("0123456789"))
+
+	ds := &shrinkingDataStore{ DataStore: e.DataStore }
+	e.DataStore = ds
+	h := NewHandler(e)
+
+	// Deleted in the meantime.
+	w := doRequest(h, "GET", "/r/ns/a.txt", testRootToken, "", "Range", "bytes=2-5")
+	expectStatus(t, w, http.StatusNotFound)
+
+	// Now too short for the range.
+	ds.v = []byte{}
+
+	w = doRequest(h, "GET", "/r/ns/a.txt", testRootToken, "", "Range", "bytes=2-5")
+	expectStatus(t, w, http.StatusRequestedRangeNotSatisfiable)
+}
+
+func TestMaxDocSize(t *testing.T) {
+	e := newTestAPI(t)
+	e.MaxDocSize = 10
+	e.Delimiters[".log"] = []byte("\n")
+	h := NewHandler(e)
+
+	for _, doc := range []string{ "a.txt", "b.txt", "c.log" } {
+		grantAll(t, e.DataStore, "tok", "ns", doc)
+	}
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "tok", "0123456789"), http.StatusOK)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "tok", "0123456789x"), http.StatusRequestEntityTooLarge)
+	expectDoc(t, e.DataStore, "ns", "a.txt", "0123456789")
+
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/b.txt", "tok", "0123456789x"), http.StatusRequestEntityTooLarge)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/b.txt", "tok", "01234"), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/b.txt", "tok", "56789"), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/b.txt", "tok", "x"), http.StatusRequestEntityTooLarge)
+	expectDoc(t, e.DataStore, "ns", "b.txt", "0123456789")
+
+	// The delimiter counts too.
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/c.log", "tok", "01234"), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/c.log", "tok", "5678"), http.StatusRequestEntityTooLarge)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/c.log", "tok", "567"), http.StatusOK)
+	expectDoc(t, e.DataStore, "ns", "c.log", "01234\n567\n")
+}
+
+func TestGetTokenPerms(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+
+	w := doRequest(h, "PUT", "/m/token/ns/a.txt", "nsadmin", `{"Token":"tok","Get":true,"Append":true}`)
+	expectStatus(t, w, http.StatusOK)
+
+	for _, tc := range []struct {
+		token string
+		expected setTokenRequest
+	} {
+		{ "tok", setTokenRequest{ Token: "tok", Get: true, Append: true } },
+		{ "other", setTokenRequest{ Token: "other" } },
+	} {
+		w = doRequest(h, "GET", "/m/token/ns/a.txt?token=" + tc.token, "nsadmin", "")
+		expectStatus(t, w, http.StatusOK)
+
+		var perms setTokenRequest
+
+		if err := json.Unmarshal(w.Body.Bytes(), &perms); err != nil {
+			t.Fatal(err)
+		}
+
+		if perms != tc.expected {
+			t.Fatalf("Expected %+v but got %+v.", tc.expected, perms)
+		}
+	}
+
+	// Only namespace admins can read grants.
+	expectStatus(t, doRequest(h, "GET", "/m/token/ns/a.txt?token=tok", "tok", ""), http.StatusForbidden)
+}
+
+func TestReadDocNames(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	for _, url := range []string{ "/batch/ns/multipart", "/r/ns/_mget" } {
+		for _, body := range []string{ "null", "{}", `"a"`, "[" } {
+			expectStatus(t, doRequest(h, "POST", url, testRootToken, body), http.StatusBadRequest)
+		}
+
+		expectStatus(t, doRequest(h, "POST", url, testRootToken, "[]"), http.StatusOK)
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	long := strings.Repeat("a", 129)
+
+	for _, tc := range []struct {
+		name string
+		valid bool
+	} {
+		{ "a", true },
+		{ "a.txt", true },
+		{ "A-b_c.1", true },
+		{ strings.Repeat("a", 128), true },
+		{ long, false },
+		{ "", false },
+		{ ".", false },
+		{ "..", false },
+		{ "a/b", false },
+		{ "../a", false },
+		{ "a%2Fb", false },
+		{ "a\\b", false },
+		{ "a b", false },
+	} {
+		if e.validName(tc.name) != tc.valid {
+			t.Fatalf("Expected validName(%q) to be %v.", tc.name, tc.valid)
+		}
+	}
+
+	for _, tc := range []struct {
+		url string
+		status int
+	} {
+		{ "/r/ns/" + long, http.StatusBadRequest },
+		{ "/r/" + long + "/a", http.StatusBadRequest },
+		{ "/r/ns/a%20b", http.StatusBadRequest },
+		{ "/r/ns/a%5Cb", http.StatusBadRequest },
+		// Slashes never end up in a name, not even encoded ones, and the
+		// router redirects paths with dot segments to their clean form.
+		{ "/r/ns/a%2Fb", http.StatusNotFound },
+		{ "/r/ns/../a", http.StatusMovedPermanently },
+		{ "/r/ns/%2E%2E", http.StatusMovedPermanently },
+	} {
+		w := doRequest(h, "POST", tc.url, "tok", "x")
+
+		if w.Code != tc.status {
+			t.Fatalf("%s: Expected status %d but got %d: %s", tc.url, tc.status, w.Code, w.Body.String())
+		}
+	}
+
+	namespaces, _ := e.DataStore.ListNamespaces()
+
+	if len(namespaces) != 0 {
+		t.Fatalf("Expected nothing to be written but got %v.", namespaces)
+	}
+
+	// Prefix grants are checked without the '*'.
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns/log-*", "nsadmin", `{"Token":"tok","Get":true}`), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns/*", "nsadmin", `{"Token":"tok","Get":true}`), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns/..*", "nsadmin", `{"Token":"tok","Get":true}`), http.StatusBadRequest)
+
+	// Names in batch writes are checked too.
+	e.DataStore.SetToken("tok", "ns", "a", true, true, true, true, true)
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/_mset", "tok", `{"a":"eA==","..":"eA=="}`), http.StatusBadRequest)
+	expectNoDoc(t, e.DataStore, "ns", "a")
+
+	// Document names starting with '_' are reserved for routes like
+	// _mget and _mset, and so are the names of the export and import
+	// routes.
+	for _, doc := range []string{ "_a", "_mget", "_mset", "export", "import" } {
+		if e.validDocName(doc) {
+			t.Fatalf("Expected %q to be reserved.", doc)
+		}
+
+		expectStatus(t, doRequest(h, "POST", "/r/ns/_mset", "tok", `{"` + doc + `":"eA=="}`), http.StatusBadRequest)
+	}
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/_a", "tok", "x"), http.StatusBadRequest)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/_mget", "tok", "x"), http.StatusBadRequest)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/export", "tok", "x"), http.StatusBadRequest)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/import", "tok", "x"), http.StatusBadRequest)
+	expectStatus(t, doRequest(h, "POST", "/r/ns?prefix=_", testRootToken, ""), http.StatusBadRequest)
+
+	// Prefix grants may still start with a reserved name.
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns/export*", "nsadmin", `{"Token":"tok","Get":true}`), http.StatusOK)
+}
+
+// A DataStore failing to read the document "broken".
+type brokenDataStore struct {
+	DataStore
+}
+
+func (ds *brokenDataStore) Get(ns, doc string) ([]byte, error) {
+	if doc == "broken" {
+		return nil, errors.New("Broken!")
+	}
+
+	return ds.DataStore.Get(ns, doc)
+}
+
+func TestMgetDocs(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.Put("ns", "a", []byte("A"))
+	e.DataStore.Put("ns", "b", []byte("B"))
+	e.DataStore.SetToken("tok", "ns", "a", true, false, false, false, false)
+	e.DataStore.SetToken("tok", "ns", "missing", true, false, false, false, false)
+
+	w := doRequest(h, "POST", "/r/ns/_mget", "tok", `["a","b","missing"]`)
+	expectStatus(t, w, http.StatusOK)
+
+	var values map[string][]byte
+
+	if err := json.Unmarshal(w.Body.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+
+	// Denied and missing documents are left out.
+	if len(values) != 1 || string(values["a"]) != "A" {
+		t.Fatalf("Expected only a but got %v.", values)
+	}
+
+	// Other errors fail the whole request.
+	e.DataStore = &brokenDataStore{ DataStore: e.DataStore }
+	e.DataStore.SetToken("tok", "ns", "broken", true, false, false, false, false)
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/_mget", "tok", `["a","broken"]`), http.StatusInternalServerError)
+}
+
+func TestMsetDocs(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetToken("tok", "ns", "a", false, true, false, false, false)
+
+	// One denied document fails the whole batch.
+	w := doRequest(h, "POST", "/r/ns/_mset", "tok", `{"a":"QQ==","b":"Qg=="}`)
+	expectStatus(t, w, http.StatusForbidden)
+	expectNoDoc(t, e.DataStore, "ns", "a")
+	expectNoDoc(t, e.DataStore, "ns", "b")
+
+	e.DataStore.SetToken("tok", "ns", "b", false, true, false, false, false)
+
+	w = doRequest(h, "POST", "/r/ns/_mset", "tok", `{"a":"QQ==","b":"Qg=="}`)
+	expectStatus(t, w, http.StatusOK)
+	expectDoc(t, e.DataStore, "ns", "a", "A")
+	expectDoc(t, e.DataStore, "ns", "b", "B")
+}
+
+func TestRequireToken(t *testing.T) {
+	e := newTestAPI(t)
+	e.RequireToken = true
+	e.EnableMetrics = true
+	h := NewHandler(e)
+
+	for _, tc := range []struct {
+		method, url string
+	} {
+		{ "GET", "/r/ns/a.txt" },
+		{ "POST", "/r/ns/a.txt" },
+		{ "GET", "/r" },
+		{ "GET", "/m/stats" },
+		{ "POST", "/batch/ns/multipart" },
+		{ "GET", "/c/ns/n" },
+	} {
+		expectStatus(t, doRequest(h, tc.method, tc.url, "", "x"), http.StatusUnauthorized)
+	}
+
+	// With a token the request gets to the permission checks.
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt", "nobody", ""), http.StatusForbidden)
+
+	for _, url := range []string{ "/", "/metrics", "/healthz", "/readyz" } {
+		expectStatus(t, doRequest(h, "GET", url, "", ""), http.StatusOK)
+	}
+}
+
+func TestGetToken(t *testing.T) {
+	for _, tc := range []struct {
+		headers []string
+		expected string
+	} {
+		{ []string{ "Authorization", "Bearer tok" }, "tok" },
+		{ []string{ "Authorization", "bearer  tok " }, "tok" },
+		{ []string{ "X-API-TOKEN", "tok" }, "tok" },
+		// The X-API-TOKEN header wins.
+		{ []string{ "X-API-TOKEN", "tok", "Authorization", "Bearer other" }, "tok" },
+		{ []string{ "Authorization", "Basic dXNlcjpwdw==" }, "" },
+		{ []string{ "Authorization", "Bearer" }, "" },
+		{ []string{ "Authorization", "Bearer " }, "" },
+		{ []string{ "Authorization", "Bearertok" }, "" },
+		{ nil, "" },
+	} {
+		r := httptest.NewRequest("GET", "/r/ns/a.txt", nil)
+
+		for i := 0; i + 1 < len(tc.headers); i += 2 {
+			r.Header.Set(tc.headers[i], tc.headers[i + 1])
+		}
+
+		if token := getToken(r); token != tc.expected {
+			t.Fatalf("%v: Expected %q but got %q.", tc.headers, tc.expected, token)
+		}
+	}
+
+	// And bearer tokens authorize requests.
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "", "hi", "Authorization", "Bearer tok"), http.StatusOK)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "", "hi", "Authorization", "Bearer other"), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "other", "hi", "Authorization", "Bearer tok"), http.StatusForbidden)
+}
+
+func TestMediaSeek(t *testing.T) {
+	e := newTestAPI(t)
+	e.ContentTypes[".mp4"] = "video/mp4"
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "clip.mp4")
+
+	clip := strings.Repeat("0123456789", 1000)
+	e.DataStore.Put("ns", "clip.mp4", []byte(clip))
+
+	w := doRequest(h, "HEAD", "/r/ns/clip.mp4", "tok", "")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Expected Accept-Ranges: bytes but got %q.", w.Header().Get("Accept-Ranges"))
+	}
+
+	etag := w.Header().Get("ETag")
+
+	// What a browser sends when seeking.
+	w = doRequest(h, "GET", "/r/ns/clip.mp4", "tok", "", "Range", "bytes=5000-", "If-Range", etag)
+	expectStatus(t, w, http.StatusPartialContent)
+
+	for name, expected := range map[string]string {
+		"Content-Type": "video/mp4",
+		"Content-Range": "bytes 5000-9999/10000",
+		"Content-Length": "5000",
+		"Accept-Ranges": "bytes",
+	} {
+		if w.Header().Get(name) != expected {
+			t.Fatalf("Expected %s: %s but got %q.", name, expected, w.Header().Get(name))
+		}
+	}
+
+	if w.Body.String() != clip[5000:] {
+		t.Fatal("Unexpected body.")
+	}
+
+	// A stale If-Range gets the whole document.
+	w = doRequest(h, "GET", "/r/ns/clip.mp4", "tok", "", "Range", "bytes=5000-", "If-Range", `"stale"`)
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Header().Get("Content-Length") != "10000" || w.Body.String() != clip {
+		t.Fatalf("Expected the whole document but got %d bytes.", w.Body.Len())
+	}
+}
+
+func TestListNamespaces(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetAdmin("admin", true)
+
+	w := doRequest(h, "GET", "/m/namespaces", "admin", "")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Body.String() != "[]" {
+		t.Fatalf("Expected [] but got %s.", w.Body.String())
+	}
+
+	e.DataStore.Put("a", "x", []byte("123"))
+	e.DataStore.Put("a", "y", []byte("45"))
+	e.DataStore.Put("b", "z", []byte("6"))
+	e.DataStore.SetNamespaceAdmin("nsadmin", "b", true)
+
+	w = doRequest(h, "GET", "/m/namespaces", "admin", "")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Body.String() != `["a","b"]` {
+		t.Fatalf("Expected [\"a\",\"b\"] but got %s.", w.Body.String())
+	}
+
+	w = doRequest(h, "GET", "/m/namespaces?detail=1", "admin", "")
+	expectStatus(t, w, http.StatusOK)
+
+	var details []namespaceDetail
+
+	if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []namespaceDetail{
+		{ Name: "a", DocCount: 2, TotalBytes: 5 },
+		{ Name: "b", DocCount: 1, TotalBytes: 1, AdminCount: 1 },
+	}
+
+	if len(details) != 2 || details[0] != expected[0] || details[1] != expected[1] {
+		t.Fatalf("Expected %+v but got %+v.", expected, details)
+	}
+
+	// Namespace admins can't list the namespaces.
+	expectStatus(t, doRequest(h, "GET", "/m/namespaces", "nsadmin", ""), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "GET", "/m/namespaces", "", ""), http.StatusForbidden)
+}
+
+func TestGzip(t *testing.T) {
+	e := newTestAPI(t)
+	e.CompressResponsesAbove = 100
+	e.MaxDocSize = 4096
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.log")
+	grantAll(t, e.DataStore, "tok", "ns", "b.log")
+
+	doc := strings.Repeat("all work and no play\n", 100)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(doc))
+	zw.Close()
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.log", "tok", buf.String(), "Content-Encoding", "gzip"), http.StatusOK)
+	expectDoc(t, e.DataStore, "ns", "a.log", doc)
+
+	w := doRequest(h, "GET", "/r/ns/a.log", "tok", "", "Accept-Encoding", "gzip")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Expected a gzip response but got %v.", w.Header())
+	}
+
+	zr, err := gzip.NewReader(w.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(zr)
+
+	if err != nil || string(b) != doc {
+		t.Fatalf("Unexpected response %q: %v", b, err)
+	}
+
+	// Weak and strong ETags both match.
+	etag := w.Header().Get("ETag")
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.log", "tok", "", "If-None-Match", etag), http.StatusNotModified)
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.log", "tok", "", "If-None-Match", strings.TrimPrefix(etag, "W/")), http.StatusNotModified)
+
+	// Without Accept-Encoding or for ranges nothing is compressed.
+	w = doRequest(h, "GET", "/r/ns/a.log", "tok", "")
+
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != doc {
+		t.Fatal("Expected an uncompressed response.")
+	}
+
+	w = doRequest(h, "GET", "/r/ns/a.log", "tok", "", "Accept-Encoding", "gzip", "Range", "bytes=0-9")
+	expectStatus(t, w, http.StatusPartialContent)
+
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != doc[:10] {
+		t.Fatal("Expected an uncompressed range.")
+	}
+
+	// Decompressing stops at MaxDocSize.
+	buf.Reset()
+	zw = gzip.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("x"), 8192))
+	zw.Close()
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/b.log", "tok", buf.String(), "Content-Encoding", "gzip"), http.StatusRequestEntityTooLarge)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/b.log", "tok", "not gzip", "Content-Encoding", "gzip"), http.StatusBadRequest)
+	expectNoDoc(t, e.DataStore, "ns", "b.log")
+}
+
+// A DataStore that can't be reached.
+type downDataStore struct {
+	DataStore
+}
+
+func (ds *downDataStore) Ping() error {
+	return errors.New("Connection refused!")
+}
+
+func TestHealthChecks(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	for _, url := range []string{ "/healthz", "/readyz" } {
+		w := doRequest(h, "GET", url, "", "")
+		expectStatus(t, w, http.StatusOK)
+
+		if w.Body.String() != `{"status":"ok"}` {
+			t.Fatalf("%s: Unexpected body %s", url, w.Body.String())
+		}
+	}
+
+	// Only readiness depends on the DataStore.
+	e.DataStore = &downDataStore{ DataStore: e.DataStore }
+
+	expectStatus(t, doRequest(h, "GET", "/healthz", "", ""), http.StatusOK)
+
+	w := doRequest(h, "GET", "/readyz", "", "")
+	expectStatus(t, w, http.StatusServiceUnavailable)
+
+	if w.Body.String() != `{"status":"unavailable"}` {
+		t.Fatalf("Unexpected body %s", w.Body.String())
+	}
+}
+
+func TestPrependDoc(t *testing.T) {
+	e := newTestAPI(t)
+	e.Delimiters[".log"] = []byte("\n")
+	h := NewHandler(e)
+
+	e.DataStore.SetToken("tok", "ns", "a.log", true, true, true, false, true)
+	e.DataStore.SetToken("app", "ns", "a.log", false, false, true, false, false)
+
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log", "tok", "two"), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log/prepend", "tok", "one"), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log?mode=prepend", "tok", "zero"), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log", "tok", "three"), http.StatusOK)
+	expectDoc(t, e.DataStore, "ns", "a.log", "zero\none\ntwo\nthree\n")
+
+	// Appending doesn't allow prepending.
+	if ok, err := e.DataStore.CanPrepend("app", "ns", "a.log"); err != nil || ok {
+		t.Fatalf("Expected the append grant not to allow prepending: %v, %v", ok, err)
+	}
+
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log/prepend", "app", "x"), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log?mode=prepend", "app", "x"), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log", "app", "four"), http.StatusOK)
+	expectDoc(t, e.DataStore, "ns", "a.log", "zero\none\ntwo\nthree\nfour\n")
+}
+
+func TestAppendDelimiterHeader(t *testing.T) {
+	e := newTestAPI(t)
+	e.Delimiters[".log"] = []byte("\n")
+	h := NewHandler(e)
+
+	for _, tc := range []struct {
+		name string
+		url string
+		headers []string
+		status int
+		expected string
+	} {
+		{ "absent", "/r/ns/a.log", nil, http.StatusOK, "x\n" },
+		{ "empty", "/r/ns/b.log", []string{ "X-Delimiter", "" }, http.StatusOK, "x" },
+		{ "escaped", "/r/ns/c.log", []string{ "X-Delimiter", "\\n" }, http.StatusOK, "x\\n" },
+		{ "override", "/r/ns/d.log", []string{ "X-Delimiter", ";" }, http.StatusOK, "x;" },
+		{ "base64", "/r/ns/e.log", []string{ "X-Delimiter", "AAo=", "X-Delimiter-Encoding", "base64" }, http.StatusOK, "x\x00\n" },
+		{ "prepend", "/r/ns/f.log/prepend", []string{ "X-Delimiter", ";" }, http.StatusOK, "x;" },
+		{ "stream", "/r/ns/g.log/stream", []string{ "X-Delimiter", ";" }, http.StatusOK, "x;" },
+		{ "bad base64", "/r/ns/h.log", []string{ "X-Delimiter", "!", "X-Delimiter-Encoding", "base64" }, http.StatusBadRequest, "" },
+		{ "unknown encoding", "/r/ns/i.log", []string{ "X-Delimiter", ";", "X-Delimiter-Encoding", "hex" }, http.StatusBadRequest, "" },
+	} {
+		doc := strings.Split(tc.url, "/")[3]
+		e.DataStore.SetToken("tok", "ns", doc, true, true, true, false, true)
+
+		w := doRequest(h, "PUT", tc.url, "tok", "x", tc.headers...)
+
+		if w.Code != tc.status {
+			t.Fatalf("%s: Expected %d but got %d: %s", tc.name, tc.status, w.Code, w.Body.String())
+		}
+
+		if tc.status != http.StatusOK {
+			expectNoDoc(t, e.DataStore, "ns", doc)
+			continue
+		}
+
+		expectDoc(t, e.DataStore, "ns", doc, tc.expected)
+	}
+}
+
+func TestRevokeTokenRoute(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetAdmin("admin", true)
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+	e.DataStore.SetNamespaceAdmin("nsadmin2", "ns", true)
+	e.DataStore.SetToken("tok", "ns", "a.txt", true, true, true, true, true)
+
+	expectStatus(t, doRequest(h, "DELETE", "/m/token/ns?token=tok", "tok", ""), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "DELETE", "/m/token/ns?token=tok", "nsadmin", ""), http.StatusOK)
+
+	if ok, _ := e.DataStore.CanGet("tok", "ns", "a.txt"); ok {
+		t.Fatal("Expected the token to be revoked.")
+	}
+
+	// Only admins can revoke namespace admins.
+	expectStatus(t, doRequest(h, "DELETE", "/m/token/ns?token=nsadmin2", "nsadmin", ""), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "DELETE", "/m/token/ns?token=nsadmin2", "admin", ""), http.StatusOK)
+
+	if ok, _ := e.DataStore.IsNamespaceAdmin("nsadmin2", "ns"); ok {
+		t.Fatal("Expected the namespace admin to be revoked.")
+	}
+}
+
+func TestRotateRoot(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	body := `{"old":"` + testRootToken + `","new":"newroot"}`
+
+	expectStatus(t, doRequest(h, "PUT", "/m/root", "nobody", body), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "PUT", "/m/root", testRootToken, `{"old":"wrong","new":"evil"}`), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "PUT", "/m/root", testRootToken, body), http.StatusOK)
+
+	// The old root token is no longer root.
+	expectStatus(t, doRequest(h, "PUT", "/m/root", testRootToken, body), http.StatusForbidden)
+
+	// A token is generated if none is given.
+	w := doRequest(h, "PUT", "/m/root", "newroot", `{"old":"newroot"}`)
+	expectStatus(t, w, http.StatusOK)
+
+	var rrr rotateRootResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &rrr); err != nil || rrr.Token == "" {
+		t.Fatalf("Expected a generated token but got %q: %v", w.Body.String(), err)
+	}
+
+	if ok, _ := e.DataStore.IsRoot(rrr.Token); !ok {
+		t.Fatal("Expected the generated token to be root.")
+	}
+}
+
+func TestSnapshotRoutes(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetAdmin("admin", true)
+	e.DataStore.Put("ns", "a", []byte("hello"))
+
+	expectStatus(t, doRequest(h, "GET", "/m/snapshot", "nobody", ""), http.StatusForbidden)
+
+	w := doRequest(h, "GET", "/m/snapshot", "admin", "")
+	expectStatus(t, w, http.StatusOK)
+
+	snap := w.Body.String()
+	e.DataStore.Put("ns", "a", []byte("changed"))
+
+	// Only root can restore.
+	expectStatus(t, doRequest(h, "PUT", "/m/restore", "admin", snap), http.StatusForbidden)
+	expectDoc(t, e.DataStore, "ns", "a", "changed")
+
+	expectStatus(t, doRequest(h, "PUT", "/m/restore", testRootToken, "{"), http.StatusBadRequest)
+	expectStatus(t, doRequest(h, "PUT", "/m/restore", testRootToken, snap), http.StatusOK)
+	expectDoc(t, e.DataStore, "ns", "a", "hello")
+}
+
+func TestGeneratedTokenHeader(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetAdmin("admin", true)
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+
+	for _, tc := range []struct {
+		url string
+		token string
+		body string
+		generated bool
+	} {
+		{ "/m/token/ns/a.txt", "nsadmin", `{"Get":true}`, true },
+		{ "/m/token/ns/a.txt", "nsadmin", `{"Token":"tok","Get":true}`, false },
+		{ "/m/token/ns", "nsadmin", `{"Get":true}`, true },
+		{ "/m/token/ns", "nsadmin", `{"Token":"tok","Get":true}`, false },
+		{ "/m/admin/ns", "admin", `{"Is":true}`, true },
+		{ "/m/admin/ns", "admin", `{"Token":"nsadmin2","Is":true}`, false },
+		{ "/m/admin", testRootToken, `{"Is":true}`, true },
+		{ "/m/admin", testRootToken, `{"Token":"admin2","Is":true}`, false },
+		{ "/m/root", testRootToken, `{"Old":"` + testRootToken + `","New":"newroot"}`, false },
+		{ "/m/root", "newroot", `{"Old":"newroot"}`, true },
+	} {
+		w := doRequest(h, "PUT", tc.url, tc.token, tc.body)
+		expectStatus(t, w, http.StatusOK)
+
+		var resp struct {
+			Token string
+		}
+
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := w.Header().Get("X-Generated-Token")
+
+		if tc.generated && (hdr == "" || hdr != resp.Token) {
+			t.Fatalf("%s: Expected the generated token %q in the header but got %q.", tc.url, resp.Token, hdr)
+		}
+
+		if !tc.generated && hdr != "" {
+			t.Fatalf("%s: Expected no X-Generated-Token but got %q.", tc.url, hdr)
+		}
+	}
+}
+
+func TestPatchDoc(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.json")
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+	e.DataStore.SetToken("reader", "ns", "a.json", true, false, false, false, false)
+	e.DataStore.Put("ns", "a.json", []byte(`{"a":1}`))
+	e.DataStore.Put("ns", "a.txt", []byte(`{"a":1}`))
+
+	const patchType = "application/json-patch+json"
+
+	for _, tc := range []struct {
+		url string
+		token string
+		contentType string
+		body string
+		status int
+		expected string
+	} {
+		{ "/r/ns/a.json", "tok", patchType, `[{"op":"add","path":"/b","value":2}]`, http.StatusOK, `{"a":1,"b":2}` },
+		{ "/r/ns/a.json", "tok", "application/merge-patch+json", `{"a":null}`, http.StatusOK, `{"b":2}` },
+		{ "/r/ns/a.json", "tok", patchType, `[{"op":"test","path":"/b","value":3},{"op":"remove","path":"/b"}]`, http.StatusConflict, `{"b":2}` },
+		{ "/r/ns/a.json", "tok", patchType, `[{"op":"remove","path":"/c"}]`, http.StatusConflict, `{"b":2}` },
+		{ "/r/ns/a.json", "tok", patchType, `{"op":"remove","path":"/b"}`, http.StatusBadRequest, `{"b":2}` },
+		{ "/r/ns/a.json", "tok", "application/json", `{"a":1}`, http.StatusUnsupportedMediaType, `{"b":2}` },
+		{ "/r/ns/a.json", "reader", patchType, `[{"op":"remove","path":"/b"}]`, http.StatusForbidden, `{"b":2}` },
+		{ "/r/ns/a.txt", "tok", patchType, `[{"op":"remove","path":"/a"}]`, http.StatusUnsupportedMediaType, `{"a":1}` },
+	} {
+		w := doRequest(h, "PATCH", tc.url, tc.token, tc.body, "Content-Type", tc.contentType)
+
+		if w.Code != tc.status {
+			t.Fatalf("%s: Expected %d but got %d: %s", tc.body, tc.status, w.Code, w.Body.String())
+		}
+
+		expectDoc(t, e.DataStore, "ns", strings.TrimPrefix(tc.url, "/r/ns/"), tc.expected)
+	}
+}
+
+func TestPutDocStream(t *testing.T) {
+	dir := t.TempDir()
+	fds, err := NewFileDataStore(dir, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := strings.Repeat("0123456789abcdef", 512 * 1024)
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		e := newTestAPI(t)
+		e.DataStore = ds
+		e.MaxDocSize = 16 * 1024 * 1024
+		h := NewHandler(e)
+
+		grantAll(t, ds, "tok", "ns", "a.txt")
+		grantAll(t, ds, "tok", "ns", "b.txt")
+
+		w := doRequest(h, "POST", "/r/ns/a.txt", "tok", big)
+		expectStatus(t, w, http.StatusOK)
+		expectDoc(t, ds, "ns", "a.txt", big)
+
+		etag := w.Header().Get("ETag")
+		w = doRequest(h, "GET", "/r/ns/a.txt", "tok", "")
+
+		if etag == "" || w.Header().Get("ETag") != etag {
+			t.Fatalf("%s: Expected the ETag %q but got %q.", name, etag, w.Header().Get("ETag"))
+		}
+
+		// The size limit still applies.
+		e.MaxDocSize = 4 * 1024 * 1024
+		expectStatus(t, doRequest(h, "POST", "/r/ns/b.txt", "tok", big), http.StatusRequestEntityTooLarge)
+		expectNoDoc(t, ds, "ns", "b.txt")
+	}
+
+	// No temporary files are left behind.
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "ns"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "a.txt" {
+		t.Fatalf("Unexpected files %v.", entries)
+	}
+}
+
+func TestAdminSetToken(t *testing.T) {
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetAdmin("admin", true)
+
+	for _, token := range []string{ "admin", testRootToken } {
+		ns := "ns-" + token
+		expectStatus(t, doRequest(h, "PUT", "/m/token/" + ns + "/a.txt", token, `{"Token":"tok","Get":true}`), http.StatusOK)
+
+		if ok, _ := e.DataStore.CanGet("tok", ns, "a.txt"); !ok {
+			t.Fatalf("Expected %s to grant in %s.", token, ns)
+		}
+	}
+
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns/a.txt", "nobody", `{"Token":"tok","Get":true}`), http.StatusForbidden)
+}
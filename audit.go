@@ -0,0 +1,99 @@
+package jogdb
+
+import "github.com/gorilla/mux"
+import "net/http"
+import "io"
+import "log"
+import "sync"
+import "time"
+import "encoding/json"
+
+// Records who changed what. See ApiState.AuditLogger.
+type AuditLogger interface {
+	// Called after the operation `op` (the name of the route, e.g.
+	// "putDoc") succeeded. `token` is the hex encoded SHA-256 of the
+	// client's token, empty for anonymous requests. `ns` and `doc` are
+	// empty if the operation doesn't apply to one. `subject` is the hex
+	// encoded SHA-256 of the token whose permissions or admin status the
+	// operation changed, empty for other operations.
+	LogOp(token, op, ns, doc, subject string, ts time.Time)
+}
+
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	Token string `json:"token"`
+	Op string `json:"op"`
+	Ns string `json:"ns,omitempty"`
+	Doc string `json:"doc,omitempty"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// An AuditLogger writing one JSON object per operation and line to a
+// writer. Failed writes are logged and otherwise ignored.
+type JSONAuditLogger struct {
+	w io.Writer
+	mutex *sync.Mutex
+}
+
+func NewJSONAuditLogger(w io.Writer) *JSONAuditLogger {
+	return &JSONAuditLogger {
+		w: w,
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (l *JSONAuditLogger) LogOp(token, op, ns, doc, subject string, ts time.Time) {
+	b, err := json.Marshal(auditRecord{ Time: ts, Token: token, Op: op, Ns: ns, Doc: doc, Subject: subject })
+
+	if err != nil {
+		log.Printf("JSONAuditLogger: Encoding record failed: %v", err.Error())
+		return
+	}
+
+	b = append(b, '\n')
+
+	// Concurrent records must not end up interleaved.
+	l.mutex.Lock()
+
+	_, err = l.w.Write(b)
+
+	l.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("JSONAuditLogger: Write failed: %v", err.Error())
+	}
+}
+
+// Passes the operation of the request to the AuditLogger if there is one.
+// The operation is the name of the route. Must only be called once the
+// operation succeeded.
+func (e *ApiState) audit(r *http.Request, ns, doc string) {
+	e.auditToken(r, ns, doc, "")
+}
+
+// Like audit but for operations changing the permissions or admin status
+// of `subject`.
+func (e *ApiState) auditToken(r *http.Request, ns, doc, subject string) {
+	if e.AuditLogger == nil {
+		return
+	}
+
+	op := "unknown"
+
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+		op = route.GetName()
+	}
+
+	// Tokens must not end up in the log.
+	token := getToken(r)
+
+	if token != "" {
+		token = hashToken(token)
+	}
+
+	if subject != "" {
+		subject = hashToken(subject)
+	}
+
+	e.AuditLogger.LogOp(token, op, ns, doc, subject, time.Now())
+}
@@ -0,0 +1,422 @@
+package jogdb
+
+import "sort"
+import "strings"
+import "crypto/sha256"
+import "encoding/hex"
+import "crypto/subtle"
+
+// Permission bookkeeping for DataStore implementations that keep
+// permissions in memory. It does no locking of its own, callers
+// are expected to hold the lock of their DataStore.
+//
+// If `hashed` is set the maps and the root token hold hashes of the
+// tokens (see `hashToken`) instead of the tokens themselves.
+type authState struct {
+	Perms permsType
+	NsAdmins map[string]kvBool
+	Admins kvBool
+	rootToken string
+	hashed bool
+}
+
+func newAuthState(rootToken string) *authState {
+	return &authState {
+		Perms: make(permsType),
+		NsAdmins: make(map[string]kvBool),
+		Admins: make(kvBool),
+		rootToken: rootToken,
+	}
+}
+
+// Like newAuthState but only hashes of tokens are kept.
+func newHashedAuthState(rootToken string) *authState {
+	a := newAuthState(hashToken(rootToken))
+	a.hashed = true
+
+	return a
+}
+
+// Returns the hex encoded SHA-256 hash of the token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Replaces the tokens in the selected maps by their hashes. Used to convert
+// maps persisted before tokens were hashed.
+func (a *authState) hashKeys(perms, nsAdmins, admins bool) {
+	if perms {
+		for _, nsV := range a.Perms {
+			for doc, docV := range nsV {
+				hashed := make(kvPerms)
+
+				for token, bits := range docV {
+					hashed[hashToken(token)] = bits
+				}
+
+				nsV[doc] = hashed
+			}
+		}
+	}
+
+	if nsAdmins {
+		for ns, nsV := range a.NsAdmins {
+			a.NsAdmins[ns] = hashKvBool(nsV)
+		}
+	}
+
+	if admins {
+		a.Admins = hashKvBool(a.Admins)
+	}
+}
+
+func hashKvBool(m kvBool) kvBool {
+	hashed := make(kvBool)
+
+	for token, v := range m {
+		hashed[hashToken(token)] = v
+	}
+
+	return hashed
+}
+
+// Returns the key the token is stored under.
+func (a *authState) key(token string) string {
+	if a.hashed {
+		return hashToken(token)
+	}
+
+	return token
+}
+
+// Computes new permission bits from the current ones.
+func updatePerms(curPerms uint8, get, put, app, del, pre bool) uint8 {
+	if get {
+		curPerms |= permGet
+	} else {
+		curPerms &= ^permGet
+	}
+
+	if put {
+		curPerms |= permPut
+	} else {
+		curPerms &= ^permPut
+	}
+
+	if app {
+		curPerms |= permAppend
+	} else {
+		curPerms &= ^permAppend
+	}
+
+	if del {
+		curPerms |= permDelete
+	} else {
+		curPerms &= ^permDelete
+	}
+
+	if pre {
+		curPerms |= permPrepend
+	} else {
+		curPerms &= ^permPrepend
+	}
+
+	return curPerms
+}
+
+// The comparison takes constant time so the root token can't be guessed
+// by timing requests. Lookups of other tokens in the maps are not constant
+// time.
+func (a *authState) isRoot(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(a.rootToken), []byte(a.key(token))) == 1
+}
+
+// Replaces the root token with `newToken` if `oldToken` is the root token.
+func (a *authState) rotateRoot(oldToken, newToken string) bool {
+	if !a.isRoot(oldToken) {
+		return false
+	}
+
+	a.rootToken = a.key(newToken)
+	return true
+}
+
+func (a *authState) setNamespaceAdmin(token, ns string, is bool) {
+	a.setNamespaceAdminKey(a.key(token), ns, is)
+}
+
+func (a *authState) setNamespaceAdminKey(key, ns string, is bool) {
+	nsV := a.NsAdmins[ns]
+
+	if nsV == nil {
+		if !is {
+			return // doesn't exist anyway
+		} else {
+			nsV = make(kvBool)
+			a.NsAdmins[ns] = nsV
+		}
+	}
+
+	if is {
+		nsV[key] = true
+	} else {
+		delete(nsV, key)
+	}
+}
+
+func (a *authState) setAdmin(token string, is bool) {
+	a.setAdminKey(a.key(token), is)
+}
+
+func (a *authState) setAdminKey(key string, is bool) {
+	if is {
+		a.Admins[key] = true
+	} else {
+		delete(a.Admins, key)
+	}
+}
+
+func (a *authState) isAdmin(token string) bool {
+	return a.Admins[a.key(token)]
+}
+
+func (a *authState) isNamespaceAdmin(token, ns string) bool {
+	return a.NsAdmins[ns][a.key(token)]
+}
+
+func (a *authState) setToken(token, ns, doc string, get, put, app, del, pre bool) {
+	a.setTokenKey(a.key(token), ns, doc, get, put, app, del, pre)
+}
+
+func (a *authState) setTokenKey(key, ns, doc string, get, put, app, del, pre bool) {
+	nsV := a.Perms[ns]
+
+	if nsV == nil {
+		nsV = make(map[string]kvPerms)
+		a.Perms[ns] = nsV
+	}
+
+	docV := nsV[doc]
+
+	if docV == nil {
+		docV = make(kvPerms)
+		nsV[doc] = docV
+	}
+
+	// An entry without permissions for a document denies access
+	// regardless of prefix grants, so it's kept.
+	if get == false && put == false && app == false && del == false && pre == false && isPrefixGrant(doc) {
+		delete(docV, key)
+	} else {
+		docV[key] = updatePerms(docV[key], get, put, app, del, pre)
+	}
+}
+
+// Removes all permissions of the token on documents (and prefixes) of the
+// namespace and its namespace admin status.
+func (a *authState) revokeToken(token, ns string) {
+	a.revokeTokenKey(a.key(token), ns)
+}
+
+func (a *authState) revokeTokenKey(key, ns string) {
+	for doc, docV := range a.Perms[ns] {
+		delete(docV, key)
+
+		if len(docV) == 0 {
+			delete(a.Perms[ns], doc)
+		}
+	}
+
+	delete(a.NsAdmins[ns], key)
+}
+
+// Returns the permissions set for the token on the document itself.
+func (a *authState) getToken(token, ns, doc string) (get, put, app, del, pre bool) {
+	perms := a.Perms[ns][doc][a.key(token)]
+
+	return perms & permGet != 0, perms & permPut != 0, perms & permAppend != 0, perms & permDelete != 0, perms & permPrepend != 0
+}
+
+// Returns the grants of the namespace by document and hashed token.
+func (a *authState) dumpPermissions(ns string) map[string]map[string]Perm {
+	dump := make(map[string]map[string]Perm)
+
+	for doc, docV := range a.Perms[ns] {
+		if len(docV) == 0 {
+			continue
+		}
+
+		perms := make(map[string]Perm, len(docV))
+
+		for key, bits := range docV {
+			if !a.hashed {
+				key = hashToken(key)
+			}
+
+			perms[key] = Perm {
+				Get: bits & permGet != 0,
+				Put: bits & permPut != 0,
+				Append: bits & permAppend != 0,
+				Delete: bits & permDelete != 0,
+				Prepend: bits & permPrepend != 0,
+			}
+		}
+
+		dump[doc] = perms
+	}
+
+	return dump
+}
+
+// Copies the permissions and namespace admins of the namespace into the
+// snapshot.
+func (a *authState) snapshot(ns string, snap *namespaceSnapshot) {
+	snap.HashedTokens = a.hashed
+	snap.Perms = make(map[string]kvPerms)
+
+	for doc, docV := range a.Perms[ns] {
+		if len(docV) == 0 {
+			continue
+		}
+
+		perms := make(kvPerms)
+
+		for token, bits := range docV {
+			perms[token] = bits
+		}
+
+		snap.Perms[doc] = perms
+	}
+
+	snap.Admins = make([]string, 0, len(a.NsAdmins[ns]))
+
+	for token := range a.NsAdmins[ns] {
+		snap.Admins = append(snap.Admins, token)
+	}
+
+	sort.Strings(snap.Admins)
+}
+
+// Returns true if the permissions of the snapshot can be restored. Hashed
+// tokens can't be turned back into tokens.
+func (a *authState) canRestore(snap *namespaceSnapshot) bool {
+	return a.hashed || !snap.HashedTokens
+}
+
+// Adds the permissions and namespace admins from the snapshot to the
+// namespace. Existing entries not in the snapshot are kept. Check
+// `canRestore` first.
+func (a *authState) restore(ns string, snap *namespaceSnapshot) {
+	key := a.key
+
+	if snap.HashedTokens {
+		key = func(token string) string {
+			return token
+		}
+	}
+
+	for doc, perms := range snap.Perms {
+		for token, bits := range perms {
+			get, put := bits & permGet != 0, bits & permPut != 0
+			app, del := bits & permAppend != 0, bits & permDelete != 0
+			pre := bits & permPrepend != 0
+
+			a.setTokenKey(key(token), ns, doc, get, put, app, del, pre)
+		}
+	}
+
+	for _, token := range snap.Admins {
+		a.setNamespaceAdminKey(key(token), ns, true)
+	}
+}
+
+// Returns true if the document name is a prefix grant (see `SetToken`).
+func isPrefixGrant(doc string) bool {
+	return strings.HasSuffix(doc, "*")
+}
+
+// Returns the rule reported by Explain for a prefix grant.
+func prefixGrantRule(grant string) string {
+	if grant == "*" {
+		return RuleNamespace
+	}
+
+	return RulePrefix
+}
+
+// Returns the permission bits of the token for the document and the rule
+// they come from. An entry for the document itself takes precedence.
+// Otherwise the longest prefix grant of the token matching the document
+// applies.
+func (a *authState) perms(token, ns, doc string) (uint8, string) {
+	return a.permsKey(a.key(token), ns, doc)
+}
+
+func (a *authState) permsKey(key, ns, doc string) (uint8, string) {
+	nsV := a.Perms[ns]
+
+	if tokenPerms, exists := nsV[doc][key]; exists {
+		return tokenPerms, RuleExplicit
+	}
+
+	perms := uint8(0)
+	rule := RuleNone
+	longest := -1
+
+	for grant, docV := range nsV {
+		if !isPrefixGrant(grant) || !strings.HasPrefix(doc, grant[:len(grant) - 1]) {
+			continue
+		}
+
+		if tokenPerms, exists := docV[key]; exists && len(grant) > longest {
+			perms = tokenPerms
+			rule = prefixGrantRule(grant)
+			longest = len(grant)
+		}
+	}
+
+	return perms, rule
+}
+
+// Returns true if the token has all the permission bits in `perm` set
+// for the document.
+func (a *authState) can(token, ns, doc string, perm uint8) bool {
+	perms, _ := a.perms(token, ns, doc)
+
+	return (perms & perm) == perm
+}
+
+func (a *authState) explain(token, ns, doc string) Explanation {
+	tokenPerms, rule := a.perms(token, ns, doc)
+
+	explain := func(perm uint8) PermExplanation {
+		return PermExplanation{ Allowed: (tokenPerms & perm) == perm, Rule: rule }
+	}
+
+	return Explanation{
+		Get: explain(permGet),
+		Put: explain(permPut),
+		Append: explain(permAppend),
+		Delete: explain(permDelete),
+		Prepend: explain(permPrepend),
+	}
+}
+
+// Returns the documents of `docs` (the documents stored in the namespace)
+// the token can perform a Get on, in the same order. Entries for the
+// documents themselves as well as prefix grants are taken into account,
+// being a namespace admin is not.
+func (a *authState) accessibleDocs(token, ns string, docs []string) []string {
+	accessible := make([]string, 0)
+	key := a.key(token)
+
+	for _, doc := range docs {
+		if perms, _ := a.permsKey(key, ns, doc); perms & permGet != 0 {
+			accessible = append(accessible, doc)
+		}
+	}
+
+	return accessible
+}
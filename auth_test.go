@@ -0,0 +1,479 @@
+package jogdb
+
+import "testing"
+import "net/http"
+import "path/filepath"
+import "strings"
+import "encoding/json"
+
+func TestPrefixGrant(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		ds.SetToken("tok", "ns", "logs-*", false, true, false, false, false)
+		ds.SetToken("tok", "ns", "logs-secret", true, false, false, false, false)
+		ds.SetToken("all", "ns", "*", true, false, false, false, false)
+
+		for _, tc := range []struct {
+			token string
+			doc string
+			expected bool
+		} {
+			{ "tok", "logs-1", true },
+			{ "tok", "logs-", true },
+			{ "tok", "log", false },
+			{ "tok", "other", false },
+			// An entry for the document itself takes precedence.
+			{ "tok", "logs-secret", false },
+			{ "all", "logs-1", false },
+		} {
+			if ok, err := ds.CanPut(tc.token, "ns", tc.doc); err != nil || ok != tc.expected {
+				t.Fatalf("%s: Expected CanPut(%s, %s) to be %v: %v", name, tc.token, tc.doc, tc.expected, err)
+			}
+		}
+
+		if ok, _ := ds.CanGet("all", "ns", "anything"); !ok {
+			t.Fatalf("%s: Expected \"*\" to match every document.", name)
+		}
+
+		if ok, _ := ds.CanGet("tok", "ns", "logs-1"); ok {
+			t.Fatalf("%s: Expected the prefix grant to only allow puts.", name)
+		}
+	}
+
+	// Through the API.
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetToken("tok", "ns", "logs-*", false, true, false, false, false)
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/logs-1.txt", "tok", "x"), http.StatusOK)
+	expectStatus(t, doRequest(h, "POST", "/r/ns/other.txt", "tok", "x"), http.StatusForbidden)
+	expectDoc(t, e.DataStore, "ns", "logs-1.txt", "x")
+	expectNoDoc(t, e.DataStore, "ns", "other.txt")
+}
+
+func TestMemDataStoreHashesTokens(t *testing.T) {
+	ds := NewMemDataStore(testRootToken)
+
+	ds.SetToken("tok", "ns", "doc", true, false, false, false, false)
+	ds.SetNamespaceAdmin("nsadmin", "ns", true)
+	ds.SetAdmin("admin", true)
+
+	if ok, err := ds.CanGet("tok", "ns", "doc"); err != nil || !ok {
+		t.Fatalf("Expected the token to be able to read: %v, %v", ok, err)
+	}
+
+	if ok, err := ds.IsNamespaceAdmin("nsadmin", "ns"); err != nil || !ok {
+		t.Fatalf("Expected a namespace admin: %v, %v", ok, err)
+	}
+
+	if ok, err := ds.IsAdmin("admin"); err != nil || !ok {
+		t.Fatalf("Expected an admin: %v, %v", ok, err)
+	}
+
+	if ok, err := ds.IsRoot(testRootToken); err != nil || !ok {
+		t.Fatalf("Expected the root token: %v, %v", ok, err)
+	}
+
+	// Knowing a hash is not enough.
+	if ok, _ := ds.CanGet(hashToken("tok"), "ns", "doc"); ok {
+		t.Fatal("Expected the hash of a token not to be able to read.")
+	}
+
+	if ok, _ := ds.IsRoot(hashToken(testRootToken)); ok {
+		t.Fatal("Expected the hash of the root token not to be root.")
+	}
+
+	states := []*authState{ ds.auth }
+
+	for _, s := range ds.shards {
+		states = append(states, s.auth)
+	}
+
+	for _, a := range states {
+		b, err := json.Marshal(a)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, token := range []string{ "tok", "nsadmin", "admin", testRootToken } {
+			if strings.Contains(string(b), `"` + token + `"`) || a.rootToken == token {
+				t.Fatalf("Found the token %s in %s", token, b)
+			}
+		}
+	}
+}
+
+func TestIsRoot(t *testing.T) {
+	for name, a := range map[string]*authState {
+		"plain": newAuthState(testRootToken),
+		"hashed": newHashedAuthState(testRootToken),
+	} {
+		for _, tc := range []struct {
+			token string
+			expected bool
+		} {
+			{ testRootToken, true },
+			{ "toor", false },
+			{ "", false },
+			{ testRootToken[:1], false },
+			{ testRootToken + "x", false },
+		} {
+			if a.isRoot(tc.token) != tc.expected {
+				t.Fatalf("%s: Expected isRoot(%q) to be %v.", name, tc.token, tc.expected)
+			}
+		}
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		ds.SetToken("tok", "ns", "a", true, true, true, true, true)
+		ds.SetToken("tok", "ns", "logs/*", true, false, true, false, false)
+		ds.SetToken("tok", "other", "a", true, false, false, false, false)
+		ds.SetToken("keep", "ns", "a", true, false, false, false, false)
+		ds.SetNamespaceAdmin("tok", "ns", true)
+
+		if err := ds.RevokeToken("tok", "ns"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, doc := range []string{ "a", "logs/x", "logs/*" } {
+			if ok, err := ds.CanGet("tok", "ns", doc); err != nil || ok {
+				t.Fatalf("%s: Expected no access to %s after revoking: %v, %v", name, doc, ok, err)
+			}
+		}
+
+		if get, put, app, del, pre, err := ds.GetToken("tok", "ns", "logs/*"); err != nil || get || put || app || del || pre {
+			t.Fatalf("%s: Expected the prefix grant to be gone: %v", name, err)
+		}
+
+		if ok, err := ds.IsNamespaceAdmin("tok", "ns"); err != nil || ok {
+			t.Fatalf("%s: Expected the namespace admin status to be gone: %v, %v", name, ok, err)
+		}
+
+		// Other namespaces and other tokens are untouched.
+		if ok, err := ds.CanGet("tok", "other", "a"); err != nil || !ok {
+			t.Fatalf("%s: Expected access to another namespace: %v, %v", name, ok, err)
+		}
+
+		if ok, err := ds.CanGet("keep", "ns", "a"); err != nil || !ok {
+			t.Fatalf("%s: Expected another token to keep its access: %v, %v", name, ok, err)
+		}
+	}
+
+	// The file store persists the revocation.
+	fds, err = NewFileDataStore(fds.root, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := fds.CanGet("tok", "ns", "a"); err != nil || ok {
+		t.Fatalf("Expected no access after reopening: %v, %v", ok, err)
+	}
+
+	if ok, err := fds.IsNamespaceAdmin("tok", "ns"); err != nil || ok {
+		t.Fatalf("Expected no namespace admin status after reopening: %v, %v", ok, err)
+	}
+}
+
+func TestRotateRootToken(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		if err := ds.RotateRootToken("wrong", "evil"); err != ErrAccessDenied {
+			t.Fatalf("%s: Expected ErrAccessDenied but got %v.", name, err)
+		}
+
+		if err := ds.RotateRootToken(testRootToken, "newroot"); err != nil {
+			t.Fatal(err)
+		}
+
+		for token, expected := range map[string]bool {
+			testRootToken: false,
+			"newroot": true,
+			"evil": false,
+		} {
+			if ok, err := ds.IsRoot(token); err != nil || ok != expected {
+				t.Fatalf("%s: Expected IsRoot(%s) to be %v: %v", name, token, expected, err)
+			}
+		}
+	}
+
+	// The file store doesn't persist the new token.
+	fds, err = NewFileDataStore(fds.root, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := fds.IsRoot(testRootToken); !ok {
+		t.Fatal("Expected the configured root token after reopening.")
+	}
+}
+
+func TestNamespaceToken(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		SetNamespaceToken(ds, "tok", "ns", true, false, true)
+		ds.SetToken("tok", "ns", "writable", true, true, false, false, false)
+		// An entry with all permissions false denies what the namespace
+		// grant allows.
+		ds.SetToken("tok", "ns", "secret", false, false, false, false, false)
+
+		for _, tc := range []struct {
+			doc string
+			get, put, app bool
+		} {
+			{ "a", true, false, true },
+			{ "anything/else", true, false, true },
+			{ "writable", true, true, false },
+			{ "secret", false, false, false },
+		} {
+			get, _ := ds.CanGet("tok", "ns", tc.doc)
+			put, _ := ds.CanPut("tok", "ns", tc.doc)
+			app, _ := ds.CanAppend("tok", "ns", tc.doc)
+
+			if get != tc.get || put != tc.put || app != tc.app {
+				t.Fatalf("%s: %s: Expected %v/%v/%v but got %v/%v/%v.", name, tc.doc, tc.get, tc.put, tc.app, get, put, app)
+			}
+		}
+
+		if ok, _ := ds.CanGet("tok", "other", "a"); ok {
+			t.Fatalf("%s: Expected the grant to be limited to its namespace.", name)
+		}
+
+		if err := ds.RevokeToken("tok", "ns"); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, _ := ds.CanGet("tok", "ns", "a"); ok {
+			t.Fatalf("%s: Expected no access after revoking.", name)
+		}
+	}
+
+	// Only namespace admins can set namespace grants.
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns", "tok", `{"Token":"tok","Get":true}`), http.StatusForbidden)
+	expectStatus(t, doRequest(h, "PUT", "/m/token/ns", "nsadmin", `{"Token":"tok","Get":true}`), http.StatusOK)
+
+	if ok, _ := e.DataStore.CanGet("tok", "ns", "a.txt"); !ok {
+		t.Fatal("Expected the namespace grant to be set.")
+	}
+}
+
+func TestLongestPrefixGrant(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rds, _ := newTestRedisDataStore(t)
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+		"redis": rds,
+	} {
+		ds.SetToken("tok", "ns", "*", true, false, false, false, false)
+		ds.SetToken("tok", "ns", "logs/*", true, true, true, false, false)
+		ds.SetToken("tok", "ns", "logs/2024-*", true, false, false, false, false)
+		ds.SetToken("tok", "ns", "logs/2024-01", false, false, true, false, false)
+		ds.SetToken("tok", "ns", "logs/secret", false, false, false, false, false)
+
+		for _, tc := range []struct {
+			doc string
+			get, put, app bool
+		} {
+			{ "readme", true, false, false },
+			{ "logs/x", true, true, true },
+			// The narrower grant restricts what `logs/*` allows.
+			{ "logs/2024-02", true, false, false },
+			// An entry for the document itself overrides all prefix grants.
+			{ "logs/2024-01", false, false, true },
+			{ "logs/secret", false, false, false },
+		} {
+			get, _ := ds.CanGet("tok", "ns", tc.doc)
+			put, _ := ds.CanPut("tok", "ns", tc.doc)
+			app, _ := ds.CanAppend("tok", "ns", tc.doc)
+
+			if get != tc.get || put != tc.put || app != tc.app {
+				t.Fatalf("%s: %s: Expected %v/%v/%v but got %v/%v/%v.", name, tc.doc, tc.get, tc.put, tc.app, get, put, app)
+			}
+		}
+	}
+}
+
+func TestAdminsAreNamespaceAdmins(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bds, err := NewBoltDataStore(filepath.Join(t.TempDir(), "jog.db"), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bds.Close()
+
+	rds, _ := newTestRedisDataStore(t)
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+		"bolt": bds,
+		"redis": rds,
+	} {
+		ds.SetAdmin("admin", true)
+		ds.SetNamespaceAdmin("nsadmin", "ns", true)
+
+		for _, tc := range []struct {
+			token string
+			ns string
+			expected bool
+		} {
+			{ "admin", "ns", true },
+			{ "admin", "anywhere", true },
+			{ testRootToken, "anywhere", true },
+			{ "nsadmin", "ns", true },
+			{ "nsadmin", "anywhere", false },
+			{ "nobody", "ns", false },
+		} {
+			if ok, err := ds.IsNamespaceAdmin(tc.token, tc.ns); err != nil || ok != tc.expected {
+				t.Fatalf("%s: Expected IsNamespaceAdmin(%s, %s) to be %v: %v", name, tc.token, tc.ns, tc.expected, err)
+			}
+
+			err := CheckedSetToken(ds, tc.token, "tok", tc.ns, "a", true, false, false, false, false)
+
+			if tc.expected && err != nil {
+				t.Fatalf("%s: Expected %s to grant in %s: %v", name, tc.token, tc.ns, err)
+			}
+
+			if !tc.expected && err != ErrAccessDenied {
+				t.Fatalf("%s: Expected ErrAccessDenied for %s in %s but got %v.", name, tc.token, tc.ns, err)
+			}
+		}
+
+		if ok, _ := ds.CanGet("tok", "anywhere", "a"); !ok {
+			t.Fatalf("%s: Expected the grant to be set.", name)
+		}
+
+		// Namespace admins can't revoke admins.
+		if err := CheckedRevokeToken(ds, "nsadmin", "admin", "ns"); err != ErrAccessDenied {
+			t.Fatalf("%s: Expected ErrAccessDenied but got %v.", name, err)
+		}
+	}
+}
+
+func TestDumpPermissions(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bds, err := NewBoltDataStore(filepath.Join(t.TempDir(), "jog.db"), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bds.Close()
+
+	rds, _ := newTestRedisDataStore(t)
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+		"bolt": bds,
+		"redis": rds,
+	} {
+		ds.SetToken("tok", "ns", "a", true, false, true, false, false)
+		ds.SetToken("tok", "ns", "logs/*", false, true, false, true, true)
+		ds.SetToken("tok", "ns", "logs/secret", false, false, false, false, false)
+		ds.SetToken("other", "other", "a", true, true, true, true, true)
+
+		dump, err := ds.DumpPermissions("ns")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tok := hashToken("tok")
+
+		expected := map[string]map[string]Perm {
+			"a": { tok: { Get: true, Append: true } },
+			"logs/*": { tok: { Put: true, Delete: true, Prepend: true } },
+			// Denials are included.
+			"logs/secret": { tok: {} },
+		}
+
+		if len(dump) != len(expected) {
+			t.Fatalf("%s: Expected %v but got %v.", name, expected, dump)
+		}
+
+		for doc, docV := range expected {
+			if len(dump[doc]) != 1 || dump[doc][tok] != docV[tok] {
+				t.Fatalf("%s: Expected %v for %s but got %v.", name, docV, doc, dump[doc])
+			}
+		}
+	}
+
+	// Only namespace admins can dump the grants.
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetNamespaceAdmin("nsadmin", "ns", true)
+	e.DataStore.SetToken("tok", "ns", "a", true, false, false, false, false)
+
+	expectStatus(t, doRequest(h, "GET", "/m/perms/ns", "tok", ""), http.StatusForbidden)
+
+	w := doRequest(h, "GET", "/m/perms/ns", "nsadmin", "")
+	expectStatus(t, w, http.StatusOK)
+
+	if strings.Contains(w.Body.String(), `"tok"`) || !strings.Contains(w.Body.String(), hashToken("tok")) {
+		t.Fatalf("Expected hashed tokens but got %s.", w.Body.String())
+	}
+}
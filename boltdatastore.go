@@ -0,0 +1,1202 @@
+package jogdb
+
+import "sync"
+import "sort"
+import "strconv"
+import "bytes"
+import "time"
+import "io"
+import "io/ioutil"
+import "encoding/binary"
+import "encoding/json"
+import "go.etcd.io/bbolt"
+import "github.com/FMNSSun/rndstring"
+
+// Top level buckets of a BoltDataStore. The documents, modification
+// times and document metadata have a nested bucket per namespace. The
+// meta bucket holds the permissions, admins and expiry times as JSON.
+var boltDocsBucket = []byte("docs")
+var boltModTimesBucket = []byte("modtimes")
+var boltDocMetaBucket = []byte("docmeta")
+var boltCountersBucket = []byte("counters")
+var boltMetaBucket = []byte("meta")
+
+// A DataStore persisting everything in a single bbolt database file.
+// Every write is a single transaction, so unlike with FileDataStore a crash
+// never leaves a write half done. Permissions, admins and expiry times are
+// additionally kept in memory like in FileDataStore. Only hashes of tokens
+// are kept. Namespace and document names can't be empty. Using them anyway
+// results in ErrInvalidName.
+type BoltDataStore struct {
+	db *bbolt.DB
+	expiry expiryTable
+	mutex *sync.Mutex
+	auth *authState
+	nameGenerator rndstring.StringGenerator
+}
+
+// Opens the database at `path`, creating it if it doesn't exist, and loads
+// the permissions, admins and expiry times stored in it. This also starts a
+// goroutine periodically removing documents whose TTL has passed.
+func NewBoltDataStore(path, rootToken string) (*BoltDataStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ Timeout: time.Second })
+
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &BoltDataStore {
+		db: db,
+		expiry: make(expiryTable),
+		mutex: &sync.Mutex{},
+		auth: newHashedAuthState(rootToken),
+		nameGenerator: newNameGenerator(),
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{ boltDocsBucket, boltModTimesBucket, boltDocMetaBucket, boltCountersBucket, boltMetaBucket } {
+			_, err := tx.CreateBucketIfNotExists(name)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		err = db.View(func(tx *bbolt.Tx) error {
+			err := loadBoltMeta(tx, "perms", &ds.auth.Perms)
+
+			if err == nil {
+				err = loadBoltMeta(tx, "nsadmins", &ds.auth.NsAdmins)
+			}
+
+			if err == nil {
+				err = loadBoltMeta(tx, "admins", &ds.auth.Admins)
+			}
+
+			if err == nil {
+				err = loadBoltMeta(tx, "expiry", &ds.expiry)
+			}
+
+			return err
+		})
+	}
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	runJanitor(janitorInterval, ds.sweep)
+
+	return ds, nil
+}
+
+// Closes the database file.
+func (ds *BoltDataStore) Close() error {
+	return ds.db.Close()
+}
+
+// Reads an entry of the meta bucket into `v`. A missing entry is not an
+// error.
+func loadBoltMeta(tx *bbolt.Tx, name string, v interface{}) error {
+	b := tx.Bucket(boltMetaBucket).Get([]byte(name))
+
+	if b == nil {
+		return nil
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// Writes `v` to an entry of the meta bucket.
+func saveBoltMeta(tx *bbolt.Tx, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltMetaBucket).Put([]byte(name), b)
+}
+
+// Returns the value of the document or nil if it doesn't exist. The value
+// is copied as it's only valid during the transaction.
+func boltGet(tx *bbolt.Tx, ns, doc string) []byte {
+	b := tx.Bucket(boltDocsBucket).Bucket([]byte(ns))
+
+	if b == nil {
+		return nil
+	}
+
+	// Seeking tells empty documents apart from missing ones.
+	k, v := b.Cursor().Seek([]byte(doc))
+
+	if k == nil || string(k) != doc {
+		return nil
+	}
+
+	return append([]byte{}, v...)
+}
+
+// Stores the document and its modification time.
+func boltPut(tx *bbolt.Tx, ns, doc string, v []byte) error {
+	b, err := tx.Bucket(boltDocsBucket).CreateBucketIfNotExists([]byte(ns))
+
+	if err != nil {
+		return err
+	}
+
+	err = b.Put([]byte(doc), v)
+
+	if err != nil {
+		return err
+	}
+
+	m, err := tx.Bucket(boltModTimesBucket).CreateBucketIfNotExists([]byte(ns))
+
+	if err != nil {
+		return err
+	}
+
+	t := make([]byte, 8)
+	binary.BigEndian.PutUint64(t, uint64(time.Now().UnixNano()))
+
+	return m.Put([]byte(doc), t)
+}
+
+// Returns the metadata of the document, empty if there is none.
+func boltGetMeta(tx *bbolt.Tx, ns, doc string) (DocMeta, error) {
+	var meta DocMeta
+
+	b := tx.Bucket(boltDocMetaBucket).Bucket([]byte(ns))
+
+	if b == nil {
+		return meta, nil
+	}
+
+	v := b.Get([]byte(doc))
+
+	if v == nil {
+		return meta, nil
+	}
+
+	return meta, json.Unmarshal(v, &meta)
+}
+
+// Stores the metadata of the document. Empty metadata is removed instead.
+func boltSetMeta(tx *bbolt.Tx, ns, doc string, meta DocMeta) error {
+	if meta == (DocMeta{}) {
+		b := tx.Bucket(boltDocMetaBucket).Bucket([]byte(ns))
+
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(doc))
+	}
+
+	v, err := json.Marshal(meta)
+
+	if err != nil {
+		return err
+	}
+
+	b, err := tx.Bucket(boltDocMetaBucket).CreateBucketIfNotExists([]byte(ns))
+
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(doc), v)
+}
+
+// Removes the document, its modification time and its metadata. The
+// buckets of the namespace are removed once it's empty.
+func boltDelete(tx *bbolt.Tx, ns, doc string) error {
+	docs, modTimes := tx.Bucket(boltDocsBucket), tx.Bucket(boltModTimesBucket)
+	b := docs.Bucket([]byte(ns))
+
+	if b == nil {
+		return nil
+	}
+
+	err := b.Delete([]byte(doc))
+
+	if err != nil {
+		return err
+	}
+
+	if m := modTimes.Bucket([]byte(ns)); m != nil {
+		err = m.Delete([]byte(doc))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = boltSetMeta(tx, ns, doc, DocMeta{})
+
+	if err != nil {
+		return err
+	}
+
+	if k, _ := b.Cursor().First(); k != nil {
+		return nil
+	}
+
+	err = docs.DeleteBucket([]byte(ns))
+
+	if err == nil && modTimes.Bucket([]byte(ns)) != nil {
+		err = modTimes.DeleteBucket([]byte(ns))
+	}
+
+	if err == nil && tx.Bucket(boltDocMetaBucket).Bucket([]byte(ns)) != nil {
+		err = tx.Bucket(boltDocMetaBucket).DeleteBucket([]byte(ns))
+	}
+
+	return err
+}
+
+// Calls `f` with every document of the namespace that hasn't expired.
+// Needs to be called with the lock held.
+func (ds *BoltDataStore) forEachDoc(tx *bbolt.Tx, ns string, now time.Time, f func(doc string, v []byte) error) error {
+	b := tx.Bucket(boltDocsBucket).Bucket([]byte(ns))
+
+	if b == nil {
+		return nil
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		if ds.expiry.expired(ns, string(k), now) {
+			return nil
+		}
+
+		return f(string(k), v)
+	})
+}
+
+// Returns the names of all namespaces that have buckets.
+func boltNamespaces(tx *bbolt.Tx) []string {
+	names := make([]string, 0)
+
+	tx.Bucket(boltDocsBucket).ForEach(func(k, v []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+
+	return names
+}
+
+func validBoltName(name string) bool {
+	return name != ""
+}
+
+func validBoltDoc(ns, doc string) bool {
+	return validBoltName(ns) && validBoltName(doc)
+}
+
+// Removes a document. Needs to be called with the lock held.
+func (ds *BoltDataStore) remove(tx *bbolt.Tx, ns, doc string) error {
+	if _, exists := ds.expiry[ns][doc]; exists {
+		ds.expiry.clear(ns, doc)
+
+		err := saveBoltMeta(tx, "expiry", ds.expiry)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return boltDelete(tx, ns, doc)
+}
+
+// Removes the document if its TTL has passed. Needs to be called with
+// the lock held.
+func (ds *BoltDataStore) expire(tx *bbolt.Tx, ns, doc string) error {
+	if ds.expiry.expired(ns, doc, time.Now()) {
+		return ds.remove(tx, ns, doc)
+	}
+
+	return nil
+}
+
+// Removes all documents whose TTL has passed.
+func (ds *BoltDataStore) sweep() {
+	ds.mutex.Lock()
+
+	ds.db.Update(func(tx *bbolt.Tx) error {
+		for ns, docs := range ds.expiry.expiredDocs(time.Now()) {
+			for _, doc := range docs {
+				err := ds.remove(tx, ns, doc)
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	ds.mutex.Unlock()
+}
+
+// Writes the document and sets its metadata and expiry time. A zero expiry
+// time means it doesn't expire. Needs to be called with the lock held.
+func (ds *BoltDataStore) write(tx *bbolt.Tx, ns, doc string, v []byte, meta DocMeta, expiresAt time.Time) error {
+	err := boltPut(tx, ns, doc, v)
+
+	if err != nil {
+		return err
+	}
+
+	err = boltSetMeta(tx, ns, doc, meta)
+
+	if err != nil {
+		return err
+	}
+
+	_, hadExpiry := ds.expiry[ns][doc]
+
+	if expiresAt.IsZero() && !hadExpiry {
+		return nil
+	}
+
+	if expiresAt.IsZero() {
+		ds.expiry.clear(ns, doc)
+	} else {
+		ds.expiry.set(ns, doc, expiresAt)
+	}
+
+	return saveBoltMeta(tx, "expiry", ds.expiry)
+}
+
+// Replaces the document with what `f` returns for its current value (nil
+// if it doesn't exist) if `f` returns true. The expiry time is kept.
+func (ds *BoltDataStore) update(ns, doc string, f func(cur []byte) ([]byte, bool, error)) error {
+	if !validBoltDoc(ns, doc) {
+		return ErrInvalidName
+	}
+
+	ds.mutex.Lock()
+
+	err := ds.db.Update(func(tx *bbolt.Tx) error {
+		err := ds.expire(tx, ns, doc)
+
+		if err != nil {
+			return err
+		}
+
+		v, write, err := f(boltGet(tx, ns, doc))
+
+		if err != nil || !write {
+			return err
+		}
+
+		return boltPut(tx, ns, doc, v)
+	})
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) Get(ns, doc string) ([]byte, error) {
+	if !validBoltDoc(ns, doc) {
+		return nil, ErrInvalidName
+	}
+
+	var v []byte
+
+	ds.mutex.Lock()
+
+	if ds.expiry.expired(ns, doc, time.Now()) {
+		ds.mutex.Unlock()
+		return nil, nil
+	}
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		v = boltGet(tx, ns, doc)
+		return nil
+	})
+
+	ds.mutex.Unlock()
+	return v, err
+}
+
+func (ds *BoltDataStore) GetRange(ns, doc string, off, length int64) ([]byte, error) {
+	v, err := ds.Get(ns, doc)
+
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	length, err = clampRange(int64(len(v)), off, length)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v[off:off + length], nil
+}
+
+func (ds *BoltDataStore) Size(ns, doc string) (int64, bool, error) {
+	v, err := ds.Get(ns, doc)
+
+	if err != nil || v == nil {
+		return 0, false, err
+	}
+
+	return int64(len(v)), true, nil
+}
+
+func (ds *BoltDataStore) Put(ns, doc string, v []byte) error {
+	return ds.PutWithTTL(ns, doc, v, 0)
+}
+
+func (ds *BoltDataStore) PutStream(ns, doc string, r io.Reader) error {
+	// Bolt needs the whole value, it's read outside of the transaction
+	// so a slow reader doesn't block everybody else.
+	v, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	return ds.Put(ns, doc, v)
+}
+
+func (ds *BoltDataStore) PutWithTTL(ns, doc string, v []byte, ttl time.Duration) error {
+	return ds.PutWithMeta(ns, doc, v, DocMeta{}, ttl)
+}
+
+func (ds *BoltDataStore) PutWithMeta(ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error {
+	if !validBoltDoc(ns, doc) {
+		return ErrInvalidName
+	}
+
+	var expiresAt time.Time
+
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	ds.mutex.Lock()
+
+	err := ds.db.Update(func(tx *bbolt.Tx) error {
+		return ds.write(tx, ns, doc, v, meta, expiresAt)
+	})
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) GetMeta(ns, doc string) (DocMeta, error) {
+	if !validBoltDoc(ns, doc) {
+		return DocMeta{}, ErrInvalidName
+	}
+
+	var meta DocMeta
+
+	ds.mutex.Lock()
+
+	if ds.expiry.expired(ns, doc, time.Now()) {
+		ds.mutex.Unlock()
+		return meta, nil
+	}
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		meta, err = boltGetMeta(tx, ns, doc)
+		return err
+	})
+
+	ds.mutex.Unlock()
+	return meta, err
+}
+
+func (ds *BoltDataStore) PutBatch(ns string, docs map[string][]byte) error {
+	for doc := range docs {
+		if !validBoltDoc(ns, doc) {
+			return ErrInvalidName
+		}
+	}
+
+	ds.mutex.Lock()
+
+	err := ds.db.Update(func(tx *bbolt.Tx) error {
+		for doc, v := range docs {
+			err := ds.write(tx, ns, doc, v, DocMeta{}, time.Time{})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) CompareAndPut(ns, doc string, expected, v []byte) (bool, error) {
+	if !validBoltDoc(ns, doc) {
+		return false, ErrInvalidName
+	}
+
+	var swapped bool
+
+	ds.mutex.Lock()
+
+	err := ds.db.Update(func(tx *bbolt.Tx) error {
+		err := ds.expire(tx, ns, doc)
+
+		if err != nil {
+			return err
+		}
+
+		cur := boltGet(tx, ns, doc)
+
+		if (cur == nil) != (expected == nil) || (cur != nil && !bytes.Equal(cur, expected)) {
+			return nil
+		}
+
+		swapped = true
+
+		return ds.write(tx, ns, doc, v, DocMeta{}, time.Time{})
+	})
+
+	ds.mutex.Unlock()
+	return swapped && err == nil, err
+}
+
+func (ds *BoltDataStore) Append(ns, doc string, delim, v []byte) error {
+	return ds.update(ns, doc, func(cur []byte) ([]byte, bool, error) {
+		b := make([]byte, 0, len(cur) + len(v) + len(delim))
+		b = append(b, cur...)
+		b = append(b, v...)
+		b = append(b, delim...)
+
+		return b, true, nil
+	})
+}
+
+func (ds *BoltDataStore) Prepend(ns, doc string, delim, v []byte) error {
+	return ds.update(ns, doc, func(cur []byte) ([]byte, bool, error) {
+		b := make([]byte, 0, len(v) + len(delim) + len(cur))
+		b = append(b, v...)
+		b = append(b, delim...)
+		b = append(b, cur...)
+
+		return b, true, nil
+	})
+}
+
+func (ds *BoltDataStore) AppendFrom(ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error) {
+	// Read outside of the transaction so a slow reader doesn't block
+	// everybody else.
+	v, err := readLimited(r, limit)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(v)), ds.Append(ns, doc, delim, v)
+}
+
+func (ds *BoltDataStore) ReplaceInDoc(ns, doc string, old, new []byte, all bool) (int, error) {
+	if len(old) == 0 {
+		return 0, nil
+	}
+
+	var n int
+
+	err := ds.update(ns, doc, func(cur []byte) ([]byte, bool, error) {
+		n = bytes.Count(cur, old)
+
+		if n == 0 {
+			return nil, false, nil
+		}
+
+		if !all {
+			n = 1
+		}
+
+		return bytes.Replace(cur, old, new, n), true, nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (ds *BoltDataStore) MergeJSON(ns, doc string, patch []byte) ([]byte, error) {
+	return modifyJSON(ds, ns, doc, patch, mergeJSON)
+}
+
+func (ds *BoltDataStore) PatchJSON(ns, doc string, patch []byte) ([]byte, error) {
+	return modifyJSON(ds, ns, doc, patch, patchJSON)
+}
+
+func (ds *BoltDataStore) Modify(ns, doc string, fn func(old []byte) ([]byte, error)) error {
+	return ds.update(ns, doc, func(cur []byte) ([]byte, bool, error) {
+		v, err := fn(cur)
+		return v, v != nil, err
+	})
+}
+
+func (ds *BoltDataStore) Delete(ns, doc string) error {
+	if !validBoltDoc(ns, doc) {
+		return ErrInvalidName
+	}
+
+	ds.mutex.Lock()
+
+	err := ds.db.Update(func(tx *bbolt.Tx) error {
+		return ds.remove(tx, ns, doc)
+	})
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) CreateUnique(ns, prefix string) (string, error) {
+	if !validBoltName(ns) {
+		return "", ErrInvalidName
+	}
+
+	var doc string
+
+	ds.mutex.Lock()
+
+	err := ds.db.Update(func(tx *bbolt.Tx) error {
+		for i := 0; i < maxCreateUniqueAttempts; i++ {
+			name := prefix + ds.nameGenerator.Generate()
+
+			err := ds.expire(tx, ns, name)
+
+			if err != nil {
+				return err
+			}
+
+			if boltGet(tx, ns, name) == nil {
+				doc = name
+				return boltPut(tx, ns, doc, []byte{})
+			}
+		}
+
+		return ErrNoUniqueName
+	})
+
+	ds.mutex.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	return doc, nil
+}
+
+func (ds *BoltDataStore) List(ns string) ([]string, error) {
+	docs := make([]string, 0)
+
+	ds.mutex.Lock()
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		return ds.forEachDoc(tx, ns, time.Now(), func(doc string, v []byte) error {
+			docs = append(docs, doc)
+			return nil
+		})
+	})
+
+	ds.mutex.Unlock()
+
+	// Keys are sorted by their bytes already.
+	return docs, err
+}
+
+func (ds *BoltDataStore) ListNamespaces() ([]string, error) {
+	names := make([]string, 0)
+
+	ds.mutex.Lock()
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		now := time.Now()
+
+		for _, ns := range boltNamespaces(tx) {
+			docs := 0
+
+			err := ds.forEachDoc(tx, ns, now, func(doc string, v []byte) error {
+				docs++
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if docs > 0 {
+				names = append(names, ns)
+			}
+		}
+
+		return nil
+	})
+
+	ds.mutex.Unlock()
+
+	sort.Strings(names)
+	return names, err
+}
+
+func (ds *BoltDataStore) NamespaceStats(ns string) (NamespaceStats, error) {
+	var stats NamespaceStats
+
+	ds.mutex.Lock()
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		return ds.forEachDoc(tx, ns, time.Now(), func(doc string, v []byte) error {
+			stats.DocCount++
+			stats.TotalBytes += int64(len(v))
+			return nil
+		})
+	})
+
+	stats.AdminCount = len(ds.auth.NsAdmins[ns])
+
+	ds.mutex.Unlock()
+	return stats, err
+}
+
+func (ds *BoltDataStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+
+	ds.mutex.Lock()
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		now := time.Now()
+
+		for _, ns := range boltNamespaces(tx) {
+			docs := 0
+
+			err := ds.forEachDoc(tx, ns, now, func(doc string, v []byte) error {
+				docs++
+				stats.TotalBytes += int64(len(v))
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if docs > 0 {
+				stats.Namespaces++
+				stats.Documents += docs
+			}
+		}
+
+		return nil
+	})
+
+	ds.mutex.Unlock()
+	return stats, err
+}
+
+// Reads the modification times of all documents and sorts them, so this
+// takes time proportional to the number of documents in the store (times
+// its log) on every call.
+func (ds *BoltDataStore) RecentlyModified(n int) ([]DocRef, error) {
+	refs := make([]DocRef, 0)
+
+	ds.mutex.Lock()
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		modTimes := tx.Bucket(boltModTimesBucket)
+
+		for _, ns := range boltNamespaces(tx) {
+			m := modTimes.Bucket([]byte(ns))
+
+			if m == nil {
+				continue
+			}
+
+			err := m.ForEach(func(k, v []byte) error {
+				if ds.expiry.expired(ns, string(k), now) || len(v) != 8 {
+					return nil
+				}
+
+				modTime := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+				refs = append(refs, DocRef{ Ns: ns, Doc: string(k), ModTime: modTime })
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	ds.mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newestDocRefs(refs, n), nil
+}
+
+// Checks that the database is still open.
+func (ds *BoltDataStore) Ping() error {
+	return ds.db.View(func(tx *bbolt.Tx) error {
+		return nil
+	})
+}
+
+func (ds *BoltDataStore) RotateRootToken(oldToken, newToken string) error {
+	ds.mutex.Lock()
+
+	ok := ds.auth.rotateRoot(oldToken, newToken)
+
+	ds.mutex.Unlock()
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+func (ds *BoltDataStore) IsRoot(token string) (bool, error) {
+	ds.mutex.Lock()
+
+	is := ds.auth.isRoot(token)
+
+	ds.mutex.Unlock()
+	return is, nil
+}
+
+// Writes the named parts of the permissions in a single transaction.
+// Needs to be called with the lock held.
+func (ds *BoltDataStore) saveAuth(perms, nsAdmins, admins bool) error {
+	return ds.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+
+		if perms {
+			err = saveBoltMeta(tx, "perms", ds.auth.Perms)
+		}
+
+		if err == nil && nsAdmins {
+			err = saveBoltMeta(tx, "nsadmins", ds.auth.NsAdmins)
+		}
+
+		if err == nil && admins {
+			err = saveBoltMeta(tx, "admins", ds.auth.Admins)
+		}
+
+		return err
+	})
+}
+
+func (ds *BoltDataStore) RevokeToken(token, ns string) error {
+	ds.mutex.Lock()
+
+	ds.auth.revokeToken(token, ns)
+	err := ds.saveAuth(true, true, false)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) SetNamespaceAdmin(token, ns string, is bool) error {
+	ds.mutex.Lock()
+
+	ds.auth.setNamespaceAdmin(token, ns, is)
+	err := ds.saveAuth(false, true, false)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) SetAdmin(token string, is bool) error {
+	ds.mutex.Lock()
+
+	ds.auth.setAdmin(token, is)
+	err := ds.saveAuth(false, false, true)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) IsAdmin(token string) (bool, error) {
+	ds.mutex.Lock()
+
+	is := ds.auth.isAdmin(token)
+
+	ds.mutex.Unlock()
+	return is, nil
+}
+
+func (ds *BoltDataStore) IsNamespaceAdmin(token, ns string) (bool, error) {
+	ds.mutex.Lock()
+
+	is := ds.auth.isNamespaceAdmin(token, ns) || ds.auth.isAdmin(token) || ds.auth.isRoot(token)
+
+	ds.mutex.Unlock()
+	return is, nil
+}
+
+func (ds *BoltDataStore) SetToken(token, ns, doc string, get, put, app, del, pre bool) error {
+	ds.mutex.Lock()
+
+	ds.auth.setToken(token, ns, doc, get, put, app, del, pre)
+	err := ds.saveAuth(true, false, false)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) GetToken(token, ns, doc string) (get, put, app, del, pre bool, err error) {
+	ds.mutex.Lock()
+
+	get, put, app, del, pre = ds.auth.getToken(token, ns, doc)
+
+	ds.mutex.Unlock()
+	return get, put, app, del, pre, nil
+}
+
+func (ds *BoltDataStore) can(token, ns, doc string, perm uint8) (bool, error) {
+	ds.mutex.Lock()
+
+	ok := ds.auth.can(token, ns, doc, perm)
+
+	ds.mutex.Unlock()
+	return ok, nil
+}
+
+func (ds *BoltDataStore) Explain(token, ns, doc string) (Explanation, error) {
+	ds.mutex.Lock()
+
+	ex := ds.auth.explain(token, ns, doc)
+
+	ds.mutex.Unlock()
+	return explainAdmins(ds, token, ns, ex)
+}
+
+func (ds *BoltDataStore) DumpPermissions(ns string) (map[string]map[string]Perm, error) {
+	ds.mutex.Lock()
+
+	dump := ds.auth.dumpPermissions(ns)
+
+	ds.mutex.Unlock()
+	return dump, nil
+}
+
+func (ds *BoltDataStore) CanGet(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permGet)
+}
+
+func (ds *BoltDataStore) CanPut(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permPut)
+}
+
+func (ds *BoltDataStore) CanAppend(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permAppend)
+}
+
+func (ds *BoltDataStore) CanDelete(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permDelete)
+}
+
+func (ds *BoltDataStore) CanPrepend(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permPrepend)
+}
+
+func (ds *BoltDataStore) ListAccessibleDocs(token, ns string) ([]string, error) {
+	docs, admin, err := listForAccessCheck(ds, token, ns)
+
+	if err != nil || admin {
+		return docs, err
+	}
+
+	ds.mutex.Lock()
+
+	docs = ds.auth.accessibleDocs(token, ns, docs)
+
+	ds.mutex.Unlock()
+	return docs, nil
+}
+
+func (ds *BoltDataStore) ExportNamespace(ns string, w io.Writer) error {
+	snap := &namespaceSnapshot{ Namespace: ns, Documents: make(map[string][]byte) }
+
+	ds.mutex.Lock()
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		return ds.forEachDoc(tx, ns, time.Now(), func(doc string, v []byte) error {
+			snap.Documents[doc] = append([]byte{}, v...)
+
+			meta, err := boltGetMeta(tx, ns, doc)
+			snap.setMeta(doc, meta)
+
+			return err
+		})
+	})
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	ds.auth.snapshot(ns, snap)
+
+	ds.mutex.Unlock()
+
+	// Written without holding the lock as `w` may be slow.
+	return writeSnapshot(w, snap)
+}
+
+func (ds *BoltDataStore) ImportNamespace(ns string, r io.Reader) error {
+	snap, err := readSnapshot(r)
+
+	if err != nil {
+		return err
+	}
+
+	if !ds.auth.canRestore(snap) {
+		return ErrInvalidSnapshot
+	}
+
+	for doc := range snap.Documents {
+		if !validBoltDoc(ns, doc) {
+			return ErrInvalidName
+		}
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.db.Update(func(tx *bbolt.Tx) error {
+		for doc, v := range snap.Documents {
+			err := ds.write(tx, ns, doc, v, snap.Meta[doc], time.Time{})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		ds.auth.restore(ns, snap)
+
+		err := saveBoltMeta(tx, "perms", ds.auth.Perms)
+
+		if err == nil {
+			err = saveBoltMeta(tx, "nsadmins", ds.auth.NsAdmins)
+		}
+
+		return err
+	})
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) ExportPolicy(w io.Writer) error {
+	p := newPolicy(true)
+
+	ds.mutex.Lock()
+	ds.auth.exportPolicy(p, true)
+	ds.mutex.Unlock()
+
+	// Written without holding the lock as `w` may be slow.
+	return writePolicy(w, p)
+}
+
+func (ds *BoltDataStore) ImportPolicy(r io.Reader) error {
+	p, err := readPolicy(r)
+
+	if err != nil {
+		return err
+	}
+
+	if !ds.auth.canImportPolicy(p) {
+		return ErrInvalidPolicy
+	}
+
+	ds.mutex.Lock()
+
+	ds.auth.importPolicy(p, func(string) bool { return true }, true)
+	err = ds.saveAuth(true, true, true)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *BoltDataStore) IncrCounter(ns, name string, delta int64) (int64, error) {
+	if !validBoltDoc(ns, name) {
+		return 0, ErrInvalidName
+	}
+
+	var v int64
+
+	err := ds.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.Bucket(boltCountersBucket).CreateBucketIfNotExists([]byte(ns))
+
+		if err != nil {
+			return err
+		}
+
+		if cur := b.Get([]byte(name)); cur != nil {
+			v, err = strconv.ParseInt(string(cur), 10, 64)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		v += delta
+
+		return b.Put([]byte(name), []byte(strconv.FormatInt(v, 10)))
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return v, nil
+}
+
+func (ds *BoltDataStore) GetCounter(ns, name string) (int64, error) {
+	if !validBoltDoc(ns, name) {
+		return 0, ErrInvalidName
+	}
+
+	var v int64
+
+	err := ds.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltCountersBucket).Bucket([]byte(ns))
+
+		if b == nil {
+			return nil
+		}
+
+		cur := b.Get([]byte(name))
+
+		if cur == nil {
+			return nil
+		}
+
+		var err error
+		v, err = strconv.ParseInt(string(cur), 10, 64)
+
+		return err
+	})
+
+	return v, err
+}
@@ -0,0 +1,64 @@
+package jogdb
+
+import "testing"
+import "path/filepath"
+import "time"
+
+func TestBoltDataStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jog.db")
+
+	ds, err := NewBoltDataStore(path, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds.Put("ns", "a", []byte("hello"))
+	ds.Append("ns", "log", []byte("\n"), []byte("one"))
+	ds.Append("ns", "log", []byte("\n"), []byte("two"))
+	ds.Put("ns", "b", []byte("gone"))
+	ds.Delete("ns", "b")
+	ds.PutWithTTL("ns", "c", []byte("later"), time.Hour)
+	ds.IncrCounter("ns", "n", 3)
+	ds.SetToken("tok", "ns", "a", true, false, false, false, false)
+	ds.SetNamespaceAdmin("nsadmin", "ns", true)
+	ds.SetAdmin("admin", true)
+
+	if err := ds.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewBoltDataStore(path, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer reopened.Close()
+
+	expectDoc(t, reopened, "ns", "a", "hello")
+	expectDoc(t, reopened, "ns", "log", "one\ntwo\n")
+	expectNoDoc(t, reopened, "ns", "b")
+	expectDoc(t, reopened, "ns", "c", "later")
+
+	if n, err := reopened.GetCounter("ns", "n"); err != nil || n != 3 {
+		t.Fatalf("Expected the counter to be 3 but got %d, %v", n, err)
+	}
+
+	if ok, err := reopened.CanGet("tok", "ns", "a"); err != nil || !ok {
+		t.Fatalf("Expected the grant to survive: %v, %v", ok, err)
+	}
+
+	if ok, err := reopened.IsNamespaceAdmin("nsadmin", "ns"); err != nil || !ok {
+		t.Fatalf("Expected the namespace admin to survive: %v, %v", ok, err)
+	}
+
+	if ok, err := reopened.IsAdmin("admin"); err != nil || !ok {
+		t.Fatalf("Expected the admin to survive: %v, %v", ok, err)
+	}
+
+	// The expiry time survives too.
+	if at, ok := reopened.expiry["ns"]["c"]; !ok || time.Until(at) <= 0 {
+		t.Fatalf("Expected the expiry time to survive: %v, %v", at, ok)
+	}
+}
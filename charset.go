@@ -0,0 +1,54 @@
+package jogdb
+
+import "errors"
+import "mime"
+import "strings"
+import "unicode/utf8"
+
+// This is returned by `toUTF8` for charsets it can't convert from.
+var ErrUnsupportedCharset = errors.New("Unsupported charset!")
+
+// Returns true if the media type is text that can be transcoded.
+func isTextMediaType(mediaType string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json" || mediaType == "application/xml":
+		return true
+	case strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	return false
+}
+
+// Converts `v` from the charset given in the Content-Type header `ct` to
+// UTF-8. `v` is returned as is if `ct` isn't a text type or has no charset.
+// Only UTF-8, US-ASCII and ISO-8859-1 are supported.
+func toUTF8(ct string, v []byte) ([]byte, error) {
+	if ct == "" {
+		return v, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(ct)
+
+	if err != nil || !isTextMediaType(mediaType) {
+		return v, nil
+	}
+
+	switch strings.ToLower(params["charset"]) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return v, nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		// Every byte is the code point of the same value.
+		b := make([]byte, 0, len(v))
+
+		for _, c := range v {
+			b = utf8.AppendRune(b, rune(c))
+		}
+
+		return b, nil
+	}
+
+	return nil, ErrUnsupportedCharset
+}
@@ -0,0 +1,154 @@
+package main
+
+import "encoding/json"
+import "io/ioutil"
+
+// Configuration of jogapi as read from the file given by -config.
+//
+// Example:
+//
+//  {
+//    "Listen": ":3000",
+//    "RootToken": "root-token",
+//    "ContentTypes": { ".json": "application/json", ".log": "text/plain" },
+//    "Delimiters": { ".log": "\n" },
+//    "DefaultContentType": "application/octet-stream"
+//  }
+type Config struct {
+	// Address to listen on (e.g. ":3000").
+	Listen string
+
+	// The root token. A new one is generated if this is empty.
+	RootToken string
+
+	// Directory to persist data in. Data is only kept in memory if
+	// this is empty.
+	DataDir string
+
+	// Number of versions to keep per document. Versions are only kept
+	// if this is positive and DataDir is empty.
+	MaxVersions int
+
+	// Path of a log to write all changes to so data kept in memory
+	// survives restarts. Takes precedence over MaxVersions.
+	WALPath string
+
+	// Don't sync the log to disk on every write. Faster but a crash of
+	// the machine may lose the last writes.
+	WALNoSync bool
+
+	// Path of a bbolt database file to persist data in. Takes
+	// precedence over DataDir.
+	BoltPath string
+
+	// Address of a Redis server to keep all data in, so several
+	// instances can share it. Takes precedence over DataDir and
+	// BoltPath.
+	RedisAddr string
+
+	// Content types by file extension.
+	ContentTypes map[string]string
+
+	// Append delimiters by file extension.
+	Delimiters map[string]string
+
+	// Content type for documents whose extension is not in ContentTypes.
+	DefaultContentType string
+
+	// Labels by token used in the access log instead of the token.
+	TokenLabels map[string]string
+
+	// Path of a file to append an audit log of writes and token changes
+	// to, one JSON object per line. Disabled if empty.
+	AuditLogPath string
+
+	// Address of a statsd server to send metrics to. Disabled if empty.
+	StatsdAddr string
+
+	// Maximum document size in bytes for puts and appends. Zero means
+	// only MaxRequestBytes applies.
+	MaxDocSize int64
+
+	// Maximum size in bytes of a single append. Zero means MaxDocSize
+	// applies.
+	MaxAppendSize int64
+
+	// Maximum size in bytes of request bodies of the document routes.
+	// Defaults to 10MiB if zero.
+	MaxRequestBytes int64
+
+	// Maximum size in bytes of request bodies of the management
+	// routes. Defaults to 64KiB if zero.
+	MaxManagementRequestBytes int64
+
+	// Puts with a body bigger than this many bytes are streamed to the
+	// store instead of being read into memory first. Defaults to 1MiB
+	// if zero.
+	StreamPutsAbove int64
+
+	// Expose Prometheus metrics at /metrics.
+	EnableMetrics bool
+
+	// Reject requests without a token with 401 instead of allowing
+	// anonymous access.
+	RequireToken bool
+
+	// Convert text request bodies sent in ISO-8859-1 to UTF-8.
+	TranscodeToUTF8 bool
+
+	// Store the Content-Type of puts with the document and serve it
+	// instead of the one by extension.
+	StoreContentTypes bool
+
+	// Origins browsers may call the API from. "*" allows any origin.
+	AllowedOrigins []string
+
+	// IPs and networks (CIDR) allowed to use the management routes.
+	// Everybody is allowed if this is empty.
+	AdminIPAllowList []string
+
+	// Take the client address from X-Forwarded-For. Only set this
+	// behind a trusted proxy.
+	TrustProxy bool
+
+	// Requests per second and burst allowed per address and token.
+	// Disabled if RateLimitPerSecond is zero.
+	RateLimitPerSecond float64
+	RateLimitBurst int
+
+	// Send documents bigger than this many bytes gzip compressed to
+	// clients accepting it. Zero disables compression.
+	CompressResponsesAbove int
+
+	// Seconds to wait for in-flight requests when shutting down.
+	ShutdownTimeout int
+}
+
+// Returns the configuration used when no config file is given.
+func defaultConfig() *Config {
+	return &Config {
+		Listen: ":3000",
+		ContentTypes: map[string]string {
+			".json" : "application/json",
+			".txt" : "text/plain",
+			".log" : "text/plain",
+		},
+		Delimiters: map[string]string {
+			".log" : "\n",
+		},
+		DefaultContentType: "application/octet-stream",
+		ShutdownTimeout: 10,
+	}
+}
+
+// Reads the configuration from a JSON file into `cfg`. Settings missing
+// from the file keep their value in `cfg`.
+func loadConfig(path string, cfg *Config) error {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, cfg)
+}
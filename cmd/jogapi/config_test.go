@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+import "io/ioutil"
+import "path/filepath"
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"Listen": "127.0.0.1:4000",
+		"RootToken": "secret",
+		"ContentTypes": { ".csv": "text/csv" },
+		"MaxDocSize": 1024,
+		"AllowedOrigins": ["https://example.com"],
+		"RateLimitPerSecond": 2.5
+	}`)
+
+	cfg := defaultConfig()
+
+	err := loadConfig(path, cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != "127.0.0.1:4000" || cfg.RootToken != "secret" || cfg.MaxDocSize != 1024 || cfg.RateLimitPerSecond != 2.5 {
+		t.Fatalf("Settings from the file were not applied: %+v", cfg)
+	}
+
+	if len(cfg.AllowedOrigins) != 1 || cfg.AllowedOrigins[0] != "https://example.com" {
+		t.Fatalf("Unexpected AllowedOrigins: %v", cfg.AllowedOrigins)
+	}
+
+	// Entries of maps are added to the defaults.
+	if cfg.ContentTypes[".csv"] != "text/csv" || cfg.ContentTypes[".json"] != "application/json" {
+		t.Fatalf("Unexpected ContentTypes: %v", cfg.ContentTypes)
+	}
+
+	// Settings missing from the file keep their defaults.
+	if cfg.DefaultContentType != "application/octet-stream" || cfg.ShutdownTimeout != 10 || cfg.Delimiters[".log"] != "\n" {
+		t.Fatalf("Defaults were not kept: %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	err := loadConfig(filepath.Join(t.TempDir(), "missing.json"), defaultConfig())
+
+	if err == nil {
+		t.Fatal("Expected an error for a missing file.")
+	}
+
+	err = loadConfig(writeConfig(t, `{ "Listen": `), defaultConfig())
+
+	if err == nil {
+		t.Fatal("Expected an error for invalid JSON.")
+	}
+
+	err = loadConfig(writeConfig(t, `{ "MaxDocSize": "big" }`), defaultConfig())
+
+	if err == nil {
+		t.Fatal("Expected an error for a value of the wrong type.")
+	}
+}
@@ -4,20 +4,32 @@ import . "github.com/FMNSSun/jogdb"
 import "github.com/FMNSSun/rndstring"
 import "net/http"
 import "github.com/gorilla/handlers"
+import "github.com/go-redis/redis/v8"
 import "os"
 import "log"
 import "flag"
 import "bufio"
 import "fmt"
 import "strings"
+import "net"
+import "context"
+import "io"
+import "os/signal"
+import "syscall"
+import "time"
 
 func main() {
 	configFile := flag.String("config","","Path to the configuration file.")
+	listen := flag.String("listen",":3000","Address to listen on. The config file takes precedence.")
+	flag.Parse()
+
+	cfg := defaultConfig()
+	cfg.Listen = *listen
 
 	if *configFile == "" {
-		mainDefault()
+		mainDefault(cfg)
 	} else {
-		log.Fatal("Config file not implemented yet!")
+		mainConfig(*configFile, cfg)
 	}
 }
 
@@ -33,10 +45,30 @@ func readln(reader *bufio.Reader, msg string, args... interface{}) string {
 	return strings.Trim(line, "\r\t\n ")
 }
 
-func mainDefault() {
+func mainDefault(cfg *Config) {
 	reader := bufio.NewReader(os.Stdin)
 
-	rootToken := readln(reader, "Root token [leave empty to generate new one]: ")
+	cfg.RootToken = readln(reader, "Root token [leave empty to generate new one]: ")
+
+	run(cfg)
+}
+
+func mainConfig(path string, cfg *Config) {
+	err := loadConfig(path, cfg)
+
+	if err != nil {
+		log.Fatalf("Loading config file failed: %v", err.Error())
+	}
+
+	run(cfg)
+}
+
+func run(cfg *Config) {
+	_, _, err := net.SplitHostPort(cfg.Listen)
+
+	if err != nil {
+		log.Fatalf("Invalid listen address %q: %v", cfg.Listen, err.Error())
+	}
 
 	tg, err := rndstring.NewStringGenerator("hex", 14)
 	
@@ -44,28 +76,153 @@ func mainDefault() {
 		log.Fatal(err.Error())
 	}
 
+	rootToken := cfg.RootToken
+
 	if rootToken == "" {
 		rootToken = tg.Generate()
 	}
 
 	log.Printf("Root Token: %s", rootToken)
 
+	var ds DataStore = NewMemDataStore(rootToken)
+
+	if cfg.MaxVersions > 0 {
+		ds = NewVersionedMemDataStore(rootToken, cfg.MaxVersions)
+	}
+
+	if cfg.WALPath != "" {
+		wds, err := NewMemDataStoreWithWAL(rootToken, cfg.WALPath)
+
+		if err != nil {
+			log.Fatalf("Opening write-ahead log failed: %v", err.Error())
+		}
+
+		wds.NoSync = cfg.WALNoSync
+		ds = wds
+	}
+
+	if cfg.DataDir != "" {
+		ds, err = NewFileDataStore(cfg.DataDir, rootToken)
+
+		if err != nil {
+			log.Fatalf("Opening data directory failed: %v", err.Error())
+		}
+	}
+
+	if cfg.BoltPath != "" {
+		ds, err = NewBoltDataStore(cfg.BoltPath, rootToken)
+
+		if err != nil {
+			log.Fatalf("Opening database failed: %v", err.Error())
+		}
+	}
+
+	if cfg.RedisAddr != "" {
+		ds = NewRedisDataStore(redis.NewClient(&redis.Options{ Addr: cfg.RedisAddr }), rootToken)
+	}
+
+	delimiters := make(map[string][]byte)
+
+	for ext, delim := range cfg.Delimiters {
+		delimiters[ext] = []byte(delim)
+	}
+
 	apiState := &ApiState{
-		ContentTypes: map[string]string {
-			".json" : "application/json",
-			".txt" : "text/plain",
-			".log" : "text/plain",
+		ContentTypes: cfg.ContentTypes,
+		Delimiters: delimiters,
+		Validators: map[string]func([]byte) error {
+			".json" : ValidateJSON,
 		},
-		Delimiters: map[string][]byte {
-			".log" : []byte("\n"),
-		},
-		DefaultContentType: "application/octet-stream",
-		DataStore: NewMemDataStore(rootToken),
+		DefaultContentType: cfg.DefaultContentType,
+		TokenLabels: cfg.TokenLabels,
+		StatsdAddr: cfg.StatsdAddr,
+		MaxDocSize: cfg.MaxDocSize,
+		MaxAppendSize: cfg.MaxAppendSize,
+		MaxRequestBytes: cfg.MaxRequestBytes,
+		MaxManagementRequestBytes: cfg.MaxManagementRequestBytes,
+		StreamPutsAbove: cfg.StreamPutsAbove,
+		EnableMetrics: cfg.EnableMetrics,
+		RequireToken: cfg.RequireToken,
+		TranscodeToUTF8: cfg.TranscodeToUTF8,
+		StoreContentTypes: cfg.StoreContentTypes,
+		AllowedOrigins: cfg.AllowedOrigins,
+		CompressResponsesAbove: cfg.CompressResponsesAbove,
+		AdminIPAllowList: cfg.AdminIPAllowList,
+		TrustProxy: cfg.TrustProxy,
+		RateLimit: RateLimit{ PerSecond: cfg.RateLimitPerSecond, Burst: cfg.RateLimitBurst },
+		DataStore: ds,
 		StringGenerator: tg,
 	}
 
-	apiRouter := NewAPI(apiState)
+	if cfg.AuditLogPath != "" {
+		f, err := os.OpenFile(cfg.AuditLogPath, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+
+		if err != nil {
+			log.Fatalf("Opening audit log failed: %v", err.Error())
+		}
+
+		defer f.Close()
+
+		apiState.AuditLogger = NewJSONAuditLogger(f)
+	}
+
+	apiRouter := NewHandler(apiState)
+
+	loggedRouter := handlers.RecoveryHandler()(apiState.LabelTokens(handlers.LoggingHandler(os.Stdout, apiRouter)))
+
+	server := &http.Server{
+		Addr: cfg.Listen,
+		Handler: loggedRouter,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	failed := false
+
+	err = serve(ctx, server, time.Duration(cfg.ShutdownTimeout) * time.Second)
+
+	if err != nil {
+		log.Printf("Serving failed: %v", err.Error())
+		failed = true
+	}
+
+	// Stores needing cleanup implement io.Closer. They are closed even if
+	// serving failed so everything written so far is kept.
+	if c, ok := ds.(io.Closer); ok {
+		err = c.Close()
+
+		if err != nil {
+			log.Printf("Closing the datastore failed: %v", err.Error())
+			failed = true
+		}
+	}
+
+	if failed {
+		stop()
+		os.Exit(1)
+	}
+}
+
+// Runs the server until `ctx` is done and then shuts it down, waiting at
+// most `timeout` for in-flight requests to finish.
+func serve(ctx context.Context, server *http.Server, timeout time.Duration) error {
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	loggedRouter := handlers.RecoveryHandler()(handlers.LoggingHandler(os.Stdout, apiRouter))
-	log.Fatal(http.ListenAndServe(":3000", loggedRouter))
+	return server.Shutdown(shutdownCtx)
 }
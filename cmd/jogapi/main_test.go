@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+import "net/http"
+import "time"
+import "context"
+import "net"
+
+func TestServeShutdown(t *testing.T) {
+	server := &http.Server{
+		Addr: "127.0.0.1:0",
+		Handler: http.NotFoundHandler(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- serve(ctx, server, time.Second)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after the context was done.")
+	}
+}
+
+func TestServeListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	server := &http.Server{
+		Addr: l.Addr().String(),
+		Handler: http.NotFoundHandler(),
+	}
+
+	err = serve(context.Background(), server, time.Second)
+
+	if err == nil {
+		t.Fatal("Expected an error for an address in use.")
+	}
+}
@@ -1,21 +1,90 @@
 package jogdb
 
 import "sync"
+import "sort"
+import "hash/fnv"
+import "crypto/sha256"
+import "compress/gzip"
+import "bytes"
+import "time"
 import "errors"
+import "io"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "github.com/FMNSSun/rndstring"
 
 type DataStore interface {
 	// Returns the value associated with the namespace and document name.
 	Get(ns, doc string) ([]byte, error)
 
+	// Returns `length` bytes of the value starting at `off`. The length is
+	// clamped to the end of the value. Returns ErrInvalidRange if `off` or
+	// `length` is negative or `off` lies past the end of the value. Returns
+	// nil if the document doesn't exist.
+	GetRange(ns, doc string, off, length int64) ([]byte, error)
+
+	// Like Put but the document expires after `ttl`. Expired documents
+	// behave as if they had been deleted. A `ttl` of zero or less means
+	// the document doesn't expire. A Put without TTL or a Delete removes
+	// the expiry.
+	PutWithTTL(ns, doc string, v []byte, ttl time.Duration) error
+
+	// Like PutWithTTL but also stores `meta` with the document. Writes
+	// replacing the whole document (Put, PutWithTTL, PutBatch, PutStream,
+	// CompareAndPut) store empty metadata, writes changing it (Append,
+	// Prepend, ReplaceInDoc, MergeJSON, PatchJSON, Modify) keep it.
+	PutWithMeta(ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error
+
+	// Returns the metadata stored with the document. The metadata is
+	// empty if the document doesn't exist.
+	GetMeta(ns, doc string) (DocMeta, error)
+
+	// Like Put but the value is read from `r` until EOF. If reading fails
+	// nothing is stored and the error is returned. Persistent stores may
+	// write the value as it's read instead of buffering it in memory.
+	PutStream(ns, doc string, r io.Reader) error
+
+	// Returns the size of the value associated with the namespace and
+	// document name and whether the document exists.
+	Size(ns, doc string) (int64, bool, error)
+
 	// Sets the value associated with the namespace and document name.
 	Put(ns, doc string, v []byte) error
 
+	// Puts all documents at once. Readers either see none or all of the
+	// new values.
+	PutBatch(ns string, docs map[string][]byte) error
+
+	// Like Put but only writes if the current value is byte-equal to
+	// `expected`. A nil `expected` means the document must not exist.
+	// Returns whether the value was written. A successful write removes
+	// the expiry like Put does.
+	CompareAndPut(ns, doc string, expected, v []byte) (bool, error)
+
 	// Appends to the value associated with the namespace and document
 	// name while inserting the specified delimiter after the value
 	// that is to be appended.
 	Append(ns, doc string, delim, v []byte) error
 
-	// Returns true if the token has permission to perform a Get.
+	// Like Append but inserts the value followed by the delimiter at
+	// the start of the document.
+	Prepend(ns, doc string, delim, v []byte) error
+
+	// Replaces occurrences of `old` in the document with `new` and returns
+	// the number of replacements. Only the first occurrence is replaced
+	// unless `all` is true. This works on bytes so for structured documents
+	// (e.g. JSON) the result may no longer be valid. An empty `old` matches
+	// nothing.
+	ReplaceInDoc(ns, doc string, old, new []byte, all bool) (int, error)
+
+	// Removes the document. Removing a document that doesn't exist is
+	// not an error.
+	Delete(ns, doc string) error
+
+	// Returns true if the token has permission to perform a Get. Like
+	// the other Can* methods this only considers the token's grants, the
+	// Checked* functions additionally allow namespace admins.
 	CanGet(token, ns, doc string) (bool, error)
 
 	// Returns true if the token has permission to perform a Put.
@@ -24,11 +93,46 @@ type DataStore interface {
 	// Returns true if the token has permission to perform an Append.
 	CanAppend(token, ns, doc string) (bool, error)
 
-	// Set permissions for the token for the document and namespace as
-	// specified.
-	SetToken(token, ns, doc string, get, put, app bool) error
+	// Returns true if the token has permission to perform a Delete.
+	CanDelete(token, ns, doc string) (bool, error)
+
+	// Returns true if the token has permission to perform a Prepend.
+	CanPrepend(token, ns, doc string) (bool, error)
 
-	// Returns true if the token is a namespace admin.
+	// Returns for each permission whether the token has it and which
+	// rule decided that. Like the Checked* functions this allows root,
+	// admins and namespace admins everything.
+	Explain(token, ns, doc string) (Explanation, error)
+
+	// Returns the grants of the namespace by document (or prefix grant)
+	// and token. Tokens are given as their hex encoded SHA-256 as most
+	// stores don't keep anything else. Entries with all permissions
+	// false deny what a prefix grant would allow.
+	DumpPermissions(ns string) (map[string]map[string]Perm, error)
+
+	// Set permissions for the token for the document and namespace as
+	// specified. A document name ending in `*` is a prefix grant applying
+	// to all documents starting with what comes before the `*` ("*" alone
+	// matches every document in the namespace). Prefix grants are only
+	// consulted if the token has no entry for the document itself and
+	// if several match only the longest one applies. An entry for a
+	// document is kept even if all permissions are false, so it denies
+	// what prefix grants would allow until the token is revoked. Setting
+	// all permissions of a prefix grant to false removes it.
+	SetToken(token, ns, doc string, get, put, app, del, pre bool) error
+
+	// Returns the permissions set for the token for the document and
+	// namespace, i.e. what was last passed to SetToken. Prefix grants
+	// matching the document are not taken into account. All permissions
+	// are false if the token has no entry.
+	GetToken(token, ns, doc string) (get, put, app, del, pre bool, err error)
+
+	// Removes all permissions of the token within the namespace,
+	// including prefix grants and namespace admin status.
+	RevokeToken(token, ns string) error
+
+	// Returns true if the token is a namespace admin. Admins and the
+	// root token are namespace admins of every namespace.
 	IsNamespaceAdmin(token, ns string) (bool, error)
 
 	// Returns true if the token is an admin.
@@ -44,6 +148,209 @@ type DataStore interface {
 
 	// Returns true if the token is root. 
 	IsRoot(token string) (bool, error)
+
+	// Replaces the root token with `newToken`. Returns ErrAccessDenied
+	// if `oldToken` is not the root token.
+	RotateRootToken(oldToken, newToken string) error
+
+	// Returns an error if the DataStore can't currently serve requests
+	// (e.g. its storage isn't reachable).
+	Ping() error
+
+	// Creates an empty document in the namespace whose name is `prefix`
+	// followed by a random string that is not yet in use and returns
+	// the chosen name.
+	CreateUnique(ns, prefix string) (string, error)
+
+	// Returns the sorted names of all documents in the namespace.
+	List(ns string) ([]string, error)
+
+	// Returns the sorted names of all documents in the namespace the
+	// token can perform a Get on, either through a grant (including
+	// prefix grants) or by being a namespace admin. Grants for documents
+	// that don't exist are ignored.
+	ListAccessibleDocs(token, ns string) ([]string, error)
+
+	// Writes the documents, permissions and namespace admins of the
+	// namespace to `w` in a versioned JSON format. Expiry times and
+	// counters are not included.
+	ExportNamespace(ns string, w io.Writer) error
+
+	// Reads a snapshot written by ExportNamespace (possibly of another
+	// namespace) from `r` and adds its documents, permissions and namespace
+	// admins to the namespace. Documents and permissions in the snapshot
+	// replace existing ones, everything else is kept. Returns
+	// ErrInvalidSnapshot if the snapshot can't be read or contains hashed
+	// tokens this DataStore can't use.
+	ImportNamespace(ns string, r io.Reader) error
+
+	// Writes all permissions, namespace admins and admins (but not the
+	// root token) to `w` as a versioned JSON policy document.
+	ExportPolicy(w io.Writer) error
+
+	// Reads a policy written by ExportPolicy from `r` and replaces all
+	// permissions, namespace admins and admins with it at once. Returns
+	// ErrInvalidPolicy without changing anything if the policy is invalid
+	// or contains hashed tokens this DataStore can't use.
+	ImportPolicy(r io.Reader) error
+
+	// Returns the sorted names of all namespaces containing documents.
+	ListNamespaces() ([]string, error)
+
+	// Returns statistics about the documents and admins of the namespace.
+	NamespaceStats(ns string) (NamespaceStats, error)
+
+	// Returns statistics about the whole store. Expired documents are
+	// not counted.
+	Stats() (StoreStats, error)
+
+	// Returns the `n` most recently modified documents of all namespaces,
+	// most recent first.
+	RecentlyModified(n int) ([]DocRef, error)
+
+	// Adds `delta` to the named counter in the namespace and returns the
+	// new value. Counters are independent of documents and start at zero.
+	IncrCounter(ns, name string, delta int64) (int64, error)
+
+	// Returns the value of the named counter in the namespace.
+	GetCounter(ns, name string) (int64, error)
+
+	// Like Append but the value is read from `r`. If `r` has more than
+	// `limit` bytes nothing is appended and ErrTooLarge is returned.
+	// Returns the number of bytes of the value that were appended (not
+	// counting the delimiter).
+	AppendFrom(ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error)
+
+	// Merges the JSON object `patch` into the document (see RFC 7386),
+	// stores the result and returns it. Returns ErrInvalidPatch if `patch`
+	// isn't valid JSON and ErrNotJSON if the current document isn't.
+	// A missing or empty document is treated as if it were null.
+	MergeJSON(ns, doc string, patch []byte) ([]byte, error)
+
+	// Applies the JSON Patch `patch` (see RFC 6902) to the document,
+	// stores the result and returns it. Returns ErrInvalidPatch if
+	// `patch` isn't a valid JSON Patch, ErrNotJSON if the current
+	// document isn't JSON and ErrPatchFailed if an operation can't be
+	// applied, in which case nothing is written. A missing or empty
+	// document is treated as if it were null.
+	PatchJSON(ns, doc string, patch []byte) ([]byte, error)
+
+	// Atomically replaces the document with what `fn` returns for its
+	// current value (nil if it doesn't exist). Nothing is written if `fn`
+	// returns an error (which is returned) or nil. The expiry time is kept.
+	// `fn` is called with the document locked and must not block or access
+	// the store. It must not keep or modify `old` and may be called more
+	// than once by stores that retry on conflicts.
+	Modify(ns, doc string, fn func(old []byte) (new []byte, err error)) error
+}
+
+// Optionally implemented by DataStores that can return the SHA-256 of a
+// document without the caller having to read and hash it.
+type Hasher interface {
+	// Returns the SHA-256 of the document or nil if it doesn't exist.
+	Hash(ns, doc string) ([]byte, error)
+}
+
+// Optionally implemented by DataStores that keep previous versions of
+// documents.
+type Versioner interface {
+	// Returns the document as of the revision or nil if that version
+	// doesn't exist (anymore).
+	GetVersion(ns, doc string, rev int) ([]byte, error)
+
+	// Returns the retained versions of the document, oldest first.
+	ListVersions(ns, doc string) ([]VersionInfo, error)
+}
+
+// Optionally implemented by DataStores that can dump and restore all of
+// their contents for backups.
+type Snapshotter interface {
+	// Writes all namespaces with their documents, expiry times,
+	// counters, permissions and namespace admins as well as the admins.
+	// The root token is not included.
+	Snapshot(w io.Writer) error
+
+	// Replaces everything but the root token with the contents of a
+	// snapshot written by `Snapshot`. Returns ErrInvalidSnapshot if it
+	// can't be read.
+	Restore(r io.Reader) error
+}
+
+// Rules reported by `Explain`.
+const (
+	// The token has an entry for the document itself.
+	RuleExplicit = "explicit"
+
+	// The token has no entry for the document itself but a prefix grant
+	// matching it.
+	RulePrefix = "prefix"
+
+	// The token has no entry for the document itself and no prefix grant
+	// matching it but a grant for the whole namespace ("*", see
+	// SetNamespaceToken).
+	RuleNamespace = "namespace"
+
+	// The token has no grant allowing it but is the root token, an admin
+	// or a namespace admin of the namespace. The Checked* functions
+	// allow them everything.
+	RuleRoot = "root"
+	RuleAdmin = "admin"
+	RuleNamespaceAdmin = "namespaceAdmin"
+
+	// No rule applies to the token, which means it is denied.
+	RuleNone = "none"
+)
+
+// Whether a single permission is granted and which rule decided it.
+type PermExplanation struct {
+	Allowed bool
+	Rule string
+}
+
+// The result of `Explain`.
+type Explanation struct {
+	Get PermExplanation
+	Put PermExplanation
+	Append PermExplanation
+	Delete PermExplanation
+	Prepend PermExplanation
+}
+
+// Metadata stored along with a document, see `PutWithMeta`.
+type DocMeta struct {
+	// Content type the document was written with. Empty if unknown.
+	ContentType string `json:",omitempty"`
+}
+
+// The permissions of a token on a document as returned by
+// `DumpPermissions`.
+type Perm struct {
+	Get bool
+	Put bool
+	Append bool
+	Delete bool
+	Prepend bool
+}
+
+// The result of `NamespaceStats`.
+type NamespaceStats struct {
+	DocCount int
+	TotalBytes int64
+	AdminCount int
+}
+
+// The result of `Stats`.
+type StoreStats struct {
+	Namespaces int
+	Documents int
+	TotalBytes int64
+}
+
+// A document as returned by `RecentlyModified`.
+type DocRef struct {
+	Ns string
+	Doc string
+	ModTime time.Time
 }
 
 // This is returned by the Check* functions in case
@@ -51,6 +358,69 @@ type DataStore interface {
 // simply lacks permission to perform the action. 
 var ErrAccessDenied = errors.New("Access denied!")
 
+// This is returned if a DataStore can't store a namespace or document
+// under the requested name.
+var ErrInvalidName = errors.New("Invalid name!")
+
+// This is returned by `CreateUnique` if no unused name could be found.
+var ErrNoUniqueName = errors.New("No unique name found!")
+
+// This is returned by `GetRange` if the range doesn't lie within the document.
+var ErrInvalidRange = errors.New("Invalid range!")
+
+// This is returned by `MergeJSON` and `PatchJSON` if the document is not
+// valid JSON.
+var ErrNotJSON = errors.New("Document is not valid JSON!")
+
+// This is returned by `MergeJSON` and `PatchJSON` if the patch is not valid.
+var ErrInvalidPatch = errors.New("Patch is not valid JSON!")
+
+// This is returned by `PatchJSON` if an operation of the patch can't be
+// applied to the document.
+var ErrPatchFailed = errors.New("Patch can't be applied!")
+
+// This is returned by `IncrDoc` if the document isn't a base-10 integer or
+// the result doesn't fit into an int64.
+var ErrNotInteger = errors.New("Document is not an integer!")
+
+// This is returned by `AppendFrom` if the reader has more than `limit` bytes.
+var ErrTooLarge = errors.New("Value too large!")
+
+// Reads all of `r` for `AppendFrom`. Returns ErrTooLarge if `r` has more
+// than `limit` bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	// One more byte than allowed is read to notice if there is more.
+	v, err := ioutil.ReadAll(io.LimitReader(r, limit + 1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(v)) > limit {
+		return nil, ErrTooLarge
+	}
+
+	return v, nil
+}
+
+// Checks a range for `GetRange` against a value of `size` bytes and returns
+// the length clamped to the end of the value.
+func clampRange(size, off, length int64) (int64, error) {
+	if off < 0 || length < 0 || off > size {
+		return 0, ErrInvalidRange
+	}
+
+	if length > size - off {
+		length = size - off
+	}
+
+	return length, nil
+}
+
+// How often `CreateUnique` generates a new name on collision before
+// giving up.
+const maxCreateUniqueAttempts = 16
+
 // Invokes the `SetAdmin` method on `ds` iff `clientToken` is root.
 func CheckedSetAdmin(ds DataStore, clientToken, token string, is bool) error {
 	ok, err := ds.IsRoot(clientToken)
@@ -81,364 +451,2147 @@ func CheckedSetNamespaceAdmin(ds DataStore, clientToken, token, ns string, is bo
 	return ds.SetNamespaceAdmin(token, ns, is)
 }
 
-// Invokes the `SetToken` method on `ds` iff `clientToken` is namespace admin for the
-// specified namespace. 
-func CheckedSetToken(ds DataStore, clientToken, token, ns, doc string, get, put, app bool) error {
-	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
+// Invokes the `RevokeToken` method on `ds` iff `clientToken` is admin or
+// namespace admin for the specified namespace. Only admins can revoke the
+// token of a namespace admin as only admins can make namespace admins.
+func CheckedRevokeToken(ds DataStore, clientToken, token, ns string) error {
+	ok, err := ds.IsAdmin(clientToken)
 
 	if err != nil {
 		return err
 	}
 
-	if !ok {
-		return ErrAccessDenied
+	if ok {
+		return ds.RevokeToken(token, ns)
 	}
 
-	return ds.SetToken(token, ns, doc, get, put, app)
-}
-
-// Invokes the `Get` method on `ds` iff `clientToken` has Get permissions.
-func CheckedGet(ds DataStore, clientToken, ns, doc string) ([]byte, error) {
-	ok, err := ds.CanGet(clientToken, ns, doc)
+	ok, err = ds.IsNamespaceAdmin(clientToken, ns)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if !ok {
-		return nil, ErrAccessDenied
+		return ErrAccessDenied
 	}
 
-	return ds.Get(ns, doc)
-}
-
-// Invokes the `Get` method on `ds` iff `clientToken` has Put permissions.
-func CheckedPut(ds DataStore, clientToken, ns, doc string, v []byte) error {
-	ok, err := ds.CanPut(clientToken, ns, doc)
+	ok, err = ds.IsNamespaceAdmin(token, ns)
 
 	if err != nil {
 		return err
 	}
 
-	if !ok {
+	if ok {
 		return ErrAccessDenied
 	}
 
-	return ds.Put(ns, doc, v)
+	return ds.RevokeToken(token, ns)
 }
 
-// Invokes the `Get` method on `ds` iff `clientToken` has Append permissions.
-func CheckedAppend(ds DataStore, clientToken, ns, doc string, delim, v []byte) error {
-	ok, err := ds.CanAppend(clientToken, ns, doc)
+// Adds `delta` to the document interpreted as a base-10 integer, stores
+// the result and returns it. A missing or empty document counts as 0 and
+// whitespace around the number is ignored.
+func IncrDoc(ds DataStore, ns, doc string, delta int64) (int64, error) {
+	var n int64
 
-	if err != nil {
-		return err
-	}
+	err := ds.Modify(ns, doc, func(old []byte) ([]byte, error) {
+		cur := int64(0)
+		s := strings.TrimSpace(string(old))
 
-	if !ok {
-		return ErrAccessDenied
-	}
+		if s != "" {
+			var err error
+			cur, err = strconv.ParseInt(s, 10, 64)
 
-	return ds.Append(ns, doc, delim, v)
-}
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+		}
 
-const permGet = uint8(1)
-const permPut = uint8(2)
-const permAppend = uint8(4)
+		n = cur + delta
 
-type kvBytes map[string][]byte
-type kvPerms map[string]uint8
-type kvBool map[string]bool
-type storageType map[string]kvBytes
-type permsType map[string]map[string]kvPerms
+		// Signed overflow wraps around.
+		if (delta > 0 && n < cur) || (delta < 0 && n > cur) {
+			return nil, ErrNotInteger
+		}
 
-type MemDataStore struct {
-	storage storageType
-	perms permsType
-	mutex *sync.Mutex
-	nsAdmins map[string]kvBool
-	admins kvBool
-	rootToken string
-}
+		return []byte(strconv.FormatInt(n, 10)), nil
+	})
 
-func NewMemDataStore(rootToken string) *MemDataStore {
-	return & MemDataStore {
-		storage: make(storageType),
-		perms: make(permsType),
-		mutex: &sync.Mutex{},
-		nsAdmins: make(map[string]kvBool),
-		admins: make(kvBool),
-		rootToken: rootToken,
+	if err != nil {
+		return 0, err
 	}
-}
-
-func (ds *MemDataStore) IsRoot(token string) (bool, error) {
-	ds.mutex.Lock()
 
-	is := ds.rootToken == token
-
-	ds.mutex.Unlock()
-	return is, nil
+	return n, nil
 }
 
-func (ds *MemDataStore) SetNamespaceAdmin(token, ns string, is bool) error {
-	ds.mutex.Lock()
-
-	nsV := ds.nsAdmins[ns]
+// Invokes `IncrDoc` iff `clientToken` has Put permissions.
+func CheckedIncrDoc(ds DataStore, clientToken, ns, doc string, delta int64) (int64, error) {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
 
-	if nsV == nil {
-		if !is {
-			ds.mutex.Unlock()
-			return nil // doesn't exist anyway
-		} else {
-			nsV = make(kvBool)
-			ds.nsAdmins[ns] = nsV
-		}
+	if err != nil {
+		return 0, err
 	}
 
-	if is {
-		nsV[token] = true
-	} else {
-		delete(nsV, token)
+	if !ok {
+		return 0, ErrAccessDenied
 	}
 
-	ds.mutex.Unlock()
-	return nil
+	return IncrDoc(ds, ns, doc, delta)
 }
 
-func (ds *MemDataStore) SetAdmin(token string, is bool) error {
-	ds.mutex.Lock()
-
-	if is {
-		ds.admins[token] = true
-	} else {
-		delete(ds.admins, token)
-	}
+// Grants the token permissions on every document of the namespace. This
+// is the prefix grant "*" (see `SetToken`), so entries for documents take
+// precedence. Setting all permissions to false removes the grant.
+func SetNamespaceToken(ds DataStore, token, ns string, get, put, app bool) error {
+	return ds.SetToken(token, ns, "*", get, put, app, false, false)
+}
 
-	ds.mutex.Unlock()
-	return nil
+// Invokes `SetNamespaceToken` iff `clientToken` is namespace admin for the
+// namespace.
+func CheckedSetNamespaceToken(ds DataStore, clientToken, token, ns string, get, put, app bool) error {
+	return CheckedSetToken(ds, clientToken, token, ns, "*", get, put, app, false, false)
 }
 
-func (ds *MemDataStore) IsAdmin(token string) (bool, error) {
-	ds.mutex.Lock()
+// Invokes the `SetToken` method on `ds` iff `clientToken` is namespace admin for the
+// specified namespace. 
+func CheckedSetToken(ds DataStore, clientToken, token, ns, doc string, get, put, app, del, pre bool) error {
+	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
 
-	exists := ds.admins[token]
+	if err != nil {
+		return err
+	}
 
-	if exists {
-		ds.mutex.Unlock()
-		return true, nil
+	if !ok {
+		return ErrAccessDenied
 	}
 
-	ds.mutex.Unlock()
-	return false, nil
+	return ds.SetToken(token, ns, doc, get, put, app, del, pre)
 }
 
-func (ds *MemDataStore) IsNamespaceAdmin(token, ns string) (bool, error) {
-	ds.mutex.Lock()
-
-	nsV := ds.nsAdmins[ns]
+// Invokes the `CreateUnique` method on `ds` iff `clientToken` is namespace admin
+// for the specified namespace.
+func CheckedCreateUnique(ds DataStore, clientToken, ns, prefix string) (string, error) {
+	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
 
-	if nsV == nil {
-		ds.mutex.Unlock()
-		return false, nil
+	if err != nil {
+		return "", err
 	}
 
-	exists := nsV[token]
-
-	if exists {
-		ds.mutex.Unlock()
-		return true, nil
+	if !ok {
+		return "", ErrAccessDenied
 	}
 
-	ds.mutex.Unlock()
-	return false, nil
+	return ds.CreateUnique(ns, prefix)
 }
 
-func (ds *MemDataStore) SetToken(token, ns, doc string, get, put, app bool) error {
-	ds.mutex.Lock()
+// Invokes the `List` method on `ds` iff `clientToken` is namespace admin for the
+// specified namespace.
+func CheckedList(ds DataStore, clientToken, ns string) ([]string, error) {
+	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
 
-	nsV := ds.perms[ns]
+	if err != nil {
+		return nil, err
+	}
 
-	if nsV == nil {
-		nsV = make(map[string]kvPerms)
-		ds.perms[ns] = nsV
+	if !ok {
+		return nil, ErrAccessDenied
 	}
 
-	docV := nsV[doc]
+	return ds.List(ns)
+}
+
+// Invokes the `ExportNamespace` method on `ds` iff `clientToken` is namespace
+// admin.
+func CheckedExportNamespace(ds DataStore, clientToken, ns string, w io.Writer) error {
+	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
 
-	if docV == nil {
-		docV = make(kvPerms)
-		nsV[doc] = docV
+	if err != nil {
+		return err
 	}
 
-	if get == false && put == false && app == false {
-		delete(docV, token)
-	} else {
-		curPerms := docV[token]
+	if !ok {
+		return ErrAccessDenied
+	}
 
-		if get {
-			curPerms |= permGet
-		} else {
-			curPerms &= ^permGet
-		}
+	return ds.ExportNamespace(ns, w)
+}
 
-		if put {
-			curPerms |= permPut
-		} else {
-			curPerms &= ^permPut
-		}
+// Invokes the `ImportNamespace` method on `ds` iff `clientToken` is admin.
+func CheckedImportNamespace(ds DataStore, clientToken, ns string, r io.Reader) error {
+	ok, err := ds.IsAdmin(clientToken)
 
-		if app {
-			curPerms |= permAppend
-		} else {
-			curPerms &= ^permAppend
-		}
+	if err != nil {
+		return err
+	}
 
-		docV[token] = curPerms
+	if !ok {
+		return ErrAccessDenied
 	}
 
-	ds.mutex.Unlock()
-	return nil
+	return ds.ImportNamespace(ns, r)
 }
 
-func (ds *MemDataStore) CanGet(token, ns, doc string) (bool, error) {
-	ds.mutex.Lock()
+// Invokes the `RotateRootToken` method on `ds` iff `clientToken` is root.
+func CheckedRotateRootToken(ds DataStore, clientToken, oldToken, newToken string) error {
+	ok, err := ds.IsRoot(clientToken)
 
-	nsV := ds.perms[ns]
+	if err != nil {
+		return err
+	}
 
-	if nsV == nil {
-		ds.mutex.Unlock()
-		return false, nil
+	if !ok {
+		return ErrAccessDenied
 	}
 
-	docV := nsV[doc]
+	return ds.RotateRootToken(oldToken, newToken)
+}
 
-	if docV == nil {
-		ds.mutex.Unlock()
-		return false, nil
-	}
+// Invokes the `ExportPolicy` method on `ds` iff `clientToken` is root.
+func CheckedExportPolicy(ds DataStore, clientToken string, w io.Writer) error {
+	ok, err := ds.IsRoot(clientToken)
 
-	tokenPerms := docV[token]
+	if err != nil {
+		return err
+	}
 
-	if (tokenPerms & permGet) == permGet {
-		ds.mutex.Unlock()
-		return true, nil
-	} else {
-		ds.mutex.Unlock()
-		return false, nil
+	if !ok {
+		return ErrAccessDenied
 	}
+
+	return ds.ExportPolicy(w)
 }
 
-func (ds *MemDataStore) CanPut(token, ns, doc string) (bool, error) {
-	ds.mutex.Lock()
+// Invokes the `ImportPolicy` method on `ds` iff `clientToken` is root.
+func CheckedImportPolicy(ds DataStore, clientToken string, r io.Reader) error {
+	ok, err := ds.IsRoot(clientToken)
 
-	nsV := ds.perms[ns]
+	if err != nil {
+		return err
+	}
 
-	if nsV == nil {
-		ds.mutex.Unlock()
-		return false, nil
+	if !ok {
+		return ErrAccessDenied
 	}
 
-	docV := nsV[doc]
+	return ds.ImportPolicy(r)
+}
 
-	if docV == nil {
-		ds.mutex.Unlock()
-		return false, nil
-	}
+// Invokes the `ListNamespaces` method on `ds` iff `clientToken` is admin.
+func CheckedListNamespaces(ds DataStore, clientToken string) ([]string, error) {
+	ok, err := ds.IsAdmin(clientToken)
 
-	tokenPerms := docV[token]
+	if err != nil {
+		return nil, err
+	}
 
-	if (tokenPerms & permPut) == permPut {
-		ds.mutex.Unlock()
-		return true, nil
-	} else {
-		ds.mutex.Unlock()
-		return false, nil
+	if !ok {
+		return nil, ErrAccessDenied
 	}
+
+	return ds.ListNamespaces()
 }
 
-func (ds *MemDataStore) CanAppend(token, ns, doc string) (bool, error) {
-	ds.mutex.Lock()
+// Invokes the `NamespaceStats` method on `ds` iff `clientToken` is admin.
+func CheckedNamespaceStats(ds DataStore, clientToken, ns string) (NamespaceStats, error) {
+	ok, err := ds.IsAdmin(clientToken)
 
-	nsV := ds.perms[ns]
+	if err != nil {
+		return NamespaceStats{}, err
+	}
 
-	if nsV == nil {
-		ds.mutex.Unlock()
-		return false, nil
+	if !ok {
+		return NamespaceStats{}, ErrAccessDenied
 	}
 
-	docV := nsV[doc]
+	return ds.NamespaceStats(ns)
+}
 
-	if docV == nil {
-		ds.mutex.Unlock()
-		return false, nil
-	}
+// Invokes the `Stats` method on `ds` iff `clientToken` is admin.
+func CheckedStats(ds DataStore, clientToken string) (StoreStats, error) {
+	ok, err := ds.IsAdmin(clientToken)
 
-	tokenPerms := docV[token]
+	if err != nil {
+		return StoreStats{}, err
+	}
 
-	if (tokenPerms & permAppend) == permAppend {
-		ds.mutex.Unlock()
-		return true, nil
-	} else {
-		ds.mutex.Unlock()
-		return false, nil
+	if !ok {
+		return StoreStats{}, ErrAccessDenied
 	}
+
+	return ds.Stats()
 }
 
-func (ds *MemDataStore) Append(ns, doc string, delim, v []byte) error {
-	ds.mutex.Lock()
+// Invokes the `RecentlyModified` method on `ds` iff `clientToken` is admin.
+func CheckedRecentlyModified(ds DataStore, clientToken string, n int) ([]DocRef, error) {
+	ok, err := ds.IsAdmin(clientToken)
 
-	nsV := ds.storage[ns]
+	if err != nil {
+		return nil, err
+	}
 
-	if nsV == nil {
-		nsV = make(kvBytes)
-		ds.storage[ns] = nsV
+	if !ok {
+		return nil, ErrAccessDenied
 	}
 
-	nsV[doc] = append(nsV[doc], v...)
-	nsV[doc] = append(nsV[doc], delim...)
+	return ds.RecentlyModified(n)
+}
 
-	ds.mutex.Unlock()
+// Invokes the `ListAccessibleDocs` method on `ds` iff `clientToken` is namespace
+// admin for the specified namespace.
+func CheckedListAccessibleDocs(ds DataStore, clientToken, token, ns string) ([]string, error) {
+	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
 
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return ds.ListAccessibleDocs(token, ns)
+}
+
+// Invokes the `GetToken` method on `ds` iff `clientToken` is namespace
+// admin.
+func CheckedGetToken(ds DataStore, clientToken, token, ns, doc string) (get, put, app, del, pre bool, err error) {
+	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
+
+	if err != nil {
+		return false, false, false, false, false, err
+	}
+
+	if !ok {
+		return false, false, false, false, false, ErrAccessDenied
+	}
+
+	return ds.GetToken(token, ns, doc)
+}
+
+// Invokes the `DumpPermissions` method on `ds` iff `clientToken` is
+// namespace admin for the specified namespace.
+func CheckedDumpPermissions(ds DataStore, clientToken, ns string) (map[string]map[string]Perm, error) {
+	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return ds.DumpPermissions(ns)
+}
+
+// Invokes the `Explain` method on `ds` iff `clientToken` is namespace admin for
+// the specified namespace.
+func CheckedExplain(ds DataStore, clientToken, token, ns, doc string) (Explanation, error) {
+	ok, err := ds.IsNamespaceAdmin(clientToken, ns)
+
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	if !ok {
+		return Explanation{}, ErrAccessDenied
+	}
+
+	return ds.Explain(token, ns, doc)
+}
+
+// Allows the permissions of `ex` not granted to the token if the token is
+// root, an admin or a namespace admin of the namespace, like hasPerm does.
+func explainAdmins(ds DataStore, token, ns string, ex Explanation) (Explanation, error) {
+	isRoot, err := ds.IsRoot(token)
+
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	isAdmin, err := ds.IsAdmin(token)
+
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	isNsAdmin, err := ds.IsNamespaceAdmin(token, ns)
+
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	var rule string
+
+	switch {
+	case isRoot:
+		rule = RuleRoot
+	case isAdmin:
+		rule = RuleAdmin
+	case isNsAdmin:
+		rule = RuleNamespaceAdmin
+	default:
+		return ex, nil
+	}
+
+	for _, pe := range []*PermExplanation{ &ex.Get, &ex.Put, &ex.Append, &ex.Delete, &ex.Prepend } {
+		if !pe.Allowed {
+			pe.Allowed = true
+			pe.Rule = rule
+		}
+	}
+
+	return ex, nil
+}
+
+// Returns the documents of the namespace and whether the token is a
+// namespace admin, in which case it can access all of them.
+func listForAccessCheck(ds DataStore, token, ns string) ([]string, bool, error) {
+	docs, err := ds.List(ns)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	admin, err := ds.IsNamespaceAdmin(token, ns)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return docs, admin, nil
+}
+
+// Returns what `can` (one of the Can* methods of `ds`) returns for the
+// token unless that is false and the token is namespace admin (which admins
+// and the root token are as well), who are always allowed. They could grant
+// themselves the permission anyway.
+func hasPerm(ds DataStore, can func(token, ns, doc string) (bool, error), token, ns, doc string) (bool, error) {
+	ok, err := can(token, ns, doc)
+
+	if err != nil || ok {
+		return ok, err
+	}
+
+	return ds.IsNamespaceAdmin(token, ns)
+}
+
+// Invokes the `Get` method on `ds` iff `clientToken` has Get permissions.
+func CheckedGet(ds DataStore, clientToken, ns, doc string) ([]byte, error) {
+	ok, err := hasPerm(ds, ds.CanGet, clientToken, ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return ds.Get(ns, doc)
+}
+
+// Invokes the `GetRange` method on `ds` iff `clientToken` has Get permissions.
+func CheckedGetRange(ds DataStore, clientToken, ns, doc string, off, length int64) ([]byte, error) {
+	ok, err := hasPerm(ds, ds.CanGet, clientToken, ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return ds.GetRange(ns, doc, off, length)
+}
+
+// Invokes the `Hash` method on `h` iff `clientToken` has Get permissions
+// according to `ds`.
+func CheckedHash(ds DataStore, h Hasher, clientToken, ns, doc string) ([]byte, error) {
+	ok, err := hasPerm(ds, ds.CanGet, clientToken, ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return h.Hash(ns, doc)
+}
+
+// Invokes the `GetVersion` method on `vs` iff `clientToken` has Get
+// permissions on `ds`.
+func CheckedGetVersion(ds DataStore, vs Versioner, clientToken, ns, doc string, rev int) ([]byte, error) {
+	ok, err := hasPerm(ds, ds.CanGet, clientToken, ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return vs.GetVersion(ns, doc, rev)
+}
+
+// Invokes the `ListVersions` method on `vs` iff `clientToken` has Get
+// permissions on `ds`.
+func CheckedListVersions(ds DataStore, vs Versioner, clientToken, ns, doc string) ([]VersionInfo, error) {
+	ok, err := hasPerm(ds, ds.CanGet, clientToken, ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return vs.ListVersions(ns, doc)
+}
+
+// Invokes the `Snapshot` method on `ss` iff `clientToken` is admin
+// according to `ds`.
+func CheckedSnapshot(ds DataStore, ss Snapshotter, clientToken string, w io.Writer) error {
+	ok, err := ds.IsAdmin(clientToken)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ss.Snapshot(w)
+}
+
+// Invokes the `Restore` method on `ss` iff `clientToken` is root according
+// to `ds`.
+func CheckedRestore(ds DataStore, ss Snapshotter, clientToken string, r io.Reader) error {
+	ok, err := ds.IsRoot(clientToken)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ss.Restore(r)
+}
+
+// Invokes the `Size` method on `ds` iff `clientToken` has Get permissions.
+func CheckedSize(ds DataStore, clientToken, ns, doc string) (int64, bool, error) {
+	ok, err := hasPerm(ds, ds.CanGet, clientToken, ns, doc)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !ok {
+		return 0, false, ErrAccessDenied
+	}
+
+	return ds.Size(ns, doc)
+}
+
+// Invokes the `Get` method on `ds` iff `clientToken` has Put permissions.
+func CheckedPut(ds DataStore, clientToken, ns, doc string, v []byte) error {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ds.Put(ns, doc, v)
+}
+
+// Invokes the `PutWithTTL` method on `ds` iff `clientToken` has Put permissions.
+func CheckedPutWithTTL(ds DataStore, clientToken, ns, doc string, v []byte, ttl time.Duration) error {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ds.PutWithTTL(ns, doc, v, ttl)
+}
+
+// Invokes the `PutWithMeta` method on `ds` iff `clientToken` has Put permissions.
+func CheckedPutWithMeta(ds DataStore, clientToken, ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ds.PutWithMeta(ns, doc, v, meta, ttl)
+}
+
+// Invokes the `GetMeta` method on `ds` iff `clientToken` has Get permissions.
+func CheckedGetMeta(ds DataStore, clientToken, ns, doc string) (DocMeta, error) {
+	ok, err := hasPerm(ds, ds.CanGet, clientToken, ns, doc)
+
+	if err != nil {
+		return DocMeta{}, err
+	}
+
+	if !ok {
+		return DocMeta{}, ErrAccessDenied
+	}
+
+	return ds.GetMeta(ns, doc)
+}
+
+// Invokes the `PutStream` method on `ds` iff `clientToken` has Put permissions.
+func CheckedPutStream(ds DataStore, clientToken, ns, doc string, r io.Reader) error {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ds.PutStream(ns, doc, r)
+}
+
+// Invokes the `Get` method on `ds` iff `clientToken` has Append permissions.
+func CheckedAppend(ds DataStore, clientToken, ns, doc string, delim, v []byte) error {
+	ok, err := hasPerm(ds, ds.CanAppend, clientToken, ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ds.Append(ns, doc, delim, v)
+}
+
+// Invokes the `Prepend` method on `ds` iff `clientToken` has Prepend permissions.
+func CheckedPrepend(ds DataStore, clientToken, ns, doc string, delim, v []byte) error {
+	ok, err := hasPerm(ds, ds.CanPrepend, clientToken, ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ds.Prepend(ns, doc, delim, v)
+}
+
+// Invokes the `ReplaceInDoc` method on `ds` iff `clientToken` has Put permissions.
+func CheckedReplaceInDoc(ds DataStore, clientToken, ns, doc string, old, new []byte, all bool) (int, error) {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return 0, ErrAccessDenied
+	}
+
+	return ds.ReplaceInDoc(ns, doc, old, new, all)
+}
+
+// Invokes the `PutBatch` method on `ds` iff `clientToken` has Put permissions
+// for every document. Nothing is written otherwise.
+func CheckedPutBatch(ds DataStore, clientToken, ns string, docs map[string][]byte) error {
+	for doc := range docs {
+		ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return ErrAccessDenied
+		}
+	}
+
+	return ds.PutBatch(ns, docs)
+}
+
+// Invokes the `CompareAndPut` method on `ds` iff `clientToken` has Put permissions.
+func CheckedCompareAndPut(ds DataStore, clientToken, ns, doc string, expected, v []byte) (bool, error) {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		return false, ErrAccessDenied
+	}
+
+	return ds.CompareAndPut(ns, doc, expected, v)
+}
+
+// Invokes the `Modify` method on `ds` iff `clientToken` has Put permissions.
+func CheckedModify(ds DataStore, clientToken, ns, doc string, fn func(old []byte) ([]byte, error)) error {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ds.Modify(ns, doc, fn)
+}
+
+// Invokes the `MergeJSON` method on `ds` iff `clientToken` has Put permissions.
+func CheckedMergeJSON(ds DataStore, clientToken, ns, doc string, patch []byte) ([]byte, error) {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return ds.MergeJSON(ns, doc, patch)
+}
+
+// Invokes the `PatchJSON` method on `ds` iff `clientToken` has Put permissions.
+func CheckedPatchJSON(ds DataStore, clientToken, ns, doc string, patch []byte) ([]byte, error) {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+
+	return ds.PatchJSON(ns, doc, patch)
+}
+
+// Invokes the `Delete` method on `ds` iff `clientToken` has Delete permissions.
+func CheckedDelete(ds DataStore, clientToken, ns, doc string) error {
+	ok, err := hasPerm(ds, ds.CanDelete, clientToken, ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return ds.Delete(ns, doc)
+}
+
+// Invokes the `AppendFrom` method on `ds` iff `clientToken` has Append permissions.
+// Permissions are checked before anything is read from `r`.
+func CheckedAppendFrom(ds DataStore, clientToken, ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error) {
+	ok, err := hasPerm(ds, ds.CanAppend, clientToken, ns, doc)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return 0, ErrAccessDenied
+	}
+
+	return ds.AppendFrom(ns, doc, delim, r, limit)
+}
+
+// Invokes the `IncrCounter` method on `ds` iff `clientToken` has Put permissions
+// for the counter name.
+func CheckedIncrCounter(ds DataStore, clientToken, ns, name string, delta int64) (int64, error) {
+	ok, err := hasPerm(ds, ds.CanPut, clientToken, ns, name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return 0, ErrAccessDenied
+	}
+
+	return ds.IncrCounter(ns, name, delta)
+}
+
+// Invokes the `GetCounter` method on `ds` iff `clientToken` has Get permissions
+// for the counter name.
+func CheckedGetCounter(ds DataStore, clientToken, ns, name string) (int64, error) {
+	ok, err := hasPerm(ds, ds.CanGet, clientToken, ns, name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return 0, ErrAccessDenied
+	}
+
+	return ds.GetCounter(ns, name)
+}
+
+const permGet = uint8(1)
+const permPut = uint8(2)
+const permAppend = uint8(4)
+const permDelete = uint8(8)
+const permPrepend = uint8(16)
+
+type kvDocs map[string]*memDoc
+type kvPerms map[string]uint8
+type kvBool map[string]bool
+type kvInt64 map[string]int64
+type storageType map[string]kvDocs
+type permsType map[string]map[string]kvPerms
+
+// A document of a MemDataStore. Its lock only guards the contents so
+// writes to different documents don't contend. Once a document has been
+// removed from the store it's marked as such and must not be written to
+// anymore.
+type memDoc struct {
+	mutex sync.RWMutex
+	removed bool
+
+	// The contents, gzip compressed if `compressed` is set. Use `value`
+	// to read them.
+	v []byte
+	compressed bool
+
+	// Size of the uncompressed contents.
+	size int64
+
+	// SHA-256 of the contents, computed on demand by `Hash`. Nil if not
+	// yet computed.
+	hash []byte
+
+	// Time of the last write.
+	modTime time.Time
+
+	// Metadata as given to PutWithMeta, not touched by `set`.
+	meta DocMeta
+}
+
+// Replaces the contents, drops the cached hash and updates the modification
+// time. The contents are stored
+// compressed if they are bigger than `compressAbove` and `compressAbove` is
+// positive. Needs to be called with the lock of the document held.
+func (d *memDoc) set(v []byte, compressAbove int) {
+	d.v = v
+	d.compressed = false
+	d.size = int64(len(v))
+	d.hash = nil
+	d.modTime = time.Now()
+
+	if compressAbove <= 0 || len(v) <= compressAbove {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	zw.Write(v)
+	zw.Close() // writes to a bytes.Buffer don't fail
+
+	d.v = buf.Bytes()
+	d.compressed = true
+}
+
+// Returns the contents. If they are stored uncompressed the returned slice
+// is the stored one and must not be modified. Needs to be called with the
+// lock of the document held.
+func (d *memDoc) value() []byte {
+	if !d.compressed {
+		return d.v
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(d.v))
+
+	if err == nil {
+		v := make([]byte, 0, d.size)
+		buf := bytes.NewBuffer(v)
+		_, err = buf.ReadFrom(zr)
+
+		if err == nil {
+			return buf.Bytes()
+		}
+	}
+
+	panic(err) // can't happen, the data was compressed by `set`
+}
+
+// Like value but the returned slice is always a copy.
+func (d *memDoc) copyValue() []byte {
+	if d.compressed {
+		return d.value()
+	}
+
+	v := make([]byte, len(d.v))
+	copy(v, d.v)
+
+	return v
+}
+
+// A partition of a MemDataStore holding a subset of the namespaces. Its
+// lock guards the maps (documents, expiry times, permissions, namespace
+// admins and counters) of these namespaces. The lock of a document may be
+// acquired while holding the lock of its shard but not the other way round.
+type memShard struct {
+	mutex sync.RWMutex
+	storage storageType
+	expiry expiryTable
+	counters map[string]kvInt64
+
+	// Only `Perms` and `NsAdmins` are used, admins and the root token
+	// are kept by the MemDataStore.
+	auth *authState
+}
+
+func newMemShard() *memShard {
+	return &memShard {
+		storage: make(storageType),
+		expiry: make(expiryTable),
+		counters: make(map[string]kvInt64),
+		auth: newHashedAuthState(""),
+	}
+}
+
+// Namespaces are distributed over shards so operations on different
+// namespaces don't contend. The lock of the MemDataStore only guards admins
+// and the root token. Read-only methods only acquire locks for reading.
+//
+// Tokens are not kept, only their SHA-256 hashes. Exported namespaces thus
+// contain hashes and can only be imported into another MemDataStore.
+type MemDataStore struct {
+	// Documents bigger than this many bytes are stored gzip compressed and
+	// decompressed on every read. This trades CPU for memory. Appending to
+	// a compressed document decompresses and recompresses all of it, so
+	// this is a bad fit for large documents that are appended to often.
+	// Zero (the default) disables compression. Must be set before the
+	// store is used.
+	CompressStoredAbove int
+
+	shards []*memShard
+	mutex *sync.RWMutex
+	auth *authState
+	nameGenerator rndstring.StringGenerator
+}
+
+// Number of shards used by NewMemDataStore.
+const defaultMemShards = 16
+
+// Creates a new MemDataStore with the default number of shards. This also
+// starts a goroutine periodically removing documents whose TTL has passed.
+func NewMemDataStore(rootToken string) *MemDataStore {
+	return NewShardedMemDataStore(rootToken, defaultMemShards)
+}
+
+// Creates a new MemDataStore distributing namespaces over `shards` shards
+// (at least one). This also starts a goroutine periodically removing
+// documents whose TTL has passed.
+func NewShardedMemDataStore(rootToken string, shards int) *MemDataStore {
+	if shards < 1 {
+		shards = 1
+	}
+
+	ds := & MemDataStore {
+		shards: make([]*memShard, shards),
+		mutex: &sync.RWMutex{},
+		auth: newHashedAuthState(rootToken),
+		nameGenerator: newNameGenerator(),
+	}
+
+	for i := range ds.shards {
+		ds.shards[i] = newMemShard()
+	}
+
+	runJanitor(janitorInterval, ds.sweep)
+
+	return ds
+}
+
+// Returns the shard holding the namespace.
+func (ds *MemDataStore) shard(ns string) *memShard {
+	h := fnv.New32a()
+	h.Write([]byte(ns))
+
+	return ds.shards[h.Sum32() % uint32(len(ds.shards))]
+}
+
+// Removes a document. Needs to be called with the lock held.
+func (s *memShard) remove(ns, doc string) {
+	s.expiry.clear(ns, doc)
+
+	nsV := s.storage[ns]
+
+	if nsV == nil {
+		return
+	}
+
+	d := nsV[doc]
+
+	if d != nil {
+		d.mutex.Lock()
+		d.removed = true
+		d.set(nil, 0)
+		d.mutex.Unlock()
+	}
+
+	delete(nsV, doc)
+
+	if len(nsV) == 0 {
+		delete(s.storage, ns)
+	}
+}
+
+// Removes the document if its TTL has passed. Needs to be called with
+// the lock held.
+func (s *memShard) expire(ns, doc string) {
+	if s.expiry.expired(ns, doc, time.Now()) {
+		s.remove(ns, doc)
+	}
+}
+
+// Returns the document or nil if it doesn't exist. If `create` is set a
+// missing document is created. Needs to be called with the lock held.
+func (s *memShard) doc(ns, doc string, create bool) *memDoc {
+	s.expire(ns, doc)
+
+	nsV := s.storage[ns]
+
+	if nsV == nil {
+		if !create {
+			return nil
+		}
+
+		nsV = make(kvDocs)
+		s.storage[ns] = nsV
+	}
+
+	d := nsV[doc]
+
+	if d == nil && create {
+		d = &memDoc{ v: []byte{}, modTime: time.Now() }
+		nsV[doc] = d
+	}
+
+	return d
+}
+
+// Returns the document or nil if it doesn't exist. If `create` is set a
+// missing document is created. Only acquires the lock of the shard for
+// writing if a document needs to be created or has expired. Must not be
+// called with the lock of the shard held.
+func (s *memShard) lookupDoc(ns, doc string, create bool) *memDoc {
+	if create {
+		s.mutex.Lock()
+
+		d := s.doc(ns, doc, true)
+
+		s.mutex.Unlock()
+		return d
+	}
+
+	s.mutex.RLock()
+
+	expired := s.expiry.expired(ns, doc, time.Now())
+	d := s.storage[ns][doc]
+
+	s.mutex.RUnlock()
+
+	if expired {
+		s.mutex.Lock()
+
+		d = s.doc(ns, doc, false)
+
+		s.mutex.Unlock()
+	}
+
+	return d
+}
+
+// Returns the document with its lock held for writing or nil if it doesn't
+// exist. If `create` is set a missing document is created. Must not be called
+// with the lock of the shard held.
+func (s *memShard) lockDoc(ns, doc string, create bool) *memDoc {
+	for {
+		d := s.lookupDoc(ns, doc, create)
+
+		if d == nil {
+			return nil
+		}
+
+		d.mutex.Lock()
+
+		if !d.removed {
+			return d
+		}
+
+		// Removed in the meantime, try again.
+		d.mutex.Unlock()
+	}
+}
+
+// Returns the document with its lock held for reading or nil if it doesn't
+// exist. Must not be called with the lock of the shard held.
+func (s *memShard) rlockDoc(ns, doc string) *memDoc {
+	for {
+		d := s.lookupDoc(ns, doc, false)
+
+		if d == nil {
+			return nil
+		}
+
+		d.mutex.RLock()
+
+		if !d.removed {
+			return d
+		}
+
+		// Removed in the meantime, try again.
+		d.mutex.RUnlock()
+	}
+}
+
+// Replaces the contents of the document and sets its expiry time. A zero
+// expiry time means it doesn't expire. See `memDoc.set` for `compressAbove`.
+func (s *memShard) put(ns, doc string, v []byte, meta DocMeta, expiresAt time.Time, compressAbove int) {
+	for {
+		s.mutex.Lock()
+
+		d := s.doc(ns, doc, true)
+
+		if expiresAt.IsZero() {
+			s.expiry.clear(ns, doc)
+		} else {
+			s.expiry.set(ns, doc, expiresAt)
+		}
+
+		s.mutex.Unlock()
+
+		d.mutex.Lock()
+
+		if !d.removed {
+			d.set(v, compressAbove)
+			d.meta = meta
+			d.mutex.Unlock()
+			return
+		}
+
+		// Removed in the meantime, try again.
+		d.mutex.Unlock()
+	}
+}
+
+// Removes all documents whose TTL has passed.
+func (ds *MemDataStore) sweep() {
+	for _, s := range ds.shards {
+		s.mutex.Lock()
+
+		for ns, docs := range s.expiry.expiredDocs(time.Now()) {
+			for _, doc := range docs {
+				s.remove(ns, doc)
+			}
+		}
+
+		s.mutex.Unlock()
+	}
+}
+
+// Returns the generator used for the random part of names created by
+// `CreateUnique`.
+func newNameGenerator() rndstring.StringGenerator {
+	nameGenerator, err := rndstring.NewStringGenerator("hex", 14)
+
+	if err != nil {
+		panic(err) // can't happen, the parameters are fixed
+	}
+
+	return nameGenerator
+}
+
+func (ds *MemDataStore) Ping() error {
+	return nil
+}
+
+func (ds *MemDataStore) IsRoot(token string) (bool, error) {
+	ds.mutex.RLock()
+
+	is := ds.auth.isRoot(token)
+
+	ds.mutex.RUnlock()
+	return is, nil
+}
+
+func (ds *MemDataStore) RotateRootToken(oldToken, newToken string) error {
+	ds.mutex.Lock()
+
+	ok := ds.auth.rotateRoot(oldToken, newToken)
+
+	ds.mutex.Unlock()
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+func (ds *MemDataStore) RevokeToken(token, ns string) error {
+	s := ds.shard(ns)
+	s.mutex.Lock()
+
+	s.auth.revokeToken(token, ns)
+
+	s.mutex.Unlock()
+	return nil
+}
+
+func (ds *MemDataStore) SetNamespaceAdmin(token, ns string, is bool) error {
+	s := ds.shard(ns)
+	s.mutex.Lock()
+
+	s.auth.setNamespaceAdmin(token, ns, is)
+
+	s.mutex.Unlock()
+	return nil
+}
+
+func (ds *MemDataStore) SetAdmin(token string, is bool) error {
+	ds.mutex.Lock()
+
+	ds.auth.setAdmin(token, is)
+
+	ds.mutex.Unlock()
+	return nil
+}
+
+func (ds *MemDataStore) IsAdmin(token string) (bool, error) {
+	ds.mutex.RLock()
+
+	is := ds.auth.isAdmin(token)
+
+	ds.mutex.RUnlock()
+	return is, nil
+}
+
+func (ds *MemDataStore) IsNamespaceAdmin(token, ns string) (bool, error) {
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	is := s.auth.isNamespaceAdmin(token, ns)
+
+	s.mutex.RUnlock()
+
+	if is {
+		return true, nil
+	}
+
+	// Admins and the root token are kept outside of the shards.
+	ds.mutex.RLock()
+
+	is = ds.auth.isAdmin(token) || ds.auth.isRoot(token)
+
+	ds.mutex.RUnlock()
+	return is, nil
+}
+
+func (ds *MemDataStore) SetToken(token, ns, doc string, get, put, app, del, pre bool) error {
+	s := ds.shard(ns)
+	s.mutex.Lock()
+
+	s.auth.setToken(token, ns, doc, get, put, app, del, pre)
+
+	s.mutex.Unlock()
+	return nil
+}
+
+func (ds *MemDataStore) GetToken(token, ns, doc string) (get, put, app, del, pre bool, err error) {
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	get, put, app, del, pre = s.auth.getToken(token, ns, doc)
+
+	s.mutex.RUnlock()
+	return get, put, app, del, pre, nil
+}
+
+func (ds *MemDataStore) can(token, ns, doc string, perm uint8) (bool, error) {
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	ok := s.auth.can(token, ns, doc, perm)
+
+	s.mutex.RUnlock()
+	return ok, nil
+}
+
+func (ds *MemDataStore) Explain(token, ns, doc string) (Explanation, error) {
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	ex := s.auth.explain(token, ns, doc)
+
+	s.mutex.RUnlock()
+	return explainAdmins(ds, token, ns, ex)
+}
+
+func (ds *MemDataStore) DumpPermissions(ns string) (map[string]map[string]Perm, error) {
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	dump := s.auth.dumpPermissions(ns)
+
+	s.mutex.RUnlock()
+	return dump, nil
+}
+
+func (ds *MemDataStore) CanGet(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permGet)
+}
+
+func (ds *MemDataStore) CanPut(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permPut)
+}
+
+func (ds *MemDataStore) CanAppend(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permAppend)
+}
+
+func (ds *MemDataStore) CanDelete(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permDelete)
+}
+
+func (ds *MemDataStore) CanPrepend(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permPrepend)
+}
+
+func (ds *MemDataStore) Append(ns, doc string, delim, v []byte) error {
+	d := ds.shard(ns).lockDoc(ns, doc, true)
+
+	// A compressed document is decompressed, appended to and compressed
+	// again.
+	d.set(append(append(d.value(), v...), delim...), ds.CompressStoredAbove)
+
+	d.mutex.Unlock()
+
+	return nil
+}
+
+func (ds *MemDataStore) Prepend(ns, doc string, delim, v []byte) error {
+	d := ds.shard(ns).lockDoc(ns, doc, true)
+
+	cur := d.value()
+
+	b := make([]byte, 0, len(v) + len(delim) + len(cur))
+	b = append(b, v...)
+	b = append(b, delim...)
+	b = append(b, cur...)
+
+	d.set(b, ds.CompressStoredAbove)
+
+	d.mutex.Unlock()
+
+	return nil
+}
+
+func (ds *MemDataStore) AppendFrom(ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error) {
+	// Read outside of the lock so a slow reader doesn't block
+	// everybody else.
+	v, err := readLimited(r, limit)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(v)), ds.Append(ns, doc, delim, v)
+}
+
+func (ds *MemDataStore) Put(ns, doc string, v []byte) error {
+	ds.shard(ns).put(ns, doc, v, DocMeta{}, time.Time{}, ds.CompressStoredAbove)
+
+	return nil
+}
+
+func (ds *MemDataStore) PutStream(ns, doc string, r io.Reader) error {
+	// Read outside of the lock so a slow reader doesn't block
+	// everybody else.
+	v, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	return ds.Put(ns, doc, v)
+}
+
+func (ds *MemDataStore) PutWithTTL(ns, doc string, v []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ds.Put(ns, doc, v)
+	}
+
+	ds.shard(ns).put(ns, doc, v, DocMeta{}, time.Now().Add(ttl), ds.CompressStoredAbove)
+
+	return nil
+}
+
+func (ds *MemDataStore) PutWithMeta(ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error {
+	expiresAt := time.Time{}
+
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	ds.shard(ns).put(ns, doc, v, meta, expiresAt, ds.CompressStoredAbove)
+
+	return nil
+}
+
+func (ds *MemDataStore) GetMeta(ns, doc string) (DocMeta, error) {
+	d := ds.shard(ns).rlockDoc(ns, doc)
+
+	if d == nil {
+		return DocMeta{}, nil
+	}
+
+	meta := d.meta
+
+	d.mutex.RUnlock()
+	return meta, nil
+}
+
+func (ds *MemDataStore) PutBatch(ns string, docs map[string][]byte) error {
+	names := make([]string, 0, len(docs))
+
+	for doc := range docs {
+		names = append(names, doc)
+	}
+
+	// Always lock documents in the same order.
+	sort.Strings(names)
+
+	s := ds.shard(ns)
+	s.mutex.Lock()
+
+	locked := make([]*memDoc, len(names))
+
+	// All documents are locked before the first is changed so readers
+	// can't see some of the new values but not others.
+	for i, doc := range names {
+		locked[i] = s.doc(ns, doc, true)
+		locked[i].mutex.Lock()
+	}
+
+	for i, doc := range names {
+		locked[i].set(docs[doc], ds.CompressStoredAbove)
+		locked[i].meta = DocMeta{}
+		s.expiry.clear(ns, doc)
+	}
+
+	for _, d := range locked {
+		d.mutex.Unlock()
+	}
+
+	s.mutex.Unlock()
 	return nil
 }
 
-func (ds *MemDataStore) Put(ns, doc string, v []byte) error {
-	ds.mutex.Lock()
+func (ds *MemDataStore) CompareAndPut(ns, doc string, expected, v []byte) (bool, error) {
+	s := ds.shard(ns)
+
+	// The shard stays locked so the document can't be created or
+	// removed in between.
+	s.mutex.Lock()
+
+	d := s.doc(ns, doc, false)
+
+	if (d == nil) != (expected == nil) {
+		s.mutex.Unlock()
+		return false, nil
+	}
+
+	if d == nil {
+		d = s.doc(ns, doc, true)
+	}
+
+	d.mutex.Lock()
+
+	swapped := expected == nil || bytes.Equal(d.value(), expected)
+
+	if swapped {
+		d.set(v, ds.CompressStoredAbove)
+		d.meta = DocMeta{}
+		s.expiry.clear(ns, doc)
+	}
+
+	d.mutex.Unlock()
+	s.mutex.Unlock()
+
+	return swapped, nil
+}
+
+func (ds *MemDataStore) ReplaceInDoc(ns, doc string, old, new []byte, all bool) (int, error) {
+	if len(old) == 0 {
+		return 0, nil
+	}
+
+	d := ds.shard(ns).lockDoc(ns, doc, false)
+
+	if d == nil {
+		return 0, nil
+	}
+
+	cur := d.value()
+	n := bytes.Count(cur, old)
+
+	if n == 0 {
+		d.mutex.Unlock()
+		return 0, nil
+	}
+
+	if !all {
+		n = 1
+	}
+
+	d.set(bytes.Replace(cur, old, new, n), ds.CompressStoredAbove)
+
+	d.mutex.Unlock()
+	return n, nil
+}
+
+func (ds *MemDataStore) MergeJSON(ns, doc string, patch []byte) ([]byte, error) {
+	return modifyJSON(ds, ns, doc, patch, mergeJSON)
+}
 
-	nsV := ds.storage[ns]
+func (ds *MemDataStore) PatchJSON(ns, doc string, patch []byte) ([]byte, error) {
+	return modifyJSON(ds, ns, doc, patch, patchJSON)
+}
 
-	if nsV == nil {
-		nsV = make(kvBytes)
-		ds.storage[ns] = nsV
+func (ds *MemDataStore) Modify(ns, doc string, fn func(old []byte) ([]byte, error)) error {
+	s := ds.shard(ns)
+	d := s.lockDoc(ns, doc, false)
+
+	if d == nil {
+		s.mutex.Lock()
+
+		// Might have been created in the meantime.
+		d = s.doc(ns, doc, false)
+
+		if d == nil {
+			// Holding the lock of the shard keeps others from creating
+			// the document until `fn` has decided.
+			v, err := fn(nil)
+
+			if err == nil && v != nil {
+				d = s.doc(ns, doc, true)
+				d.mutex.Lock()
+				d.set(v, ds.CompressStoredAbove)
+				d.mutex.Unlock()
+			}
+
+			s.mutex.Unlock()
+			return err
+		}
+
+		d.mutex.Lock()
+		s.mutex.Unlock()
 	}
 
-	nsV[doc] = v
+	v, err := fn(d.copyValue())
 
-	ds.mutex.Unlock()
+	if err == nil && v != nil {
+		d.set(v, ds.CompressStoredAbove)
+	}
+
+	d.mutex.Unlock()
+	return err
+}
+
+func (ds *MemDataStore) Delete(ns, doc string) error {
+	s := ds.shard(ns)
+	s.mutex.Lock()
 
+	s.remove(ns, doc)
+
+	s.mutex.Unlock()
 	return nil
 }
 
 func (ds *MemDataStore) Get(ns, doc string) ([]byte, error) {
-	ds.mutex.Lock()
+	d := ds.shard(ns).rlockDoc(ns, doc)
 
-	nsV := ds.storage[ns]
+	if d == nil {
+		return nil, nil
+	}
 
-	if nsV == nil {
-		ds.mutex.Unlock()
+	// Hand out a snapshot so callers can't modify the stored value
+	// without holding the lock.
+	v := d.copyValue()
+
+	d.mutex.RUnlock()
+	return v, nil
+}
+
+func (ds *MemDataStore) GetRange(ns, doc string, off, length int64) ([]byte, error) {
+	d := ds.shard(ns).rlockDoc(ns, doc)
+
+	if d == nil {
 		return nil, nil
 	}
 
-	docV := nsV[doc]
+	length, err := clampRange(d.size, off, length)
+
+	if err != nil {
+		d.mutex.RUnlock()
+		return nil, err
+	}
+
+	// Only the window is copied.
+	v := make([]byte, length)
+	copy(v, d.value()[off:off + length])
 
-	if docV == nil {
-		ds.mutex.Unlock()
+	d.mutex.RUnlock()
+	return v, nil
+}
+
+// Returns the SHA-256 of the document or nil if it doesn't exist. The hash
+// is cached until the document changes.
+func (ds *MemDataStore) Hash(ns, doc string) ([]byte, error) {
+	d := ds.shard(ns).lockDoc(ns, doc, false)
+
+	if d == nil {
 		return nil, nil
 	}
 
+	if d.hash == nil {
+		sum := sha256.Sum256(d.value())
+		d.hash = sum[:]
+	}
+
+	// The cached hash is never modified, it's replaced.
+	h := make([]byte, len(d.hash))
+	copy(h, d.hash)
+
+	d.mutex.Unlock()
+	return h, nil
+}
+
+func (ds *MemDataStore) Size(ns, doc string) (int64, bool, error) {
+	d := ds.shard(ns).rlockDoc(ns, doc)
+
+	if d == nil {
+		return 0, false, nil
+	}
+
+	size := d.size
+
+	d.mutex.RUnlock()
+	return size, true, nil
+}
+
+func (ds *MemDataStore) CreateUnique(ns, prefix string) (string, error) {
+	s := ds.shard(ns)
+	s.mutex.Lock()
+
+	for i := 0; i < maxCreateUniqueAttempts; i++ {
+		doc := prefix + ds.nameGenerator.Generate()
+
+		if s.doc(ns, doc, false) == nil {
+			s.doc(ns, doc, true)
+			s.mutex.Unlock()
+			return doc, nil
+		}
+	}
+
+	s.mutex.Unlock()
+	return "", ErrNoUniqueName
+}
+
+func (ds *MemDataStore) List(ns string) ([]string, error) {
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	nsV := s.storage[ns]
+	docs := make([]string, 0, len(nsV))
+	now := time.Now()
+
+	for doc := range nsV {
+		if s.expiry.expired(ns, doc, now) {
+			continue
+		}
+
+		docs = append(docs, doc)
+	}
+
+	s.mutex.RUnlock()
+
+	sort.Strings(docs)
+	return docs, nil
+}
+
+func (ds *MemDataStore) ExportNamespace(ns string, w io.Writer) error {
+	snap := &namespaceSnapshot{ Namespace: ns, Documents: make(map[string][]byte) }
+
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	now := time.Now()
+
+	for doc, d := range s.storage[ns] {
+		if s.expiry.expired(ns, doc, now) {
+			continue
+		}
+
+		d.mutex.RLock()
+		snap.Documents[doc] = d.copyValue()
+		snap.setMeta(doc, d.meta)
+		d.mutex.RUnlock()
+	}
+
+	s.auth.snapshot(ns, snap)
+
+	s.mutex.RUnlock()
+
+	// Written without holding the lock as `w` may be slow.
+	return writeSnapshot(w, snap)
+}
+
+func (ds *MemDataStore) ImportNamespace(ns string, r io.Reader) error {
+	snap, err := readSnapshot(r)
+
+	if err != nil {
+		return err
+	}
+
+	if !ds.auth.canRestore(snap) {
+		return ErrInvalidSnapshot
+	}
+
+	s := ds.shard(ns)
+	s.mutex.Lock()
+
+	for doc, v := range snap.Documents {
+		d := s.doc(ns, doc, true)
+
+		d.mutex.Lock()
+		d.set(v, ds.CompressStoredAbove)
+		d.meta = snap.Meta[doc]
+		d.mutex.Unlock()
+
+		s.expiry.clear(ns, doc)
+	}
+
+	s.auth.restore(ns, snap)
+
+	s.mutex.Unlock()
+	return nil
+}
+
+// All locks are held while copying so the policy is consistent.
+func (ds *MemDataStore) ExportPolicy(w io.Writer) error {
+	p := newPolicy(true)
+
+	for _, s := range ds.shards {
+		s.mutex.RLock()
+	}
+
+	ds.mutex.RLock()
+
+	for _, s := range ds.shards {
+		s.auth.exportPolicy(p, false)
+	}
+
+	ds.auth.exportPolicy(p, true)
+
+	ds.mutex.RUnlock()
+
+	for _, s := range ds.shards {
+		s.mutex.RUnlock()
+	}
+
+	// Written without holding the lock as `w` may be slow.
+	return writePolicy(w, p)
+}
+
+func (ds *MemDataStore) ImportPolicy(r io.Reader) error {
+	p, err := readPolicy(r)
+
+	if err != nil {
+		return err
+	}
+
+	if !ds.auth.canImportPolicy(p) {
+		return ErrInvalidPolicy
+	}
+
+	for _, s := range ds.shards {
+		s.mutex.Lock()
+	}
+
+	ds.mutex.Lock()
+
+	for _, s := range ds.shards {
+		owns := func(ns string) bool {
+			return ds.shard(ns) == s
+		}
+
+		s.auth.importPolicy(p, owns, false)
+	}
+
+	ds.auth.importPolicy(p, func(string) bool { return false }, true)
+
 	ds.mutex.Unlock()
-	return docV, nil
+
+	for _, s := range ds.shards {
+		s.mutex.Unlock()
+	}
+
+	return nil
+}
+
+func (ds *MemDataStore) ListNamespaces() ([]string, error) {
+	names := make([]string, 0)
+	now := time.Now()
+
+	for _, s := range ds.shards {
+		s.mutex.RLock()
+
+		for ns, nsV := range s.storage {
+			for doc := range nsV {
+				if !s.expiry.expired(ns, doc, now) {
+					names = append(names, ns)
+					break
+				}
+			}
+		}
+
+		s.mutex.RUnlock()
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ds *MemDataStore) NamespaceStats(ns string) (NamespaceStats, error) {
+	var stats NamespaceStats
+
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	now := time.Now()
+
+	for doc, d := range s.storage[ns] {
+		if s.expiry.expired(ns, doc, now) {
+			continue
+		}
+
+		d.mutex.RLock()
+
+		stats.DocCount++
+		stats.TotalBytes += d.size
+
+		d.mutex.RUnlock()
+	}
+
+	stats.AdminCount = len(s.auth.NsAdmins[ns])
+
+	s.mutex.RUnlock()
+	return stats, nil
+}
+
+func (ds *MemDataStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+	now := time.Now()
+
+	for _, s := range ds.shards {
+		s.mutex.RLock()
+
+		for ns, nsV := range s.storage {
+			docs := 0
+
+			for doc, d := range nsV {
+				if s.expiry.expired(ns, doc, now) {
+					continue
+				}
+
+				d.mutex.RLock()
+
+				docs++
+				stats.TotalBytes += d.size
+
+				d.mutex.RUnlock()
+			}
+
+			if docs > 0 {
+				stats.Namespaces++
+				stats.Documents += docs
+			}
+		}
+
+		s.mutex.RUnlock()
+	}
+
+	return stats, nil
+}
+
+// Scans all documents and sorts them, so this takes time proportional to
+// the number of documents in the store (times its log) on every call.
+func (ds *MemDataStore) RecentlyModified(n int) ([]DocRef, error) {
+	refs := make([]DocRef, 0)
+	now := time.Now()
+
+	for _, s := range ds.shards {
+		s.mutex.RLock()
+
+		for ns, nsV := range s.storage {
+			for doc, d := range nsV {
+				if s.expiry.expired(ns, doc, now) {
+					continue
+				}
+
+				d.mutex.RLock()
+				refs = append(refs, DocRef{ Ns: ns, Doc: doc, ModTime: d.modTime })
+				d.mutex.RUnlock()
+			}
+		}
+
+		s.mutex.RUnlock()
+	}
+
+	return newestDocRefs(refs, n), nil
+}
+
+// Sorts the references by modification time, newest first, and returns
+// at most `n` of them.
+func newestDocRefs(refs []DocRef, n int) []DocRef {
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].ModTime.After(refs[j].ModTime)
+	})
+
+	if n < 0 {
+		n = 0
+	}
+
+	if len(refs) > n {
+		refs = refs[:n]
+	}
+
+	return refs
+}
+
+func (ds *MemDataStore) ListAccessibleDocs(token, ns string) ([]string, error) {
+	docs, admin, err := listForAccessCheck(ds, token, ns)
+
+	if err != nil || admin {
+		return docs, err
+	}
+
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	docs = s.auth.accessibleDocs(token, ns, docs)
+
+	s.mutex.RUnlock()
+	return docs, nil
+}
+
+func (ds *MemDataStore) IncrCounter(ns, name string, delta int64) (int64, error) {
+	s := ds.shard(ns)
+	s.mutex.Lock()
+
+	nsV := s.counters[ns]
+
+	if nsV == nil {
+		nsV = make(kvInt64)
+		s.counters[ns] = nsV
+	}
+
+	nsV[name] += delta
+	v := nsV[name]
+
+	s.mutex.Unlock()
+	return v, nil
+}
+
+func (ds *MemDataStore) GetCounter(ns, name string) (int64, error) {
+	s := ds.shard(ns)
+	s.mutex.RLock()
+
+	v := s.counters[ns][name]
+
+	s.mutex.RUnlock()
+	return v, nil
+}
+
+// All locks are held while copying so the snapshot is consistent.
+func (ds *MemDataStore) Snapshot(w io.Writer) error {
+	snap := newStoreSnapshot(true)
+
+	for _, s := range ds.shards {
+		s.mutex.RLock()
+	}
+
+	ds.mutex.RLock()
+
+	for _, s := range ds.shards {
+		for ns, nsV := range s.storage {
+			nsSnap := snap.namespace(ns)
+
+			for doc, d := range nsV {
+				d.mutex.RLock()
+				nsSnap.Documents[doc] = d.copyValue()
+				nsSnap.setMeta(doc, d.meta)
+				d.mutex.RUnlock()
+			}
+		}
+
+		for ns := range s.auth.Perms {
+			snap.namespace(ns)
+		}
+
+		for ns := range s.auth.NsAdmins {
+			snap.namespace(ns)
+		}
+
+		for ns, nsSnap := range snap.Namespaces {
+			if ds.shard(ns) == s {
+				s.auth.snapshot(ns, nsSnap)
+			}
+		}
+
+		for ns, nsV := range s.expiry {
+			for doc, at := range nsV {
+				snap.Expiry.set(ns, doc, at)
+			}
+		}
+
+		for ns, nsV := range s.counters {
+			snap.Counters[ns] = make(kvInt64)
+
+			for name, v := range nsV {
+				snap.Counters[ns][name] = v
+			}
+		}
+	}
+
+	for token := range ds.auth.Admins {
+		snap.Admins = append(snap.Admins, token)
+	}
+
+	sort.Strings(snap.Admins)
+
+	ds.mutex.RUnlock()
+
+	for _, s := range ds.shards {
+		s.mutex.RUnlock()
+	}
+
+	// Written without holding the lock as `w` may be slow.
+	return writeStoreSnapshot(w, snap)
 }
 
+func (ds *MemDataStore) Restore(r io.Reader) error {
+	snap, err := readStoreSnapshot(r)
+
+	if err != nil {
+		return err
+	}
+
+	for _, s := range ds.shards {
+		s.mutex.Lock()
+	}
+
+	ds.mutex.Lock()
+
+	for _, s := range ds.shards {
+		// Removed one by one so concurrent writers notice.
+		for ns, nsV := range s.storage {
+			for doc := range nsV {
+				s.remove(ns, doc)
+			}
+		}
+
+		s.expiry = make(expiryTable)
+		s.counters = make(map[string]kvInt64)
+		s.auth.Perms = make(permsType)
+		s.auth.NsAdmins = make(map[string]kvBool)
+	}
+
+	for ns, nsSnap := range snap.Namespaces {
+		s := ds.shard(ns)
+
+		for doc, v := range nsSnap.Documents {
+			d := s.doc(ns, doc, true)
+
+			d.mutex.Lock()
+			d.set(v, ds.CompressStoredAbove)
+			d.meta = nsSnap.Meta[doc]
+			d.mutex.Unlock()
+		}
+
+		nsSnap.HashedTokens = snap.HashedTokens
+		s.auth.restore(ns, nsSnap)
+	}
+
+	for ns, nsV := range snap.Expiry {
+		s := ds.shard(ns)
 
+		for doc, at := range nsV {
+			if s.storage[ns][doc] != nil {
+				s.expiry.set(ns, doc, at)
+			}
+		}
+	}
+
+	for ns, nsV := range snap.Counters {
+		ds.shard(ns).counters[ns] = nsV
+	}
+
+	ds.auth.Admins = make(kvBool)
+
+	for _, token := range snap.Admins {
+		if snap.HashedTokens {
+			ds.auth.setAdminKey(token, true)
+		} else {
+			ds.auth.setAdmin(token, true)
+		}
+	}
+
+	ds.mutex.Unlock()
+
+	for _, s := range ds.shards {
+		s.mutex.Unlock()
+	}
+
+	return nil
+}
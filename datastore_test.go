@@ -0,0 +1,814 @@
+package jogdb
+
+import "testing"
+import "net/http"
+import "bytes"
+import "path/filepath"
+import "strings"
+import "encoding/json"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "time"
+import "errors"
+
+func expectDoc(t *testing.T, ds DataStore, ns, doc, expected string) {
+	t.Helper()
+
+	v, err := ds.Get(ns, doc)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v == nil || string(v) != expected {
+		t.Fatalf("Expected %q in %s/%s but got %q.", expected, ns, doc, v)
+	}
+}
+
+func expectNoDoc(t *testing.T, ds DataStore, ns, doc string) {
+	t.Helper()
+
+	v, err := ds.Get(ns, doc)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != nil {
+		t.Fatalf("Expected %s/%s to not exist but got %q.", ns, doc, v)
+	}
+}
+
+// Gives `token` all permissions on the document.
+func grantAll(t *testing.T, ds DataStore, token, ns, doc string) {
+	t.Helper()
+
+	err := ds.SetToken(token, ns, doc, true, true, true, true, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemDataStoreGetCopy(t *testing.T) {
+	ds := NewMemDataStore(testRootToken)
+	ds.Put("ns", "a", []byte("hello"))
+
+	v, err := ds.Get("ns", "a")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v[0] = 'j'
+
+	expectDoc(t, ds, "ns", "a", "hello")
+}
+
+func TestList(t *testing.T) {
+	ds := NewMemDataStore(testRootToken)
+
+	docs, err := ds.List("ns")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not nil so it's served as [] rather than null.
+	if docs == nil || len(docs) != 0 {
+		t.Fatalf("Expected no documents but got %#v.", docs)
+	}
+
+	for _, doc := range []string{ "c", "a", "b" } {
+		ds.Put("ns", doc, []byte(doc))
+	}
+
+	ds.Put("other", "d", []byte("d"))
+
+	docs, err = ds.List("ns")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(docs, ",") != "a,b,c" {
+		t.Fatalf("Expected a,b,c but got %v.", docs)
+	}
+}
+
+// Appends in parallel to one document per worker and to a single shared
+// document. Only the latter has to serialize the appends.
+func BenchmarkMemDataStoreParallelAppend(b *testing.B) {
+	for _, shared := range []bool{ false, true } {
+		name := "separate"
+
+		if shared {
+			name = "shared"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			ds := NewMemDataStore(testRootToken)
+			delim, v := []byte("\n"), []byte("x")
+
+			var workers int64
+
+			b.RunParallel(func(pb *testing.PB) {
+				doc := "doc"
+
+				if !shared {
+					doc += strconv.FormatInt(atomic.AddInt64(&workers, 1), 10)
+				}
+
+				for pb.Next() {
+					ds.Append("ns", doc, delim, v)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemDataStoreParallelGet(b *testing.B) {
+	ds := NewMemDataStore(testRootToken)
+	ds.Put("ns", "doc", bytes.Repeat([]byte("x"), 1024))
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := ds.Get("ns", "doc"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestShardedMemDataStore(t *testing.T) {
+	for _, shards := range []int{ 1, 4 } {
+		ds := NewShardedMemDataStore(testRootToken, shards)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < 16; i++ {
+			ns := "ns" + strconv.Itoa(i)
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < 50; j++ {
+					ds.Append(ns, "log", []byte(","), []byte(strconv.Itoa(j)))
+				}
+
+				ds.Put(ns, "a", []byte(ns))
+				ds.IncrCounter(ns, "n", 1)
+				ds.SetNamespaceAdmin("admin-" + ns, ns, true)
+			}()
+		}
+
+		wg.Wait()
+
+		var log []string
+
+		for j := 0; j < 50; j++ {
+			log = append(log, strconv.Itoa(j) + ",")
+		}
+
+		for i := 0; i < 16; i++ {
+			ns := "ns" + strconv.Itoa(i)
+
+			expectDoc(t, ds, ns, "a", ns)
+			expectDoc(t, ds, ns, "log", strings.Join(log, ""))
+
+			docs, err := ds.List(ns)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(docs, ",") != "a,log" {
+				t.Fatalf("%d shards: Expected a,log in %s but got %v.", shards, ns, docs)
+			}
+
+			if n, err := ds.GetCounter(ns, "n"); err != nil || n != 1 {
+				t.Fatalf("%d shards: Expected the counter of %s to be 1 but got %d, %v.", shards, ns, n, err)
+			}
+
+			// Namespace admins are kept by the shard of their namespace.
+			if ok, _ := ds.IsNamespaceAdmin("admin-" + ns, ns); !ok {
+				t.Fatalf("%d shards: Expected admin-%s to be a namespace admin.", shards, ns)
+			}
+
+			if ok, _ := ds.IsNamespaceAdmin("admin-" + ns, "other"); ok {
+				t.Fatalf("%d shards: Expected admin-%s to only be a namespace admin of %s.", shards, ns, ns)
+			}
+		}
+
+		used := 0
+
+		for _, s := range ds.shards {
+			if len(s.storage) > 0 {
+				used++
+			}
+		}
+
+		if shards > 1 && used < 2 {
+			t.Fatalf("Expected the namespaces to be spread over the %d shards.", shards)
+		}
+	}
+}
+
+// Puts to different namespaces in parallel, with all namespaces in one
+// shard and spread over the default number of shards.
+func BenchmarkShardedMemDataStore(b *testing.B) {
+	for _, shards := range []int{ 1, defaultMemShards } {
+		b.Run("shards-" + strconv.Itoa(shards), func(b *testing.B) {
+			ds := NewShardedMemDataStore(testRootToken, shards)
+			v := []byte("x")
+
+			var workers int64
+
+			b.RunParallel(func(pb *testing.PB) {
+				ns := "ns" + strconv.FormatInt(atomic.AddInt64(&workers, 1), 10)
+
+				for pb.Next() {
+					ds.Put(ns, "doc", v)
+				}
+			})
+		})
+	}
+}
+
+func TestCompareAndPutConcurrent(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		ds.Put("ns", "a", []byte("v0"))
+
+		const workers = 16
+
+		var wg sync.WaitGroup
+		var swapped int64
+
+		for i := 1; i <= workers; i++ {
+			wg.Add(1)
+
+			go func(v string) {
+				defer wg.Done()
+
+				ok, err := ds.CompareAndPut("ns", "a", []byte("v0"), []byte(v))
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if ok {
+					atomic.AddInt64(&swapped, 1)
+				}
+			}("v" + strconv.Itoa(i))
+		}
+
+		wg.Wait()
+
+		if swapped != 1 {
+			t.Fatalf("%s: Expected exactly one swap but got %d.", name, swapped)
+		}
+
+		v, _ := ds.Get("ns", "a")
+
+		if string(v) == "v0" {
+			t.Fatalf("%s: Expected the winner's value.", name)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		ds.Put("ns", "a", []byte("hello"))
+		ds.Put("ns", "b", []byte("hi"))
+		ds.Put("other", "c", []byte("x"))
+		ds.PutWithTTL("other", "d", []byte("expired"), time.Millisecond)
+
+		// Expired documents are not counted.
+		time.Sleep(5 * time.Millisecond)
+
+		stats, err := ds.Stats()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := StoreStats{ Namespaces: 2, Documents: 3, TotalBytes: 8 }
+
+		if stats != expected {
+			t.Fatalf("%s: Expected %+v but got %+v.", name, expected, stats)
+		}
+	}
+
+	// Only admins can read the stats.
+	e := newTestAPI(t)
+	h := NewHandler(e)
+
+	e.DataStore.SetAdmin("admin", true)
+	e.DataStore.Put("ns", "a", []byte("hello"))
+
+	expectStatus(t, doRequest(h, "GET", "/m/stats", "nobody", ""), http.StatusForbidden)
+
+	w := doRequest(h, "GET", "/m/stats", "admin", "")
+	expectStatus(t, w, http.StatusOK)
+
+	var stats StoreStats
+
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Documents != 1 || stats.TotalBytes != 5 {
+		t.Fatalf("Unexpected stats %s: %v", w.Body.String(), err)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		ds.Put("ns", "a", []byte("0123456789"))
+
+		for _, tc := range []struct {
+			off, length int64
+			expected string
+			err error
+		} {
+			{ 0, 4, "0123", nil },
+			{ 3, 0, "", nil },
+			// The length is clamped to the end.
+			{ 8, 10, "89", nil },
+			// At the end there is nothing left but that is no error.
+			{ 10, 5, "", nil },
+			{ 11, 1, "", ErrInvalidRange },
+			{ -1, 2, "", ErrInvalidRange },
+			{ 0, -1, "", ErrInvalidRange },
+		} {
+			v, err := ds.GetRange("ns", "a", tc.off, tc.length)
+
+			if err != tc.err {
+				t.Fatalf("%s: Expected %v for %d+%d but got %v.", name, tc.err, tc.off, tc.length, err)
+			}
+
+			if err == nil && (v == nil || string(v) != tc.expected) {
+				t.Fatalf("%s: Expected %q for %d+%d but got %q.", name, tc.expected, tc.off, tc.length, v)
+			}
+		}
+
+		v, err := ds.GetRange("ns", "missing", 0, 1)
+
+		if err != nil || v != nil {
+			t.Fatalf("%s: Expected nothing for a missing document but got %q, %v.", name, v, err)
+		}
+	}
+}
+
+func TestPrepend(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		for _, v := range []string{ "three", "two", "one" } {
+			if err := ds.Prepend("ns", "a", []byte("\n"), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		v, _ := ds.Get("ns", "a")
+
+		if string(v) != "one\ntwo\nthree\n" {
+			t.Fatalf("%s: Expected the newest entry first but got %q.", name, v)
+		}
+	}
+
+	// Through the append route.
+	e := newTestAPI(t)
+	e.Delimiters[".log"] = []byte("\n")
+	h := NewHandler(e)
+
+	e.DataStore.SetToken("tok", "ns", "a.log", false, false, true, false, true)
+
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log", "tok", "old"), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log?mode=prepend", "tok", "new"), http.StatusOK)
+	expectStatus(t, doRequest(h, "PUT", "/r/ns/a.log?mode=sideways", "tok", "x"), http.StatusBadRequest)
+	expectDoc(t, e.DataStore, "ns", "a.log", "new\nold\n")
+}
+
+func TestMemDataStoreCompression(t *testing.T) {
+	ds := NewMemDataStore(testRootToken)
+	ds.CompressStoredAbove = 16
+
+	compressed := func(doc string) bool {
+		s := ds.shard("ns")
+
+		s.mutex.RLock()
+		d := s.storage["ns"][doc]
+		s.mutex.RUnlock()
+
+		d.mutex.RLock()
+		defer d.mutex.RUnlock()
+
+		return d.compressed
+	}
+
+	atLimit := strings.Repeat("a", 16)
+	above := strings.Repeat("b", 17)
+
+	ds.Put("ns", "small", []byte(atLimit))
+	ds.Put("ns", "big", []byte(above))
+
+	expectDoc(t, ds, "ns", "small", atLimit)
+	expectDoc(t, ds, "ns", "big", above)
+
+	if compressed("small") || !compressed("big") {
+		t.Fatal("Expected only documents above the limit to be compressed.")
+	}
+
+	ds.Append("ns", "big", []byte("\n"), []byte("tail"))
+	expectDoc(t, ds, "ns", "big", above + "tail\n")
+
+	// Growing beyond the limit compresses the document.
+	ds.Append("ns", "small", nil, []byte("a"))
+	expectDoc(t, ds, "ns", "small", atLimit + "a")
+
+	if !compressed("small") {
+		t.Fatal("Expected the grown document to be compressed.")
+	}
+
+	v, err := ds.GetRange("ns", "big", 15, 4)
+
+	if err != nil || string(v) != "bbta" {
+		t.Fatalf("Expected %q but got %q, %v.", "bbta", v, err)
+	}
+
+	// Sizes are those of the uncompressed contents.
+	if size, _, _ := ds.Size("ns", "big"); size != int64(len(above) + 5) {
+		t.Fatalf("Expected a size of %d but got %d.", len(above) + 5, size)
+	}
+}
+
+func TestListAccessibleDocs(t *testing.T) {
+	dir := t.TempDir()
+
+	fds, err := NewFileDataStore(filepath.Join(dir, "files"), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bds, err := NewBoltDataStore(filepath.Join(dir, "bolt.db"), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bds.Close()
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+		"bolt": bds,
+	} {
+		for _, doc := range []string{ "a", "b", "c", "x1", "x2" } {
+			if err := ds.Put("ns", doc, []byte(doc)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ds.Put("other", "o", []byte("o"))
+
+		ds.SetToken("tok", "ns", "a", true, false, false, false, false)
+		ds.SetToken("tok", "ns", "b", false, true, false, false, false)
+		ds.SetToken("tok", "ns", "ghost", true, false, false, false, false)
+		ds.SetToken("tok", "ns", "x*", true, false, false, false, false)
+		// An entry of its own overrides the prefix grant.
+		ds.SetToken("tok", "ns", "x2", false, false, false, false, false)
+		ds.SetToken("tok", "other", "*", true, false, false, false, false)
+		ds.SetNamespaceAdmin("nsadmin", "ns", true)
+
+		for _, tc := range []struct {
+			token, ns string
+			expected string
+		} {
+			{ "tok", "ns", "a,x1" },
+			{ "tok", "other", "o" },
+			{ "nobody", "ns", "" },
+			{ "nsadmin", "ns", "a,b,c,x1,x2" },
+			{ "nsadmin", "other", "" },
+			{ testRootToken, "ns", "a,b,c,x1,x2" },
+		} {
+			docs, err := ds.ListAccessibleDocs(tc.token, tc.ns)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(docs, ",") != tc.expected {
+				t.Fatalf("%s: Expected %q for %s in %s but got %v.", name, tc.expected, tc.token, tc.ns, docs)
+			}
+		}
+	}
+}
+
+func TestModifyConcurrent(t *testing.T) {
+	dir := t.TempDir()
+
+	wds, err := NewMemDataStoreWithWAL(testRootToken, filepath.Join(dir, "wal.log"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wds.Close()
+
+	fds, err := NewFileDataStore(filepath.Join(dir, "files"), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"versioned": NewVersionedMemDataStore(testRootToken, 1),
+		"wal": wds,
+		"file": fds,
+	} {
+		const workers = 8
+		const increments = 100
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < increments; j++ {
+					err := ds.Modify("ns", "n", func(old []byte) ([]byte, error) {
+						n, _ := strconv.Atoi(string(old))
+						return []byte(strconv.Itoa(n + 1)), nil
+					})
+
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		v, err := ds.Get("ns", "n")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(v) != strconv.Itoa(workers * increments) {
+			t.Fatalf("%s: Expected %d but got %q, updates were lost.", name, workers * increments, v)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ds := NewMemDataStore(testRootToken)
+
+	ds.SetToken("tok", "ns", "a", true, false, false, false, false)
+	ds.SetToken("tok", "ns", "x*", false, true, false, false, false)
+	SetNamespaceToken(ds, "tok", "ns", false, false, true)
+	ds.SetNamespaceAdmin("nsadmin", "ns", true)
+	ds.SetAdmin("admin", true)
+	// Admins are allowed everything even where their own grant denies it.
+	ds.SetToken("admin", "ns", "a", false, false, false, false, false)
+
+	for _, tc := range []struct {
+		token, doc string
+		get PermExplanation
+		put PermExplanation
+	} {
+		{ "tok", "a", PermExplanation{ true, RuleExplicit }, PermExplanation{ false, RuleExplicit } },
+		{ "tok", "x1", PermExplanation{ false, RulePrefix }, PermExplanation{ true, RulePrefix } },
+		{ "tok", "b", PermExplanation{ false, RuleNamespace }, PermExplanation{ false, RuleNamespace } },
+		{ "nobody", "a", PermExplanation{ false, RuleNone }, PermExplanation{ false, RuleNone } },
+		{ testRootToken, "a", PermExplanation{ true, RuleRoot }, PermExplanation{ true, RuleRoot } },
+		{ "admin", "a", PermExplanation{ true, RuleAdmin }, PermExplanation{ true, RuleAdmin } },
+		{ "nsadmin", "a", PermExplanation{ true, RuleNamespaceAdmin }, PermExplanation{ true, RuleNamespaceAdmin } },
+	} {
+		ex, err := ds.Explain(tc.token, "ns", tc.doc)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ex.Get != tc.get || ex.Put != tc.put {
+			t.Fatalf("%s on %s: Expected %v and %v but got %+v.", tc.token, tc.doc, tc.get, tc.put, ex)
+		}
+
+		// Explain agrees with what the Checked* functions allow.
+		if ok, _ := hasPerm(ds, ds.CanGet, tc.token, "ns", tc.doc); ok != ex.Get.Allowed {
+			t.Fatalf("%s on %s: Explain says %v but hasPerm says %v.", tc.token, tc.doc, ex.Get.Allowed, ok)
+		}
+	}
+
+	ex, _ := ds.Explain("tok", "ns", "b")
+
+	if !ex.Append.Allowed || ex.Append.Rule != RuleNamespace {
+		t.Fatalf("Expected the namespace grant to allow appends but got %+v.", ex)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	src := NewMemDataStore(testRootToken)
+
+	src.Put("ns", "a", []byte("hello"))
+	src.PutWithTTL("ns", "b", []byte("later"), time.Hour)
+	src.Put("other", "c", []byte("x"))
+	src.IncrCounter("ns", "n", 3)
+	src.SetToken("tok", "ns", "a", true, false, false, false, false)
+	src.SetNamespaceAdmin("nsadmin", "ns", true)
+	src.SetAdmin("admin", true)
+
+	var buf bytes.Buffer
+
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewMemDataStore("otherroot")
+
+	// Restoring replaces everything that was there before.
+	dst.Put("ns", "stale", []byte("x"))
+	dst.Put("gone", "d", []byte("x"))
+	dst.SetToken("stale", "ns", "a", true, true, true, true, true)
+	dst.SetAdmin("staleadmin", true)
+
+	if err := dst.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	expectDoc(t, dst, "ns", "a", "hello")
+	expectDoc(t, dst, "ns", "b", "later")
+	expectDoc(t, dst, "other", "c", "x")
+	expectNoDoc(t, dst, "ns", "stale")
+	expectNoDoc(t, dst, "gone", "d")
+
+	if n, err := dst.GetCounter("ns", "n"); err != nil || n != 3 {
+		t.Fatalf("Expected the counter to be 3 but got %d, %v", n, err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		check func() (bool, error)
+		expected bool
+	} {
+		{ "grant", func() (bool, error) { return dst.CanGet("tok", "ns", "a") }, true },
+		{ "stale grant", func() (bool, error) { return dst.CanGet("stale", "ns", "a") }, false },
+		{ "namespace admin", func() (bool, error) { return dst.IsNamespaceAdmin("nsadmin", "ns") }, true },
+		{ "admin", func() (bool, error) { return dst.IsAdmin("admin") }, true },
+		{ "stale admin", func() (bool, error) { return dst.IsAdmin("staleadmin") }, false },
+		// The root token is not part of the snapshot.
+		{ "old root", func() (bool, error) { return dst.IsRoot(testRootToken) }, false },
+		{ "root", func() (bool, error) { return dst.IsRoot("otherroot") }, true },
+	} {
+		if ok, err := tc.check(); err != nil || ok != tc.expected {
+			t.Fatalf("%s: Expected %v but got %v: %v", tc.name, tc.expected, ok, err)
+		}
+	}
+
+	if err := dst.Restore(strings.NewReader("{")); err != ErrInvalidSnapshot {
+		t.Fatalf("Expected ErrInvalidSnapshot but got %v.", err)
+	}
+
+	expectDoc(t, dst, "ns", "a", "hello")
+}
+
+// A reader returning some data and then an error.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("Broken!")
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+func TestPutStream(t *testing.T) {
+	fds, err := NewFileDataStore(t.TempDir(), testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ds := range map[string]DataStore {
+		"mem": NewMemDataStore(testRootToken),
+		"file": fds,
+	} {
+		if err := ds.PutStream("ns", "a", strings.NewReader("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing is stored if reading fails.
+		if err := ds.PutStream("ns", "a", &failingReader{ data: []byte("partial") }); err == nil {
+			t.Fatalf("%s: Expected an error.", name)
+		}
+
+		expectDoc(t, ds, "ns", "a", "hello")
+
+		if err := ds.PutStream("ns", "b", &failingReader{ data: []byte("partial") }); err == nil {
+			t.Fatalf("%s: Expected an error.", name)
+		}
+
+		expectNoDoc(t, ds, "ns", "b")
+	}
+}
+
+func TestCheckedAdminAccess(t *testing.T) {
+	ds := NewMemDataStore(testRootToken)
+
+	ds.SetAdmin("admin", true)
+	ds.SetNamespaceAdmin("nsadmin", "ns", true)
+
+	for _, tc := range []struct {
+		token string
+		ns string
+		allowed bool
+	} {
+		{ testRootToken, "ns", true },
+		{ "admin", "ns", true },
+		{ "admin", "other", true },
+		{ "nsadmin", "ns", true },
+		{ "nsadmin", "other", false },
+		{ "nobody", "ns", false },
+		{ "", "ns", false },
+	} {
+		check := func(op string, err error) {
+			t.Helper()
+
+			if tc.allowed && err != nil {
+				t.Fatalf("%s in %s: Expected %s to be allowed: %v", tc.token, tc.ns, op, err)
+			}
+
+			if !tc.allowed && err != ErrAccessDenied {
+				t.Fatalf("%s in %s: Expected ErrAccessDenied for %s but got %v.", tc.token, tc.ns, op, err)
+			}
+		}
+
+		check("put", CheckedPut(ds, tc.token, tc.ns, "a", []byte("b")))
+		check("append", CheckedAppend(ds, tc.token, tc.ns, "a", []byte(";"), []byte("c")))
+		check("prepend", CheckedPrepend(ds, tc.token, tc.ns, "a", []byte(";"), []byte("a")))
+
+		v, err := CheckedGet(ds, tc.token, tc.ns, "a")
+		check("get", err)
+
+		if tc.allowed && string(v) != "a;bc;" {
+			t.Fatalf("%s in %s: Expected %q but got %q.", tc.token, tc.ns, "a;bc;", v)
+		}
+
+		check("delete", CheckedDelete(ds, tc.token, tc.ns, "a"))
+		expectNoDoc(t, ds, tc.ns, "a")
+	}
+
+	// Can* still only considers grants.
+	if ok, _ := ds.CanGet(testRootToken, "ns", "a"); ok {
+		t.Fatal("Expected CanGet to ignore the root token.")
+	}
+}
@@ -0,0 +1,1466 @@
+package jogdb
+
+import "sync"
+import "os"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "path/filepath"
+import "encoding/json"
+import "strings"
+import "bytes"
+import "time"
+import "github.com/FMNSSun/rndstring"
+
+// Name of the directory below the root holding the sidecar files.
+const fileMetaDir = ".jogdb"
+
+// A DataStore persisting each document as a file `<root>/<ns>/<doc>`.
+// Permissions, admins, counters and expiry times are kept in memory and
+// written to JSON sidecar files in `<root>/.jogdb` on every change. Only
+// hashes of tokens are kept. Namespace and document
+// names must be usable as file names: they can't be empty, can't start with
+// a dot and can't contain path separators. Using them anyway results in
+// ErrInvalidName.
+type FileDataStore struct {
+	root string
+	expiry expiryTable
+	docMeta map[string]map[string]DocMeta
+	counters map[string]kvInt64
+	mutex *sync.Mutex
+	auth *authState
+	nameGenerator rndstring.StringGenerator
+}
+
+// Creates a FileDataStore storing its data below `root`. The directory is
+// created if it doesn't exist. Permissions, admins, counters, expiry
+// times and document metadata stored by a previous FileDataStore with the
+// same root are loaded. This also starts a goroutine periodically removing
+// documents whose TTL has passed.
+func NewFileDataStore(root, rootToken string) (*FileDataStore, error) {
+	ds := &FileDataStore {
+		root: root,
+		expiry: make(expiryTable),
+		docMeta: make(map[string]map[string]DocMeta),
+		counters: make(map[string]kvInt64),
+		mutex: &sync.Mutex{},
+		auth: newHashedAuthState(rootToken),
+		nameGenerator: newNameGenerator(),
+	}
+
+	err := os.MkdirAll(filepath.Join(root, fileMetaDir), 0700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ds.loadAuth()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ds.loadMeta("counters.json", &ds.counters)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ds.loadMeta("expiry.json", &ds.expiry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ds.loadMeta("docmeta.json", &ds.docMeta)
+
+	if err != nil {
+		return nil, err
+	}
+
+	runJanitor(janitorInterval, ds.sweep)
+
+	return ds, nil
+}
+
+// Removes a document. Needs to be called with the lock held.
+func (ds *FileDataStore) remove(ns, doc string) error {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	if _, exists := ds.expiry[ns][doc]; exists {
+		ds.expiry.clear(ns, doc)
+		err = ds.saveMeta("expiry.json", ds.expiry)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ds.setDocMeta(ns, doc, DocMeta{})
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err == nil {
+		// Only succeeds if the namespace is now empty.
+		os.Remove(filepath.Dir(path))
+	}
+
+	return err
+}
+
+// Removes the document if its TTL has passed. Needs to be called with
+// the lock held.
+func (ds *FileDataStore) expire(ns, doc string) error {
+	if ds.expiry.expired(ns, doc, time.Now()) {
+		return ds.remove(ns, doc)
+	}
+
+	return nil
+}
+
+// Removes all documents whose TTL has passed.
+func (ds *FileDataStore) sweep() {
+	ds.mutex.Lock()
+
+	for ns, docs := range ds.expiry.expiredDocs(time.Now()) {
+		for _, doc := range docs {
+			ds.remove(ns, doc)
+		}
+	}
+
+	ds.mutex.Unlock()
+}
+
+func validFileName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\")
+}
+
+// Returns the directory of the namespace.
+func (ds *FileDataStore) nsPath(ns string) (string, error) {
+	if !validFileName(ns) {
+		return "", ErrInvalidName
+	}
+
+	return filepath.Join(ds.root, ns), nil
+}
+
+// Returns the file of the document.
+func (ds *FileDataStore) docPath(ns, doc string) (string, error) {
+	if !validFileName(ns) || !validFileName(doc) {
+		return "", ErrInvalidName
+	}
+
+	return filepath.Join(ds.root, ns, doc), nil
+}
+
+// Reads a sidecar file into `v`. A missing file is not an error.
+func (ds *FileDataStore) loadMeta(name string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(ds.root, fileMetaDir, name))
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// Loads the permissions and admins. Sidecar files written before tokens
+// were hashed (`perms.json`, `nsadmins.json` and `admins.json`) are used
+// if there are none with hashes yet. Their tokens are hashed and they are
+// replaced by files with hashes.
+func (ds *FileDataStore) loadAuth() error {
+	files := []struct {
+		name string
+		v interface{}
+		plain bool
+	} {
+		{ name: "perms", v: &ds.auth.Perms },
+		{ name: "nsadmins", v: &ds.auth.NsAdmins },
+		{ name: "admins", v: &ds.auth.Admins },
+	}
+
+	for i := range files {
+		f := &files[i]
+
+		_, err := os.Stat(filepath.Join(ds.root, fileMetaDir, "hashed-" + f.name + ".json"))
+
+		if err == nil {
+			err = ds.loadMeta("hashed-" + f.name + ".json", f.v)
+		} else if os.IsNotExist(err) {
+			_, err = os.Stat(filepath.Join(ds.root, fileMetaDir, f.name + ".json"))
+			f.plain = err == nil
+
+			if f.plain {
+				err = ds.loadMeta(f.name + ".json", f.v)
+			} else if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	ds.auth.hashKeys(files[0].plain, files[1].plain, files[2].plain)
+
+	for _, f := range files {
+		if !f.plain {
+			continue
+		}
+
+		// The plain file is only removed once the hashes are written.
+		err := ds.saveMeta("hashed-" + f.name + ".json", f.v)
+
+		if err == nil {
+			err = os.Remove(filepath.Join(ds.root, fileMetaDir, f.name + ".json"))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes `v` to a sidecar file.
+func (ds *FileDataStore) saveMeta(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(ds.root, fileMetaDir, name), b)
+}
+
+// Writes the file by writing to a temporary file first which is then
+// renamed. Readers thus either see the old or the new content.
+func writeFileAtomic(path string, v []byte) error {
+	tmp, err := writeTempFile(filepath.Dir(path), bytes.NewReader(v))
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Copies `r` to a new temporary file in `dir` and syncs it. Returns the
+// path of the file. Nothing is left behind if that fails.
+func writeTempFile(dir string, r io.Reader) (string, error) {
+	f, err := ioutil.TempFile(dir, ".tmp-")
+
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	cerr := f.Close()
+
+	if err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// The new root token is not persisted, the root token given to
+// NewFileDataStore applies again after a restart.
+func (ds *FileDataStore) RotateRootToken(oldToken, newToken string) error {
+	ds.mutex.Lock()
+
+	ok := ds.auth.rotateRoot(oldToken, newToken)
+
+	ds.mutex.Unlock()
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+func (ds *FileDataStore) IsRoot(token string) (bool, error) {
+	ds.mutex.Lock()
+
+	is := ds.auth.isRoot(token)
+
+	ds.mutex.Unlock()
+	return is, nil
+}
+
+func (ds *FileDataStore) RevokeToken(token, ns string) error {
+	ds.mutex.Lock()
+
+	ds.auth.revokeToken(token, ns)
+	err := ds.saveMeta("hashed-perms.json", ds.auth.Perms)
+
+	if err == nil {
+		err = ds.saveMeta("hashed-nsadmins.json", ds.auth.NsAdmins)
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) SetNamespaceAdmin(token, ns string, is bool) error {
+	ds.mutex.Lock()
+
+	ds.auth.setNamespaceAdmin(token, ns, is)
+	err := ds.saveMeta("hashed-nsadmins.json", ds.auth.NsAdmins)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) SetAdmin(token string, is bool) error {
+	ds.mutex.Lock()
+
+	ds.auth.setAdmin(token, is)
+	err := ds.saveMeta("hashed-admins.json", ds.auth.Admins)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) IsAdmin(token string) (bool, error) {
+	ds.mutex.Lock()
+
+	is := ds.auth.isAdmin(token)
+
+	ds.mutex.Unlock()
+	return is, nil
+}
+
+func (ds *FileDataStore) IsNamespaceAdmin(token, ns string) (bool, error) {
+	ds.mutex.Lock()
+
+	is := ds.auth.isNamespaceAdmin(token, ns) || ds.auth.isAdmin(token) || ds.auth.isRoot(token)
+
+	ds.mutex.Unlock()
+	return is, nil
+}
+
+func (ds *FileDataStore) SetToken(token, ns, doc string, get, put, app, del, pre bool) error {
+	ds.mutex.Lock()
+
+	ds.auth.setToken(token, ns, doc, get, put, app, del, pre)
+	err := ds.saveMeta("hashed-perms.json", ds.auth.Perms)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) GetToken(token, ns, doc string) (get, put, app, del, pre bool, err error) {
+	ds.mutex.Lock()
+
+	get, put, app, del, pre = ds.auth.getToken(token, ns, doc)
+
+	ds.mutex.Unlock()
+	return get, put, app, del, pre, nil
+}
+
+func (ds *FileDataStore) can(token, ns, doc string, perm uint8) (bool, error) {
+	ds.mutex.Lock()
+
+	ok := ds.auth.can(token, ns, doc, perm)
+
+	ds.mutex.Unlock()
+	return ok, nil
+}
+
+func (ds *FileDataStore) Explain(token, ns, doc string) (Explanation, error) {
+	ds.mutex.Lock()
+
+	ex := ds.auth.explain(token, ns, doc)
+
+	ds.mutex.Unlock()
+	return explainAdmins(ds, token, ns, ex)
+}
+
+func (ds *FileDataStore) DumpPermissions(ns string) (map[string]map[string]Perm, error) {
+	ds.mutex.Lock()
+
+	dump := ds.auth.dumpPermissions(ns)
+
+	ds.mutex.Unlock()
+	return dump, nil
+}
+
+func (ds *FileDataStore) CanGet(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permGet)
+}
+
+func (ds *FileDataStore) CanPut(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permPut)
+}
+
+func (ds *FileDataStore) CanAppend(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permAppend)
+}
+
+func (ds *FileDataStore) CanDelete(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permDelete)
+}
+
+func (ds *FileDataStore) CanPrepend(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permPrepend)
+}
+
+func (ds *FileDataStore) Append(ns, doc string, delim, v []byte) error {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	// Value and delimiter go out in a single write.
+	b := make([]byte, 0, len(v) + len(delim))
+	b = append(b, v...)
+	b = append(b, delim...)
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	_, err = f.Write(b)
+	cerr := f.Close()
+
+	ds.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return cerr
+}
+
+// Unlike Append this has to rewrite the whole file.
+func (ds *FileDataStore) Prepend(ns, doc string, delim, v []byte) error {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	cur, err := ioutil.ReadFile(path)
+
+	if err != nil && !os.IsNotExist(err) {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	b := make([]byte, 0, len(v) + len(delim) + len(cur))
+	b = append(b, v...)
+	b = append(b, delim...)
+	b = append(b, cur...)
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+
+	if err == nil {
+		err = writeFileAtomic(path, b)
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) AppendFrom(ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error) {
+	// Read outside of the lock so a slow reader doesn't block
+	// everybody else.
+	v, err := readLimited(r, limit)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(v)), ds.Append(ns, doc, delim, v)
+}
+
+func (ds *FileDataStore) Put(ns, doc string, v []byte) error {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.write(ns, doc, path, v, DocMeta{}, time.Time{})
+
+	ds.mutex.Unlock()
+	return err
+}
+
+// The value is written to a temporary file next to the document first
+// which is then renamed. Only the rename happens with the lock held.
+func (ds *FileDataStore) PutStream(ns, doc string, r io.Reader) error {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := writeTempFile(filepath.Dir(path), r)
+
+	if err != nil {
+		return err
+	}
+
+	ds.mutex.Lock()
+
+	err = os.Rename(tmp, path)
+
+	if err == nil {
+		err = ds.setExpiry(ns, doc, time.Time{})
+	}
+
+	if err == nil {
+		err = ds.setDocMeta(ns, doc, DocMeta{})
+	} else {
+		os.Remove(tmp)
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) PutWithTTL(ns, doc string, v []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ds.Put(ns, doc, v)
+	}
+
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.write(ns, doc, path, v, DocMeta{}, time.Now().Add(ttl))
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) PutWithMeta(ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Time{}
+
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.write(ns, doc, path, v, meta, expiresAt)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) GetMeta(ns, doc string) (DocMeta, error) {
+	_, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return DocMeta{}, err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return DocMeta{}, err
+	}
+
+	meta := ds.docMeta[ns][doc]
+
+	ds.mutex.Unlock()
+	return meta, nil
+}
+
+// Writes the document and sets its metadata and expiry time. A zero expiry
+// time means it doesn't expire. Needs to be called with the lock held.
+func (ds *FileDataStore) write(ns, doc, path string, v []byte, meta DocMeta, expiresAt time.Time) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(path, v)
+
+	if err != nil {
+		return err
+	}
+
+	err = ds.setDocMeta(ns, doc, meta)
+
+	if err != nil {
+		return err
+	}
+
+	return ds.setExpiry(ns, doc, expiresAt)
+}
+
+// Sets the expiry time of the document, zero means it doesn't expire.
+// Needs to be called with the lock held.
+func (ds *FileDataStore) setExpiry(ns, doc string, expiresAt time.Time) error {
+	_, hadExpiry := ds.expiry[ns][doc]
+
+	if expiresAt.IsZero() && !hadExpiry {
+		return nil
+	}
+
+	if expiresAt.IsZero() {
+		ds.expiry.clear(ns, doc)
+	} else {
+		ds.expiry.set(ns, doc, expiresAt)
+	}
+
+	return ds.saveMeta("expiry.json", ds.expiry)
+}
+
+// Sets the metadata of the document, empty metadata is not stored. Needs
+// to be called with the lock held.
+func (ds *FileDataStore) setDocMeta(ns, doc string, meta DocMeta) error {
+	if ds.docMeta[ns][doc] == meta {
+		return nil
+	}
+
+	if meta == (DocMeta{}) {
+		delete(ds.docMeta[ns], doc)
+
+		if len(ds.docMeta[ns]) == 0 {
+			delete(ds.docMeta, ns)
+		}
+	} else {
+		if ds.docMeta[ns] == nil {
+			ds.docMeta[ns] = make(map[string]DocMeta)
+		}
+
+		ds.docMeta[ns][doc] = meta
+	}
+
+	return ds.saveMeta("docmeta.json", ds.docMeta)
+}
+
+// Documents are written one after the other while holding the lock so
+// readers of this FileDataStore see all or none of them. A crash may
+// leave only some of them written.
+func (ds *FileDataStore) PutBatch(ns string, docs map[string][]byte) error {
+	// Check all names first so nothing is written if one is invalid.
+	paths := make(map[string]string)
+
+	for doc := range docs {
+		path, err := ds.docPath(ns, doc)
+
+		if err != nil {
+			return err
+		}
+
+		paths[doc] = path
+	}
+
+	ds.mutex.Lock()
+
+	for doc, v := range docs {
+		err := ds.write(ns, doc, paths[doc], v, DocMeta{}, time.Time{})
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return err
+		}
+	}
+
+	ds.mutex.Unlock()
+	return nil
+}
+
+func (ds *FileDataStore) CompareAndPut(ns, doc string, expected, v []byte) (bool, error) {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return false, err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return false, err
+	}
+
+	docV, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		docV, err = nil, nil
+	} else if err == nil && docV == nil {
+		docV = []byte{}
+	}
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return false, err
+	}
+
+	if (docV == nil) != (expected == nil) || !bytes.Equal(docV, expected) {
+		ds.mutex.Unlock()
+		return false, nil
+	}
+
+	err = ds.write(ns, doc, path, v, DocMeta{}, time.Time{})
+
+	ds.mutex.Unlock()
+	return err == nil, err
+}
+
+func (ds *FileDataStore) ReplaceInDoc(ns, doc string, old, new []byte, all bool) (int, error) {
+	if len(old) == 0 {
+		return 0, nil
+	}
+
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return 0, err
+	}
+
+	docV, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		ds.mutex.Unlock()
+		return 0, nil
+	}
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return 0, err
+	}
+
+	n := bytes.Count(docV, old)
+
+	if n == 0 {
+		ds.mutex.Unlock()
+		return 0, nil
+	}
+
+	if !all {
+		n = 1
+	}
+
+	err = writeFileAtomic(path, bytes.Replace(docV, old, new, n))
+
+	ds.mutex.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (ds *FileDataStore) MergeJSON(ns, doc string, patch []byte) ([]byte, error) {
+	return modifyJSON(ds, ns, doc, patch, mergeJSON)
+}
+
+func (ds *FileDataStore) PatchJSON(ns, doc string, patch []byte) ([]byte, error) {
+	return modifyJSON(ds, ns, doc, patch, patchJSON)
+}
+
+func (ds *FileDataStore) Modify(ns, doc string, fn func(old []byte) ([]byte, error)) error {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	cur, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		cur, err = nil, nil
+	}
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	v, err := fn(cur)
+
+	if err != nil || v == nil {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+
+	if err == nil {
+		err = writeFileAtomic(path, v)
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) Delete(ns, doc string) error {
+	ds.mutex.Lock()
+
+	err := ds.remove(ns, doc)
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) Get(ns, doc string) ([]byte, error) {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return nil, err
+	}
+
+	v, err := ioutil.ReadFile(path)
+
+	ds.mutex.Unlock()
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil {
+		v = []byte{}
+	}
+
+	return v, nil
+}
+
+func (ds *FileDataStore) GetRange(ns, doc string, off, length int64) ([]byte, error) {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		ds.mutex.Unlock()
+		return nil, nil
+	}
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+
+	if err == nil {
+		length, err = clampRange(fi.Size(), off, length)
+	}
+
+	var v []byte
+
+	if err == nil {
+		// Only the window is read.
+		v = make([]byte, length)
+		_, err = f.ReadAt(v, off)
+	}
+
+	f.Close()
+	ds.mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (ds *FileDataStore) Size(ns, doc string) (int64, bool, error) {
+	path, err := ds.docPath(ns, doc)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	ds.mutex.Lock()
+
+	err = ds.expire(ns, doc)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return 0, false, err
+	}
+
+	fi, err := os.Stat(path)
+
+	ds.mutex.Unlock()
+
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return fi.Size(), true, nil
+}
+
+func (ds *FileDataStore) CreateUnique(ns, prefix string) (string, error) {
+	dir, err := ds.nsPath(ns)
+
+	if err != nil {
+		return "", err
+	}
+
+	ds.mutex.Lock()
+
+	for i := 0; i < maxCreateUniqueAttempts; i++ {
+		doc := prefix + ds.nameGenerator.Generate()
+
+		path, err := ds.docPath(ns, doc)
+
+		if err == nil {
+			err = ds.expire(ns, doc)
+		}
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return "", err
+		}
+
+		// The namespace directory is gone if an expired document
+		// was its last one.
+		err = os.MkdirAll(dir, 0700)
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return "", err
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+
+		if os.IsExist(err) {
+			continue
+		}
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return "", err
+		}
+
+		err = f.Close()
+
+		ds.mutex.Unlock()
+		return doc, err
+	}
+
+	ds.mutex.Unlock()
+	return "", ErrNoUniqueName
+}
+
+func (ds *FileDataStore) List(ns string) ([]string, error) {
+	dir, err := ds.nsPath(ns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ds.mutex.Lock()
+
+	fis, err := ioutil.ReadDir(dir)
+
+	docs := make([]string, 0, len(fis))
+
+	if os.IsNotExist(err) {
+		ds.mutex.Unlock()
+		return docs, nil
+	}
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return nil, err
+	}
+
+	now := time.Now()
+
+	// ReadDir already sorts by name.
+	for _, fi := range fis {
+		if fi.IsDir() || !validFileName(fi.Name()) {
+			continue
+		}
+
+		if ds.expiry.expired(ns, fi.Name(), now) {
+			continue
+		}
+
+		docs = append(docs, fi.Name())
+	}
+
+	ds.mutex.Unlock()
+	return docs, nil
+}
+
+func (ds *FileDataStore) ExportNamespace(ns string, w io.Writer) error {
+	dir, err := ds.nsPath(ns)
+
+	if err != nil {
+		return err
+	}
+
+	snap := &namespaceSnapshot{ Namespace: ns, Documents: make(map[string][]byte) }
+
+	ds.mutex.Lock()
+
+	fis, err := ioutil.ReadDir(dir)
+
+	if err != nil && !os.IsNotExist(err) {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	now := time.Now()
+
+	for _, fi := range fis {
+		if fi.IsDir() || !validFileName(fi.Name()) || ds.expiry.expired(ns, fi.Name(), now) {
+			continue
+		}
+
+		v, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return err
+		}
+
+		snap.Documents[fi.Name()] = v
+		snap.setMeta(fi.Name(), ds.docMeta[ns][fi.Name()])
+	}
+
+	ds.auth.snapshot(ns, snap)
+
+	ds.mutex.Unlock()
+
+	// Written without holding the lock as `w` may be slow.
+	return writeSnapshot(w, snap)
+}
+
+func (ds *FileDataStore) ImportNamespace(ns string, r io.Reader) error {
+	snap, err := readSnapshot(r)
+
+	if err != nil {
+		return err
+	}
+
+	if !ds.auth.canRestore(snap) {
+		return ErrInvalidSnapshot
+	}
+
+	// Check all names first so nothing is written if one is invalid.
+	paths := make(map[string]string)
+
+	for doc := range snap.Documents {
+		paths[doc], err = ds.docPath(ns, doc)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	ds.mutex.Lock()
+
+	for doc, v := range snap.Documents {
+		err = ds.write(ns, doc, paths[doc], v, snap.Meta[doc], time.Time{})
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return err
+		}
+	}
+
+	ds.auth.restore(ns, snap)
+
+	err = ds.saveMeta("hashed-perms.json", ds.auth.Perms)
+
+	if err == nil {
+		err = ds.saveMeta("hashed-nsadmins.json", ds.auth.NsAdmins)
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *FileDataStore) ExportPolicy(w io.Writer) error {
+	p := newPolicy(true)
+
+	ds.mutex.Lock()
+	ds.auth.exportPolicy(p, true)
+	ds.mutex.Unlock()
+
+	// Written without holding the lock as `w` may be slow.
+	return writePolicy(w, p)
+}
+
+// The three permission files are written one after the other, a crash may
+// leave only some of them updated.
+func (ds *FileDataStore) ImportPolicy(r io.Reader) error {
+	p, err := readPolicy(r)
+
+	if err != nil {
+		return err
+	}
+
+	if !ds.auth.canImportPolicy(p) {
+		return ErrInvalidPolicy
+	}
+
+	ds.mutex.Lock()
+
+	ds.auth.importPolicy(p, func(string) bool { return true }, true)
+
+	err = ds.saveMeta("hashed-perms.json", ds.auth.Perms)
+
+	if err == nil {
+		err = ds.saveMeta("hashed-nsadmins.json", ds.auth.NsAdmins)
+	}
+
+	if err == nil {
+		err = ds.saveMeta("hashed-admins.json", ds.auth.Admins)
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+// Checks that the data directory is still there.
+func (ds *FileDataStore) Ping() error {
+	fi, err := os.Stat(ds.root)
+
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("FileDataStore: %q is not a directory", ds.root)
+	}
+
+	return nil
+}
+
+func (ds *FileDataStore) ListNamespaces() ([]string, error) {
+	ds.mutex.Lock()
+
+	fis, err := ioutil.ReadDir(ds.root)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fis))
+
+	// ReadDir already sorts by name. Namespace directories are removed
+	// once empty but may still contain only expired documents.
+	for _, fi := range fis {
+		if !fi.IsDir() || !validFileName(fi.Name()) {
+			continue
+		}
+
+		docs, err := ioutil.ReadDir(filepath.Join(ds.root, fi.Name()))
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return nil, err
+		}
+
+		now := time.Now()
+
+		for _, doc := range docs {
+			if !doc.IsDir() && validFileName(doc.Name()) && !ds.expiry.expired(fi.Name(), doc.Name(), now) {
+				names = append(names, fi.Name())
+				break
+			}
+		}
+	}
+
+	ds.mutex.Unlock()
+	return names, nil
+}
+
+func (ds *FileDataStore) NamespaceStats(ns string) (NamespaceStats, error) {
+	var stats NamespaceStats
+
+	dir, err := ds.nsPath(ns)
+
+	if err != nil {
+		return stats, err
+	}
+
+	ds.mutex.Lock()
+
+	fis, err := ioutil.ReadDir(dir)
+
+	if err != nil && !os.IsNotExist(err) {
+		ds.mutex.Unlock()
+		return stats, err
+	}
+
+	now := time.Now()
+
+	for _, fi := range fis {
+		if fi.IsDir() || !validFileName(fi.Name()) || ds.expiry.expired(ns, fi.Name(), now) {
+			continue
+		}
+
+		stats.DocCount++
+		stats.TotalBytes += fi.Size()
+	}
+
+	stats.AdminCount = len(ds.auth.NsAdmins[ns])
+
+	ds.mutex.Unlock()
+	return stats, nil
+}
+
+func (ds *FileDataStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+
+	ds.mutex.Lock()
+
+	fis, err := ioutil.ReadDir(ds.root)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return stats, err
+	}
+
+	now := time.Now()
+
+	for _, fi := range fis {
+		if !fi.IsDir() || !validFileName(fi.Name()) {
+			continue
+		}
+
+		docs, err := ioutil.ReadDir(filepath.Join(ds.root, fi.Name()))
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return stats, err
+		}
+
+		count := 0
+
+		for _, doc := range docs {
+			if doc.IsDir() || !validFileName(doc.Name()) || ds.expiry.expired(fi.Name(), doc.Name(), now) {
+				continue
+			}
+
+			count++
+			stats.TotalBytes += doc.Size()
+		}
+
+		if count > 0 {
+			stats.Namespaces++
+			stats.Documents += count
+		}
+	}
+
+	ds.mutex.Unlock()
+	return stats, nil
+}
+
+// Reads the directories of all namespaces and sorts their documents by the
+// modification times of the files, so this takes time proportional to the
+// number of documents on every call.
+func (ds *FileDataStore) RecentlyModified(n int) ([]DocRef, error) {
+	refs := make([]DocRef, 0)
+
+	ds.mutex.Lock()
+
+	fis, err := ioutil.ReadDir(ds.root)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, fi := range fis {
+		if !fi.IsDir() || !validFileName(fi.Name()) {
+			continue
+		}
+
+		docs, err := ioutil.ReadDir(filepath.Join(ds.root, fi.Name()))
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return nil, err
+		}
+
+		for _, doc := range docs {
+			if doc.IsDir() || !validFileName(doc.Name()) || ds.expiry.expired(fi.Name(), doc.Name(), now) {
+				continue
+			}
+
+			refs = append(refs, DocRef{ Ns: fi.Name(), Doc: doc.Name(), ModTime: doc.ModTime() })
+		}
+	}
+
+	ds.mutex.Unlock()
+	return newestDocRefs(refs, n), nil
+}
+
+func (ds *FileDataStore) ListAccessibleDocs(token, ns string) ([]string, error) {
+	docs, admin, err := listForAccessCheck(ds, token, ns)
+
+	if err != nil || admin {
+		return docs, err
+	}
+
+	ds.mutex.Lock()
+
+	docs = ds.auth.accessibleDocs(token, ns, docs)
+
+	ds.mutex.Unlock()
+	return docs, nil
+}
+
+func (ds *FileDataStore) IncrCounter(ns, name string, delta int64) (int64, error) {
+	ds.mutex.Lock()
+
+	nsV := ds.counters[ns]
+
+	if nsV == nil {
+		nsV = make(kvInt64)
+		ds.counters[ns] = nsV
+	}
+
+	nsV[name] += delta
+	v := nsV[name]
+
+	err := ds.saveMeta("counters.json", ds.counters)
+
+	ds.mutex.Unlock()
+	return v, err
+}
+
+func (ds *FileDataStore) GetCounter(ns, name string) (int64, error) {
+	ds.mutex.Lock()
+
+	v := ds.counters[ns][name]
+
+	ds.mutex.Unlock()
+	return v, nil
+}
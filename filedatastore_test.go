@@ -0,0 +1,125 @@
+package jogdb
+
+import "testing"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+
+func TestFileDataStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	ds, err := NewFileDataStore(dir, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds.Put("ns", "a", []byte("hello"))
+	ds.Append("ns", "log", []byte("\n"), []byte("one"))
+	ds.Append("ns", "log", []byte("\n"), []byte("two"))
+	ds.SetToken("tok", "ns", "a", true, false, false, false, false)
+
+	reopened, err := NewFileDataStore(dir, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectDoc(t, reopened, "ns", "a", "hello")
+	expectDoc(t, reopened, "ns", "log", "one\ntwo\n")
+
+	// The delimiter follows each entry in the file itself.
+	b, err := ioutil.ReadFile(filepath.Join(dir, "ns", "log"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "one\ntwo\n" {
+		t.Fatalf("Expected %q on disk but got %q.", "one\ntwo\n", b)
+	}
+
+	if ok, err := reopened.CanGet("tok", "ns", "a"); err != nil || !ok {
+		t.Fatalf("Expected the grant to survive: %v, %v", ok, err)
+	}
+}
+
+func TestFileDataStoreHashesTokens(t *testing.T) {
+	root := t.TempDir()
+	meta := filepath.Join(root, fileMetaDir)
+
+	if err := os.MkdirAll(meta, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sidecars as written before tokens were hashed.
+	for name, content := range map[string]string {
+		"perms.json": `{"ns":{"doc":{"old-token":1}}}`,
+		"nsadmins.json": `{"ns":{"old-admin":true}}`,
+		"admins.json": `{"old-global":true}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(meta, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ds, err := NewFileDataStore(root, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ds.SetToken("new-token", "ns", "doc", true, false, false, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(ds *FileDataStore) {
+		t.Helper()
+
+		for _, token := range []string{ "old-token", "new-token" } {
+			if ok, err := ds.CanGet(token, "ns", "doc"); err != nil || !ok {
+				t.Fatalf("Expected %s to be able to read: %v, %v", token, ok, err)
+			}
+		}
+
+		if ok, err := ds.IsNamespaceAdmin("old-admin", "ns"); err != nil || !ok {
+			t.Fatalf("Expected the namespace admin to be kept: %v, %v", ok, err)
+		}
+
+		if ok, err := ds.IsAdmin("old-global"); err != nil || !ok {
+			t.Fatalf("Expected the admin to be kept: %v, %v", ok, err)
+		}
+	}
+
+	check(ds)
+
+	// Nothing on disk contains a token any more.
+	fis, err := ioutil.ReadDir(meta)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(filepath.Join(meta, fi.Name()))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, token := range []string{ "old-token", "new-token", "old-admin", "old-global", testRootToken } {
+			if strings.Contains(string(b), token) {
+				t.Fatalf("%s contains the token %s: %s", fi.Name(), token, b)
+			}
+		}
+	}
+
+	reopened, err := NewFileDataStore(root, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(reopened)
+}
@@ -0,0 +1,358 @@
+package jogdb
+
+import "encoding/json"
+import "reflect"
+import "strconv"
+import "strings"
+
+// An operation of a JSON Patch (RFC 6902). `Value` is nil if the member is
+// missing, which is different from null.
+type jsonPatchOp struct {
+	Op string `json:"op"`
+	Path string `json:"path"`
+	From *string `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Applies the JSON Patch (RFC 6902) `patch` to the document `docV`. The
+// operations are applied in order and if one fails nothing is changed. An
+// empty document is treated as null. Returns ErrInvalidPatch if the patch
+// is not a valid JSON Patch, ErrNotJSON if the document isn't JSON and
+// ErrPatchFailed if an operation can't be applied (e.g. a path doesn't
+// exist or a test fails).
+func patchJSON(docV, patch []byte) ([]byte, error) {
+	ops, err := parseJSONPatch(patch)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var cur interface{}
+
+	if len(docV) > 0 {
+		err = json.Unmarshal(docV, &cur)
+
+		if err != nil {
+			return nil, ErrNotJSON
+		}
+	}
+
+	for _, op := range ops {
+		cur, err = op.apply(cur)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(cur)
+}
+
+// Parses and validates a JSON Patch without applying it.
+func parseJSONPatch(patch []byte) ([]jsonPatchOp, error) {
+	var ops []jsonPatchOp
+
+	err := json.Unmarshal(patch, &ops)
+
+	if err != nil || ops == nil {
+		return nil, ErrInvalidPatch
+	}
+
+	for _, op := range ops {
+		_, err = parsePointer(op.Path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, ErrInvalidPatch
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, ErrInvalidPatch
+			}
+
+			_, err = parsePointer(*op.From)
+
+			if err != nil {
+				return nil, err
+			}
+		case "remove":
+		default:
+			return nil, ErrInvalidPatch
+		}
+	}
+
+	return ops, nil
+}
+
+// Splits a JSON Pointer (RFC 6901) into its unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, ErrInvalidPatch
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// Returns the index an array reference token refers to. "-" (the end) is
+// only allowed if `end` is set, which also allows `n` itself.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+
+	// Leading zeros and signs are not allowed.
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.Trim(token, "0123456789") != "" {
+		return 0, ErrPatchFailed
+	}
+
+	i, err := strconv.Atoi(token)
+
+	if err != nil || i > n || (i == n && !end) {
+		return 0, ErrPatchFailed
+	}
+
+	return i, nil
+}
+
+// Returns the value the tokens refer to.
+func lookupPointer(node interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, exists := n[token]
+
+			if !exists {
+				return nil, ErrPatchFailed
+			}
+
+			node = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(n), false)
+
+			if err != nil {
+				return nil, err
+			}
+
+			node = n[i]
+		default:
+			return nil, ErrPatchFailed
+		}
+	}
+
+	return node, nil
+}
+
+// Walks to the container holding the last token and replaces it with what
+// `leaf` returns for it. Returns the new `node`.
+func updatePointer(node interface{}, tokens []string, leaf func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return leaf(node, tokens[0])
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, exists := n[tokens[0]]
+
+		if !exists {
+			return nil, ErrPatchFailed
+		}
+
+		child, err := updatePointer(child, tokens[1:], leaf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		n[tokens[0]] = child
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(n), false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		child, err := updatePointer(n[i], tokens[1:], leaf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		n[i] = child
+		return n, nil
+	}
+
+	return nil, ErrPatchFailed
+}
+
+func addPointer(node interface{}, tokens []string, v interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+
+	return updatePointer(node, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = v
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), true)
+
+			if err != nil {
+				return nil, err
+			}
+
+			c = append(c, nil)
+			copy(c[i + 1:], c[i:])
+			c[i] = v
+
+			return c, nil
+		}
+
+		return nil, ErrPatchFailed
+	})
+}
+
+func removePointer(node interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	return updatePointer(node, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, exists := c[token]; !exists {
+				return nil, ErrPatchFailed
+			}
+
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return append(c[:i], c[i + 1:]...), nil
+		}
+
+		return nil, ErrPatchFailed
+	})
+}
+
+// Returns a copy of a decoded JSON value sharing nothing with it.
+func copyJSONValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(n))
+
+		for k, child := range n {
+			c[k] = copyJSONValue(child)
+		}
+
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(n))
+
+		for i, child := range n {
+			c[i] = copyJSONValue(child)
+		}
+
+		return c
+	}
+
+	return v
+}
+
+func (op *jsonPatchOp) apply(doc interface{}) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+
+	var value interface{}
+
+	if op.Value != nil {
+		// Checked to be valid JSON when the patch was parsed.
+		json.Unmarshal(op.Value, &value)
+	}
+
+	switch op.Op {
+	case "add":
+		return addPointer(doc, path, value)
+	case "remove":
+		return removePointer(doc, path)
+	case "replace":
+		_, err := lookupPointer(doc, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		doc, err = removePointer(doc, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return addPointer(doc, path, value)
+	case "move":
+		from, _ := parsePointer(*op.From)
+
+		// A value can't be moved into itself.
+		if op.Path != *op.From && strings.HasPrefix(op.Path, *op.From + "/") {
+			return nil, ErrPatchFailed
+		}
+
+		v, err := lookupPointer(doc, from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		doc, err = removePointer(doc, from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return addPointer(doc, path, v)
+	case "copy":
+		from, _ := parsePointer(*op.From)
+
+		v, err := lookupPointer(doc, from)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return addPointer(doc, path, copyJSONValue(v))
+	case "test":
+		v, err := lookupPointer(doc, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !reflect.DeepEqual(v, value) {
+			return nil, ErrPatchFailed
+		}
+
+		return doc, nil
+	}
+
+	return nil, ErrInvalidPatch
+}
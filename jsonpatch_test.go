@@ -0,0 +1,54 @@
+package jogdb
+
+import "testing"
+
+func TestPatchJSON(t *testing.T) {
+	for _, tc := range []struct {
+		doc string
+		patch string
+		expected string
+		err error
+	} {
+		// Examples from RFC 6902, appendix A.
+		{ `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, nil },
+		{ `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil },
+		{ `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil },
+		{ `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil },
+		{ `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, nil },
+		{ `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil },
+		{ `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, nil },
+		{ `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, nil },
+		{ `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, "", ErrPatchFailed },
+		{ `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`, nil },
+		{ `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, "", ErrPatchFailed },
+		{ `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`, nil },
+		{ `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`, nil },
+		{ `{"foo":null}`, `[{"op":"test","path":"/foo","value":null}]`, `{"foo":null}`, nil },
+		{ `{"foo":1}`, `[{"op":"copy","from":"/foo","path":"/bar"}]`, `{"bar":1,"foo":1}`, nil },
+		// The whole document.
+		{ `{"foo":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`, nil },
+		{ "", `[{"op":"add","path":"","value":{}}]`, `{}`, nil },
+		// Nothing is changed if a later operation fails.
+		{ `{"foo":1}`, `[{"op":"remove","path":"/foo"},{"op":"remove","path":"/foo"}]`, "", ErrPatchFailed },
+		{ `{"foo":[1]}`, `[{"op":"replace","path":"/foo/1","value":2}]`, "", ErrPatchFailed },
+		{ `{"foo":[1]}`, `[{"op":"add","path":"/foo/01","value":2}]`, "", ErrPatchFailed },
+		// Invalid patches.
+		{ `{}`, `{"op":"add","path":"/a","value":1}`, "", ErrInvalidPatch },
+		{ `{}`, `[{"op":"frobnicate","path":"/a"}]`, "", ErrInvalidPatch },
+		{ `{}`, `[{"op":"add","path":"/a"}]`, "", ErrInvalidPatch },
+		{ `{}`, `[{"op":"move","path":"/a"}]`, "", ErrInvalidPatch },
+		{ `{}`, `[{"op":"add","path":"a","value":1}]`, "", ErrInvalidPatch },
+		{ `{}`, `[`, "", ErrInvalidPatch },
+		{ `nope`, `[]`, "", ErrNotJSON },
+	} {
+		v, err := patchJSON([]byte(tc.doc), []byte(tc.patch))
+
+		if err != tc.err {
+			t.Fatalf("%s: Expected %v but got %v.", tc.patch, tc.err, err)
+		}
+
+		if err == nil && string(v) != tc.expected {
+			t.Fatalf("%s: Expected %s but got %s.", tc.patch, tc.expected, v)
+		}
+	}
+}
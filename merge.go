@@ -0,0 +1,76 @@
+package jogdb
+
+import "encoding/json"
+
+// Merges `patch` into the document `docV` as described by RFC 7386 (JSON
+// Merge Patch): objects are merged recursively, a null removes the member
+// and everything else (arrays, scalars) replaces the current value. An empty
+// document is treated as if it didn't exist. Returns ErrInvalidPatch if the
+// patch is not valid JSON and ErrNotJSON if the document isn't.
+func mergeJSON(docV, patch []byte) ([]byte, error) {
+	var patchV interface{}
+
+	err := json.Unmarshal(patch, &patchV)
+
+	if err != nil {
+		return nil, ErrInvalidPatch
+	}
+
+	var cur interface{}
+
+	if len(docV) > 0 {
+		err = json.Unmarshal(docV, &cur)
+
+		if err != nil {
+			return nil, ErrNotJSON
+		}
+	}
+
+	return json.Marshal(mergeValue(cur, patchV))
+}
+
+func mergeValue(cur, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+
+	if !ok {
+		return patch
+	}
+
+	curObj, ok := cur.(map[string]interface{})
+
+	if !ok {
+		curObj = make(map[string]interface{})
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(curObj, k)
+		} else {
+			curObj[k] = mergeValue(curObj[k], v)
+		}
+	}
+
+	return curObj
+}
+
+// Replaces the document with what `apply` returns for its current value
+// and `patch` and returns the new value.
+func modifyJSON(ds DataStore, ns, doc string, patch []byte, apply func(docV, patch []byte) ([]byte, error)) ([]byte, error) {
+	var v []byte
+
+	err := ds.Modify(ns, doc, func(cur []byte) ([]byte, error) {
+		var err error
+		v, err = apply(cur, patch)
+		return v, err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Hand out a copy, the store may keep the value.
+	r := make([]byte, len(v))
+	copy(r, v)
+
+	return r, nil
+}
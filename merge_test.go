@@ -0,0 +1,43 @@
+package jogdb
+
+import "testing"
+
+func TestMergeJSON(t *testing.T) {
+	for _, tc := range []struct {
+		doc string
+		patch string
+		expected string
+		err error
+	} {
+		// Examples from RFC 7386, appendix A.
+		{ `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`, nil },
+		{ `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`, nil },
+		{ `{"a":"b"}`, `{"a":null}`, `{}`, nil },
+		{ `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`, nil },
+		{ `{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`, nil },
+		{ `{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`, nil },
+		{ `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`, nil },
+		{ `{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`, nil },
+		{ `["a","b"]`, `["c","d"]`, `["c","d"]`, nil },
+		{ `{"a":"b"}`, `["c"]`, `["c"]`, nil },
+		{ `{"a":"foo"}`, `null`, `null`, nil },
+		{ `{"a":"foo"}`, `"bar"`, `"bar"`, nil },
+		{ `{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`, nil },
+		{ `[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`, nil },
+		{ `{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`, nil },
+		// An empty document doesn't exist yet.
+		{ "", `{"a":1}`, `{"a":1}`, nil },
+		{ `{}`, `{`, "", ErrInvalidPatch },
+		{ `nope`, `{}`, "", ErrNotJSON },
+	} {
+		v, err := mergeJSON([]byte(tc.doc), []byte(tc.patch))
+
+		if err != tc.err {
+			t.Fatalf("%s: Expected %v but got %v.", tc.patch, tc.err, err)
+		}
+
+		if err == nil && string(v) != tc.expected {
+			t.Fatalf("%s into %s: Expected %s but got %s.", tc.patch, tc.doc, tc.expected, v)
+		}
+	}
+}
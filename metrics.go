@@ -0,0 +1,97 @@
+package jogdb
+
+import "github.com/gorilla/mux"
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/prometheus/client_golang/prometheus/promhttp"
+import "net/http"
+import "fmt"
+import "time"
+
+// Prometheus metrics of an ApiState. Every ApiState has its own registry so
+// that creating several routers doesn't fail with duplicate registrations.
+type apiMetrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+}
+
+func newApiMetrics(ds DataStore) *apiMetrics {
+	m := &apiMetrics {
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "jogdb_requests_total",
+			Help: "Number of requests by operation and status code.",
+		}, []string{"operation", "status"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "jogdb_request_duration_seconds",
+			Help: "Duration of requests by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+	}
+
+	m.registry.MustRegister(m.requests, m.durations)
+
+	// The store stats are computed when scraped. Errors are reported
+	// as -1.
+	stat := func(name, help string, f func(StoreStats) float64) prometheus.GaugeFunc {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: name,
+			Help: help,
+		}, func() float64 {
+			stats, err := ds.Stats()
+
+			if err != nil {
+				return -1
+			}
+
+			return f(stats)
+		})
+	}
+
+	m.registry.MustRegister(
+		stat("jogdb_namespaces", "Number of namespaces.", func(s StoreStats) float64 {
+			return float64(s.Namespaces)
+		}),
+		stat("jogdb_documents", "Number of documents.", func(s StoreStats) float64 {
+			return float64(s.Documents)
+		}),
+		stat("jogdb_stored_bytes", "Total size of all documents in bytes.", func(s StoreStats) float64 {
+			return float64(s.TotalBytes)
+		}),
+	)
+
+	return m
+}
+
+// Returns a mux middleware counting and timing requests by route name
+// (the operation) and status code.
+func (m *apiMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "unknown"
+
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+			name = route.GetName()
+		}
+
+		rec := &statusRecorder{ ResponseWriter: w, status: http.StatusOK }
+		start := time.Now()
+
+		next.ServeHTTP(rec, r)
+
+		m.durations.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(name, fmt.Sprintf("%d", rec.status)).Inc()
+	})
+}
+
+// Adds the /metrics route and the metrics middleware to the router if
+// `e.EnableMetrics` is set. The route requires no token.
+func (e *ApiState) useMetrics(r *mux.Router) {
+	if !e.EnableMetrics {
+		return
+	}
+
+	m := newApiMetrics(e.DataStore)
+
+	r.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})).Methods("GET").Name("metrics")
+	r.Use(m.middleware)
+}
@@ -0,0 +1,31 @@
+package jogdb
+
+import "testing"
+import "net/http"
+import "strings"
+
+func TestMetrics(t *testing.T) {
+	e := newTestAPI(t)
+	e.EnableMetrics = true
+	h := NewHandler(e)
+
+	grantAll(t, e.DataStore, "tok", "ns", "a.txt")
+
+	expectStatus(t, doRequest(h, "POST", "/r/ns/a.txt", "tok", "hello"), http.StatusOK)
+	expectStatus(t, doRequest(h, "GET", "/r/ns/a.txt", "nobody", ""), http.StatusForbidden)
+
+	w := doRequest(h, "GET", "/metrics", "", "")
+	expectStatus(t, w, http.StatusOK)
+
+	for _, metric := range []string{
+		`jogdb_requests_total{operation="putDoc",status="200"} 1`,
+		`jogdb_requests_total{operation="getDoc",status="403"} 1`,
+		`jogdb_request_duration_seconds_count{operation="putDoc"} 1`,
+		"jogdb_documents 1",
+		"jogdb_stored_bytes 5",
+	} {
+		if !strings.Contains(w.Body.String(), metric) {
+			t.Fatalf("Expected %s in the metrics:\n%s", metric, w.Body.String())
+		}
+	}
+}
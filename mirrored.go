@@ -0,0 +1,586 @@
+package jogdb
+
+import "sync"
+import "log"
+import "io"
+import "io/ioutil"
+import "time"
+import "bytes"
+
+// Size of the queue of pending writes per secondary in asynchronous mode.
+const mirrorQueueSize = 1024
+
+type mirror struct {
+	ds DataStore
+	ops chan func(DataStore) error
+	done chan struct{}
+
+	// Writes dropped because the queue was full and whether the last
+	// write was dropped. Only accessed with the lock of the
+	// MirroredDataStore held.
+	dropped int64
+	dropping bool
+}
+
+// A DataStore that mirrors all writes from a primary DataStore to
+// one or more secondaries. Writes go to the primary first and, if that
+// succeeded, to the secondaries. Reads are served by the primary only.
+//
+// In asynchronous mode writes to the secondaries happen in the background
+// (in the same order as on the primary) and failures are only logged. If
+// a secondary falls more than `mirrorQueueSize` writes behind, further
+// writes to it are dropped (see DroppedWrites) rather than stalling writes
+// to the primary, so it no longer matches the primary.
+//
+// In strict mode writes to the secondaries happen before returning and
+// a failing secondary fails the write. The write has then already been
+// applied to the primary and to the secondaries before the failing one
+// and is not undone.
+type MirroredDataStore struct {
+	primary DataStore
+	mirrors []*mirror
+	strict bool
+	mutex *sync.Mutex
+}
+
+func NewMirroredDataStore(primary DataStore, strict bool) *MirroredDataStore {
+	return &MirroredDataStore {
+		primary: primary,
+		mirrors: make([]*mirror, 0),
+		strict: strict,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Adds a secondary DataStore. Only writes made after adding it are mirrored
+// to it.
+func (ds *MirroredDataStore) AddSecondary(secondary DataStore) {
+	m := &mirror {
+		ds: secondary,
+	}
+
+	if !ds.strict {
+		m.ops = make(chan func(DataStore) error, mirrorQueueSize)
+		m.done = make(chan struct{})
+		go m.run()
+	}
+
+	ds.mutex.Lock()
+	ds.mirrors = append(ds.mirrors, m)
+	ds.mutex.Unlock()
+}
+
+func (m *mirror) run() {
+	for op := range m.ops {
+		err := op(m.ds)
+
+		if err != nil {
+			log.Printf("MirroredDataStore: Write to secondary failed: %v", err.Error())
+		}
+	}
+
+	close(m.done)
+}
+
+// Queues `op` for the secondary, dropping it if the queue is full. Needs
+// to be called with the lock held.
+func (m *mirror) enqueue(op func(DataStore) error) {
+	select {
+	case m.ops <- op:
+		m.dropping = false
+	default:
+		if !m.dropping {
+			log.Printf("MirroredDataStore: Queue of secondary is full, dropping writes.")
+		}
+
+		m.dropping = true
+		m.dropped++
+	}
+}
+
+// Returns the number of writes dropped because a secondary fell too far
+// behind, summed over all secondaries. Always zero in strict mode.
+func (ds *MirroredDataStore) DroppedWrites() int64 {
+	var n int64
+
+	ds.mutex.Lock()
+
+	for _, m := range ds.mirrors {
+		n += m.dropped
+	}
+
+	ds.mutex.Unlock()
+	return n
+}
+
+// Stops mirroring and removes all secondaries. In asynchronous mode this
+// waits until the secondaries have applied the writes queued for them.
+// Neither the primary nor the secondaries are closed.
+func (ds *MirroredDataStore) Close() error {
+	ds.mutex.Lock()
+
+	mirrors := ds.mirrors
+	ds.mirrors = make([]*mirror, 0)
+
+	for _, m := range mirrors {
+		if m.ops != nil {
+			close(m.ops)
+		}
+	}
+
+	ds.mutex.Unlock()
+
+	for _, m := range mirrors {
+		if m.done != nil {
+			<-m.done
+		}
+	}
+
+	return nil
+}
+
+// Applies `op` to the primary and then `mirrorOp` to all secondaries. The lock
+// is held while doing so in order for the secondaries to see the writes in
+// the same order as the primary. In asynchronous mode `mirrorOp` is only
+// queued, never waited for.
+func (ds *MirroredDataStore) write(op, mirrorOp func(DataStore) error) error {
+	ds.mutex.Lock()
+
+	err := op(ds.primary)
+
+	if err != nil {
+		ds.mutex.Unlock()
+		return err
+	}
+
+	for _, m := range ds.mirrors {
+		if !ds.strict {
+			m.enqueue(mirrorOp)
+			continue
+		}
+
+		err = mirrorOp(m.ds)
+
+		if err != nil {
+			ds.mutex.Unlock()
+			return err
+		}
+	}
+
+	ds.mutex.Unlock()
+	return nil
+}
+
+func copyBytes(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+
+	return append([]byte{}, v...)
+}
+
+func (ds *MirroredDataStore) Get(ns, doc string) ([]byte, error) {
+	return ds.primary.Get(ns, doc)
+}
+
+func (ds *MirroredDataStore) GetRange(ns, doc string, off, length int64) ([]byte, error) {
+	return ds.primary.GetRange(ns, doc, off, length)
+}
+
+func (ds *MirroredDataStore) GetMeta(ns, doc string) (DocMeta, error) {
+	return ds.primary.GetMeta(ns, doc)
+}
+
+func (ds *MirroredDataStore) Size(ns, doc string) (int64, bool, error) {
+	return ds.primary.Size(ns, doc)
+}
+
+func (ds *MirroredDataStore) Put(ns, doc string, v []byte) error {
+	mv := copyBytes(v)
+
+	return ds.write(func(d DataStore) error {
+		return d.Put(ns, doc, v)
+	}, func(d DataStore) error {
+		return d.Put(ns, doc, mv)
+	})
+}
+
+func (ds *MirroredDataStore) PutStream(ns, doc string, r io.Reader) error {
+	// The value has to be buffered anyway as it's needed for every
+	// secondary.
+	v, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	return ds.Put(ns, doc, v)
+}
+
+func (ds *MirroredDataStore) PutWithTTL(ns, doc string, v []byte, ttl time.Duration) error {
+	mv := copyBytes(v)
+
+	return ds.write(func(d DataStore) error {
+		return d.PutWithTTL(ns, doc, v, ttl)
+	}, func(d DataStore) error {
+		return d.PutWithTTL(ns, doc, mv, ttl)
+	})
+}
+
+func (ds *MirroredDataStore) PutWithMeta(ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error {
+	mv := copyBytes(v)
+
+	return ds.write(func(d DataStore) error {
+		return d.PutWithMeta(ns, doc, v, meta, ttl)
+	}, func(d DataStore) error {
+		return d.PutWithMeta(ns, doc, mv, meta, ttl)
+	})
+}
+
+func (ds *MirroredDataStore) Append(ns, doc string, delim, v []byte) error {
+	mdelim, mv := copyBytes(delim), copyBytes(v)
+
+	return ds.write(func(d DataStore) error {
+		return d.Append(ns, doc, delim, v)
+	}, func(d DataStore) error {
+		return d.Append(ns, doc, mdelim, mv)
+	})
+}
+
+func (ds *MirroredDataStore) Prepend(ns, doc string, delim, v []byte) error {
+	mdelim, mv := copyBytes(delim), copyBytes(v)
+
+	return ds.write(func(d DataStore) error {
+		return d.Prepend(ns, doc, delim, v)
+	}, func(d DataStore) error {
+		return d.Prepend(ns, doc, mdelim, mv)
+	})
+}
+
+func (ds *MirroredDataStore) ReplaceInDoc(ns, doc string, old, new []byte, all bool) (int, error) {
+	var n int
+	mold, mnew := copyBytes(old), copyBytes(new)
+
+	err := ds.write(func(d DataStore) error {
+		var err error
+		n, err = d.ReplaceInDoc(ns, doc, old, new, all)
+		return err
+	}, func(d DataStore) error {
+		_, err := d.ReplaceInDoc(ns, doc, mold, mnew, all)
+		return err
+	})
+
+	return n, err
+}
+
+func (ds *MirroredDataStore) PutBatch(ns string, docs map[string][]byte) error {
+	mdocs := make(map[string][]byte)
+
+	for doc, v := range docs {
+		mdocs[doc] = copyBytes(v)
+	}
+
+	return ds.write(func(d DataStore) error {
+		return d.PutBatch(ns, docs)
+	}, func(d DataStore) error {
+		return d.PutBatch(ns, mdocs)
+	})
+}
+
+func (ds *MirroredDataStore) CompareAndPut(ns, doc string, expected, v []byte) (bool, error) {
+	var swapped bool
+	mv := copyBytes(v)
+
+	err := ds.write(func(d DataStore) error {
+		var err error
+		swapped, err = d.CompareAndPut(ns, doc, expected, v)
+		return err
+	}, func(d DataStore) error {
+		// Secondaries follow the outcome on the primary.
+		if !swapped {
+			return nil
+		}
+
+		return d.Put(ns, doc, mv)
+	})
+
+	return swapped, err
+}
+
+func (ds *MirroredDataStore) MergeJSON(ns, doc string, patch []byte) ([]byte, error) {
+	var v []byte
+	mpatch := copyBytes(patch)
+
+	err := ds.write(func(d DataStore) error {
+		var err error
+		v, err = d.MergeJSON(ns, doc, patch)
+		return err
+	}, func(d DataStore) error {
+		_, err := d.MergeJSON(ns, doc, mpatch)
+		return err
+	})
+
+	return v, err
+}
+
+func (ds *MirroredDataStore) PatchJSON(ns, doc string, patch []byte) ([]byte, error) {
+	var v []byte
+	mpatch := copyBytes(patch)
+
+	err := ds.write(func(d DataStore) error {
+		var err error
+		v, err = d.PatchJSON(ns, doc, patch)
+		return err
+	}, func(d DataStore) error {
+		_, err := d.PatchJSON(ns, doc, mpatch)
+		return err
+	})
+
+	return v, err
+}
+
+// `fn` only runs on the primary, the secondaries get what it returned.
+func (ds *MirroredDataStore) Modify(ns, doc string, fn func(old []byte) ([]byte, error)) error {
+	var mv []byte
+
+	return ds.write(func(d DataStore) error {
+		return d.Modify(ns, doc, func(old []byte) ([]byte, error) {
+			v, err := fn(old)
+			mv = copyBytes(v)
+			return v, err
+		})
+	}, func(d DataStore) error {
+		if mv == nil {
+			return nil
+		}
+
+		return d.Modify(ns, doc, func(old []byte) ([]byte, error) {
+			return mv, nil
+		})
+	})
+}
+
+func (ds *MirroredDataStore) Delete(ns, doc string) error {
+	op := func(d DataStore) error {
+		return d.Delete(ns, doc)
+	}
+
+	return ds.write(op, op)
+}
+
+func (ds *MirroredDataStore) AppendFrom(ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error) {
+	// The value has to be buffered anyway as it's needed for every
+	// secondary.
+	v, err := readLimited(r, limit)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(v)), ds.Append(ns, doc, delim, v)
+}
+
+func (ds *MirroredDataStore) CanGet(token, ns, doc string) (bool, error) {
+	return ds.primary.CanGet(token, ns, doc)
+}
+
+func (ds *MirroredDataStore) CanPut(token, ns, doc string) (bool, error) {
+	return ds.primary.CanPut(token, ns, doc)
+}
+
+func (ds *MirroredDataStore) CanAppend(token, ns, doc string) (bool, error) {
+	return ds.primary.CanAppend(token, ns, doc)
+}
+
+func (ds *MirroredDataStore) CanDelete(token, ns, doc string) (bool, error) {
+	return ds.primary.CanDelete(token, ns, doc)
+}
+
+func (ds *MirroredDataStore) CanPrepend(token, ns, doc string) (bool, error) {
+	return ds.primary.CanPrepend(token, ns, doc)
+}
+
+func (ds *MirroredDataStore) Explain(token, ns, doc string) (Explanation, error) {
+	return ds.primary.Explain(token, ns, doc)
+}
+
+func (ds *MirroredDataStore) DumpPermissions(ns string) (map[string]map[string]Perm, error) {
+	return ds.primary.DumpPermissions(ns)
+}
+
+func (ds *MirroredDataStore) GetToken(token, ns, doc string) (get, put, app, del, pre bool, err error) {
+	return ds.primary.GetToken(token, ns, doc)
+}
+
+func (ds *MirroredDataStore) SetToken(token, ns, doc string, get, put, app, del, pre bool) error {
+	op := func(d DataStore) error {
+		return d.SetToken(token, ns, doc, get, put, app, del, pre)
+	}
+
+	return ds.write(op, op)
+}
+
+func (ds *MirroredDataStore) RevokeToken(token, ns string) error {
+	op := func(d DataStore) error {
+		return d.RevokeToken(token, ns)
+	}
+
+	return ds.write(op, op)
+}
+
+func (ds *MirroredDataStore) IsNamespaceAdmin(token, ns string) (bool, error) {
+	return ds.primary.IsNamespaceAdmin(token, ns)
+}
+
+func (ds *MirroredDataStore) IsAdmin(token string) (bool, error) {
+	return ds.primary.IsAdmin(token)
+}
+
+func (ds *MirroredDataStore) SetNamespaceAdmin(token, ns string, is bool) error {
+	op := func(d DataStore) error {
+		return d.SetNamespaceAdmin(token, ns, is)
+	}
+
+	return ds.write(op, op)
+}
+
+func (ds *MirroredDataStore) SetAdmin(token string, is bool) error {
+	op := func(d DataStore) error {
+		return d.SetAdmin(token, is)
+	}
+
+	return ds.write(op, op)
+}
+
+// Pings the primary and, in strict mode, the secondaries as writes fail if
+// one of them fails.
+func (ds *MirroredDataStore) Ping() error {
+	err := ds.primary.Ping()
+
+	if err != nil || !ds.strict {
+		return err
+	}
+
+	ds.mutex.Lock()
+	mirrors := ds.mirrors
+	ds.mutex.Unlock()
+
+	for _, m := range mirrors {
+		err = m.ds.Ping()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ds *MirroredDataStore) RotateRootToken(oldToken, newToken string) error {
+	op := func(d DataStore) error {
+		return d.RotateRootToken(oldToken, newToken)
+	}
+
+	return ds.write(op, op)
+}
+
+func (ds *MirroredDataStore) IsRoot(token string) (bool, error) {
+	return ds.primary.IsRoot(token)
+}
+
+func (ds *MirroredDataStore) CreateUnique(ns, prefix string) (string, error) {
+	var doc string
+
+	// The name is chosen by the primary, the secondaries get an
+	// empty document of the same name.
+	err := ds.write(func(d DataStore) error {
+		var err error
+		doc, err = d.CreateUnique(ns, prefix)
+		return err
+	}, func(d DataStore) error {
+		return d.Put(ns, doc, []byte{})
+	})
+
+	return doc, err
+}
+
+func (ds *MirroredDataStore) List(ns string) ([]string, error) {
+	return ds.primary.List(ns)
+}
+
+func (ds *MirroredDataStore) ExportNamespace(ns string, w io.Writer) error {
+	return ds.primary.ExportNamespace(ns, w)
+}
+
+func (ds *MirroredDataStore) ImportNamespace(ns string, r io.Reader) error {
+	// The snapshot has to be buffered as it's needed for every DataStore.
+	b, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	op := func(d DataStore) error {
+		return d.ImportNamespace(ns, bytes.NewReader(b))
+	}
+
+	return ds.write(op, op)
+}
+
+func (ds *MirroredDataStore) ExportPolicy(w io.Writer) error {
+	return ds.primary.ExportPolicy(w)
+}
+
+func (ds *MirroredDataStore) ImportPolicy(r io.Reader) error {
+	// The policy has to be buffered as it's needed for every DataStore.
+	b, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	op := func(d DataStore) error {
+		return d.ImportPolicy(bytes.NewReader(b))
+	}
+
+	return ds.write(op, op)
+}
+
+func (ds *MirroredDataStore) ListNamespaces() ([]string, error) {
+	return ds.primary.ListNamespaces()
+}
+
+func (ds *MirroredDataStore) NamespaceStats(ns string) (NamespaceStats, error) {
+	return ds.primary.NamespaceStats(ns)
+}
+
+func (ds *MirroredDataStore) Stats() (StoreStats, error) {
+	return ds.primary.Stats()
+}
+
+func (ds *MirroredDataStore) RecentlyModified(n int) ([]DocRef, error) {
+	return ds.primary.RecentlyModified(n)
+}
+
+func (ds *MirroredDataStore) ListAccessibleDocs(token, ns string) ([]string, error) {
+	return ds.primary.ListAccessibleDocs(token, ns)
+}
+
+func (ds *MirroredDataStore) IncrCounter(ns, name string, delta int64) (int64, error) {
+	var v int64
+
+	err := ds.write(func(d DataStore) error {
+		var err error
+		v, err = d.IncrCounter(ns, name, delta)
+		return err
+	}, func(d DataStore) error {
+		_, err := d.IncrCounter(ns, name, delta)
+		return err
+	})
+
+	return v, err
+}
+
+func (ds *MirroredDataStore) GetCounter(ns, name string) (int64, error) {
+	return ds.primary.GetCounter(ns, name)
+}
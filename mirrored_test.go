@@ -0,0 +1,108 @@
+package jogdb
+
+import "testing"
+import "time"
+
+// Writes to `ds` and checks what ended up in `stores`. `sync` is called
+// before checking.
+func testMirroredWrites(t *testing.T, ds *MirroredDataStore, sync func(), stores ...DataStore) {
+	if err := ds.Put("ns", "a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.Append("ns", "a", []byte("\n"), []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.Put("ns", "b", []byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.Delete("ns", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.SetToken("tok", "ns", "a", true, false, false, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	sync()
+
+	for _, s := range stores {
+		expectDoc(t, s, "ns", "a", "helloworld\n")
+		expectNoDoc(t, s, "ns", "b")
+
+		ok, err := s.CanGet("tok", "ns", "a")
+
+		if err != nil || !ok {
+			t.Fatalf("Expected the token to be able to read: %v, %v", ok, err)
+		}
+	}
+}
+
+func TestMirroredDataStoreStrict(t *testing.T) {
+	primary, secondary := NewMemDataStore(testRootToken), NewMemDataStore(testRootToken)
+
+	ds := NewMirroredDataStore(primary, true)
+	ds.AddSecondary(secondary)
+
+	testMirroredWrites(t, ds, func() {}, primary, secondary)
+}
+
+func TestMirroredDataStoreAsync(t *testing.T) {
+	primary, secondary := NewMemDataStore(testRootToken), NewMemDataStore(testRootToken)
+
+	ds := NewMirroredDataStore(primary, false)
+	ds.AddSecondary(secondary)
+
+	testMirroredWrites(t, ds, func() {
+		ds.Close()
+	}, primary, secondary)
+}
+
+// A DataStore whose puts block until `unblock` is closed.
+type blockingDataStore struct {
+	*MemDataStore
+	unblock chan struct{}
+}
+
+func (ds *blockingDataStore) Put(ns, doc string, v []byte) error {
+	<-ds.unblock
+	return ds.MemDataStore.Put(ns, doc, v)
+}
+
+func TestMirroredDataStoreSlowSecondary(t *testing.T) {
+	primary := NewMemDataStore(testRootToken)
+	secondary := &blockingDataStore{ NewMemDataStore(testRootToken), make(chan struct{}) }
+
+	ds := NewMirroredDataStore(primary, false)
+	ds.AddSecondary(secondary)
+
+	n := mirrorQueueSize + 10
+	done := make(chan struct{})
+
+	go func() {
+		for i := 0; i < n; i++ {
+			ds.Put("ns", "doc", []byte("v"))
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writes to the primary stalled.")
+	}
+
+	// One write may be in progress on the secondary, the rest is queued
+	// or dropped.
+	if dropped := ds.DroppedWrites(); dropped < int64(n - mirrorQueueSize - 1) {
+		t.Fatalf("Expected dropped writes but got %d.", dropped)
+	}
+
+	close(secondary.unblock)
+	ds.Close()
+
+	expectDoc(t, secondary, "ns", "doc", "v")
+}
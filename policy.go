@@ -0,0 +1,190 @@
+package jogdb
+
+import "encoding/json"
+import "errors"
+import "io"
+import "sort"
+
+// Version of the policy format written by `ExportPolicy`.
+const policyVersion = 1
+
+// This is returned by `ImportPolicy` if the policy can't be read, has an
+// unsupported version or contains invalid entries.
+var ErrInvalidPolicy = errors.New("Invalid policy!")
+
+// The permissions of a token on a document (or prefix grant) as serialized
+// by `ExportPolicy`.
+type policyGrant struct {
+	Ns string `json:"ns"`
+	Doc string `json:"doc"`
+	Token string `json:"token"`
+	Get bool `json:"get"`
+	Put bool `json:"put"`
+	Append bool `json:"append"`
+	Delete bool `json:"delete"`
+	Prepend bool `json:"prepend"`
+}
+
+// The permission model (everything but the root token) as serialized by
+// `ExportPolicy`. If `HashedTokens` is set it contains hashes of tokens
+// instead of tokens and can't be imported into a DataStore that keeps
+// tokens.
+type policy struct {
+	Version int `json:"version"`
+	HashedTokens bool `json:"hashedTokens"`
+	Grants []policyGrant `json:"grants"`
+	NamespaceAdmins map[string][]string `json:"namespaceAdmins"`
+	Admins []string `json:"admins"`
+}
+
+func newPolicy(hashed bool) *policy {
+	return &policy {
+		Version: policyVersion,
+		HashedTokens: hashed,
+		Grants: make([]policyGrant, 0),
+		NamespaceAdmins: make(map[string][]string),
+		Admins: make([]string, 0),
+	}
+}
+
+// Sorts the entries so exports of the same permissions are identical.
+func writePolicy(w io.Writer, p *policy) error {
+	sort.Slice(p.Grants, func(i, j int) bool {
+		a, b := p.Grants[i], p.Grants[j]
+
+		if a.Ns != b.Ns {
+			return a.Ns < b.Ns
+		}
+
+		if a.Doc != b.Doc {
+			return a.Doc < b.Doc
+		}
+
+		return a.Token < b.Token
+	})
+
+	for _, tokens := range p.NamespaceAdmins {
+		sort.Strings(tokens)
+	}
+
+	sort.Strings(p.Admins)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(p)
+}
+
+// Reads and validates a policy.
+func readPolicy(r io.Reader) (*policy, error) {
+	var p policy
+
+	err := json.NewDecoder(r).Decode(&p)
+
+	if err != nil || p.Version != policyVersion {
+		return nil, ErrInvalidPolicy
+	}
+
+	for _, g := range p.Grants {
+		if g.Ns == "" || g.Doc == "" || g.Token == "" {
+			return nil, ErrInvalidPolicy
+		}
+	}
+
+	for ns, tokens := range p.NamespaceAdmins {
+		for _, token := range tokens {
+			if ns == "" || token == "" {
+				return nil, ErrInvalidPolicy
+			}
+		}
+	}
+
+	for _, token := range p.Admins {
+		if token == "" {
+			return nil, ErrInvalidPolicy
+		}
+	}
+
+	return &p, nil
+}
+
+// Adds the permissions and namespace admins to the policy. Admins are
+// added if `admins` is set.
+func (a *authState) exportPolicy(p *policy, admins bool) {
+	for ns, nsV := range a.Perms {
+		for doc, docV := range nsV {
+			for token, bits := range docV {
+				p.Grants = append(p.Grants, policyGrant{
+					Ns: ns,
+					Doc: doc,
+					Token: token,
+					Get: bits & permGet != 0,
+					Put: bits & permPut != 0,
+					Append: bits & permAppend != 0,
+					Delete: bits & permDelete != 0,
+					Prepend: bits & permPrepend != 0,
+				})
+			}
+		}
+	}
+
+	for ns, nsV := range a.NsAdmins {
+		for token := range nsV {
+			p.NamespaceAdmins[ns] = append(p.NamespaceAdmins[ns], token)
+		}
+	}
+
+	if admins {
+		for token := range a.Admins {
+			p.Admins = append(p.Admins, token)
+		}
+	}
+}
+
+// Returns true if the policy can be imported. Hashed tokens can't be turned
+// back into tokens.
+func (a *authState) canImportPolicy(p *policy) bool {
+	return a.hashed || !p.HashedTokens
+}
+
+// Replaces the permissions and namespace admins of the namespaces for which
+// `owns` returns true with those of the policy. Admins are replaced too if
+// `admins` is set. Check `canImportPolicy` first.
+func (a *authState) importPolicy(p *policy, owns func(ns string) bool, admins bool) {
+	key := a.key
+
+	if p.HashedTokens {
+		key = func(token string) string {
+			return token
+		}
+	}
+
+	a.Perms = make(permsType)
+	a.NsAdmins = make(map[string]kvBool)
+
+	for _, g := range p.Grants {
+		if owns(g.Ns) {
+			a.setTokenKey(key(g.Token), g.Ns, g.Doc, g.Get, g.Put, g.Append, g.Delete, g.Prepend)
+		}
+	}
+
+	for ns, tokens := range p.NamespaceAdmins {
+		if !owns(ns) {
+			continue
+		}
+
+		for _, token := range tokens {
+			a.setNamespaceAdminKey(key(token), ns, true)
+		}
+	}
+
+	if !admins {
+		return
+	}
+
+	a.Admins = make(kvBool)
+
+	for _, token := range p.Admins {
+		a.Admins[key(token)] = true
+	}
+}
@@ -0,0 +1,119 @@
+package jogdb
+
+import "net/http"
+import "math"
+import "strconv"
+import "sync"
+import "time"
+
+// Configuration of the per client rate limit. Every client has a bucket of
+// `Burst` requests which refills at `PerSecond` requests per second.
+// Rate limiting is disabled if `PerSecond` isn't positive.
+type RateLimit struct {
+	PerSecond float64
+	Burst int
+}
+
+// Idle buckets are dropped after being full for this long.
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last time.Time
+}
+
+// Token buckets by client.
+type rateLimiter struct {
+	limit RateLimit
+	mutex sync.Mutex
+	buckets map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	return &rateLimiter {
+		limit: limit,
+		buckets: make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Refills the bucket up to the time `now`.
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens + now.Sub(b.last).Seconds() * l.limit.PerSecond)
+	b.last = now
+}
+
+// Takes a request from the bucket of the client. If the bucket is empty
+// this returns false and the time until the next request is allowed.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mutex.Lock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		for k, b := range l.buckets {
+			l.refill(b, now)
+
+			if b.tokens >= float64(l.limit.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+
+		l.lastSweep = now
+	}
+
+	b := l.buckets[key]
+
+	if b == nil {
+		b = &tokenBucket{ tokens: float64(l.limit.Burst), last: now }
+		l.buckets[key] = b
+	}
+
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.limit.PerSecond * float64(time.Second))
+
+		l.mutex.Unlock()
+		return false, wait
+	}
+
+	b.tokens--
+
+	l.mutex.Unlock()
+	return true, 0
+}
+
+// Returns a handler answering requests with 429 once their client exceeds
+// `e.RateLimit`. Clients are identified by their address (see
+// `e.TrustProxy`) and their token if they sent one. Tokens alone aren't
+// used as anybody can send any token, including one belonging to somebody
+// else whose bucket would then be used up.
+func (e *ApiState) rateLimited(next http.Handler) http.Handler {
+	l := newRateLimiter(e.RateLimit)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := getToken(r)
+		key := "ip:" + e.clientIP(r).String()
+
+		if token != "" {
+			// Only hashes of tokens are kept.
+			key += " token:" + hashToken(token)
+		}
+
+		ok, wait := l.allow(key)
+
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			e.writeError(w, r, "ErrTooManyRequests: You made too many requests, try again later.", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
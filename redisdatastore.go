@@ -0,0 +1,1394 @@
+package jogdb
+
+import "context"
+import "sync"
+import "sort"
+import "strings"
+import "strconv"
+import "bytes"
+import "time"
+import "io"
+import "io/ioutil"
+import "encoding/json"
+import "github.com/go-redis/redis/v8"
+import "github.com/FMNSSun/rndstring"
+
+// Prefix of all keys written by RedisDataStore. Documents are stored at
+// `jogdb:<ns>:<doc>`. Everything else is stored below `jogdb::` which no
+// document key starts with as namespaces can't be empty.
+const redisPrefix = "jogdb:"
+
+// A DataStore keeping documents, permissions, admins and counters in Redis
+// so several jogdb instances can share them. Documents are strings, their
+// TTL is the TTL of the key. Permissions are hashes of token (hashes) to
+// permission bits, one per document or prefix grant. The root token is
+// kept in memory and thus not shared.
+//
+// Namespace names can't contain ':' and neither namespace nor document
+// names can be empty. Using them anyway results in ErrInvalidName.
+//
+// Writes that have to read the document first (Prepend, ReplaceInDoc,
+// CompareAndPut, MergeJSON and Modify) use optimistic transactions. Keeping the
+// TTL of documents in those requires Redis 6.0 or later.
+type RedisDataStore struct {
+	client redis.UniversalClient
+	ctx context.Context
+	mutex *sync.Mutex
+	auth *authState
+	nameGenerator rndstring.StringGenerator
+}
+
+func NewRedisDataStore(client redis.UniversalClient, rootToken string) *RedisDataStore {
+	return &RedisDataStore {
+		client: client,
+		ctx: context.Background(),
+		mutex: &sync.Mutex{},
+		auth: newHashedAuthState(rootToken),
+		nameGenerator: newNameGenerator(),
+	}
+}
+
+func validRedisNs(ns string) bool {
+	return ns != "" && !strings.Contains(ns, ":")
+}
+
+func redisDocKey(ns, doc string) (string, error) {
+	if !validRedisNs(ns) || doc == "" {
+		return "", ErrInvalidName
+	}
+
+	return redisPrefix + ns + ":" + doc, nil
+}
+
+func redisMetaKey(parts ...string) string {
+	return redisPrefix + ":" + strings.Join(parts, ":")
+}
+
+// Sorted set of the documents of the namespace scored by their
+// modification time in milliseconds. May contain expired documents.
+func redisDocsKey(ns string) string {
+	return redisMetaKey("docs", ns)
+}
+
+// JSON encoded metadata of a document, only exists if it's not empty. Has
+// the same TTL as the document.
+func redisDocMetaKey(ns, doc string) string {
+	return redisMetaKey("docmeta", ns, doc)
+}
+
+// Set of the namespaces that have (or had) documents.
+var redisNamespacesKey = redisMetaKey("namespaces")
+
+// Hash of the permission bits by token for a document or prefix grant.
+func redisPermsKey(ns, doc string) string {
+	return redisMetaKey("perms", ns, doc)
+}
+
+// Set of the documents and prefix grants of the namespace that have (or
+// had) permissions.
+func redisPermDocsKey(ns string) string {
+	return redisMetaKey("permdocs", ns)
+}
+
+// Set of the namespaces that have (or had) permissions or namespace admins.
+var redisPermNamespacesKey = redisMetaKey("permnamespaces")
+
+func redisNsAdminsKey(ns string) string {
+	return redisMetaKey("nsadmins", ns)
+}
+
+var redisAdminsKey = redisMetaKey("admins")
+
+func redisCountersKey(ns string) string {
+	return redisMetaKey("counters", ns)
+}
+
+// Pipelines report redis.Nil if any of their commands found nothing, that
+// is checked per command.
+func ignoreNil(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+
+	return err
+}
+
+// Adds the document to the index of its namespace with the current time
+// as modification time.
+func (ds *RedisDataStore) touch(pipe redis.Pipeliner, ns, doc string) {
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+
+	pipe.ZAdd(ds.ctx, redisDocsKey(ns), &redis.Z{ Score: float64(ms), Member: doc })
+	pipe.SAdd(ds.ctx, redisNamespacesKey, ns)
+}
+
+// Stores the metadata of the document with the given TTL or removes it if
+// it's empty.
+func (ds *RedisDataStore) setMeta(pipe redis.Pipeliner, ns, doc string, meta DocMeta, ttl time.Duration) error {
+	if meta == (DocMeta{}) {
+		pipe.Del(ds.ctx, redisDocMetaKey(ns, doc))
+		return nil
+	}
+
+	b, err := json.Marshal(meta)
+
+	if err != nil {
+		return err
+	}
+
+	pipe.Set(ds.ctx, redisDocMetaKey(ns, doc), b, ttl)
+	return nil
+}
+
+// Applies `f` to the current value of the document and stores what it
+// returns if it returns true. The value is read in an optimistic
+// transaction which is retried if the document changes concurrently. The
+// TTL and metadata of the document are kept if `keepTTL` is set and removed
+// otherwise.
+func (ds *RedisDataStore) update(ns, doc string, keepTTL bool, f func(cur []byte, exists bool) ([]byte, bool, error)) error {
+	key, err := redisDocKey(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	expiration := time.Duration(0)
+
+	if keepTTL {
+		expiration = redis.KeepTTL
+	}
+
+	for {
+		err = ds.client.Watch(ds.ctx, func(tx *redis.Tx) error {
+			cur, err := tx.Get(ds.ctx, key).Bytes()
+
+			if ignoreNil(err) != nil {
+				return err
+			}
+
+			v, write, err := f(cur, err == nil)
+
+			if err != nil || !write {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ds.ctx, key, v, expiration)
+
+				if !keepTTL {
+					pipe.Del(ds.ctx, redisDocMetaKey(ns, doc))
+				}
+
+				ds.touch(pipe, ns, doc)
+				return nil
+			})
+
+			return err
+		}, key)
+
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+}
+
+func (ds *RedisDataStore) Get(ns, doc string) ([]byte, error) {
+	key, err := redisDocKey(ns, doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := ds.client.Get(ds.ctx, key).Bytes()
+
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	return v, err
+}
+
+func (ds *RedisDataStore) Size(ns, doc string) (int64, bool, error) {
+	key, err := redisDocKey(ns, doc)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	var exists, size *redis.IntCmd
+
+	_, err = ds.client.Pipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Exists(ds.ctx, key)
+		size = pipe.StrLen(ds.ctx, key)
+		return nil
+	})
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return size.Val(), exists.Val() > 0, nil
+}
+
+// The size is checked before reading the range so a concurrent write may
+// shorten the returned range.
+func (ds *RedisDataStore) GetRange(ns, doc string, off, length int64) ([]byte, error) {
+	size, exists, err := ds.Size(ns, doc)
+
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	length, err = clampRange(size, off, length)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// GETRANGE can't return nothing, its end is inclusive.
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	key, _ := redisDocKey(ns, doc)
+
+	return ds.client.GetRange(ds.ctx, key, off, off + length - 1).Bytes()
+}
+
+func (ds *RedisDataStore) Put(ns, doc string, v []byte) error {
+	return ds.PutWithTTL(ns, doc, v, 0)
+}
+
+func (ds *RedisDataStore) PutStream(ns, doc string, r io.Reader) error {
+	v, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	return ds.Put(ns, doc, v)
+}
+
+func (ds *RedisDataStore) PutWithTTL(ns, doc string, v []byte, ttl time.Duration) error {
+	return ds.PutWithMeta(ns, doc, v, DocMeta{}, ttl)
+}
+
+func (ds *RedisDataStore) PutWithMeta(ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error {
+	key, err := redisDocKey(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	// Negative expirations have special meanings to the client and
+	// Redis only has millisecond precision.
+	if ttl < 0 {
+		ttl = 0
+	} else if ttl > 0 && ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+
+	_, err = ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ds.ctx, key, v, ttl)
+		ds.touch(pipe, ns, doc)
+		return ds.setMeta(pipe, ns, doc, meta, ttl)
+	})
+
+	return err
+}
+
+func (ds *RedisDataStore) GetMeta(ns, doc string) (DocMeta, error) {
+	var meta DocMeta
+
+	if _, err := redisDocKey(ns, doc); err != nil {
+		return meta, err
+	}
+
+	b, err := ds.client.Get(ds.ctx, redisDocMetaKey(ns, doc)).Bytes()
+
+	if err == redis.Nil {
+		return meta, nil
+	}
+
+	if err != nil {
+		return meta, err
+	}
+
+	return meta, json.Unmarshal(b, &meta)
+}
+
+func (ds *RedisDataStore) PutBatch(ns string, docs map[string][]byte) error {
+	keys := make(map[string]string)
+
+	for doc := range docs {
+		key, err := redisDocKey(ns, doc)
+
+		if err != nil {
+			return err
+		}
+
+		keys[doc] = key
+	}
+
+	_, err := ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		for doc, v := range docs {
+			pipe.Set(ds.ctx, keys[doc], v, 0)
+			pipe.Del(ds.ctx, redisDocMetaKey(ns, doc))
+			ds.touch(pipe, ns, doc)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (ds *RedisDataStore) CompareAndPut(ns, doc string, expected, v []byte) (bool, error) {
+	var swapped bool
+
+	err := ds.update(ns, doc, false, func(cur []byte, exists bool) ([]byte, bool, error) {
+		if expected == nil {
+			swapped = !exists
+		} else {
+			swapped = exists && bytes.Equal(cur, expected)
+		}
+
+		return v, swapped, nil
+	})
+
+	return swapped, err
+}
+
+func (ds *RedisDataStore) Append(ns, doc string, delim, v []byte) error {
+	key, err := redisDocKey(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Append(ds.ctx, key, string(v) + string(delim))
+		ds.touch(pipe, ns, doc)
+		return nil
+	})
+
+	return err
+}
+
+func (ds *RedisDataStore) Prepend(ns, doc string, delim, v []byte) error {
+	return ds.update(ns, doc, true, func(cur []byte, exists bool) ([]byte, bool, error) {
+		b := make([]byte, 0, len(v) + len(delim) + len(cur))
+		b = append(b, v...)
+		b = append(b, delim...)
+		b = append(b, cur...)
+
+		return b, true, nil
+	})
+}
+
+func (ds *RedisDataStore) AppendFrom(ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error) {
+	v, err := readLimited(r, limit)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(v)), ds.Append(ns, doc, delim, v)
+}
+
+func (ds *RedisDataStore) ReplaceInDoc(ns, doc string, old, new []byte, all bool) (int, error) {
+	if len(old) == 0 {
+		return 0, nil
+	}
+
+	var n int
+
+	err := ds.update(ns, doc, true, func(cur []byte, exists bool) ([]byte, bool, error) {
+		n = bytes.Count(cur, old)
+
+		if n == 0 {
+			return nil, false, nil
+		}
+
+		if !all {
+			n = 1
+		}
+
+		return bytes.Replace(cur, old, new, n), true, nil
+	})
+
+	return n, err
+}
+
+func (ds *RedisDataStore) MergeJSON(ns, doc string, patch []byte) ([]byte, error) {
+	return modifyJSON(ds, ns, doc, patch, mergeJSON)
+}
+
+func (ds *RedisDataStore) PatchJSON(ns, doc string, patch []byte) ([]byte, error) {
+	return modifyJSON(ds, ns, doc, patch, patchJSON)
+}
+
+// `fn` is called again if the document was changed concurrently.
+func (ds *RedisDataStore) Modify(ns, doc string, fn func(old []byte) ([]byte, error)) error {
+	return ds.update(ns, doc, true, func(cur []byte, exists bool) ([]byte, bool, error) {
+		if !exists {
+			cur = nil
+		}
+
+		v, err := fn(cur)
+		return v, v != nil, err
+	})
+}
+
+func (ds *RedisDataStore) Delete(ns, doc string) error {
+	key, err := redisDocKey(ns, doc)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ds.ctx, key, redisDocMetaKey(ns, doc))
+		pipe.ZRem(ds.ctx, redisDocsKey(ns), doc)
+		return nil
+	})
+
+	return err
+}
+
+func (ds *RedisDataStore) CreateUnique(ns, prefix string) (string, error) {
+	for i := 0; i < maxCreateUniqueAttempts; i++ {
+		doc := prefix + ds.nameGenerator.Generate()
+
+		key, err := redisDocKey(ns, doc)
+
+		if err != nil {
+			return "", err
+		}
+
+		created, err := ds.client.SetNX(ds.ctx, key, "", 0).Result()
+
+		if err != nil {
+			return "", err
+		}
+
+		if created {
+			_, err = ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+				ds.touch(pipe, ns, doc)
+				return nil
+			})
+
+			return doc, err
+		}
+	}
+
+	return "", ErrNoUniqueName
+}
+
+// Returns the documents of the namespace that haven't expired. Expired
+// documents are removed from the index unless they were written again in
+// the meantime.
+func (ds *RedisDataStore) docRefs(ns string) ([]DocRef, error) {
+	zs, err := ds.client.ZRangeWithScores(ds.ctx, redisDocsKey(ns), 0, -1).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make([]*redis.IntCmd, len(zs))
+
+	_, err = ds.client.Pipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		for i, z := range zs {
+			exists[i] = pipe.Exists(ds.ctx, redisPrefix + ns + ":" + z.Member.(string))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]DocRef, 0, len(zs))
+	stale := make([]string, 0)
+
+	for i, z := range zs {
+		doc := z.Member.(string)
+
+		if exists[i].Val() == 0 {
+			stale = append(stale, doc)
+			continue
+		}
+
+		refs = append(refs, DocRef{ Ns: ns, Doc: doc, ModTime: time.Unix(0, int64(z.Score) * int64(time.Millisecond)) })
+	}
+
+	if len(stale) > 0 {
+		ds.removeStale(ns, stale)
+	}
+
+	return refs, nil
+}
+
+// Removes documents from the index of the namespace if they still don't
+// exist. Failures are ignored, the next call tries again.
+func (ds *RedisDataStore) removeStale(ns string, docs []string) {
+	keys := make([]string, len(docs))
+	members := make([]interface{}, len(docs))
+
+	for i, doc := range docs {
+		keys[i] = redisPrefix + ns + ":" + doc
+		members[i] = doc
+	}
+
+	ds.client.Watch(ds.ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ds.ctx, keys...).Result()
+
+		if err != nil || n > 0 {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ds.ctx, redisDocsKey(ns), members...)
+			return nil
+		})
+
+		return err
+	}, keys...)
+}
+
+// Returns the documents of all namespaces that haven't expired by
+// namespace. Namespaces without documents are left out and removed from
+// the set of namespaces.
+func (ds *RedisDataStore) allDocRefs() (map[string][]DocRef, error) {
+	nss, err := ds.client.SMembers(ds.ctx, redisNamespacesKey).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string][]DocRef)
+
+	for _, ns := range nss {
+		refs, err := ds.docRefs(ns)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(refs) > 0 {
+			all[ns] = refs
+			continue
+		}
+
+		// Only removed if no document was added in the meantime.
+		ds.client.Watch(ds.ctx, func(tx *redis.Tx) error {
+			n, err := tx.ZCard(ds.ctx, redisDocsKey(ns)).Result()
+
+			if err != nil || n > 0 {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+				pipe.SRem(ds.ctx, redisNamespacesKey, ns)
+				return nil
+			})
+
+			return err
+		}, redisDocsKey(ns))
+	}
+
+	return all, nil
+}
+
+// Returns the sizes of the documents.
+func (ds *RedisDataStore) sizes(refs []DocRef) ([]int64, error) {
+	cmds := make([]*redis.IntCmd, len(refs))
+
+	_, err := ds.client.Pipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		for i, ref := range refs {
+			cmds[i] = pipe.StrLen(ds.ctx, redisPrefix + ref.Ns + ":" + ref.Doc)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make([]int64, len(refs))
+
+	for i, cmd := range cmds {
+		sizes[i] = cmd.Val()
+	}
+
+	return sizes, nil
+}
+
+func (ds *RedisDataStore) List(ns string) ([]string, error) {
+	if !validRedisNs(ns) {
+		return nil, ErrInvalidName
+	}
+
+	refs, err := ds.docRefs(ns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]string, len(refs))
+
+	for i, ref := range refs {
+		docs[i] = ref.Doc
+	}
+
+	sort.Strings(docs)
+	return docs, nil
+}
+
+func (ds *RedisDataStore) ListNamespaces() ([]string, error) {
+	all, err := ds.allDocRefs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(all))
+
+	for ns := range all {
+		names = append(names, ns)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ds *RedisDataStore) NamespaceStats(ns string) (NamespaceStats, error) {
+	var stats NamespaceStats
+
+	if !validRedisNs(ns) {
+		return stats, ErrInvalidName
+	}
+
+	refs, err := ds.docRefs(ns)
+
+	if err != nil {
+		return stats, err
+	}
+
+	sizes, err := ds.sizes(refs)
+
+	if err != nil {
+		return stats, err
+	}
+
+	admins, err := ds.client.SCard(ds.ctx, redisNsAdminsKey(ns)).Result()
+
+	if err != nil {
+		return stats, err
+	}
+
+	stats.DocCount = len(refs)
+
+	for _, size := range sizes {
+		stats.TotalBytes += size
+	}
+
+	stats.AdminCount = int(admins)
+
+	return stats, nil
+}
+
+func (ds *RedisDataStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+
+	all, err := ds.allDocRefs()
+
+	if err != nil {
+		return stats, err
+	}
+
+	for _, refs := range all {
+		sizes, err := ds.sizes(refs)
+
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Namespaces++
+		stats.Documents += len(refs)
+
+		for _, size := range sizes {
+			stats.TotalBytes += size
+		}
+	}
+
+	return stats, nil
+}
+
+// Reads the indexes of all namespaces, so this takes time proportional to
+// the number of documents in the store on every call.
+func (ds *RedisDataStore) RecentlyModified(n int) ([]DocRef, error) {
+	all, err := ds.allDocRefs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]DocRef, 0)
+
+	for _, nsRefs := range all {
+		refs = append(refs, nsRefs...)
+	}
+
+	return newestDocRefs(refs, n), nil
+}
+
+// Returns the permission bits of the token for the document and the rule
+// they come from like `authState.perms` does.
+func (ds *RedisDataStore) perms(token, ns, doc string) (uint8, string, error) {
+	if !validRedisNs(ns) {
+		return 0, RuleNone, ErrInvalidName
+	}
+
+	key := ds.auth.key(token)
+
+	var explicit *redis.StringCmd
+	var grants *redis.StringSliceCmd
+
+	_, err := ds.client.Pipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		explicit = pipe.HGet(ds.ctx, redisPermsKey(ns, doc), key)
+		grants = pipe.SMembers(ds.ctx, redisPermDocsKey(ns))
+		return nil
+	})
+
+	if ignoreNil(err) != nil {
+		return 0, RuleNone, err
+	}
+
+	if bits, err := explicit.Uint64(); err == nil {
+		return uint8(bits), RuleExplicit, nil
+	}
+
+	cmds := make(map[string]*redis.StringCmd)
+
+	_, err = ds.client.Pipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		for _, grant := range grants.Val() {
+			if isPrefixGrant(grant) && strings.HasPrefix(doc, grant[:len(grant) - 1]) {
+				cmds[grant] = pipe.HGet(ds.ctx, redisPermsKey(ns, grant), key)
+			}
+		}
+
+		return nil
+	})
+
+	if ignoreNil(err) != nil {
+		return 0, RuleNone, err
+	}
+
+	perms := uint8(0)
+	rule := RuleNone
+	longest := -1
+
+	for grant, cmd := range cmds {
+		if bits, err := cmd.Uint64(); err == nil && len(grant) > longest {
+			perms = uint8(bits)
+			rule = prefixGrantRule(grant)
+			longest = len(grant)
+		}
+	}
+
+	return perms, rule, nil
+}
+
+func (ds *RedisDataStore) can(token, ns, doc string, perm uint8) (bool, error) {
+	perms, _, err := ds.perms(token, ns, doc)
+
+	if err != nil {
+		return false, err
+	}
+
+	return (perms & perm) == perm, nil
+}
+
+func (ds *RedisDataStore) DumpPermissions(ns string) (map[string]map[string]Perm, error) {
+	if !validRedisNs(ns) {
+		return nil, ErrInvalidName
+	}
+
+	a, err := ds.loadAuth(false, ns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return a.dumpPermissions(ns), nil
+}
+
+func (ds *RedisDataStore) CanGet(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permGet)
+}
+
+func (ds *RedisDataStore) CanPut(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permPut)
+}
+
+func (ds *RedisDataStore) CanAppend(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permAppend)
+}
+
+func (ds *RedisDataStore) CanDelete(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permDelete)
+}
+
+func (ds *RedisDataStore) CanPrepend(token, ns, doc string) (bool, error) {
+	return ds.can(token, ns, doc, permPrepend)
+}
+
+func (ds *RedisDataStore) Explain(token, ns, doc string) (Explanation, error) {
+	tokenPerms, rule, err := ds.perms(token, ns, doc)
+
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	explain := func(perm uint8) PermExplanation {
+		return PermExplanation{ Allowed: (tokenPerms & perm) == perm, Rule: rule }
+	}
+
+	return explainAdmins(ds, token, ns, Explanation{
+		Get: explain(permGet),
+		Put: explain(permPut),
+		Append: explain(permAppend),
+		Delete: explain(permDelete),
+		Prepend: explain(permPrepend),
+	})
+}
+
+func (ds *RedisDataStore) SetToken(token, ns, doc string, get, put, app, del, pre bool) error {
+	if !validRedisNs(ns) || doc == "" {
+		return ErrInvalidName
+	}
+
+	key := ds.auth.key(token)
+	bits := updatePerms(0, get, put, app, del, pre)
+
+	_, err := ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		// Entries without permissions only deny something for
+		// documents, see authState.setTokenKey.
+		if bits == 0 && isPrefixGrant(doc) {
+			pipe.HDel(ds.ctx, redisPermsKey(ns, doc), key)
+			return nil
+		}
+
+		pipe.HSet(ds.ctx, redisPermsKey(ns, doc), key, int(bits))
+		pipe.SAdd(ds.ctx, redisPermDocsKey(ns), doc)
+		pipe.SAdd(ds.ctx, redisPermNamespacesKey, ns)
+		return nil
+	})
+
+	return err
+}
+
+func (ds *RedisDataStore) GetToken(token, ns, doc string) (get, put, app, del, pre bool, err error) {
+	if !validRedisNs(ns) {
+		return false, false, false, false, false, ErrInvalidName
+	}
+
+	bits, err := ds.client.HGet(ds.ctx, redisPermsKey(ns, doc), ds.auth.key(token)).Uint64()
+
+	if err == redis.Nil {
+		return false, false, false, false, false, nil
+	}
+
+	if err != nil {
+		return false, false, false, false, false, err
+	}
+
+	perms := uint8(bits)
+
+	return perms & permGet != 0, perms & permPut != 0, perms & permAppend != 0, perms & permDelete != 0, perms & permPrepend != 0, nil
+}
+
+func (ds *RedisDataStore) RevokeToken(token, ns string) error {
+	if !validRedisNs(ns) {
+		return ErrInvalidName
+	}
+
+	key := ds.auth.key(token)
+
+	docs, err := ds.client.SMembers(ds.ctx, redisPermDocsKey(ns)).Result()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		for _, doc := range docs {
+			pipe.HDel(ds.ctx, redisPermsKey(ns, doc), key)
+		}
+
+		pipe.SRem(ds.ctx, redisNsAdminsKey(ns), key)
+		return nil
+	})
+
+	return err
+}
+
+func (ds *RedisDataStore) IsNamespaceAdmin(token, ns string) (bool, error) {
+	is, err := ds.IsRoot(token)
+
+	if err != nil || is {
+		return is, err
+	}
+
+	is, err = ds.IsAdmin(token)
+
+	if err != nil || is {
+		return is, err
+	}
+
+	return ds.client.SIsMember(ds.ctx, redisNsAdminsKey(ns), ds.auth.key(token)).Result()
+}
+
+func (ds *RedisDataStore) IsAdmin(token string) (bool, error) {
+	return ds.client.SIsMember(ds.ctx, redisAdminsKey, ds.auth.key(token)).Result()
+}
+
+func (ds *RedisDataStore) SetNamespaceAdmin(token, ns string, is bool) error {
+	if !validRedisNs(ns) {
+		return ErrInvalidName
+	}
+
+	key := ds.auth.key(token)
+
+	_, err := ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		if !is {
+			pipe.SRem(ds.ctx, redisNsAdminsKey(ns), key)
+			return nil
+		}
+
+		pipe.SAdd(ds.ctx, redisNsAdminsKey(ns), key)
+		pipe.SAdd(ds.ctx, redisPermNamespacesKey, ns)
+		return nil
+	})
+
+	return err
+}
+
+func (ds *RedisDataStore) SetAdmin(token string, is bool) error {
+	key := ds.auth.key(token)
+
+	if is {
+		return ds.client.SAdd(ds.ctx, redisAdminsKey, key).Err()
+	}
+
+	return ds.client.SRem(ds.ctx, redisAdminsKey, key).Err()
+}
+
+func (ds *RedisDataStore) IsRoot(token string) (bool, error) {
+	ds.mutex.Lock()
+
+	is := ds.auth.isRoot(token)
+
+	ds.mutex.Unlock()
+	return is, nil
+}
+
+// The new root token only applies to this RedisDataStore, other instances
+// sharing the Redis keep theirs.
+func (ds *RedisDataStore) RotateRootToken(oldToken, newToken string) error {
+	ds.mutex.Lock()
+
+	ok := ds.auth.rotateRoot(oldToken, newToken)
+
+	ds.mutex.Unlock()
+
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	return nil
+}
+
+func (ds *RedisDataStore) Ping() error {
+	return ds.client.Ping(ds.ctx).Err()
+}
+
+// Reads the permissions and namespace admins of the namespaces (and the
+// admins if `admins` is set) into an authState.
+func (ds *RedisDataStore) loadAuth(admins bool, nss ...string) (*authState, error) {
+	a := newHashedAuthState("")
+
+	docCmds := make(map[string]*redis.StringSliceCmd)
+	adminCmds := make(map[string]*redis.StringSliceCmd)
+	var adminsCmd *redis.StringSliceCmd
+
+	_, err := ds.client.Pipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		for _, ns := range nss {
+			docCmds[ns] = pipe.SMembers(ds.ctx, redisPermDocsKey(ns))
+			adminCmds[ns] = pipe.SMembers(ds.ctx, redisNsAdminsKey(ns))
+		}
+
+		if admins {
+			adminsCmd = pipe.SMembers(ds.ctx, redisAdminsKey)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	permCmds := make(map[string]map[string]*redis.StringStringMapCmd)
+
+	_, err = ds.client.Pipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		for ns, cmd := range docCmds {
+			permCmds[ns] = make(map[string]*redis.StringStringMapCmd)
+
+			for _, doc := range cmd.Val() {
+				permCmds[ns][doc] = pipe.HGetAll(ds.ctx, redisPermsKey(ns, doc))
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for ns, docs := range permCmds {
+		for doc, cmd := range docs {
+			for key, v := range cmd.Val() {
+				bits, err := strconv.ParseUint(v, 10, 8)
+
+				if err != nil {
+					return nil, err
+				}
+
+				nsV := a.Perms[ns]
+
+				if nsV == nil {
+					nsV = make(map[string]kvPerms)
+					a.Perms[ns] = nsV
+				}
+
+				if nsV[doc] == nil {
+					nsV[doc] = make(kvPerms)
+				}
+
+				nsV[doc][key] = uint8(bits)
+			}
+		}
+	}
+
+	for ns, cmd := range adminCmds {
+		for _, key := range cmd.Val() {
+			a.setNamespaceAdminKey(key, ns, true)
+		}
+	}
+
+	if admins {
+		for _, key := range adminsCmd.Val() {
+			a.Admins[key] = true
+		}
+	}
+
+	return a, nil
+}
+
+// Adds the permissions, namespace admins and admins of the authState.
+func (ds *RedisDataStore) writeAuth(pipe redis.Pipeliner, a *authState) {
+	for ns, nsV := range a.Perms {
+		for doc, docV := range nsV {
+			for key, bits := range docV {
+				pipe.HSet(ds.ctx, redisPermsKey(ns, doc), key, int(bits))
+			}
+
+			pipe.SAdd(ds.ctx, redisPermDocsKey(ns), doc)
+		}
+
+		pipe.SAdd(ds.ctx, redisPermNamespacesKey, ns)
+	}
+
+	for ns, nsV := range a.NsAdmins {
+		for key := range nsV {
+			pipe.SAdd(ds.ctx, redisNsAdminsKey(ns), key)
+		}
+
+		pipe.SAdd(ds.ctx, redisPermNamespacesKey, ns)
+	}
+
+	for key := range a.Admins {
+		pipe.SAdd(ds.ctx, redisAdminsKey, key)
+	}
+}
+
+func (ds *RedisDataStore) ListAccessibleDocs(token, ns string) ([]string, error) {
+	if !validRedisNs(ns) {
+		return nil, ErrInvalidName
+	}
+
+	docs, admin, err := listForAccessCheck(ds, token, ns)
+
+	if err != nil || admin {
+		return docs, err
+	}
+
+	a, err := ds.loadAuth(false, ns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return a.accessibleDocs(token, ns, docs), nil
+}
+
+func (ds *RedisDataStore) ExportNamespace(ns string, w io.Writer) error {
+	if !validRedisNs(ns) {
+		return ErrInvalidName
+	}
+
+	snap := &namespaceSnapshot{ Namespace: ns, Documents: make(map[string][]byte) }
+
+	refs, err := ds.docRefs(ns)
+
+	if err != nil {
+		return err
+	}
+
+	if len(refs) > 0 {
+		keys := make([]string, len(refs))
+
+		for i, ref := range refs {
+			keys[i] = redisPrefix + ns + ":" + ref.Doc
+		}
+
+		vs, err := ds.client.MGet(ds.ctx, keys...).Result()
+
+		if err != nil {
+			return err
+		}
+
+		for i, v := range vs {
+			// Documents may have expired after listing them.
+			if s, ok := v.(string); ok {
+				snap.Documents[refs[i].Doc] = []byte(s)
+			}
+		}
+
+		for i, ref := range refs {
+			keys[i] = redisDocMetaKey(ns, ref.Doc)
+		}
+
+		vs, err = ds.client.MGet(ds.ctx, keys...).Result()
+
+		if err != nil {
+			return err
+		}
+
+		for i, v := range vs {
+			s, ok := v.(string)
+
+			if !ok {
+				continue
+			}
+
+			var meta DocMeta
+
+			err = json.Unmarshal([]byte(s), &meta)
+
+			if err != nil {
+				return err
+			}
+
+			if _, exists := snap.Documents[refs[i].Doc]; exists {
+				snap.setMeta(refs[i].Doc, meta)
+			}
+		}
+	}
+
+	a, err := ds.loadAuth(false, ns)
+
+	if err != nil {
+		return err
+	}
+
+	a.snapshot(ns, snap)
+
+	return writeSnapshot(w, snap)
+}
+
+func (ds *RedisDataStore) ImportNamespace(ns string, r io.Reader) error {
+	snap, err := readSnapshot(r)
+
+	if err != nil {
+		return err
+	}
+
+	if !ds.auth.canRestore(snap) {
+		return ErrInvalidSnapshot
+	}
+
+	if !validRedisNs(ns) {
+		return ErrInvalidName
+	}
+
+	keys := make(map[string]string)
+
+	for doc := range snap.Documents {
+		key, err := redisDocKey(ns, doc)
+
+		if err != nil {
+			return err
+		}
+
+		keys[doc] = key
+	}
+
+	// Only the entries of the snapshot are written.
+	a := newHashedAuthState("")
+	a.restore(ns, snap)
+
+	_, err = ds.client.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+		for doc, v := range snap.Documents {
+			pipe.Set(ds.ctx, keys[doc], v, 0)
+			ds.touch(pipe, ns, doc)
+
+			err := ds.setMeta(pipe, ns, doc, snap.Meta[doc], 0)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		ds.writeAuth(pipe, a)
+		return nil
+	})
+
+	return err
+}
+
+func (ds *RedisDataStore) ExportPolicy(w io.Writer) error {
+	nss, err := ds.client.SMembers(ds.ctx, redisPermNamespacesKey).Result()
+
+	if err != nil {
+		return err
+	}
+
+	a, err := ds.loadAuth(true, nss...)
+
+	if err != nil {
+		return err
+	}
+
+	p := newPolicy(true)
+	a.exportPolicy(p, true)
+
+	return writePolicy(w, p)
+}
+
+// The old permissions are removed and the new ones written in a single
+// transaction which is retried if permissions of new documents or
+// namespaces are set concurrently.
+func (ds *RedisDataStore) ImportPolicy(r io.Reader) error {
+	p, err := readPolicy(r)
+
+	if err != nil {
+		return err
+	}
+
+	if !ds.auth.canImportPolicy(p) {
+		return ErrInvalidPolicy
+	}
+
+	for _, g := range p.Grants {
+		if !validRedisNs(g.Ns) {
+			return ErrInvalidPolicy
+		}
+	}
+
+	for ns := range p.NamespaceAdmins {
+		if !validRedisNs(ns) {
+			return ErrInvalidPolicy
+		}
+	}
+
+	a := newHashedAuthState("")
+	a.importPolicy(p, func(string) bool { return true }, true)
+
+	for {
+		err = ds.client.Watch(ds.ctx, func(tx *redis.Tx) error {
+			nss, err := tx.SMembers(ds.ctx, redisPermNamespacesKey).Result()
+
+			if err != nil {
+				return err
+			}
+
+			old := []string{ redisPermNamespacesKey, redisAdminsKey }
+			docsKeys := make([]string, len(nss))
+
+			for i, ns := range nss {
+				docsKeys[i] = redisPermDocsKey(ns)
+				old = append(old, redisPermDocsKey(ns), redisNsAdminsKey(ns))
+			}
+
+			if len(docsKeys) > 0 {
+				err = tx.Watch(ds.ctx, docsKeys...).Err()
+
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, ns := range nss {
+				docs, err := tx.SMembers(ds.ctx, redisPermDocsKey(ns)).Result()
+
+				if err != nil {
+					return err
+				}
+
+				for _, doc := range docs {
+					old = append(old, redisPermsKey(ns, doc))
+				}
+			}
+
+			_, err = tx.TxPipelined(ds.ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ds.ctx, old...)
+				ds.writeAuth(pipe, a)
+				return nil
+			})
+
+			return err
+		}, redisPermNamespacesKey)
+
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+}
+
+func (ds *RedisDataStore) IncrCounter(ns, name string, delta int64) (int64, error) {
+	if !validRedisNs(ns) {
+		return 0, ErrInvalidName
+	}
+
+	return ds.client.HIncrBy(ds.ctx, redisCountersKey(ns), name, delta).Result()
+}
+
+func (ds *RedisDataStore) GetCounter(ns, name string) (int64, error) {
+	if !validRedisNs(ns) {
+		return 0, ErrInvalidName
+	}
+
+	v, err := ds.client.HGet(ds.ctx, redisCountersKey(ns), name).Int64()
+
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return v, err
+}
@@ -0,0 +1,114 @@
+package jogdb
+
+import "testing"
+import "time"
+import "github.com/alicebob/miniredis/v2"
+import "github.com/go-redis/redis/v8"
+
+// Returns a RedisDataStore backed by a miniredis server that is stopped
+// when the test ends.
+func newTestRedisDataStore(t *testing.T) (*RedisDataStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{ Addr: mr.Addr() })
+
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	return NewRedisDataStore(client, testRootToken), mr
+}
+
+func TestRedisDataStore(t *testing.T) {
+	ds, mr := newTestRedisDataStore(t)
+
+	expectNoDoc(t, ds, "ns", "a")
+
+	if err := ds.Put("ns", "a", []byte("two\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.Append("ns", "a", []byte("\n"), []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.Prepend("ns", "a", []byte("\n"), []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectDoc(t, ds, "ns", "a", "one\ntwo\nthree\n")
+
+	// Appending creates the document.
+	ds.Append("ns", "b", []byte(","), []byte("x"))
+	expectDoc(t, ds, "ns", "b", "x,")
+
+	docs, err := ds.List("ns")
+
+	if err != nil || len(docs) != 2 || docs[0] != "a" || docs[1] != "b" {
+		t.Fatalf("Unexpected documents %v: %v", docs, err)
+	}
+
+	ds.Delete("ns", "b")
+	expectNoDoc(t, ds, "ns", "b")
+
+	// Documents expire with their key.
+	ds.PutWithTTL("ns", "c", []byte("soon"), time.Minute)
+	expectDoc(t, ds, "ns", "c", "soon")
+
+	mr.FastForward(2 * time.Minute)
+	expectNoDoc(t, ds, "ns", "c")
+
+	if err := ds.Put("bad:ns", "a", []byte("x")); err != ErrInvalidName {
+		t.Fatalf("Expected ErrInvalidName but got %v.", err)
+	}
+}
+
+func TestRedisDataStorePerms(t *testing.T) {
+	ds, _ := newTestRedisDataStore(t)
+
+	ds.SetToken("tok", "ns", "a", true, false, true, false, false)
+	ds.SetToken("tok", "ns", "logs/*", true, false, false, false, false)
+	ds.SetNamespaceAdmin("nsadmin", "ns", true)
+	ds.SetAdmin("admin", true)
+
+	for _, tc := range []struct {
+		doc string
+		can func(token, ns, doc string) (bool, error)
+		expected bool
+	} {
+		{ "a", ds.CanGet, true },
+		{ "a", ds.CanAppend, true },
+		{ "a", ds.CanPut, false },
+		{ "a", ds.CanPrepend, false },
+		{ "logs/x", ds.CanGet, true },
+		{ "logs/x", ds.CanAppend, false },
+		{ "b", ds.CanGet, false },
+	} {
+		if ok, err := tc.can("tok", "ns", tc.doc); err != nil || ok != tc.expected {
+			t.Fatalf("%s: Expected %v but got %v: %v", tc.doc, tc.expected, ok, err)
+		}
+	}
+
+	if get, put, app, del, pre, err := ds.GetToken("tok", "ns", "a"); err != nil || !get || put || !app || del || pre {
+		t.Fatalf("Unexpected permissions: %v", err)
+	}
+
+	if ok, err := ds.IsNamespaceAdmin("nsadmin", "ns"); err != nil || !ok {
+		t.Fatalf("Expected a namespace admin: %v, %v", ok, err)
+	}
+
+	if ok, err := ds.IsAdmin("admin"); err != nil || !ok {
+		t.Fatalf("Expected an admin: %v, %v", ok, err)
+	}
+
+	if ok, err := ds.IsRoot(testRootToken); err != nil || !ok {
+		t.Fatalf("Expected the root token: %v, %v", ok, err)
+	}
+
+	if err := ds.RevokeToken("tok", "ns"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := ds.CanGet("tok", "ns", "logs/x"); ok {
+		t.Fatal("Expected no access after revoking.")
+	}
+}
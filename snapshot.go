@@ -0,0 +1,115 @@
+package jogdb
+
+import "encoding/json"
+import "errors"
+import "io"
+
+// Version of the namespace snapshot format written by `ExportNamespace`.
+const snapshotVersion = 1
+
+// This is returned by `ImportNamespace` if the snapshot can't be read or
+// has an unsupported version.
+var ErrInvalidSnapshot = errors.New("Invalid snapshot!")
+
+// A namespace as serialized by `ExportNamespace`. Documents are base64
+// encoded in the JSON. `Meta` only has entries for documents with
+// metadata. Permissions are the permission bits by document
+// and token. If `HashedTokens` is set the snapshot contains hashes of
+// tokens instead of tokens and can't be imported into a DataStore that
+// keeps tokens.
+type namespaceSnapshot struct {
+	Version int
+	Namespace string
+	Documents map[string][]byte
+	Meta map[string]DocMeta `json:",omitempty"`
+	Perms map[string]kvPerms
+	Admins []string
+	HashedTokens bool
+}
+
+// Records the metadata of the document unless it's empty.
+func (snap *namespaceSnapshot) setMeta(doc string, meta DocMeta) {
+	if meta == (DocMeta{}) {
+		return
+	}
+
+	if snap.Meta == nil {
+		snap.Meta = make(map[string]DocMeta)
+	}
+
+	snap.Meta[doc] = meta
+}
+
+func writeSnapshot(w io.Writer, snap *namespaceSnapshot) error {
+	snap.Version = snapshotVersion
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+func readSnapshot(r io.Reader) (*namespaceSnapshot, error) {
+	var snap namespaceSnapshot
+
+	err := json.NewDecoder(r).Decode(&snap)
+
+	if err != nil || snap.Version != snapshotVersion {
+		return nil, ErrInvalidSnapshot
+	}
+
+	return &snap, nil
+}
+
+// Version of the store snapshot format written by `Snapshot`.
+const storeSnapshotVersion = 1
+
+// A whole store as serialized by `Snapshot`. The namespaces only use
+// `Documents`, `Meta`, `Perms` and `Admins`. Expiry times and counters are by
+// namespace and document or counter name. If `HashedTokens` is set the
+// snapshot contains hashes of tokens instead of tokens.
+type storeSnapshot struct {
+	Version int
+	HashedTokens bool
+	Namespaces map[string]*namespaceSnapshot
+	Expiry expiryTable
+	Counters map[string]kvInt64
+	Admins []string
+}
+
+func newStoreSnapshot(hashed bool) *storeSnapshot {
+	return &storeSnapshot {
+		HashedTokens: hashed,
+		Namespaces: make(map[string]*namespaceSnapshot),
+		Expiry: make(expiryTable),
+		Counters: make(map[string]kvInt64),
+		Admins: make([]string, 0),
+	}
+}
+
+// Returns the namespace, adding it if it's not in the snapshot yet.
+func (snap *storeSnapshot) namespace(ns string) *namespaceSnapshot {
+	nsSnap := snap.Namespaces[ns]
+
+	if nsSnap == nil {
+		nsSnap = &namespaceSnapshot{ Namespace: ns, Documents: make(map[string][]byte) }
+		snap.Namespaces[ns] = nsSnap
+	}
+
+	return nsSnap
+}
+
+func writeStoreSnapshot(w io.Writer, snap *storeSnapshot) error {
+	snap.Version = storeSnapshotVersion
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+func readStoreSnapshot(r io.Reader) (*storeSnapshot, error) {
+	var snap storeSnapshot
+
+	err := json.NewDecoder(r).Decode(&snap)
+
+	if err != nil || snap.Version != storeSnapshotVersion {
+		return nil, ErrInvalidSnapshot
+	}
+
+	return &snap, nil
+}
@@ -0,0 +1,91 @@
+package jogdb
+
+import "github.com/gorilla/mux"
+import "net"
+import "net/http"
+import "fmt"
+import "log"
+import "time"
+
+// Prefix of all metric names sent to statsd.
+const statsdPrefix = "jogdb."
+
+// Sends metrics to a statsd server over UDP. Sending is fire and forget,
+// lost packets or an unreachable server are silently ignored.
+type statsdClient struct {
+	conn net.Conn
+}
+
+func newStatsdClient(addr string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdClient{ conn: conn }, nil
+}
+
+func (c *statsdClient) send(name, value, kind string) {
+	fmt.Fprintf(c.conn, "%s%s:%s|%s", statsdPrefix, name, value, kind)
+}
+
+// Increments the counter `name` by `n`.
+func (c *statsdClient) count(name string, n int64) {
+	c.send(name, fmt.Sprintf("%d", n), "c")
+}
+
+// Records a duration for the timer `name`.
+func (c *statsdClient) timing(name string, d time.Duration) {
+	c.send(name, fmt.Sprintf("%d", d / time.Millisecond), "ms")
+}
+
+// Remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Returns a mux middleware counting requests by route and status code as
+// `requests.<route>.<status>` and timing them as `requests.<route>`. Each
+// route performs one datastore operation so this covers those as well.
+func statsdMiddleware(c *statsdClient) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := "unknown"
+
+			if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+				name = route.GetName()
+			}
+
+			rec := &statusRecorder{ ResponseWriter: w, status: http.StatusOK }
+			start := time.Now()
+
+			next.ServeHTTP(rec, r)
+
+			c.timing("requests." + name, time.Since(start))
+			c.count(fmt.Sprintf("requests.%s.%d", name, rec.status), 1)
+		})
+	}
+}
+
+// Adds the statsd middleware to the router if `e.StatsdAddr` is set.
+func (e *ApiState) useStatsd(r *mux.Router) {
+	if e.StatsdAddr == "" {
+		return
+	}
+
+	c, err := newStatsdClient(e.StatsdAddr)
+
+	if err != nil {
+		log.Printf("Statsd: Disabled, can't use %q: %v", e.StatsdAddr, err.Error())
+		return
+	}
+
+	r.Use(statsdMiddleware(c))
+}
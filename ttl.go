@@ -0,0 +1,85 @@
+package jogdb
+
+import "sync"
+import "time"
+
+// How often DataStores sweep documents whose TTL has passed.
+const janitorInterval = time.Minute
+
+// Expiry times of documents by namespace and document name.
+type expiryTable map[string]map[string]time.Time
+
+func (t expiryTable) set(ns, doc string, at time.Time) {
+	nsV := t[ns]
+
+	if nsV == nil {
+		nsV = make(map[string]time.Time)
+		t[ns] = nsV
+	}
+
+	nsV[doc] = at
+}
+
+func (t expiryTable) clear(ns, doc string) {
+	nsV := t[ns]
+
+	if nsV == nil {
+		return
+	}
+
+	delete(nsV, doc)
+
+	if len(nsV) == 0 {
+		delete(t, ns)
+	}
+}
+
+// Returns true if the document has an expiry time and it has passed.
+func (t expiryTable) expired(ns, doc string, now time.Time) bool {
+	at, exists := t[ns][doc]
+
+	return exists && !now.Before(at)
+}
+
+// Returns the names of all expired documents by namespace.
+func (t expiryTable) expiredDocs(now time.Time) map[string][]string {
+	docs := make(map[string][]string)
+
+	for ns, nsV := range t {
+		for doc, at := range nsV {
+			if !now.Before(at) {
+				docs[ns] = append(docs[ns], doc)
+			}
+		}
+	}
+
+	return docs
+}
+
+// Calls `sweep` every `interval` until the returned function is called
+// (or for as long as the process runs).
+func runJanitor(interval time.Duration, sweep func()) func() {
+	stop := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+
+		for {
+			select {
+			case <-ticker.C:
+				sweep()
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			close(stop)
+		})
+	}
+}
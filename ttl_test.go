@@ -0,0 +1,81 @@
+package jogdb
+
+import "testing"
+import "os"
+import "path/filepath"
+import "time"
+
+func TestTTLExpiry(t *testing.T) {
+	ds := NewMemDataStore(testRootToken)
+
+	ds.PutWithTTL("ns", "a", []byte("a"), 20 * time.Millisecond)
+	ds.PutWithTTL("ns", "b", []byte("b"), 20 * time.Millisecond)
+	ds.PutWithTTL("ns", "c", []byte("c"), time.Hour)
+	// A plain put clears the expiry.
+	ds.PutWithTTL("ns", "d", []byte("d"), 20 * time.Millisecond)
+	ds.Put("ns", "d", []byte("d"))
+
+	expectDoc(t, ds, "ns", "a", "a")
+
+	time.Sleep(30 * time.Millisecond)
+
+	// Reads don't return expired documents before the janitor ran.
+	expectNoDoc(t, ds, "ns", "a")
+	expectDoc(t, ds, "ns", "c", "c")
+	expectDoc(t, ds, "ns", "d", "d")
+
+	// The janitor removes expired documents nobody read.
+	ds.sweep()
+
+	s := ds.shard("ns")
+
+	s.mutex.RLock()
+	_, exists := s.storage["ns"]["b"]
+	s.mutex.RUnlock()
+
+	if exists {
+		t.Fatal("Expected the sweep to remove the expired document.")
+	}
+}
+
+func TestFileDataStoreTTLExpiry(t *testing.T) {
+	dir := t.TempDir()
+
+	ds, err := NewFileDataStore(dir, testRootToken)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds.PutWithTTL("ns", "a", []byte("a"), 20 * time.Millisecond)
+	ds.PutWithTTL("ns", "b", []byte("b"), 20 * time.Millisecond)
+
+	time.Sleep(30 * time.Millisecond)
+
+	expectNoDoc(t, ds, "ns", "a")
+
+	ds.sweep()
+
+	if _, err := os.Stat(filepath.Join(dir, "ns", "b")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the sweep to remove the file but got %v.", err)
+	}
+}
+
+func TestRunJanitor(t *testing.T) {
+	swept := make(chan struct{}, 1)
+
+	stop := runJanitor(time.Millisecond, func() {
+		select {
+		case swept <- struct{}{}:
+		default:
+		}
+	})
+
+	defer stop()
+
+	select {
+	case <-swept:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the janitor to sweep.")
+	}
+}
@@ -0,0 +1,285 @@
+package jogdb
+
+import "io"
+import "io/ioutil"
+import "sync"
+import "time"
+
+// A version of a document as returned by `ListVersions`.
+type VersionInfo struct {
+	Rev int
+	Size int
+	ModTime time.Time
+}
+
+type docVersion struct {
+	info VersionInfo
+	value []byte
+}
+
+// The retained versions of a document, oldest first.
+type docHistory struct {
+	lastRev int
+	versions []docVersion
+}
+
+// A MemDataStore that keeps the last versions of every document. Every
+// successful write through it stores the resulting value as a new version
+// with the next revision number of the document (starting at 1), so the
+// newest version is the current value. Only the last `maxVersions` versions
+// are kept per document.
+//
+// Versions survive a Delete so deleted documents can be recovered. Changes
+// made by ImportNamespace, Restore and expiring documents don't create
+// versions.
+type VersionedMemDataStore struct {
+	*MemDataStore
+	maxVersions int
+	mutex *sync.Mutex
+	history map[string]map[string]*docHistory
+}
+
+func NewVersionedMemDataStore(rootToken string, maxVersions int) *VersionedMemDataStore {
+	if maxVersions < 1 {
+		maxVersions = 1
+	}
+
+	return &VersionedMemDataStore {
+		MemDataStore: NewMemDataStore(rootToken),
+		maxVersions: maxVersions,
+		mutex: &sync.Mutex{},
+		history: make(map[string]map[string]*docHistory),
+	}
+}
+
+// Stores the current value of the document as a new version. The caller
+// must hold the lock.
+func (ds *VersionedMemDataStore) record(ns, doc string) {
+	v, _ := ds.MemDataStore.Get(ns, doc)
+
+	if v == nil {
+		return
+	}
+
+	nsV := ds.history[ns]
+
+	if nsV == nil {
+		nsV = make(map[string]*docHistory)
+		ds.history[ns] = nsV
+	}
+
+	h := nsV[doc]
+
+	if h == nil {
+		h = &docHistory{}
+		nsV[doc] = h
+	}
+
+	h.lastRev++
+	h.versions = append(h.versions, docVersion {
+		info: VersionInfo{ Rev: h.lastRev, Size: len(v), ModTime: time.Now() },
+		value: v,
+	})
+
+	if len(h.versions) > ds.maxVersions {
+		h.versions = append([]docVersion{}, h.versions[len(h.versions) - ds.maxVersions:]...)
+	}
+}
+
+// Applies `op` and records new versions of `docs` if it succeeded and
+// `changed` returns true. The lock is held while doing so in order for the
+// versions to be in the same order as the writes.
+func (ds *VersionedMemDataStore) write(ns string, docs []string, op func() error, changed func() bool) error {
+	ds.mutex.Lock()
+
+	err := op()
+
+	if err == nil && changed() {
+		for _, doc := range docs {
+			ds.record(ns, doc)
+		}
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func always() bool {
+	return true
+}
+
+func (ds *VersionedMemDataStore) Put(ns, doc string, v []byte) error {
+	return ds.write(ns, []string{doc}, func() error {
+		return ds.MemDataStore.Put(ns, doc, v)
+	}, always)
+}
+
+func (ds *VersionedMemDataStore) PutStream(ns, doc string, r io.Reader) error {
+	// Read outside of the lock so a slow reader doesn't block
+	// everybody else.
+	v, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	return ds.Put(ns, doc, v)
+}
+
+func (ds *VersionedMemDataStore) PutWithTTL(ns, doc string, v []byte, ttl time.Duration) error {
+	return ds.write(ns, []string{doc}, func() error {
+		return ds.MemDataStore.PutWithTTL(ns, doc, v, ttl)
+	}, always)
+}
+
+func (ds *VersionedMemDataStore) PutWithMeta(ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error {
+	return ds.write(ns, []string{doc}, func() error {
+		return ds.MemDataStore.PutWithMeta(ns, doc, v, meta, ttl)
+	}, always)
+}
+
+func (ds *VersionedMemDataStore) PutBatch(ns string, docs map[string][]byte) error {
+	names := make([]string, 0, len(docs))
+
+	for doc := range docs {
+		names = append(names, doc)
+	}
+
+	return ds.write(ns, names, func() error {
+		return ds.MemDataStore.PutBatch(ns, docs)
+	}, always)
+}
+
+func (ds *VersionedMemDataStore) CompareAndPut(ns, doc string, expected, v []byte) (bool, error) {
+	var swapped bool
+
+	err := ds.write(ns, []string{doc}, func() error {
+		var err error
+		swapped, err = ds.MemDataStore.CompareAndPut(ns, doc, expected, v)
+		return err
+	}, func() bool {
+		return swapped
+	})
+
+	return swapped, err
+}
+
+func (ds *VersionedMemDataStore) Append(ns, doc string, delim, v []byte) error {
+	return ds.write(ns, []string{doc}, func() error {
+		return ds.MemDataStore.Append(ns, doc, delim, v)
+	}, always)
+}
+
+func (ds *VersionedMemDataStore) Prepend(ns, doc string, delim, v []byte) error {
+	return ds.write(ns, []string{doc}, func() error {
+		return ds.MemDataStore.Prepend(ns, doc, delim, v)
+	}, always)
+}
+
+func (ds *VersionedMemDataStore) AppendFrom(ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error) {
+	var n int64
+
+	err := ds.write(ns, []string{doc}, func() error {
+		var err error
+		n, err = ds.MemDataStore.AppendFrom(ns, doc, delim, r, limit)
+		return err
+	}, always)
+
+	return n, err
+}
+
+func (ds *VersionedMemDataStore) ReplaceInDoc(ns, doc string, old, new []byte, all bool) (int, error) {
+	var n int
+
+	err := ds.write(ns, []string{doc}, func() error {
+		var err error
+		n, err = ds.MemDataStore.ReplaceInDoc(ns, doc, old, new, all)
+		return err
+	}, func() bool {
+		return n > 0
+	})
+
+	return n, err
+}
+
+func (ds *VersionedMemDataStore) MergeJSON(ns, doc string, patch []byte) ([]byte, error) {
+	var v []byte
+
+	err := ds.write(ns, []string{doc}, func() error {
+		var err error
+		v, err = ds.MemDataStore.MergeJSON(ns, doc, patch)
+		return err
+	}, always)
+
+	return v, err
+}
+
+func (ds *VersionedMemDataStore) PatchJSON(ns, doc string, patch []byte) ([]byte, error) {
+	var v []byte
+
+	err := ds.write(ns, []string{doc}, func() error {
+		var err error
+		v, err = ds.MemDataStore.PatchJSON(ns, doc, patch)
+		return err
+	}, always)
+
+	return v, err
+}
+
+func (ds *VersionedMemDataStore) Modify(ns, doc string, fn func(old []byte) ([]byte, error)) error {
+	var v []byte
+
+	return ds.write(ns, []string{doc}, func() error {
+		return ds.MemDataStore.Modify(ns, doc, func(old []byte) ([]byte, error) {
+			var err error
+			v, err = fn(old)
+			return v, err
+		})
+	}, func() bool {
+		return v != nil
+	})
+}
+
+func (ds *VersionedMemDataStore) CreateUnique(ns, prefix string) (string, error) {
+	ds.mutex.Lock()
+
+	doc, err := ds.MemDataStore.CreateUnique(ns, prefix)
+
+	if err == nil {
+		ds.record(ns, doc)
+	}
+
+	ds.mutex.Unlock()
+	return doc, err
+}
+
+func (ds *VersionedMemDataStore) GetVersion(ns, doc string, rev int) ([]byte, error) {
+	ds.mutex.Lock()
+
+	if h := ds.history[ns][doc]; h != nil {
+		for _, version := range h.versions {
+			if version.info.Rev == rev {
+				ds.mutex.Unlock()
+				return copyBytes(version.value), nil
+			}
+		}
+	}
+
+	ds.mutex.Unlock()
+	return nil, nil
+}
+
+func (ds *VersionedMemDataStore) ListVersions(ns, doc string) ([]VersionInfo, error) {
+	infos := make([]VersionInfo, 0)
+
+	ds.mutex.Lock()
+
+	if h := ds.history[ns][doc]; h != nil {
+		for _, version := range h.versions {
+			infos = append(infos, version.info)
+		}
+	}
+
+	ds.mutex.Unlock()
+	return infos, nil
+}
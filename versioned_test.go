@@ -0,0 +1,51 @@
+package jogdb
+
+import "testing"
+
+func TestVersionedMemDataStore(t *testing.T) {
+	ds := NewVersionedMemDataStore(testRootToken, 3)
+
+	for _, v := range []string{ "one", "two", "three", "four" } {
+		if err := ds.Put("ns", "doc", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectDoc(t, ds, "ns", "doc", "four")
+
+	versions, err := ds.ListVersions("ns", "doc")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the last three versions are kept.
+	if len(versions) != 3 || versions[0].Rev != 2 || versions[2].Rev != 4 || versions[2].Size != 4 {
+		t.Fatalf("Unexpected versions: %+v", versions)
+	}
+
+	for rev, expected := range map[int]string{ 1: "", 2: "two", 4: "four", 5: "" } {
+		v, err := ds.GetVersion("ns", "doc", rev)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(v) != expected {
+			t.Fatalf("Expected %q for revision %d but got %q.", expected, rev, v)
+		}
+	}
+
+	// Versions survive deletes.
+	if err := ds.Delete("ns", "doc"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoDoc(t, ds, "ns", "doc")
+
+	v, err := ds.GetVersion("ns", "doc", 3)
+
+	if err != nil || string(v) != "three" {
+		t.Fatalf("Expected the deleted document's version but got %q, %v", v, err)
+	}
+}
@@ -0,0 +1,786 @@
+package jogdb
+
+import "os"
+import "io"
+import "log"
+import "bytes"
+import "path/filepath"
+import "io/ioutil"
+import "bufio"
+import "sync"
+import "time"
+import "errors"
+import "encoding/json"
+
+// How often a WALMemDataStore rewrites its log as a snapshot.
+const walCompactInterval = 10 * time.Minute
+
+// This is returned by `NewMemDataStoreWithWAL` if a complete record of the
+// log can't be read.
+var ErrCorruptWAL = errors.New("Corrupt write-ahead log!")
+
+// This is returned by writes to a WALMemDataStore after it was closed.
+var ErrWALClosed = errors.New("Write-ahead log is closed!")
+
+// A change as written to the log, one JSON object per line. Tokens are
+// the hashes the MemDataStore keeps. `ExpiresAt` is in nanoseconds since
+// the epoch, zero means the document doesn't expire. `Time` is when the
+// change was made, in nanoseconds since the epoch as well.
+type walRecord struct {
+	Op string `json:"op"`
+	Time int64 `json:"time,omitempty"`
+	Ns string `json:"ns,omitempty"`
+	Doc string `json:"doc,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Delim []byte `json:"delim,omitempty"`
+	Old []byte `json:"old,omitempty"`
+	New []byte `json:"new,omitempty"`
+	All bool `json:"all,omitempty"`
+	Docs map[string][]byte `json:"docs,omitempty"`
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	Meta *DocMeta `json:"meta,omitempty"`
+	Delta int64 `json:"delta,omitempty"`
+	Token string `json:"token,omitempty"`
+	Perms uint8 `json:"perms,omitempty"`
+	Is bool `json:"is,omitempty"`
+}
+
+// A MemDataStore that logs every change to a file and replays it when
+// created again, so writes survive a crash. A change is logged before it
+// is applied in memory, so nothing is visible that isn't in the log. If
+// applying a logged change fails replaying it fails the same way. Writes
+// are serialized to keep the log in the same order as the changes, reads
+// are not affected.
+//
+// The log is periodically rewritten as a snapshot of the current state so
+// it doesn't grow forever. ImportNamespace, ImportPolicy and Restore
+// rewrite it right away. Documents removed because their TTL passed aren't logged,
+// their expiry times are restored instead.
+type WALMemDataStore struct {
+	*MemDataStore
+
+	// If set the log isn't synced to disk before a write returns. This
+	// is a lot faster but the last writes may be lost if the machine (not
+	// just the process) crashes. Must be set before the store is used.
+	NoSync bool
+
+	path string
+	file *os.File
+	mutex *sync.Mutex
+	stopCompacting func()
+}
+
+// Creates a MemDataStore logging to `walPath`. If the file exists the
+// changes in it are replayed first. This includes rotations of the root
+// token, so `rootToken` only matters if the log doesn't rotate it. A
+// record cut off by a crash while writing it is dropped. This also starts
+// goroutines periodically removing documents whose TTL has passed and
+// rewriting the log.
+func NewMemDataStoreWithWAL(rootToken, walPath string) (*WALMemDataStore, error) {
+	ds := &WALMemDataStore {
+		MemDataStore: NewMemDataStore(rootToken),
+		path: walPath,
+		mutex: &sync.Mutex{},
+	}
+
+	file, err := os.OpenFile(walPath, os.O_RDWR | os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = ds.replay(file)
+
+	if err == nil {
+		_, err = file.Seek(0, io.SeekEnd)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	ds.file = file
+
+	ds.stopCompacting = runJanitor(walCompactInterval, func() {
+		err := ds.Compact()
+
+		if err != nil && err != ErrWALClosed {
+			log.Printf("WALMemDataStore: Compacting the log failed: %v", err.Error())
+		}
+	})
+
+	return ds, nil
+}
+
+// Applies all records of the log and truncates it after the last complete
+// one.
+func (ds *WALMemDataStore) replay(file *os.File) error {
+	r := bufio.NewReader(file)
+	expiry := make(expiryTable)
+
+	var off int64
+
+	for {
+		line, err := r.ReadBytes('\n')
+
+		if err == io.EOF {
+			// Anything after the last newline is an incomplete
+			// record.
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var rec walRecord
+
+		if json.Unmarshal(line, &rec) != nil {
+			return ErrCorruptWAL
+		}
+
+		ds.apply(&rec, expiry)
+		off += int64(len(line))
+	}
+
+	// Expiry times are only set once all records are applied, otherwise
+	// documents that were appended to before their TTL passed would be
+	// recreated without one.
+	for ns, nsV := range expiry {
+		s := ds.shard(ns)
+		s.mutex.Lock()
+
+		for doc, at := range nsV {
+			if s.storage[ns][doc] != nil {
+				s.expiry.set(ns, doc, at)
+			}
+		}
+
+		s.mutex.Unlock()
+	}
+
+	return file.Truncate(off)
+}
+
+// Applies a record to the MemDataStore. Expiry times are tracked in
+// `expiry` instead of being set.
+func (ds *WALMemDataStore) apply(rec *walRecord, expiry expiryTable) {
+	ms := ds.MemDataStore
+
+	// Changes keeping the expiry time see an expired document as missing.
+	switch rec.Op {
+	case "append", "prepend", "replace", "merge", "patch", "modify":
+		if expiry.expired(rec.Ns, rec.Doc, time.Unix(0, rec.Time)) {
+			ms.Delete(rec.Ns, rec.Doc)
+			expiry.clear(rec.Ns, rec.Doc)
+		}
+	}
+
+	switch rec.Op {
+	case "put":
+		var meta DocMeta
+
+		if rec.Meta != nil {
+			meta = *rec.Meta
+		}
+
+		ms.PutWithMeta(rec.Ns, rec.Doc, rec.Value, meta, 0)
+
+		if rec.ExpiresAt != 0 {
+			expiry.set(rec.Ns, rec.Doc, time.Unix(0, rec.ExpiresAt))
+		} else {
+			expiry.clear(rec.Ns, rec.Doc)
+		}
+	case "batch":
+		ms.PutBatch(rec.Ns, rec.Docs)
+
+		for doc := range rec.Docs {
+			expiry.clear(rec.Ns, doc)
+		}
+	case "append":
+		ms.Append(rec.Ns, rec.Doc, rec.Delim, rec.Value)
+	case "prepend":
+		ms.Prepend(rec.Ns, rec.Doc, rec.Delim, rec.Value)
+	case "replace":
+		ms.ReplaceInDoc(rec.Ns, rec.Doc, rec.Old, rec.New, rec.All)
+	case "merge":
+		ms.MergeJSON(rec.Ns, rec.Doc, rec.Value)
+	case "patch":
+		ms.PatchJSON(rec.Ns, rec.Doc, rec.Value)
+	case "modify":
+		// The value is logged as what the callback returned, an empty
+		// one is decoded as nil though.
+		v := rec.Value
+
+		if v == nil {
+			v = []byte{}
+		}
+
+		ms.Modify(rec.Ns, rec.Doc, func(old []byte) ([]byte, error) {
+			return v, nil
+		})
+	case "delete":
+		ms.Delete(rec.Ns, rec.Doc)
+		expiry.clear(rec.Ns, rec.Doc)
+	case "incr":
+		ms.IncrCounter(rec.Ns, rec.Doc, rec.Delta)
+	case "perm":
+		s := ds.shard(rec.Ns)
+		s.auth.setTokenKey(rec.Token, rec.Ns, rec.Doc, rec.Perms & permGet != 0, rec.Perms & permPut != 0,
+			rec.Perms & permAppend != 0, rec.Perms & permDelete != 0, rec.Perms & permPrepend != 0)
+	case "revoke":
+		ds.shard(rec.Ns).auth.revokeTokenKey(rec.Token, rec.Ns)
+	case "nsadmin":
+		ds.shard(rec.Ns).auth.setNamespaceAdminKey(rec.Token, rec.Ns, rec.Is)
+	case "admin":
+		ms.auth.setAdminKey(rec.Token, rec.Is)
+	case "root":
+		ms.auth.rootToken = rec.Token
+	}
+}
+
+// Appends a record to the log and syncs it unless `NoSync` is set. Needs
+// to be called with the lock held.
+func (ds *WALMemDataStore) log(rec *walRecord) error {
+	if ds.file == nil {
+		return ErrWALClosed
+	}
+
+	b, err := json.Marshal(rec)
+
+	if err != nil {
+		return err
+	}
+
+	// A single write so a crash can only cut off the end.
+	_, err = ds.file.Write(append(b, '\n'))
+
+	if err != nil || ds.NoSync {
+		return err
+	}
+
+	return ds.file.Sync()
+}
+
+// Logs the record returned by `rec` and then applies the change with
+// `op`. Both are called with the lock held, so `rec` can look at the
+// current state to decide what to log. Nothing is logged if `rec` returns
+// nil and `op` isn't called if `rec` or logging fails.
+func (ds *WALMemDataStore) write(rec func() (*walRecord, error), op func() error) error {
+	ds.mutex.Lock()
+
+	r, err := rec()
+
+	if err == nil && r != nil {
+		r.Time = time.Now().UnixNano()
+		err = ds.log(r)
+	}
+
+	if err == nil {
+		err = op()
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+// Returns a function for `write` that logs `rec`.
+func logs(rec *walRecord) func() (*walRecord, error) {
+	return func() (*walRecord, error) {
+		return rec, nil
+	}
+}
+
+// Rewrites the log as a snapshot of the current state. The new log is
+// written to a temporary file first and then moved over the old one.
+func (ds *WALMemDataStore) Compact() error {
+	ds.mutex.Lock()
+
+	err := ds.compact()
+
+	ds.mutex.Unlock()
+	return err
+}
+
+// Needs to be called with the lock held.
+func (ds *WALMemDataStore) compact() error {
+	if ds.file == nil {
+		return ErrWALClosed
+	}
+
+	tmpPath := ds.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+
+	for _, rec := range ds.snapshotRecords() {
+		err = enc.Encode(rec)
+
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, ds.path)
+	}
+
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	ds.file.Close()
+	ds.file = file
+
+	// The rename only survives a crash once the directory is synced.
+	return syncDir(filepath.Dir(ds.path))
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Returns records recreating the current state.
+func (ds *WALMemDataStore) snapshotRecords() []*walRecord {
+	recs := make([]*walRecord, 0)
+	ms := ds.MemDataStore
+	now := time.Now()
+
+	for _, s := range ms.shards {
+		s.mutex.RLock()
+
+		for ns, nsV := range s.storage {
+			for doc, d := range nsV {
+				if s.expiry.expired(ns, doc, now) {
+					continue
+				}
+
+				rec := &walRecord{ Op: "put", Ns: ns, Doc: doc }
+
+				if at, exists := s.expiry[ns][doc]; exists {
+					rec.ExpiresAt = at.UnixNano()
+				}
+
+				d.mutex.RLock()
+				rec.Value = d.copyValue()
+				rec.Meta = walMeta(d.meta)
+				d.mutex.RUnlock()
+
+				recs = append(recs, rec)
+			}
+		}
+
+		for ns, nsV := range s.counters {
+			for name, v := range nsV {
+				recs = append(recs, &walRecord{ Op: "incr", Ns: ns, Doc: name, Delta: v })
+			}
+		}
+
+		for ns, nsV := range s.auth.Perms {
+			for doc, docV := range nsV {
+				for key, bits := range docV {
+					recs = append(recs, &walRecord{ Op: "perm", Ns: ns, Doc: doc, Token: key, Perms: bits })
+				}
+			}
+		}
+
+		for ns, nsV := range s.auth.NsAdmins {
+			for key := range nsV {
+				recs = append(recs, &walRecord{ Op: "nsadmin", Ns: ns, Token: key, Is: true })
+			}
+		}
+
+		s.mutex.RUnlock()
+	}
+
+	ms.mutex.RLock()
+
+	for key := range ms.auth.Admins {
+		recs = append(recs, &walRecord{ Op: "admin", Token: key, Is: true })
+	}
+
+	recs = append(recs, &walRecord{ Op: "root", Token: ms.auth.rootToken })
+
+	ms.mutex.RUnlock()
+
+	return recs
+}
+
+// Closes the log and stops rewriting it. Writes fail afterwards.
+func (ds *WALMemDataStore) Close() error {
+	ds.stopCompacting()
+
+	ds.mutex.Lock()
+
+	var err error
+
+	if ds.file != nil {
+		err = ds.file.Close()
+		ds.file = nil
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+func (ds *WALMemDataStore) Put(ns, doc string, v []byte) error {
+	return ds.write(logs(&walRecord{ Op: "put", Ns: ns, Doc: doc, Value: v }), func() error {
+		return ds.MemDataStore.Put(ns, doc, v)
+	})
+}
+
+func (ds *WALMemDataStore) PutStream(ns, doc string, r io.Reader) error {
+	// Read outside of the lock so a slow reader doesn't block
+	// everybody else.
+	v, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	return ds.Put(ns, doc, v)
+}
+
+func (ds *WALMemDataStore) PutWithTTL(ns, doc string, v []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ds.Put(ns, doc, v)
+	}
+
+	expiresAt := time.Now().Add(ttl)
+
+	// The shard is used directly so the logged expiry time is exactly
+	// the one set.
+	return ds.write(logs(&walRecord{ Op: "put", Ns: ns, Doc: doc, Value: v, ExpiresAt: expiresAt.UnixNano() }), func() error {
+		ds.shard(ns).put(ns, doc, v, DocMeta{}, expiresAt, ds.CompressStoredAbove)
+		return nil
+	})
+}
+
+func (ds *WALMemDataStore) PutWithMeta(ns, doc string, v []byte, meta DocMeta, ttl time.Duration) error {
+	var expiresAt time.Time
+
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	rec := &walRecord{ Op: "put", Ns: ns, Doc: doc, Value: v, Meta: walMeta(meta) }
+
+	if !expiresAt.IsZero() {
+		rec.ExpiresAt = expiresAt.UnixNano()
+	}
+
+	return ds.write(logs(rec), func() error {
+		ds.shard(ns).put(ns, doc, v, meta, expiresAt, ds.CompressStoredAbove)
+		return nil
+	})
+}
+
+// Metadata as logged, nil if it's empty.
+func walMeta(meta DocMeta) *DocMeta {
+	if meta == (DocMeta{}) {
+		return nil
+	}
+
+	return &meta
+}
+
+func (ds *WALMemDataStore) PutBatch(ns string, docs map[string][]byte) error {
+	return ds.write(logs(&walRecord{ Op: "batch", Ns: ns, Docs: docs }), func() error {
+		return ds.MemDataStore.PutBatch(ns, docs)
+	})
+}
+
+// The comparison is done before logging, a successful swap is logged as
+// a put.
+func (ds *WALMemDataStore) CompareAndPut(ns, doc string, expected, v []byte) (bool, error) {
+	var swapped bool
+
+	err := ds.write(func() (*walRecord, error) {
+		cur, err := ds.MemDataStore.Get(ns, doc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		swapped = (cur == nil) == (expected == nil) && (expected == nil || bytes.Equal(cur, expected))
+
+		if !swapped {
+			return nil, nil
+		}
+
+		return &walRecord{ Op: "put", Ns: ns, Doc: doc, Value: v }, nil
+	}, func() error {
+		if !swapped {
+			return nil
+		}
+
+		return ds.MemDataStore.Put(ns, doc, v)
+	})
+
+	return swapped && err == nil, err
+}
+
+func (ds *WALMemDataStore) Append(ns, doc string, delim, v []byte) error {
+	return ds.write(logs(&walRecord{ Op: "append", Ns: ns, Doc: doc, Delim: delim, Value: v }), func() error {
+		return ds.MemDataStore.Append(ns, doc, delim, v)
+	})
+}
+
+func (ds *WALMemDataStore) Prepend(ns, doc string, delim, v []byte) error {
+	return ds.write(logs(&walRecord{ Op: "prepend", Ns: ns, Doc: doc, Delim: delim, Value: v }), func() error {
+		return ds.MemDataStore.Prepend(ns, doc, delim, v)
+	})
+}
+
+func (ds *WALMemDataStore) AppendFrom(ns, doc string, delim []byte, r io.Reader, limit int64) (int64, error) {
+	// Read outside of the lock so a slow reader doesn't block
+	// everybody else.
+	v, err := readLimited(r, limit)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(v)), ds.Append(ns, doc, delim, v)
+}
+
+func (ds *WALMemDataStore) ReplaceInDoc(ns, doc string, old, new []byte, all bool) (int, error) {
+	var n int
+
+	err := ds.write(func() (*walRecord, error) {
+		cur, err := ds.MemDataStore.Get(ns, doc)
+
+		// Nothing to log if there's nothing to replace.
+		if err != nil || len(old) == 0 || !bytes.Contains(cur, old) {
+			return nil, err
+		}
+
+		return &walRecord{ Op: "replace", Ns: ns, Doc: doc, Old: old, New: new, All: all }, nil
+	}, func() error {
+		var err error
+		n, err = ds.MemDataStore.ReplaceInDoc(ns, doc, old, new, all)
+		return err
+	})
+
+	return n, err
+}
+
+func (ds *WALMemDataStore) MergeJSON(ns, doc string, patch []byte) ([]byte, error) {
+	var v []byte
+
+	err := ds.write(logs(&walRecord{ Op: "merge", Ns: ns, Doc: doc, Value: patch }), func() error {
+		var err error
+		v, err = ds.MemDataStore.MergeJSON(ns, doc, patch)
+		return err
+	})
+
+	return v, err
+}
+
+func (ds *WALMemDataStore) PatchJSON(ns, doc string, patch []byte) ([]byte, error) {
+	var v []byte
+
+	err := ds.write(logs(&walRecord{ Op: "patch", Ns: ns, Doc: doc, Value: patch }), func() error {
+		var err error
+		v, err = ds.MemDataStore.PatchJSON(ns, doc, patch)
+		return err
+	})
+
+	return v, err
+}
+
+// The value `fn` returns is logged, not `fn` itself. `fn` is called
+// before logging, which is fine as writes are serialized.
+func (ds *WALMemDataStore) Modify(ns, doc string, fn func(old []byte) ([]byte, error)) error {
+	var v []byte
+
+	return ds.write(func() (*walRecord, error) {
+		old, err := ds.MemDataStore.Get(ns, doc)
+
+		if err == nil {
+			v, err = fn(old)
+		}
+
+		if err != nil || v == nil {
+			return nil, err
+		}
+
+		return &walRecord{ Op: "modify", Ns: ns, Doc: doc, Value: v }, nil
+	}, func() error {
+		if v == nil {
+			return nil
+		}
+
+		return ds.MemDataStore.Modify(ns, doc, func(old []byte) ([]byte, error) {
+			return v, nil
+		})
+	})
+}
+
+func (ds *WALMemDataStore) Delete(ns, doc string) error {
+	return ds.write(logs(&walRecord{ Op: "delete", Ns: ns, Doc: doc }), func() error {
+		return ds.MemDataStore.Delete(ns, doc)
+	})
+}
+
+func (ds *WALMemDataStore) CreateUnique(ns, prefix string) (string, error) {
+	var doc string
+
+	// The name is chosen before logging, no other write can take it
+	// until the document is created as writes are serialized.
+	err := ds.write(func() (*walRecord, error) {
+		for i := 0; i < maxCreateUniqueAttempts; i++ {
+			doc = prefix + ds.nameGenerator.Generate()
+
+			_, exists, err := ds.MemDataStore.Size(ns, doc)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !exists {
+				return &walRecord{ Op: "put", Ns: ns, Doc: doc, Value: []byte{} }, nil
+			}
+		}
+
+		return nil, ErrNoUniqueName
+	}, func() error {
+		return ds.MemDataStore.Put(ns, doc, []byte{})
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return doc, nil
+}
+
+func (ds *WALMemDataStore) IncrCounter(ns, name string, delta int64) (int64, error) {
+	var v int64
+
+	err := ds.write(logs(&walRecord{ Op: "incr", Ns: ns, Doc: name, Delta: delta }), func() error {
+		var err error
+		v, err = ds.MemDataStore.IncrCounter(ns, name, delta)
+		return err
+	})
+
+	return v, err
+}
+
+// The permissions resulting from the change are logged rather than the
+// change itself.
+func (ds *WALMemDataStore) SetToken(token, ns, doc string, get, put, app, del, pre bool) error {
+	key := ds.auth.key(token)
+	bits := updatePerms(0, get, put, app, del, pre)
+
+	return ds.write(logs(&walRecord{ Op: "perm", Ns: ns, Doc: doc, Token: key, Perms: bits }), func() error {
+		return ds.MemDataStore.SetToken(token, ns, doc, get, put, app, del, pre)
+	})
+}
+
+func (ds *WALMemDataStore) RevokeToken(token, ns string) error {
+	return ds.write(logs(&walRecord{ Op: "revoke", Ns: ns, Token: ds.auth.key(token) }), func() error {
+		return ds.MemDataStore.RevokeToken(token, ns)
+	})
+}
+
+func (ds *WALMemDataStore) SetNamespaceAdmin(token, ns string, is bool) error {
+	return ds.write(logs(&walRecord{ Op: "nsadmin", Ns: ns, Token: ds.auth.key(token), Is: is }), func() error {
+		return ds.MemDataStore.SetNamespaceAdmin(token, ns, is)
+	})
+}
+
+func (ds *WALMemDataStore) SetAdmin(token string, is bool) error {
+	return ds.write(logs(&walRecord{ Op: "admin", Token: ds.auth.key(token), Is: is }), func() error {
+		return ds.MemDataStore.SetAdmin(token, is)
+	})
+}
+
+func (ds *WALMemDataStore) RotateRootToken(oldToken, newToken string) error {
+	return ds.write(func() (*walRecord, error) {
+		ok, err := ds.MemDataStore.IsRoot(oldToken)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return nil, ErrAccessDenied
+		}
+
+		return &walRecord{ Op: "root", Token: ds.auth.key(newToken) }, nil
+	}, func() error {
+		return ds.MemDataStore.RotateRootToken(oldToken, newToken)
+	})
+}
+
+// Rewrites the log instead of logging the imported documents and
+// permissions.
+func (ds *WALMemDataStore) ImportNamespace(ns string, r io.Reader) error {
+	ds.mutex.Lock()
+
+	err := ds.MemDataStore.ImportNamespace(ns, r)
+
+	if err == nil {
+		err = ds.compact()
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+// Rewrites the log instead of logging the imported permissions.
+func (ds *WALMemDataStore) ImportPolicy(r io.Reader) error {
+	ds.mutex.Lock()
+
+	err := ds.MemDataStore.ImportPolicy(r)
+
+	if err == nil {
+		err = ds.compact()
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
+
+// Rewrites the log instead of logging the restored state.
+func (ds *WALMemDataStore) Restore(r io.Reader) error {
+	ds.mutex.Lock()
+
+	err := ds.MemDataStore.Restore(r)
+
+	if err == nil {
+		err = ds.compact()
+	}
+
+	ds.mutex.Unlock()
+	return err
+}
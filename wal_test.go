@@ -0,0 +1,98 @@
+package jogdb
+
+import "testing"
+import "os"
+import "path/filepath"
+
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+
+	ds, err := NewMemDataStoreWithWAL(testRootToken, path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds.Put("ns", "a", []byte("hello"))
+	ds.Append("ns", "a", []byte("\n"), []byte("world"))
+	ds.Put("ns", "b", []byte("gone"))
+	ds.Delete("ns", "b")
+	ds.ReplaceInDoc("ns", "a", []byte("world"), []byte("there"), false)
+	ds.Modify("ns", "c", func(old []byte) ([]byte, error) {
+		return []byte("modified"), nil
+	})
+	ds.IncrCounter("ns", "n", 3)
+	ds.SetToken("tok", "ns", "a", true, false, false, false, false)
+	ds.RotateRootToken("wrong", "evil")
+
+	if err := ds.RotateRootToken(testRootToken, "newroot"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while writing leaves an incomplete record behind.
+	f, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND, 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte(`{"op":"put","ns":"ns","doc":"d"`))
+	f.Close()
+
+	check := func(ds *WALMemDataStore) {
+		t.Helper()
+
+		expectDoc(t, ds, "ns", "a", "hellothere\n")
+		expectNoDoc(t, ds, "ns", "b")
+		expectDoc(t, ds, "ns", "c", "modified")
+		expectNoDoc(t, ds, "ns", "d")
+
+		if n, err := ds.GetCounter("ns", "n"); err != nil || n != 3 {
+			t.Fatalf("Expected the counter to be 3 but got %d, %v", n, err)
+		}
+
+		if ok, err := ds.CanGet("tok", "ns", "a"); err != nil || !ok {
+			t.Fatalf("Expected the token to be able to read: %v, %v", ok, err)
+		}
+
+		if ok, _ := ds.IsRoot("newroot"); !ok {
+			t.Fatal("Expected the rotated root token.")
+		}
+
+		if ok, _ := ds.IsRoot(testRootToken); ok {
+			t.Fatal("Expected the old root token to be replaced.")
+		}
+	}
+
+	replayed, err := NewMemDataStoreWithWAL(testRootToken, path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(replayed)
+
+	// Compacting keeps the state.
+	if err := replayed.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed.Close()
+
+	compacted, err := NewMemDataStoreWithWAL(testRootToken, path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(compacted)
+
+	// Nothing is applied that can't be logged.
+	compacted.Close()
+
+	if err := compacted.Put("ns", "e", []byte("lost")); err != ErrWALClosed {
+		t.Fatalf("Expected ErrWALClosed but got %v.", err)
+	}
+
+	expectNoDoc(t, compacted, "ns", "e")
+}